@@ -5,6 +5,8 @@ import (
 	"net/http"
 
 	"github.com/OscarVillanueva/goapi/internal/app/handlers"
+	"github.com/OscarVillanueva/goapi/internal/app/jobs"
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
 	"github.com/OscarVillanueva/goapi/internal/platform"
 
 	"go.opentelemetry.io/otel"
@@ -42,7 +44,7 @@ func main()  {
 
 	defer func() {
 		if err := tp.Shutdown(ctx); err != nil {
-			log.Error("Error shutting down tracer: %v", err)
+			log.Errorf("Error shutting down tracer: %v", err)
 		}
 	}()
 
@@ -58,10 +60,25 @@ func main()  {
 		log.Panic(err)
 	}
 
+	tools.StartJWTKeyRotation(ctx)
+
 	if err := platform.InitDbConnection(ctx); err != nil {
 		log.Panic(err)
 	}
 
+	jobs.StartEmailOutbox(ctx)
+	jobs.StartAccountDeletions(ctx)
+
+	if err := platform.InitPaymentManager(ctx); err != nil {
+		log.Panic(err)
+	}
+
+	jobs.StartPendingPaymentsExpiry(ctx)
+
+	if err := platform.InitOidcManager(ctx); err != nil {
+		log.Panic(err)
+	}
+
 	log.Info("Starting GO API Server")
 	if err := http.ListenAndServe("backend:4321", r); err != nil {
 		log.Panic(err)
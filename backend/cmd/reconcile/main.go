@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/OscarVillanueva/goapi/internal/app/jobs"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Compares the quantity of every product with its stock ledger, it exits
+// with 1 when any product drifted so it can run from cron or CI
+func main() {
+	ctx := context.Background()
+
+	if err := platform.InitDbConnection(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	drifted, err := jobs.ReconcileStock(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if drifted {
+		os.Exit(1)
+	}
+
+	log.Info("The stock ledger matches every product")
+}
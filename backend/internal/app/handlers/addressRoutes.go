@@ -0,0 +1,363 @@
+package handlers
+
+import (
+	"fmt"
+	"errors"
+	"strings"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const AddressRouterName = "address-router"
+
+func AddressRouter(router chi.Router) {
+	router.Use(middleware.Authorization)
+
+	router.Get("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AddressRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", AddressRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		addresses, err := db.FetchAddresses(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch addresses successfully")
+
+		resp := tools.Message {
+			Message: "Addresses",
+			Data: addresses,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Post("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AddressRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./", AddressRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var address requests.SaveAddress
+		if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := address.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		created, err := db.CreateAddress(userID, &address, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Address created successfully")
+
+		resp := tools.Message {
+			Message: "Address created successfully",
+			Data: created,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Get("/{address}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AddressRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./{address}", AddressRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		addressID := chi.URLParam(r, "address")
+
+		span.SetAttributes(
+			attribute.String("AddressUuid", addressID),
+		)
+
+		if strings.TrimSpace(addressID) == "" {
+			err := errors.New("Invalid address id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		address, err := db.FetchAddress(addressID, userID, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrAddressNotFound) {
+				tools.NotFoundErrorHandler(w, "Address not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Address found successfully")
+
+		resp := tools.Message {
+			Message: "Address",
+			Data: address,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Put("/{address}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AddressRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./{address}", AddressRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		addressID := chi.URLParam(r, "address")
+
+		span.SetAttributes(
+			attribute.String("AddressUuid", addressID),
+		)
+
+		if strings.TrimSpace(addressID) == "" {
+			err := errors.New("Invalid address id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		var address requests.SaveAddress
+		if err := json.NewDecoder(r.Body).Decode(&address); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := address.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		updated, err := db.UpdateAddress(addressID, userID, &address, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrAddressNotFound) {
+				tools.NotFoundErrorHandler(w, "Address not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Address updated successfully")
+
+		resp := tools.Message {
+			Message: "Address updated successfully",
+			Data: updated,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Put("/{address}/default", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AddressRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./{address}/default", AddressRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		addressID := chi.URLParam(r, "address")
+
+		span.SetAttributes(
+			attribute.String("AddressUuid", addressID),
+		)
+
+		if strings.TrimSpace(addressID) == "" {
+			err := errors.New("Invalid address id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		if err := db.SetDefaultAddress(addressID, userID, ctx); err != nil {
+			if errors.Is(err, db.ErrAddressNotFound) {
+				tools.NotFoundErrorHandler(w, "Address not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Default address updated successfully")
+
+		resp := tools.Message {
+			Message: "Default address updated successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Delete("/{address}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AddressRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{address}", AddressRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		addressID := chi.URLParam(r, "address")
+
+		span.SetAttributes(
+			attribute.String("AddressUuid", addressID),
+		)
+
+		if strings.TrimSpace(addressID) == "" {
+			err := errors.New("Invalid address id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		if err := db.DeleteAddress(addressID, userID, ctx); err != nil {
+			if errors.Is(err, db.ErrAddressNotFound) {
+				tools.NotFoundErrorHandler(w, "Address not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Address deleted successfully")
+
+		resp := tools.Message {
+			Message: "Address deleted successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+}
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/http"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/sessions"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const AdminRouterName = "admin-router"
+
+func AdminRouter(router chi.Router) {
+	router.Use(middleware.Authorization)
+
+	// The account with the ADMIN_EMAIL becomes the first admin, after that
+	// only the admins give the role
+	router.Post("/bootstrap", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AdminRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./bootstrap", AdminRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		adminEmail := strings.TrimSpace(os.Getenv("ADMIN_EMAIL"))
+		if adminEmail == "" {
+			msg := "The admin bootstrap is disabled"
+			span.SetStatus(codes.Error, msg)
+			tools.ForbiddenErrorHandler(w, msg)
+			return
+		}
+
+		user, err := db.FetchUserByUuid(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if !strings.EqualFold(user.Email, adminEmail) {
+			msg := "Only the configured account can become the first admin"
+			span.SetStatus(codes.Error, msg)
+			tools.ForbiddenErrorHandler(w, msg)
+			return
+		}
+
+		if err := db.BootstrapAdmin(userID, ctx); err != nil {
+			if errors.Is(err, db.ErrAdminExists) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Admin bootstrapped")
+
+		resp := tools.Message {
+			Message: "You are the admin now, refresh the token to get the new permissions",
+			Data: dao.RoleAdmin,
+		}
+
+		resp.WriteMessageWithCode(w, http.StatusCreated)
+	})
+
+	router.Group(func (router chi.Router) {
+		router.Use(middleware.RequirePermissions(dao.PermissionAdminUsers))
+
+		router.Get("/roles", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AdminRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./roles", AdminRouterName))
+			defer span.End()
+
+			roles, err := db.FetchRoles(ctx)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Fetch roles successfully")
+
+			resp := tools.Message {
+				Message: "List of roles",
+				Data: roles,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Get("/users/{user}/roles", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AdminRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./users/{user}/roles", AdminRouterName))
+			defer span.End()
+
+			userID := chi.URLParam(r, "user")
+
+			span.SetAttributes(
+				attribute.String("UserUuid", userID),
+			)
+
+			roles, err := db.FetchUserRoles(userID, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrRoleUserNotFound) {
+					tools.NotFoundErrorHandler(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Fetch user roles successfully")
+
+			resp := tools.Message {
+				Message: "Roles of the user",
+				Data: roles,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Put("/users/{user}/roles/{role}", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AdminRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./users/{user}/roles/{role}", AdminRouterName))
+			defer span.End()
+
+			adminID, _ := ctx.Value(middleware.UserUUIDKey).(string)
+			userID := chi.URLParam(r, "user")
+			role := chi.URLParam(r, "role")
+
+			span.SetAttributes(
+				attribute.String("uuid", adminID),
+				attribute.String("UserUuid", userID),
+				attribute.String("Role", role),
+			)
+
+			userRole, err := db.AssignRole(userID, role, adminID, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrRoleUserNotFound) || errors.Is(err, db.ErrRoleNotFound) {
+					tools.NotFoundErrorHandler(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Role assigned successfully")
+
+			resp := tools.Message {
+				Message: "Role assigned, it reaches the token of the user with the next refresh",
+				Data: userRole,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Delete("/users/{user}/roles/{role}", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AdminRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./users/{user}/roles/{role}", AdminRouterName))
+			defer span.End()
+
+			adminID, _ := ctx.Value(middleware.UserUUIDKey).(string)
+			userID := chi.URLParam(r, "user")
+			role := chi.URLParam(r, "role")
+
+			span.SetAttributes(
+				attribute.String("uuid", adminID),
+				attribute.String("UserUuid", userID),
+				attribute.String("Role", role),
+			)
+
+			if err := db.RevokeRole(userID, role, ctx); err != nil {
+				if errors.Is(err, db.ErrUserRoleNotFound) {
+					tools.NotFoundErrorHandler(w, err.Error())
+					return
+				}
+
+				if errors.Is(err, db.ErrLastAdmin) {
+					tools.UnprocessableContent(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			// The access tokens still carry the permissions of the role, the
+			// user has to refresh to continue
+			if err := sessions.RevokeUserTokens(userID, time.Now().UTC(), ctx); err != nil {
+				span.RecordError(err)
+			}
+
+			span.SetStatus(codes.Ok, "Role revoked successfully")
+
+			resp := tools.Message {
+				Message: "Role revoked",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+	})
+
+	router.Group(func (router chi.Router) {
+		router.Use(middleware.RequirePermissions(dao.PermissionAdminEmails))
+
+		// The failed emails are listed by default, they are the dead letters
+		router.Get("/emails", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AdminRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./emails", AdminRouterName))
+			defer span.End()
+
+			status := r.URL.Query().Get("status")
+			pageStr := r.URL.Query().Get("page")
+			page := 1
+
+			span.SetAttributes(
+				attribute.String("Status", status),
+				attribute.String("Page", pageStr),
+			)
+
+			if status == "" {
+				status = dao.OutboxEmailFailed
+			}
+
+			if status != dao.OutboxEmailPending && status != dao.OutboxEmailSent && status != dao.OutboxEmailFailed {
+				tools.BadRequestErrorHandler(w, errors.New("Invalid status, use pending, sent or failed"))
+				return
+			}
+
+			if pageStr != "" {
+				parsedPage, err := strconv.Atoi(pageStr)
+
+				if err != nil || parsedPage <= 0 {
+					tools.BadRequestErrorHandler(w, errors.New("Invalid Page number"))
+					return
+				}
+
+				page = parsedPage
+			}
+
+			emails, err := db.FetchOutboxEmails(status, page, ctx)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Fetch outbox emails successfully")
+
+			resp := tools.Message {
+				Message: "List of emails",
+				Data: emails,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Post("/emails/{email}/retry", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AdminRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./emails/{email}/retry", AdminRouterName))
+			defer span.End()
+
+			adminID, _ := ctx.Value(middleware.UserUUIDKey).(string)
+			emailID := chi.URLParam(r, "email")
+
+			span.SetAttributes(
+				attribute.String("uuid", adminID),
+				attribute.String("OutboxEmailUuid", emailID),
+			)
+
+			email, err := db.RetryOutboxEmail(emailID, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrOutboxEmailNotFound) {
+					tools.NotFoundErrorHandler(w, err.Error())
+					return
+				}
+
+				if errors.Is(err, db.ErrOutboxEmailNotFailed) {
+					tools.UnprocessableContent(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Email retried successfully")
+
+			resp := tools.Message {
+				Message: "The email is queued again",
+				Data: email,
+			}
+
+			resp.WriteMessage(w)
+		})
+	})
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"fmt"
+	"errors"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const ApiKeyRouterName = "api-key-router"
+
+// An API key can't manage the keys, otherwise a leaked key could create
+// new ones
+func ApiKeyRouter(router chi.Router) {
+	router.Use(middleware.Authorization)
+	router.Use(middleware.RejectApiKeys)
+
+	router.Get("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ApiKeyRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", ApiKeyRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		keys, err := db.FetchApiKeys(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch API keys successfully")
+
+		resp := tools.Message {
+			Message: "List of API keys",
+			Data: keys,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Post("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ApiKeyRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./", ApiKeyRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var apiKey requests.CreateApiKey
+		if err := json.NewDecoder(r.Body).Decode(&apiKey); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := apiKey.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		created, err := db.CreateApiKey(userID, &apiKey, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrApiKeysFull) || errors.Is(err, db.ErrApiKeyScopes) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "API key created successfully")
+
+		resp := tools.Message {
+			Message: "API key created successfully, keep the key because it isn't shown again",
+			Data: created,
+		}
+
+		resp.WriteMessageWithCode(w, http.StatusCreated)
+	})
+
+	router.Get("/{key}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ApiKeyRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./{key}", ApiKeyRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+		keyID := chi.URLParam(r, "key")
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+			attribute.String("ApiKeyUuid", keyID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		key, err := db.FetchApiKey(keyID, userID, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrApiKeyNotFound) {
+				tools.NotFoundErrorHandler(w, "API key not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch API key successfully")
+
+		resp := tools.Message {
+			Message: "API key",
+			Data: key,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Put("/{key}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ApiKeyRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./{key}", ApiKeyRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+		keyID := chi.URLParam(r, "key")
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+			attribute.String("ApiKeyUuid", keyID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var apiKey requests.UpdateApiKey
+		if err := json.NewDecoder(r.Body).Decode(&apiKey); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := apiKey.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		key, err := db.UpdateApiKey(keyID, userID, &apiKey, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrApiKeyNotFound) {
+				tools.NotFoundErrorHandler(w, "API key not found")
+				return
+			}
+
+			if errors.Is(err, db.ErrApiKeyScopes) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "API key updated successfully")
+
+		resp := tools.Message {
+			Message: "API key updated successfully",
+			Data: key,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Delete("/{key}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ApiKeyRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{key}", ApiKeyRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+		keyID := chi.URLParam(r, "key")
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+			attribute.String("ApiKeyUuid", keyID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		if err := db.DeleteApiKey(keyID, userID, ctx); err != nil {
+			if errors.Is(err, db.ErrApiKeyNotFound) {
+				tools.NotFoundErrorHandler(w, "API key not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "API key deleted successfully")
+
+		resp := tools.Message {
+			Message: "API key deleted successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+}
@@ -1,27 +1,46 @@
 package handlers
 
 import (
+	"io"
 	"fmt"
 	"time"
 	"errors"
+	"context"
+	"strings"
 	"net/http"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"encoding/base64"
 
 	"github.com/OscarVillanueva/goapi/internal/app/tools"
 	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
 	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
 	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/sessions"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/ratelimit"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
 	"github.com/OscarVillanueva/goapi/internal/platform"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.opentelemetry.io/otel"
 	"github.com/go-chi/chi/v5"
 	mysql "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
 )
 
 const AuthRouterName = "auth-router"
 
+// The user has this long to come back from the OIDC provider
+const oidcStateTTL = 10 * time.Minute
+
+// The cookie ties the state to the browser that started the login, a
+// callback URL opened anywhere else is rejected
+const oidcBindingCookie = "oidc_binding"
+
 func AuthRouter(router chi.Router) {
 	router.Post("/create-account", func(w http.ResponseWriter, r *http.Request){
 		w.Header().Set("Content-Type", "application/json")
@@ -41,11 +60,15 @@ func AuthRouter(router chi.Router) {
 		if err := account.Validate(); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			tools.BadRequestErrorHandler(w, err)
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if rateLimited(w, r, "create-account", account.Email, ctx) {
 			return
 		}
 
-		token, err := db.CreateAccount(account, ctx)
+		err := db.CreateAccount(account, emails.Locale(r.Header.Get("Accept-Language")), ctx)
 		if err != nil  {
 			var mysqlErr *mysql.MySQLError
 
@@ -65,18 +88,6 @@ func AuthRouter(router chi.Router) {
 			return
 		}
 
-		to := []string{account.Email}
-		msg := []byte(fmt.Sprintf("Use this token to verify your account: %s", token))
-		if err := platform.SendEmail(to, msg); err != nil {
-			span.SetAttributes(
-				attribute.String("Email", account.Email),
-			)
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			tools.ServiceUnavailableErrorHandler(w)
-			return
-		}
-
 		span.SetStatus(codes.Ok, "Created Account")
 
 		resp := tools.Message {
@@ -105,7 +116,11 @@ func AuthRouter(router chi.Router) {
 		if err := verify.Validate(); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			tools.BadRequestErrorHandler(w, err)
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if rateLimited(w, r, "verify-account", verify.Email, ctx) {
 			return
 		}
 
@@ -117,6 +132,7 @@ func AuthRouter(router chi.Router) {
 			)
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
+			recordCodeFailure(verify.Email, signInPurposes, ctx)
 			tools.UnprocessableContent(w, "The token or email are invalid")
 			return
 		}
@@ -172,7 +188,11 @@ func AuthRouter(router chi.Router) {
 		if err := resend.Validate(); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			tools.BadRequestErrorHandler(w, err)
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if rateLimited(w, r, "resend-code", resend.Email, ctx) {
 			return
 		}
 
@@ -190,23 +210,13 @@ func AuthRouter(router chi.Router) {
 		}
 
 		var magic dao.Magic
-		if err := db.RegenerateMagicLink(ctx, user.Uuid, &magic); err != nil {
+		if err := db.RegenerateMagicLink(ctx, user, emails.Locale(r.Header.Get("Accept-Language")), &magic); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
 			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
-		to := []string{resend.Email}
-		msg := []byte(fmt.Sprintf("Use this token to verify your account: %s", magic.Token))
-		if err := platform.SendEmail(to, msg); err != nil {
-			span.RecordError(err)
-			span.SetStatus(codes.Error, err.Error())
-			tools.InternalServerErrorHandler(w, nil)
-			return
-		}
-
-
 		span.SetStatus(codes.Ok, "ResendCode success")
 
 		resp := tools.Message {
@@ -235,7 +245,11 @@ func AuthRouter(router chi.Router) {
 		if err := login.Validate(); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			tools.BadRequestErrorHandler(w, err)
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if rateLimited(w, r, "login", login.Email, ctx) {
 			return
 		}
 
@@ -272,6 +286,7 @@ func AuthRouter(router chi.Router) {
 			)
 			span.RecordError(errors.New(msg))
 			span.SetStatus(codes.Error, msg)
+			recordCodeFailure(login.Email, signInPurposes, ctx)
 			tools.UnauthorizedErrorHandler(w, &msg)
 			return
 		}
@@ -287,33 +302,655 @@ func AuthRouter(router chi.Router) {
 			return
 		}
 
-		token, err := tools.GenerateJWT(
-			time.Now().UTC().Add(120 * time.Hour), 
-			map[string]any{ "uuid": user.Uuid, "name": user.Name },
-			ctx,
+		session, err := issueSession(user, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if err := db.DeleteMagicLink(user.Uuid, ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Login success")
+
+		// The message keeps the access token for the clients of the old
+		// response
+		resp := tools.Message {
+			Message: session.AccessToken,
+			Data: session,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	// The signed link of a verification, login or email change email. Opening
+	// it only shows the confirmation, the link is used by the POST
+	router.Get("/auth/magic", func(w http.ResponseWriter, r *http.Request){
+		tr := otel.Tracer(AuthRouterName)
+		_, span := tr.Start(r.Context(), fmt.Sprintf("%s/auth/magic/confirm", AuthRouterName))
+		defer span.End()
+
+		token := r.URL.Query().Get("token")
+		claims, err := tools.ParseMagicLink(token)
+		if err != nil {
+			msg := "The link is invalid or expired"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, tools.ErrMagicLinkDisabled) {
+				tools.NotFoundErrorHandler(w, "The magic links are disabled")
+				return
+			}
+
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("UserUuid", claims.Subject),
+			attribute.String("Purpose", claims.Purpose),
+		)
+
+		if err := tools.WriteMagicLinkPage(w, token, claims.Purpose); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Magic link confirmation")
+	})
+
+	// Does what the purpose of the link says and works once like the code, the
+	// token comes from the confirmation page as a form or from an app as json
+	router.Post("/auth/magic", func(w http.ResponseWriter, r *http.Request){
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AuthRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s/auth/magic", AuthRouterName))
+		defer span.End()
+
+		if rateLimited(w, r, "magic-link", "", ctx) {
+			return
+		}
+
+		redeem := requests.RedeemMagicLink{}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&redeem); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+				return
+			}
+		} else {
+			redeem.Token = r.PostFormValue("token")
+		}
+
+		if err := redeem.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		claims, err := tools.ParseMagicLink(redeem.Token)
+		if err != nil {
+			msg := "The link is invalid or expired"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, tools.ErrMagicLinkDisabled) {
+				tools.NotFoundErrorHandler(w, "The magic links are disabled")
+				return
+			}
+
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("UserUuid", claims.Subject),
+			attribute.String("Purpose", claims.Purpose),
 		)
 
+		user, err := db.UseMagicLink(*claims, emails.Locale(r.Header.Get("Accept-Language")), ctx)
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, db.ErrMagicLinkNotFound) || errors.Is(err, tools.ErrMagicLinkExpired) {
+				msg := "The link is invalid or expired"
+				tools.UnauthorizedErrorHandler(w, &msg)
+				return
+			}
+
+			if errors.Is(err, db.ErrEmailTaken) {
+				tools.ConflictErrorHandler(w, err.Error())
+				return
+			}
+
 			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
-		if err := db.DeleteMagicLink(user.Uuid, ctx); err != nil {
+		if claims.Purpose == dao.MagicPurposeChangeEmail {
+			closeSessionsAfterEmailChange(user.Uuid, ctx)
+
+			span.SetStatus(codes.Ok, "Email changed")
+
+			resp := tools.Message {
+				Message: "Email changed, sign in again with the new email",
+				Data: "success",
+			}
+
+			resp.WriteMessage(w)
+			return
+		}
+
+		if claims.Purpose == dao.MagicPurposeVerify {
+			span.SetStatus(codes.Ok, "Verified Account")
+
+			resp := tools.Message {
+				Message: "Verified account",
+				Data: "success",
+			}
+
+			resp.WriteMessage(w)
+			return
+		}
+
+		session, err := issueSession(*user, ctx)
+		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
 		span.SetStatus(codes.Ok, "Login success")
 
 		resp := tools.Message {
-			Message: token,
-			Data: "success",
+			Message: session.AccessToken,
+			Data: session,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Post("/token/refresh", func(w http.ResponseWriter, r *http.Request){
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AuthRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s/token/refresh", AuthRouterName))
+		defer span.End()
+
+		var refresh requests.RefreshToken
+		if err := json.NewDecoder(r.Body).Decode(&refresh); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := refresh.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		refreshToken, userID, err := db.RotateRefreshToken(refresh.RefreshToken, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrRefreshTokenInvalid) || errors.Is(err, db.ErrRefreshTokenExpired) || errors.Is(err, db.ErrRefreshTokenReused) {
+				msg := err.Error()
+				tools.UnauthorizedErrorHandler(w, &msg)
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("UserUuid", userID),
+		)
+
+		user, err := db.FetchUserByUuid(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		accessToken, err := generateAccessToken(*user, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Token refreshed")
+
+		resp := tools.Message {
+			Message: "Token refreshed",
+			Data: requests.TokenPair{
+				AccessToken: accessToken,
+				TokenType: "Bearer",
+				ExpiresIn: int64(tools.AccessTokenTTL().Seconds()),
+				RefreshToken: refreshToken,
+			},
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	// The browser starts the OIDC login here and is sent to the provider, the
+	// state, nonce and PKCE verifier wait in redis for the callback
+	router.Get("/auth/oidc/login", func(w http.ResponseWriter, r *http.Request){
+		tr := otel.Tracer(AuthRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s/auth/oidc/login", AuthRouterName))
+		defer span.End()
+
+		state := tools.GenerateSecureToken(32)
+		binding := tools.GenerateSecureToken(32)
+		login := requests.OidcLoginState{
+			Nonce: tools.GenerateSecureToken(16),
+			Verifier: tools.GenerateSecureToken(32),
+			Binding: tools.HashToken(binding),
+		}
+
+		if state == "" || binding == "" || login.Nonce == "" || login.Verifier == "" {
+			err := errors.New("We couldn't generate the OIDC state")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		value, err := json.Marshal(login)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if err := platform.SaveSecretWithTTL(oidcStateKey(state), string(value), oidcStateTTL, ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ServiceUnavailableErrorHandler(w)
+			return
+		}
+
+		challenge := sha256.Sum256([]byte(login.Verifier))
+		authorizationURL, err := platform.OidcAuthorizationURL(state, login.Nonce, base64.RawURLEncoding.EncodeToString(challenge[:]), ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, platform.ErrOidcDisabled) {
+				tools.NotFoundErrorHandler(w, err.Error())
+				return
+			}
+
+			tools.ServiceUnavailableErrorHandler(w)
+			return
+		}
+
+		setOidcBindingCookie(w, r, binding, int(oidcStateTTL.Seconds()))
+
+		span.SetStatus(codes.Ok, "Redirected to the OIDC provider")
+
+		http.Redirect(w, r, authorizationURL, http.StatusFound)
+	})
+
+	router.Get("/auth/oidc/callback", func(w http.ResponseWriter, r *http.Request){
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(AuthRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s/auth/oidc/callback", AuthRouterName))
+		defer span.End()
+
+		query := r.URL.Query()
+
+		if providerErr := query.Get("error"); providerErr != "" {
+			msg := fmt.Sprintf("The OIDC provider rejected the login: %s", providerErr)
+			span.RecordError(errors.New(msg))
+			span.SetStatus(codes.Error, msg)
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		state := query.Get("state")
+		code := query.Get("code")
+		if state == "" || code == "" {
+			tools.BadRequestErrorHandler(w, errors.New("The state and code are required"))
+			return
+		}
+
+		// The state is single use so a callback can't be replayed
+		value, err := platform.ConsumeSecret(oidcStateKey(state), ctx)
+		if errors.Is(err, platform.ErrSecretNotFound) {
+			msg := "The OIDC login expired, please start again"
+			span.SetStatus(codes.Error, msg)
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ServiceUnavailableErrorHandler(w)
+			return
+		}
+
+		var login requests.OidcLoginState
+		if err := json.Unmarshal([]byte(value), &login); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		setOidcBindingCookie(w, r, "", -1)
+
+		cookie, err := r.Cookie(oidcBindingCookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(tools.HashToken(cookie.Value)), []byte(login.Binding)) != 1 {
+			msg := "The OIDC login was started in another browser, please start again"
+			span.SetStatus(codes.Error, msg)
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		identity, err := platform.ExchangeOidcCode(code, login.Verifier, login.Nonce, ctx)
+		if err != nil {
+			msg := "We couldn't verify the OIDC login"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("Issuer", identity.Issuer),
+			attribute.String("Subject", identity.Subject),
+			attribute.String("Email", identity.Email),
+		)
+
+		user, err := db.LinkOidcIdentity(*identity, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, db.ErrOidcEmailNotVerified) {
+				tools.ForbiddenErrorHandler(w, err.Error())
+				return
+			}
+
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		session, err := issueSession(*user, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "OIDC login success")
+
+		resp := tools.Message {
+			Message: session.AccessToken,
+			Data: session,
 		}
 
 		resp.WriteMessage(w)
 	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(middleware.Authorization)
+
+		router.Post("/logout", func(w http.ResponseWriter, r *http.Request){
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AuthRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s/logout", AuthRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+			tokenID, _ := ctx.Value(middleware.TokenIdKey).(string)
+			expiresAt, _ := ctx.Value(middleware.TokenExpiresAtKey).(time.Time)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+				attribute.String("TokenId", tokenID),
+			)
+
+			if !ok || userID == "" || tokenID == "" {
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			// The body is optional
+			var logout requests.Logout
+			if err := json.NewDecoder(r.Body).Decode(&logout); err != nil && !errors.Is(err, io.EOF) {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+				return
+			}
+
+			if err := logout.Validate(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ValidationErrorHandler(w, err)
+				return
+			}
+
+			if logout.RefreshToken != nil && *logout.RefreshToken != "" {
+				err := db.RevokeRefreshTokenFamily(*logout.RefreshToken, userID, ctx)
+				if err != nil && !errors.Is(err, db.ErrRefreshTokenInvalid) {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+					tools.InternalServerErrorHandler(w, nil)
+					return
+				}
+			}
+
+			if err := sessions.RevokeToken(tokenID, expiresAt, ctx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ServiceUnavailableErrorHandler(w)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Logout success")
+
+			resp := tools.Message {
+				Message: "The session was closed",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Post("/logout-all", func(w http.ResponseWriter, r *http.Request){
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(AuthRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s/logout-all", AuthRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == "" {
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			if err := closeAllSessions(userID, ctx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Logout from every session success")
+
+			resp := tools.Message {
+				Message: "Every session was closed",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+	})
+}
+
+// closeAllSessions revokes the refresh tokens and rejects every access token
+// issued until now
+func closeAllSessions(userID string, ctx context.Context) error {
+	if err := db.RevokeUserRefreshTokens(userID, ctx); err != nil {
+		return err
+	}
+
+	return sessions.RevokeUserTokens(userID, time.Now().UTC(), ctx)
+}
+
+// closeSessionsAfterEmailChange runs once the new email is committed, the
+// change can't be undone so a failure is logged and the change still succeeds
+func closeSessionsAfterEmailChange(userID string, ctx context.Context) {
+	if err := closeAllSessions(userID, ctx); err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		log.WithField("user", userID).Error(err)
+	}
+}
+
+// issueSession starts a new refresh token family with its first access token
+func issueSession(user dao.User, ctx context.Context) (*requests.TokenPair, error) {
+	accessToken, err := generateAccessToken(user, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := db.CreateRefreshToken(user.Uuid, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &requests.TokenPair{
+		AccessToken: accessToken,
+		TokenType: "Bearer",
+		ExpiresIn: int64(tools.AccessTokenTTL().Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
 }
 
+func generateAccessToken(user dao.User, ctx context.Context) (string, error) {
+	claims := tools.TokenClaims{
+		ExpiresAt: time.Now().UTC().Add(tools.AccessTokenTTL()),
+		Subject: user.Uuid,
+		Audience: []string{tools.AccessTokenAudience},
+	}
+
+	// The roles are read on every refresh, a change reaches the token with
+	// the next one
+	roles, permissions, err := db.FetchUserAccess(user.Uuid, ctx)
+	if err != nil {
+		return "", err
+	}
+
+	data := map[string]any{
+		"uuid": user.Uuid,
+		"name": user.Name,
+		"roles": roles,
+		"permissions": permissions,
+	}
+
+	return tools.GenerateJWT(claims, data, ctx)
+}
+
+
+func oidcStateKey(state string) string {
+	return fmt.Sprintf("oidc-state:%s", state)
+}
+
+// setOidcBindingCookie is only sent back to the OIDC routes, a negative max
+// age removes it
+func setOidcBindingCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name: oidcBindingCookie,
+		Value: value,
+		Path: "/auth/oidc",
+		MaxAge: maxAge,
+		HttpOnly: true,
+		Secure: r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		// Lax still sends it on the redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// rateLimited counts the request against the limits of the route and writes
+// the 429 when one of them was exceeded
+func rateLimited(w http.ResponseWriter, r *http.Request, route string, email string, ctx context.Context) bool {
+	err := ratelimit.Check(route, email, ratelimit.ClientIP(r), ctx)
+
+	var limitErr *ratelimit.LimitedError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("Email", email),
+		attribute.String("RateLimitScope", limitErr.Scope),
+	)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	tools.TooManyRequestsErrorHandler(w, limitErr.RetryAfter)
+
+	return true
+}
+
+// signInPurposes are the codes the verify and login routes accept, a wrong
+// code counts against both
+var signInPurposes = []string{dao.MagicPurposeVerify, dao.MagicPurposeLogin}
+
+// recordCodeFailure counts a wrong code of the email against its codes with
+// the purposes, they stop working after db.MaxMagicLinkAttempts failures
+func recordCodeFailure(email string, purposes []string, ctx context.Context) {
+	span := trace.SpanFromContext(ctx)
+
+	invalidated, err := db.RecordMagicLinkFailure(email, purposes, ctx)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+
+	if invalidated {
+		span.AddEvent("magic_code.lockout", trace.WithAttributes(
+			attribute.String("Email", email),
+			attribute.Int("MaxAttempts", db.MaxMagicLinkAttempts),
+		))
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"time"
+	"strings"
+	"testing"
+	"net/url"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The tests run without a database, a request that reaches it answers 500
+// so the cases tell which ones would use the link
+func TestMagicLinkRoutes(t *testing.T) {
+	t.Setenv("MAGIC_LINK_SECRET", "test-secret")
+
+	router := chi.NewRouter()
+	router.Route("/", AuthRouter)
+
+	token, err := tools.SignMagicLink(tools.MagicLinkClaims{
+		Subject: "user-1",
+		Purpose: dao.MagicPurposeLogin,
+		Nonce: "nonce-1",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := tools.SignMagicLink(tools.MagicLinkClaims{
+		Subject: "user-1",
+		Purpose: dao.MagicPurposeLogin,
+		Nonce: "nonce-2",
+		ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := func(token string) *http.Request {
+		request := httptest.NewRequest(http.MethodPost, "/auth/magic", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return request
+	}
+
+	cases := []struct {
+		name string
+		request *http.Request
+		status int
+		contentType string
+	}{
+		{"opening the link only shows the page", httptest.NewRequest(http.MethodGet, "/auth/magic?token=" + url.QueryEscape(token), nil), http.StatusOK, "text/html"},
+		{"opening a tampered link", httptest.NewRequest(http.MethodGet, "/auth/magic?token=" + url.QueryEscape(token + "x"), nil), http.StatusUnauthorized, "application/json"},
+		{"opening an expired link", httptest.NewRequest(http.MethodGet, "/auth/magic?token=" + url.QueryEscape(expired), nil), http.StatusUnauthorized, "application/json"},
+		{"posting without token", form(""), http.StatusUnprocessableEntity, "application/json"},
+		{"posting a tampered token", form(token + "x"), http.StatusUnauthorized, "application/json"},
+		{"posting an expired token", form(expired), http.StatusUnauthorized, "application/json"},
+		{"posting the token uses the link", form(token), http.StatusInternalServerError, "application/json"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, c.request)
+
+			if recorder.Code != c.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, c.status, recorder.Body.String())
+			}
+
+			if !strings.HasPrefix(recorder.Header().Get("Content-Type"), c.contentType) {
+				t.Fatalf("Content-Type = %q, want %q", recorder.Header().Get("Content-Type"), c.contentType)
+			}
+		})
+	}
+}
@@ -0,0 +1,571 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/exports"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/parameters"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const MeRouterName = "me-router"
+
+// The profile is only for the sessions, no API key scope covers it
+func MeRouter(router chi.Router) {
+	router.Use(middleware.Authorization)
+	router.Use(middleware.RejectApiKeys)
+
+	router.Get("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		user, err := db.FetchUserByUuid(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		roles, _ := ctx.Value(middleware.RolesKey).([]string)
+		permissions, _ := ctx.Value(middleware.PermissionsKey).([]string)
+
+		profile := requests.Profile{
+			Uuid: user.Uuid,
+			Name: user.Name,
+			Email: user.Email,
+			Verified: user.Verified,
+			CreatedAt: user.CreatedAt,
+			Roles: roles,
+			Permissions: permissions,
+		}
+
+		if expiresAt, ok := ctx.Value(middleware.TokenExpiresAtKey).(time.Time); ok {
+			profile.TokenExpiresAt = &expiresAt
+		}
+
+		deletion, err := db.FetchAccountDeletion(userID, ctx)
+		if err != nil && !errors.Is(err, db.ErrAccountDeletionNotFound) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if deletion != nil {
+			profile.DeletionScheduledFor = &deletion.ScheduledFor
+		}
+
+		span.SetStatus(codes.Ok, "Fetch profile successfully")
+
+		resp := tools.Message {
+			Message: "Profile",
+			Data: profile,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Patch("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PATCH./", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var update requests.UpdateProfile
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := update.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		user, err := db.UpdateUserName(userID, update.Name, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Profile updated successfully")
+
+		// The access tokens carry the old name until the next refresh
+		resp := tools.Message {
+			Message: "Profile updated successfully",
+			Data: requests.Profile{
+				Uuid: user.Uuid,
+				Name: user.Name,
+				Email: user.Email,
+				Verified: user.Verified,
+				CreatedAt: user.CreatedAt,
+			},
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	// The code goes to the new email, the account keeps the current one
+	// until the code is confirmed
+	router.Post("/email", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./email", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var change requests.ChangeEmail
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := change.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if rateLimited(w, r, "change-email", change.Email, ctx) {
+			return
+		}
+
+		user, err := db.FetchUserByUuid(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if err := db.RequestEmailChange(*user, change.Email, emails.Locale(r.Header.Get("Accept-Language")), ctx); err != nil {
+			if errors.Is(err, db.ErrEmailTaken) {
+				tools.ConflictErrorHandler(w, err.Error())
+				return
+			}
+
+			if errors.Is(err, db.ErrEmailUnchanged) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Email change requested")
+
+		resp := tools.Message {
+			Message: "Code sent to the new email, confirm it to change the email",
+			Data: "success",
+		}
+
+		resp.WriteMessageWithCode(w, http.StatusAccepted)
+	})
+
+	// Every session ends after the change, the old email gets a notice
+	router.Post("/email/confirm", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./email/confirm", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var confirm requests.ConfirmEmailChange
+		if err := json.NewDecoder(r.Body).Decode(&confirm); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := confirm.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		user, err := db.FetchUserByUuid(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if rateLimited(w, r, "confirm-email", user.Email, ctx) {
+			return
+		}
+
+		if _, err := db.ConfirmEmailChange(userID, confirm.Token, emails.Locale(r.Header.Get("Accept-Language")), ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, db.ErrEmailChangeInvalid) {
+				recordCodeFailure(user.Email, []string{dao.MagicPurposeChangeEmail}, ctx)
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			if errors.Is(err, db.ErrEmailTaken) {
+				tools.ConflictErrorHandler(w, err.Error())
+				return
+			}
+
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		closeSessionsAfterEmailChange(userID, ctx)
+
+		span.SetStatus(codes.Ok, "Email changed")
+
+		resp := tools.Message {
+			Message: "Email changed, sign in again with the new email",
+			Data: "success",
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	// The archive is sent while it's written, the images are read from the
+	// bucket one by one
+	router.Get("/export", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./export", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		// The limit goes before the export reads anything, it's per user so
+		// an email change doesn't reset it
+		if rateLimited(w, r, "account-export", userID, ctx) {
+			return
+		}
+
+		export, err := db.FetchAccountExport(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		export.Profile.Roles, _ = ctx.Value(middleware.RolesKey).([]string)
+		export.Profile.Permissions, _ = ctx.Value(middleware.PermissionsKey).([]string)
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exports.AccountArchiveName(time.Now().UTC())))
+		w.WriteHeader(http.StatusOK)
+
+		// The status is already sent, a failure in the middle of the stream
+		// leaves the archive incomplete and is only recorded in the trace
+		archive := exports.NewAccountArchive(w)
+		if err := writeAccountArchive(archive, export, userID, ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+
+		if err := archive.Close(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Account exported")
+	})
+
+	// The account stays usable during the cooling-off period, only
+	// DELETE /me/deletion cancels it
+	router.Delete("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		user, err := db.FetchUserByUuid(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		deletion, err := db.RequestAccountDeletion(*user, emails.Locale(r.Header.Get("Accept-Language")), ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, db.ErrAccountHasOpenOrders) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Account deletion scheduled")
+
+		resp := tools.Message {
+			Message: "The account will be deleted after the cooling-off period",
+			Data: deletion,
+		}
+
+		resp.WriteMessageWithCode(w, http.StatusAccepted)
+	})
+
+	router.Delete("/deletion", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(MeRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./deletion", MeRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		if err := db.CancelAccountDeletion(userID, ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, db.ErrAccountDeletionNotFound) {
+				tools.NotFoundErrorHandler(w, err.Error())
+				return
+			}
+
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Account deletion cancelled")
+
+		resp := tools.Message {
+			Message: "The account deletion was cancelled",
+			Data: "success",
+		}
+
+		resp.WriteMessage(w)
+	})
+}
+
+// writeAccountArchive writes every entry of the export, the purchases are
+// streamed from the database like the purchases export
+func writeAccountArchive(archive *exports.AccountArchive, export *requests.AccountExport, userID string, ctx context.Context) error {
+	profile := struct {
+		Profile requests.Profile `json:"profile"`
+		Addresses []dao.Address `json:"addresses"`
+		Deletion *dao.AccountDeletion `json:"account_deletion"`
+	}{
+		Profile: export.Profile,
+		Addresses: export.Addresses,
+		Deletion: export.Deletion,
+	}
+
+	if err := archive.WriteJSON("profile.json", profile); err != nil {
+		return err
+	}
+
+	if err := archive.WriteJSON("products.json", export.Products); err != nil {
+		return err
+	}
+
+	reviews := struct {
+		Reviews []dao.Review `json:"reviews"`
+		Images []dao.ReviewImage `json:"images"`
+	}{
+		Reviews: export.Reviews,
+		Images: export.ReviewImages,
+	}
+
+	if err := archive.WriteJSON("reviews.json", reviews); err != nil {
+		return err
+	}
+
+	entry, err := archive.Create("purchases.json")
+	if err != nil {
+		return err
+	}
+
+	writer, err := exports.NewTicketLineWriter(entry, exports.FormatJSON)
+	if err != nil {
+		return err
+	}
+
+	params := parameters.GetTicketsParams{
+		Buyer: userID,
+		Context: ctx,
+		Sort: parameters.TicketsOldestFirst,
+	}
+
+	if err := db.StreamTicketLines(params, writer.Write); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	for _, product := range export.Products {
+		if product.Image == nil {
+			continue
+		}
+
+		if err := addArchiveImage(archive, "products", platform.ImageObjectName(*product.Image), ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, image := range export.ReviewImages {
+		if err := addArchiveImage(archive, "reviews", image.ObjectName, ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addArchiveImage skips an image that is missing in the bucket, the rest of
+// the archive is still useful without it
+func addArchiveImage(archive *exports.AccountArchive, folder string, object string, ctx context.Context) error {
+	image, err := platform.GetImage(object, ctx)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		return nil
+	}
+
+	defer image.Close()
+
+	return archive.AddImage(folder, object, image)
+}
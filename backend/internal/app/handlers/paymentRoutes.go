@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"io"
+	"fmt"
+	"errors"
+	"context"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const PaymentsRouterName = "payments-router"
+
+func PaymentsRouter(router chi.Router) {
+	router.Post("/webhook", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(PaymentsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./webhook", PaymentsRouterName))
+		defer span.End()
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1 << 20))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := platform.VerifyWebhookSignature(r.Header.Get("X-Payment-Signature"), body); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			msg := err.Error()
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
+		var event platform.PaymentEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("IntentId", event.IntentId),
+			attribute.String("Event", event.Type),
+		)
+
+		intent, err := db.FetchPaymentIntentByUuid(event.IntentId, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrPaymentIntentNotFound) {
+				tools.NotFoundErrorHandler(w, "Payment intent not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		var changed bool
+		switch event.Type {
+			case platform.WebhookPaymentSucceeded:
+				changed, err = db.TransitionPaymentIntent(intent.Uuid, []string{dao.PaymentIntentPending}, dao.PaymentIntentCaptured, &event.ProviderRef, nil, ctx)
+				if err == nil && changed {
+					if mailErr := sendPurchaseConfirmation(intent.TicketId, intent.Buyer, emails.DefaultLocale, ctx); mailErr != nil {
+						span.RecordError(mailErr)
+					}
+				}
+
+			case platform.WebhookPaymentFailed:
+				reason := event.Reason
+				changed, err = db.FailPaymentIntent(intent.Uuid, []string{dao.PaymentIntentPending}, dao.PaymentIntentDeclined, &event.ProviderRef, &reason, dao.StockActorPayments, ctx)
+
+			default:
+				err := fmt.Errorf("Unknown event type: %s", event.Type)
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		// Repeated deliveries are acknowledged without changes
+		span.SetAttributes(
+			attribute.Bool("Changed", changed),
+		)
+		span.SetStatus(codes.Ok, "Webhook processed")
+
+		resp := tools.Message {
+			Message: "Webhook processed",
+			Data: changed,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	// Scripting the gateway is for the simulations, it never runs outside of
+	// development and only the admins can do it
+	router.Group(func (router chi.Router) {
+		router.Use(middleware.DevelopmentOnly)
+		router.Use(middleware.Authorization)
+		router.Use(middleware.RejectApiKeys)
+		router.Use(middleware.RequirePermissions(dao.PermissionAdminPayments))
+
+		router.Put("/mock/script", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(PaymentsRouterName)
+			_, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./mock/script", PaymentsRouterName))
+			defer span.End()
+
+			mock, ok := platform.GetPaymentProvider().(*platform.MockPaymentProvider)
+			if !ok {
+				tools.NotFoundErrorHandler(w, "The mock payment provider is not enabled")
+				return
+			}
+
+			var script requests.MockPaymentScript
+			if err := json.NewDecoder(r.Body).Decode(&script); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+				return
+			}
+
+			if err := script.Validate(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ValidationErrorHandler(w, err)
+				return
+			}
+
+			mock.Script(script.Outcomes...)
+
+			span.SetAttributes(
+				attribute.StringSlice("Outcomes", script.Outcomes),
+			)
+			span.SetStatus(codes.Ok, "Mock payments scripted")
+
+			resp := tools.Message {
+				Message: "The next payments were scripted",
+				Data: script.Outcomes,
+			}
+
+			resp.WriteMessage(w)
+		})
+	})
+}
+
+// chargeTicket authorizes and captures the total of the ticket, declined or
+// timed out payments and the ones the database couldn't record give the
+// reserved stock back
+func chargeTicket(ticketID string, buyer string, metadata map[string]string, ctx context.Context) (*dao.PaymentIntent, error) {
+	tr := otel.Tracer(PaymentsRouterName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.chargeTicket", PaymentsRouterName))
+	defer span.End()
+
+	// Without an intent nothing else would close the ticket, its units go
+	// back to the stock right away
+	release := func(err error) (*dao.PaymentIntent, error) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		if releaseErr := db.ReleaseTicket(ticketID, buyer, ctx); releaseErr != nil {
+			span.RecordError(releaseErr)
+			log.WithField("ticket", ticketID).Error(releaseErr)
+		}
+
+		return nil, err
+	}
+
+	provider := platform.GetPaymentProvider()
+	if provider == nil {
+		return release(errors.New("Empty payment provider"))
+	}
+
+	intent, err := db.CreatePaymentIntent(ticketID, buyer, provider.Name(), platform.GetPaymentCurrency(), ctx)
+	if err != nil {
+		return release(err)
+	}
+
+	span.SetAttributes(
+		attribute.String("IntentId", intent.Uuid),
+		attribute.String("TicketId", ticketID),
+	)
+
+	fail := func(status string, reason string, providerRef *string) (*dao.PaymentIntent, error) {
+		if _, err := db.FailPaymentIntent(intent.Uuid, []string{dao.PaymentIntentPending, dao.PaymentIntentAuthorized}, status, providerRef, &reason, buyer, ctx); err != nil {
+			return nil, err
+		}
+
+		intent.Status = status
+		intent.FailureReason = &reason
+		span.SetStatus(codes.Error, reason)
+		return intent, nil
+	}
+
+	// abort runs when the provider took the payment but the database couldn't
+	// record it, the money is given back and the ticket closed. When that
+	// fails too the ticket is left to the pending payments expiry job
+	abort := func(err error, providerRef string, captured bool) (*dao.PaymentIntent, error) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		status := dao.PaymentIntentVoided
+		var providerErr error
+		if captured {
+			status = dao.PaymentIntentRefunded
+			_, providerErr = provider.Refund(providerRef, intent.Amount, ctx)
+		} else {
+			_, providerErr = provider.Void(providerRef, ctx)
+		}
+
+		if providerErr != nil {
+			span.RecordError(providerErr)
+			log.WithFields(log.Fields{
+				"ticket": ticketID,
+				"intent": intent.Uuid,
+			}).Error(providerErr)
+			return nil, err
+		}
+
+		reason := "database_error"
+		if _, failErr := fail(status, reason, &providerRef); failErr != nil {
+			log.WithFields(log.Fields{
+				"ticket": ticketID,
+				"intent": intent.Uuid,
+			}).Error(failErr)
+		}
+
+		return nil, err
+	}
+
+	result, err := provider.Authorize(platform.PaymentRequest{
+		IntentId: intent.Uuid,
+		Reference: ticketID,
+		Amount: intent.Amount,
+		Currency: intent.Currency,
+		Metadata: metadata,
+	}, ctx)
+
+	if errors.Is(err, platform.ErrPaymentTimeout) {
+		span.RecordError(err)
+		return fail(dao.PaymentIntentTimedOut, "timeout", nil)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		return fail(dao.PaymentIntentDeclined, "provider_error", nil)
+	}
+
+	intent.ProviderRef = &result.ProviderRef
+
+	switch result.Status {
+		case platform.PaymentAuthorized:
+			if _, err := db.TransitionPaymentIntent(intent.Uuid, []string{dao.PaymentIntentPending}, dao.PaymentIntentAuthorized, &result.ProviderRef, nil, ctx); err != nil {
+				return abort(err, result.ProviderRef, false)
+			}
+
+			if _, err := provider.Capture(result.ProviderRef, intent.Amount, ctx); err != nil {
+				span.RecordError(err)
+				provider.Void(result.ProviderRef, ctx)
+				return fail(dao.PaymentIntentVoided, "capture_failed", &result.ProviderRef)
+			}
+
+			if _, err := db.TransitionPaymentIntent(intent.Uuid, []string{dao.PaymentIntentAuthorized}, dao.PaymentIntentCaptured, nil, nil, ctx); err != nil {
+				return abort(err, result.ProviderRef, true)
+			}
+
+			intent.Status = dao.PaymentIntentCaptured
+
+		case platform.PaymentPending:
+			if _, err := db.TransitionPaymentIntent(intent.Uuid, []string{dao.PaymentIntentPending}, dao.PaymentIntentPending, &result.ProviderRef, nil, ctx); err != nil {
+				return abort(err, result.ProviderRef, false)
+			}
+
+		default:
+			return fail(dao.PaymentIntentDeclined, result.Reason, &result.ProviderRef)
+	}
+
+	span.SetAttributes(
+		attribute.String("PaymentStatus", intent.Status),
+	)
+
+	return intent, nil
+}
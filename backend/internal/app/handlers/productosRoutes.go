@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 
 	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
 	"github.com/OscarVillanueva/goapi/internal/app/models/parameters"
 	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
 	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
@@ -27,6 +28,8 @@ const ProductsRouterName = "products-router"
 func ProductsRouter(router chi.Router)  {
 	router.Use(middleware.Authorization)
 
+	router.Route("/{product}/reviews", ReviewsRouter)
+
 	router.Get("/", func (w http.ResponseWriter, r *http.Request) {
 		tr := otel.Tracer(ProductsRouterName)
 		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", ProductsRouterName))
@@ -88,18 +91,47 @@ func ProductsRouter(router chi.Router)  {
 			onlyAvailable = parsedAvailable
 		}
 
+		onlyLowStock := false
+		lowStockStr := r.URL.Query().Get("low_stock")
+
+		span.SetAttributes(
+			attribute.String("LowStock", lowStockStr),
+		)
+
+		if lowStockStr != "" {
+			parsedLowStock, err := strconv.ParseBool(lowStockStr)
+
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid low_stock value"))
+				return
+			}
+
+			onlyLowStock = parsedLowStock
+		}
+
 		search := r.URL.Query().Get("search")
+		sort := r.URL.Query().Get("sort")
 
 		span.SetAttributes(
 			attribute.String("Search", search),
+			attribute.String("Sort", sort),
 		)
 
+		if sort != "" && sort != "rating" {
+			tools.BadRequestErrorHandler(w, errors.New("Invalid sort, use rating"))
+			return
+		}
+
 		products, err := db.GetProducts(parameters.GetProductsParams{
 			User: userID,
 			Page: page,
 			Context: ctx,
 			OnlyAvailable: onlyAvailable,
 			SearchName: search,
+			SortByRating: sort == "rating",
+			OnlyLowStock: onlyLowStock,
 		})
 		if err != nil {
 			span.RecordError(err)
@@ -118,7 +150,7 @@ func ProductsRouter(router chi.Router)  {
 		resp.WriteMessage(w)
 	})
 
-	router.Post("/", func (w http.ResponseWriter, r *http.Request)  {
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Post("/", func (w http.ResponseWriter, r *http.Request)  {
 		w.Header().Set("Content-Type", "application/json")
 
 		tr := otel.Tracer(ProductsRouterName)
@@ -148,7 +180,7 @@ func ProductsRouter(router chi.Router)  {
 		if err := product.Validate(); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			tools.BadRequestErrorHandler(w, err)
+			tools.ValidationErrorHandler(w, err)
 			return
 		}
 
@@ -170,7 +202,7 @@ func ProductsRouter(router chi.Router)  {
 		resp.WriteMessage(w)
 	})
 
-	router.Delete("/{product}", func (w http.ResponseWriter, r *http.Request)  {
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Delete("/{product}", func (w http.ResponseWriter, r *http.Request)  {
 		w.Header().Set("Content-Type", "application/json")
 
 		tr := otel.Tracer(ProductsRouterName)
@@ -229,7 +261,7 @@ func ProductsRouter(router chi.Router)  {
 		resp.WriteMessage(w)
 	})
 
-	router.Put("/{product}", func (w http.ResponseWriter, r *http.Request) {
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Put("/{product}", func (w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
 		tr := otel.Tracer(AuthRouterName)
@@ -275,7 +307,7 @@ func ProductsRouter(router chi.Router)  {
 		if err := product.Validate(); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			tools.BadRequestErrorHandler(w, err)
+			tools.ValidationErrorHandler(w, err)
 			return
 		}
 
@@ -305,7 +337,79 @@ func ProductsRouter(router chi.Router)  {
 		resp.WriteMessage(w)
 	})
 
-	router.Put("/{product}/image", func (w http.ResponseWriter, r *http.Request)  {
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Get("/{product}/stock-movements", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		page := 1
+
+		tr := otel.Tracer(ProductsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./stock-movements", ProductsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("UserID", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+		pageStr := r.URL.Query().Get("page")
+
+		span.SetAttributes(
+			attribute.String("ProductId", productID),
+			attribute.String("Page", pageStr),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		if pageStr != "" {
+			parsedPage, err := strconv.Atoi(pageStr)
+
+			if err != nil || parsedPage <= 0 {
+				tools.BadRequestErrorHandler(w, errors.New("Invalid Page number"))
+				return
+			}
+
+			page = parsedPage
+		}
+
+		movements, err := db.FetchStockMovements(productID, userID, page, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrProductNotFound){
+				tools.NotFoundErrorHandler(w, "Product not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch stock movements successfully")
+
+		resp := tools.Message {
+			Message: "Stock movements",
+			Data: movements,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Put("/{product}/image", func (w http.ResponseWriter, r *http.Request)  {
 		w.Header().Set("Content-Type", "application/json")
 
 		tr := otel.Tracer(AuthRouterName)
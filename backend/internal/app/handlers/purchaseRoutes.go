@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"os"
 	"fmt"
 	"time"
+	"context"
 	"errors"
 	"strconv"
 	"strings"
@@ -11,13 +13,21 @@ import (
 
 	"github.com/OscarVillanueva/goapi/internal/app/tools"
 	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
 	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/parameters"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/receipts"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/exports"
 	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+	"github.com/OscarVillanueva/goapi/internal/app/jobs"
+	"github.com/OscarVillanueva/goapi/internal/platform"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel"
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
 const PurchaseRouterName = "pruchase-router"
@@ -46,7 +56,7 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		var ticket []requests.CreatePurchase
+		var ticket requests.CreateTicket
 		if err := json.NewDecoder(r.Body).Decode(&ticket); err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
@@ -54,20 +64,19 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		i := 0
-		var valErr error
-
-		for i < len(ticket) && valErr == nil {
-			if err := ticket[i].Validate(); err != nil {
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
-				valErr = err
-			}
+		if err := ticket.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
 
-			i = i + 1
+		blockSelfPurchase, _ := strconv.ParseBool(os.Getenv("BLOCK_SELF_PURCHASE"))
+		options := parameters.CheckoutOptions{
+			BlockSelfPurchase: blockSelfPurchase,
 		}
 
-		purchaseID, err := db.BatchPurchase(ticket, userID, ctx)
+		purchaseID, alerts, err := db.BatchPurchase(ticket, userID, options, ctx)
 
 		if err != nil {
 			var stockErr *db.ErrInsufficientStock
@@ -78,8 +87,25 @@ func PurchaseRouter(router chi.Router)  {
 				return
 			}
 
-			if err.Error() == "quantity must be greater than zero" {
-				tools.BadRequestErrorHandler(w, err)
+			if errors.Is(err, db.ErrProductNotFound) || errors.Is(err, db.ErrAddressNotFound) {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			var selfErr *db.ErrSelfPurchase
+			if errors.As(err, &selfErr) {
+				span.RecordError(errors.New(selfErr.Error()))
+				span.SetStatus(codes.Error, selfErr.Error())
+				tools.UnprocessableContent(w, selfErr.Error())
+				return
+			}
+
+			if errors.Is(err, db.ErrInvalidQuantity) {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnprocessableContent(w, err.Error())
 				return
 			}
 
@@ -90,6 +116,59 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
+		// The outcome can only be forced by an admin while developing
+		metadata := map[string]string{}
+		outcome := r.Header.Get("X-Mock-Payment")
+		if outcome != "" && platform.IsDevelopment() && middleware.HasPermission(ctx, dao.PermissionAdminPayments) {
+			metadata["mock_outcome"] = outcome
+		}
+
+		intent, err := chargeTicket(purchaseID, userID, metadata, ctx)
+		if err != nil {
+			span.SetAttributes(
+				attribute.String("TicketId", purchaseID),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("TicketId", purchaseID),
+			attribute.String("PaymentStatus", intent.Status),
+		)
+
+		// Declined payments give the stock back, the alerts are only sent
+		// while the units are still sold or reserved
+		if len(alerts) > 0 && (intent.Status == dao.PaymentIntentCaptured || intent.Status == dao.PaymentIntentPending) {
+			go jobs.NotifyStockAlerts(alerts, context.WithoutCancel(ctx))
+		}
+
+		switch intent.Status {
+			case dao.PaymentIntentCaptured:
+			case dao.PaymentIntentPending:
+				span.SetStatus(codes.Ok, "Purchase waiting for the payment confirmation")
+
+				resp := tools.Message {
+					Message: "Purchase created, waiting for the payment confirmation",
+					Data: purchaseID,
+				}
+
+				resp.WriteMessageWithCode(w, http.StatusAccepted)
+				return
+			default:
+				msg := fmt.Sprintf("The payment was not completed: %s", intent.Status)
+				span.SetStatus(codes.Error, msg)
+				tools.PaymentRequiredErrorHandler(w, msg)
+				return
+		}
+
+		// The purchase is already committed, a failed confirmation email
+		// is only recorded in the trace
+		if err := sendPurchaseConfirmation(purchaseID, userID, emails.Locale(r.Header.Get("Accept-Language")), ctx); err != nil {
+			span.RecordError(err)
+		}
 
 		span.SetStatus(codes.Ok, "Create Putchases successfully")
 
@@ -103,29 +182,60 @@ func PurchaseRouter(router chi.Router)  {
 	
 	router.Get("/", func (w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		page := 1
 
-		tr := otel.Tracer(ProductsRouterName)
-		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", ProductsRouterName))
+		tr := otel.Tracer(PurchaseRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", PurchaseRouterName))
 		defer span.End()
 
-		pageStr := r.URL.Query().Get("page")
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
 
 		span.SetAttributes(
-			attribute.String("Page", pageStr),
+			attribute.String("UserUuid", userID),
 		)
-		
-		if pageStr != "" {
-			parsedPage, err := strconv.Atoi(pageStr)
 
-			if err != nil || parsedPage <= 0 {
-				tools.BadRequestErrorHandler(w, errors.New("Invalid Page number"))
-				return
-			}
+		if !ok || userID == ""{
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
 
-			page = parsedPage
+		params, err := parseTicketsParams(r, userID)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
 		}
-		
+
+		params.Context = ctx
+
+		tickets, err := db.FetchTickets(params)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch Purchase successfully")
+
+		// The body keeps the list the clients already read, the pagination
+		// goes in the headers
+		w.Header().Set("X-Page-Size", strconv.Itoa(tickets.PageSize))
+		w.Header().Set("X-Total-Pages", strconv.Itoa(tickets.Pages))
+
+		resp := tools.Message {
+			Message: "List of purchases",
+			Data: tickets.Tickets,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Get("/export", func (w http.ResponseWriter, r *http.Request) {
+		tr := otel.Tracer(PurchaseRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./export", PurchaseRouterName))
+		defer span.End()
+
 		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
 
 		span.SetAttributes(
@@ -137,7 +247,31 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		tickets, err := db.FetchTickets(page, userID, ctx)
+		formatStr := r.URL.Query().Get("format")
+
+		span.SetAttributes(
+			attribute.String("Format", formatStr),
+		)
+
+		format, err := exports.ParseFormat(formatStr)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		params, err := parseTicketsParams(r, userID)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		params.Context = ctx
+
+		writer, err := exports.NewTicketLineWriter(w, format)
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
@@ -145,14 +279,46 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		span.SetStatus(codes.Ok, "Fetch Purchase successfully")
+		// The headers are sent with the first line, the query and the first
+		// row can still fail with a 500
+		started := false
+		start := func() {
+			if started {
+				return
+			}
 
-		resp := tools.Message {
-			Message: "List of purchases",
-			Data: tickets,
+			started = true
+			w.Header().Set("Content-Type", format.ContentType())
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exports.FileName(format, time.Now().UTC())))
+			w.WriteHeader(http.StatusOK)
 		}
 
-		resp.WriteMessage(w)
+		err = db.StreamTicketLines(params, func(line requests.TicketExportLine) error {
+			start()
+			return writer.Write(line)
+		})
+
+		// Once the status is sent, a failure in the middle of the stream
+		// leaves the document incomplete and is only recorded in the trace
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if !started {
+				tools.InternalServerErrorHandler(w, nil)
+			}
+			return
+		}
+
+		start()
+
+		if err := writer.Close(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Purchases exported successfully")
 	})
 
 	router.Get("/{purchase}", func (w http.ResponseWriter, r *http.Request) {
@@ -190,30 +356,124 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		purchases, err := db.FetchPurchase(purchaseID, userID, ctx)
+		ticket, purchases, err := db.FetchPurchase(purchaseID, userID, ctx)
 		if err != nil {
+			if errors.Is(err, db.ErrTicketNotFound) {
+				span.SetStatus(codes.Unset, "Purchase not found")
+				tools.NotFoundErrorHandler(w, "Purchase not found")
+				return
+			}
+
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
 			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
-		if len(purchases) == 0 {
-			span.SetStatus(codes.Unset, "Purchase not found")
-			tools.NotFoundErrorHandler(w, "Purchase not found")
+		detail := requests.NewTicketDetail(*ticket, purchases)
+
+		subOrders, err := db.FetchTicketSubOrders(purchaseID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
+		detail.SubOrders = subOrders
+
+		intent, err := db.FetchPaymentIntent(purchaseID, ctx)
+		if err != nil && !errors.Is(err, db.ErrPaymentIntentNotFound) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		detail.Payment = intent
+
 		span.SetStatus(codes.Ok, "Purchase found successfully")
 
 		resp := tools.Message {
 			Message: "Purchase details",
-			Data: purchases,
+			Data: detail,
 		}
 
 		resp.WriteMessage(w)
 	})
 
+	router.Get("/{purchase}/receipt", func (w http.ResponseWriter, r *http.Request) {
+		tr := otel.Tracer(PurchaseRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./receipt", PurchaseRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		purchaseID := chi.URLParam(r, "purchase")
+		formatStr := r.URL.Query().Get("format")
+
+		span.SetAttributes(
+			attribute.String("PurchaseUuid", purchaseID),
+			attribute.String("Format", formatStr),
+		)
+
+		if strings.TrimSpace(purchaseID) == "" {
+			err := errors.New("Invalid purchase id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		format, err := receipts.ParseFormat(formatStr)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		receipt, err := db.FetchReceipt(purchaseID, userID, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrTicketNotFound) {
+				span.SetStatus(codes.Error, err.Error())
+				tools.NotFoundErrorHandler(w, "Purchase not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		document, err := receipts.Render(receipt, format)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Receipt rendered successfully")
+
+		w.Header().Set("Content-Type", format.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", receipts.FileName(receipt, format)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(document)
+	})
 
 	router.Delete("/{purchase}", func (w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -250,21 +510,27 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		purchases, err := db.FetchPurchase(purchaseID, userID, ctx)
+		ticket, _, err := db.FetchPurchase(purchaseID, userID, ctx)
 		if err != nil {
+			if errors.Is(err, db.ErrTicketNotFound) {
+				span.SetStatus(codes.Unset, "Purchase not found")
+				tools.NotFoundErrorHandler(w, "Purchase not found")
+				return
+			}
+
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
 			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
-		if len(purchases) == 0 {
-			span.SetStatus(codes.Unset, err.Error())
-			tools.NotFoundErrorHandler(w, "Purchase not found")
+		if ticket.Status == dao.TicketCancelled || ticket.Status == dao.TicketPaymentFailed {
+			span.SetStatus(codes.Error, db.ErrTicketClosed.Error())
+			tools.BadRequestErrorHandler(w, db.ErrTicketClosed)
 			return
 		}
 
-		if time.Since(purchases[0].CreatedAt) > time.Hour {
+		if time.Since(ticket.CreatedAt) > time.Hour {
 			err := errors.New("The purchase its to old to delete")
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
@@ -272,13 +538,37 @@ func PurchaseRouter(router chi.Router)  {
 			return
 		}
 
-		if err := db.DeletePurchase(purchases, ctx); err != nil {
+		// The ticket is locked and its shipments checked again in the same
+		// transaction that closes it
+		if err := db.DeletePurchase(purchaseID, userID, ctx); err != nil {
+			if errors.Is(err, db.ErrOrderShipped) || errors.Is(err, db.ErrTicketClosed) {
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
 			tools.InternalServerErrorHandler(w, nil)
 			return
 		}
 
+		// The money goes back once the ticket is closed, a cancelled ticket
+		// whose payment is still held is refunded again by the pending
+		// payments job
+		if err := jobs.RefundTicket(purchaseID, ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			resp := tools.Message {
+				Message: "Purchase deleted, the refund will be retried",
+				Data: true,
+			}
+
+			resp.WriteMessageWithCode(w, http.StatusAccepted)
+			return
+		}
+
 		span.SetStatus(codes.Ok, "Purchase deleted successfully")
 
 		resp := tools.Message {
@@ -289,3 +579,134 @@ func PurchaseRouter(router chi.Router)  {
 		resp.WriteMessage(w)
 	})
 }
+
+// sendPurchaseConfirmation enqueues the receipt, the outbox worker sends it
+func sendPurchaseConfirmation(purchaseID string, userID string, locale string, ctx context.Context) error {
+	receipt, err := db.FetchReceipt(purchaseID, userID, ctx)
+	if err != nil {
+		return err
+	}
+
+	document, err := receipts.Render(receipt, receipts.FormatPDF)
+	if err != nil {
+		return err
+	}
+
+	to := []string{receipt.BuyerEmail}
+	attachment := platform.EmailAttachment{
+		Name: receipts.FileName(receipt, receipts.FormatPDF),
+		ContentType: receipts.FormatPDF.ContentType(),
+		Content: document,
+	}
+
+	email, err := emails.Compose(emails.OrderConfirmation, locale, to, receipt, attachment)
+	if err != nil {
+		return err
+	}
+
+	return db.EnqueueEmail(emails.OrderConfirmation, email, ctx)
+}
+
+// parseTicketsParams reads the filters shared by the purchase history and its
+// export. Dates take YYYY-MM-DD or RFC 3339, a plain date in "to" includes
+// the whole day
+func parseTicketsParams(r *http.Request, buyer string) (parameters.GetTicketsParams, error) {
+	query := r.URL.Query()
+	params := parameters.GetTicketsParams{
+		Buyer: buyer,
+		Page: 1,
+		Product: strings.TrimSpace(query.Get("product")),
+		Seller: strings.TrimSpace(query.Get("seller")),
+		Sort: parameters.TicketsNewestFirst,
+	}
+
+	if pageStr := query.Get("page"); pageStr != "" {
+		parsedPage, err := strconv.Atoi(pageStr)
+
+		if err != nil || parsedPage <= 0 {
+			return params, errors.New("Invalid Page number")
+		}
+
+		params.Page = parsedPage
+	}
+
+	if from := query.Get("from"); from != "" {
+		parsedFrom, _, err := parseDateFilter(from)
+		if err != nil {
+			return params, errors.New("Invalid from date")
+		}
+
+		params.From = &parsedFrom
+	}
+
+	if to := query.Get("to"); to != "" {
+		parsedTo, dateOnly, err := parseDateFilter(to)
+		if err != nil {
+			return params, errors.New("Invalid to date")
+		}
+
+		if dateOnly {
+			parsedTo = parsedTo.AddDate(0, 0, 1)
+		}
+
+		params.To = &parsedTo
+	}
+
+	if params.From != nil && params.To != nil && !params.From.Before(*params.To) {
+		return params, errors.New("The from date must be before the to date")
+	}
+
+	if minStr := query.Get("min_total"); minStr != "" {
+		minTotal, err := strconv.ParseFloat(minStr, 64)
+		if err != nil || minTotal < 0 {
+			return params, errors.New("Invalid min_total")
+		}
+
+		params.MinTotal = &minTotal
+	}
+
+	if maxStr := query.Get("max_total"); maxStr != "" {
+		maxTotal, err := strconv.ParseFloat(maxStr, 64)
+		if err != nil || maxTotal < 0 {
+			return params, errors.New("Invalid max_total")
+		}
+
+		params.MaxTotal = &maxTotal
+	}
+
+	if params.MinTotal != nil && params.MaxTotal != nil && *params.MinTotal > *params.MaxTotal {
+		return params, errors.New("min_total can't be greater than max_total")
+	}
+
+	if params.Product != "" {
+		if _, err := uuid.Parse(params.Product); err != nil {
+			return params, errors.New("Invalid product uuid")
+		}
+	}
+
+	if params.Seller != "" {
+		if _, err := uuid.Parse(params.Seller); err != nil {
+			return params, errors.New("Invalid seller uuid")
+		}
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		switch sort {
+			case parameters.TicketsNewestFirst, parameters.TicketsOldestFirst, parameters.TicketsCheapestFirst, parameters.TicketsPriciestFirst:
+				params.Sort = sort
+			default:
+				return params, errors.New("Invalid sort, use created_at, -created_at, total or -total")
+		}
+	}
+
+	return params, nil
+}
+
+func parseDateFilter(value string) (time.Time, bool, error) {
+	if parsed, err := time.Parse(time.DateOnly, value); err == nil {
+		return parsed, true, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	return parsed.UTC(), false, err
+}
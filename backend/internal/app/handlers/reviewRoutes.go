@@ -0,0 +1,760 @@
+package handlers
+
+import (
+	"fmt"
+	"errors"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const ReviewsRouterName = "reviews-router"
+
+// ReviewsRouter is mounted under /products/{product}/reviews
+func ReviewsRouter(router chi.Router) {
+	router.Get("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		page := 1
+		pageStr := r.URL.Query().Get("page")
+		sort := r.URL.Query().Get("sort")
+
+		span.SetAttributes(
+			attribute.String("Page", pageStr),
+			attribute.String("Sort", sort),
+		)
+
+		if pageStr != "" {
+			parsedPage, err := strconv.Atoi(pageStr)
+
+			if err != nil || parsedPage <= 0 {
+				tools.BadRequestErrorHandler(w, errors.New("Invalid Page number"))
+				return
+			}
+
+			page = parsedPage
+		}
+
+		switch sort {
+			case "", db.ReviewsNewestFirst, db.ReviewsOldestFirst, db.ReviewsBestRated:
+			default:
+				tools.BadRequestErrorHandler(w, errors.New("Invalid sort, use newest, oldest or rating"))
+				return
+		}
+
+		reviews, err := db.FetchReviews(productID, page, sort, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch reviews successfully")
+
+		resp := tools.Message {
+			Message: "Reviews",
+			Data: reviews,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Post("/", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		var review requests.SaveReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := review.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		created, err := db.CreateReview(productID, userID, &review, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Review created successfully")
+
+		resp := tools.Message {
+			Message: "Review created successfully",
+			Data: created,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Put("/{review}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./{review}", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		var review requests.SaveReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := review.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		updated, err := db.UpdateReview(reviewID, productID, userID, &review, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Review updated successfully")
+
+		resp := tools.Message {
+			Message: "Review updated successfully",
+			Data: updated,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Delete("/{review}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{review}", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		objects, err := db.DeleteReview(reviewID, productID, userID, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		// The review is already gone, an image left in the bucket is only
+		// recorded in the trace
+		for _, object := range objects {
+			if err := platform.RemoveImage(object, ctx); err != nil {
+				span.RecordError(err)
+			}
+		}
+
+		span.SetStatus(codes.Ok, "Review deleted successfully")
+
+		resp := tools.Message {
+			Message: "Review deleted successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Post("/{review}/images", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./{review}/images", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		review, err := db.FetchReview(reviewID, productID, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if review.Author != userID {
+			span.SetStatus(codes.Error, db.ErrNotReviewAuthor.Error())
+			tools.ForbiddenErrorHandler(w, db.ErrNotReviewAuthor.Error())
+			return
+		}
+
+		// << 20 is a short of 2^20 -> 5 * 1MB
+		r.ParseMultipartForm(5 << 20)
+
+		file, handler, err := r.FormFile("image")
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("We couldn't get the image"))
+			return
+		}
+
+		defer file.Close()
+
+		contentType := handler.Header.Get("Content-Type")
+		if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/webp" {
+			err := errors.New("Only jpeg, png, and webp images are allowed")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		objectName := fmt.Sprintf("reviews/%s/%s%s", reviewID, uuid.New().String(), filepath.Ext(handler.Filename))
+
+		path, err := platform.PutImage(objectName, file, handler.Size, contentType, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			msg := "We couldn't save your image"
+			tools.InternalServerErrorHandler(w, &msg)
+			return
+		}
+
+		image, err := db.AddReviewImage(reviewID, userID, objectName, path, ctx)
+		if err != nil {
+			if removeErr := platform.RemoveImage(objectName, ctx); removeErr != nil {
+				span.RecordError(removeErr)
+			}
+
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Review image uploaded successfully")
+
+		resp := tools.Message {
+			Message: "Image added to the review",
+			Data: image,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Delete("/{review}/images/{image}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{review}/images/{image}", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		imageID := chi.URLParam(r, "image")
+
+		span.SetAttributes(
+			attribute.String("ImageUuid", imageID),
+		)
+
+		object, err := db.RemoveReviewImage(imageID, reviewID, userID, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		if err := platform.RemoveImage(object, ctx); err != nil {
+			span.RecordError(err)
+		}
+
+		span.SetStatus(codes.Ok, "Review image deleted successfully")
+
+		resp := tools.Message {
+			Message: "Image removed from the review",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Put("/{review}/reply", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./{review}/reply", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		var reply requests.ReviewReply
+		if err := json.NewDecoder(r.Body).Decode(&reply); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := reply.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if err := db.ReplyToReview(reviewID, productID, userID, &reply.Body, ctx); err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Review replied successfully")
+
+		resp := tools.Message {
+			Message: "Reply saved successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Delete("/{review}/reply", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{review}/reply", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		if err := db.ReplyToReview(reviewID, productID, userID, nil, ctx); err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Review reply deleted successfully")
+
+		resp := tools.Message {
+			Message: "Reply deleted successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Post("/{review}/flags", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(ReviewsRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./{review}/flags", ReviewsRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		productID := chi.URLParam(r, "product")
+
+		span.SetAttributes(
+			attribute.String("ProductUuid", productID),
+		)
+
+		if strings.TrimSpace(productID) == "" {
+			err := errors.New("Invalid product id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		reviewID := chi.URLParam(r, "review")
+
+		span.SetAttributes(
+			attribute.String("ReviewUuid", reviewID),
+		)
+
+		var flag requests.FlagReview
+		if err := json.NewDecoder(r.Body).Decode(&flag); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := flag.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		hidden, err := db.FlagReview(reviewID, productID, userID, flag.Reason, ctx)
+		if err != nil {
+			if writeReviewError(w, err) {
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Review flagged successfully")
+
+		resp := tools.Message {
+			Message: "Thanks, the review was reported",
+			Data: hidden,
+		}
+
+		resp.WriteMessage(w)
+	})
+}
+
+// writeReviewError answers the errors of the review repository that are
+// caused by the request, it returns false for the unexpected ones
+func writeReviewError(w http.ResponseWriter, err error) bool {
+	switch {
+		case errors.Is(err, db.ErrProductNotFound):
+			tools.NotFoundErrorHandler(w, "Product not found")
+		case errors.Is(err, db.ErrReviewNotFound):
+			tools.NotFoundErrorHandler(w, "Review not found")
+		case errors.Is(err, db.ErrNotVerifiedPurchase), errors.Is(err, db.ErrNotReviewAuthor), errors.Is(err, db.ErrNotProductSeller):
+			tools.ForbiddenErrorHandler(w, err.Error())
+		case errors.Is(err, db.ErrReviewExists), errors.Is(err, db.ErrOwnReviewFlag), errors.Is(err, db.ErrReviewAlreadyFlagged), errors.Is(err, db.ErrReviewImagesFull):
+			tools.UnprocessableContent(w, err.Error())
+		default:
+			return false
+	}
+
+	return true
+}
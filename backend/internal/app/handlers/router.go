@@ -6,6 +6,8 @@ import (
 	"time"
 	"fmt"
 
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
 	"github.com/go-chi/chi/v5"
 	log "github.com/sirupsen/logrus"
 	chimiddle "github.com/go-chi/chi/middleware"
@@ -16,11 +18,38 @@ func Router(r *chi.Mux) {
 	r.Use(chimiddle.StripSlashes)
 
 	r.Route("/", AuthRouter)
+
+	r.Route("/.well-known", WellKnownRouter)
 	
 	r.Route("/products", ProductsRouter)
 
 	r.Route("/purchase", PurchaseRouter)
 
+	r.Route("/seller", SellerRouter)
+
+	r.Route("/payments", PaymentsRouter)
+
+	r.Route("/addresses", AddressRouter)
+
+	r.Route("/wishlists", WishlistRouter)
+
+	r.Route("/admin", AdminRouter)
+
+	r.Route("/api-keys", ApiKeyRouter)
+
+	r.Route("/me", MeRouter)
+
+	// The embedded OIDC provider only answers when OIDC_PROVIDER is mock
+	r.HandleFunc("/oidc/mock/*", func(w http.ResponseWriter, r *http.Request) {
+		provider := platform.GetMockOidcProvider()
+		if provider == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		provider.ServeHTTP(w, r)
+	})
+
 	r.Route("/ping", func(router chi.Router){
 		router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			response := struct {
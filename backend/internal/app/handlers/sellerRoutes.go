@@ -0,0 +1,469 @@
+package handlers
+
+import (
+	"fmt"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/parameters"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const SellerRouterName = "seller-router"
+
+func SellerRouter(router chi.Router) {
+	router.Use(middleware.Authorization)
+
+	router.With(middleware.RequirePermissions(dao.PermissionOrdersFulfil)).Get("/orders", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		page := 1
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./orders", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		pageStr := r.URL.Query().Get("page")
+
+		span.SetAttributes(
+			attribute.String("Page", pageStr),
+		)
+
+		if pageStr != "" {
+			parsedPage, err := strconv.Atoi(pageStr)
+
+			if err != nil || parsedPage <= 0 {
+				tools.BadRequestErrorHandler(w, errors.New("Invalid Page number"))
+				return
+			}
+
+			page = parsedPage
+		}
+
+		orders, err := db.FetchSellerOrders(parameters.GetSellerOrdersParams{
+			Seller: userID,
+			Page: page,
+			Context: ctx,
+			Status: r.URL.Query().Get("status"),
+			FulfillmentStatus: r.URL.Query().Get("fulfillment_status"),
+		})
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch seller orders successfully")
+
+		resp := tools.Message {
+			Message: "List of orders",
+			Data: orders,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionOrdersFulfil)).Get("/orders/{order}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./orders/order", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		orderID := chi.URLParam(r, "order")
+
+		span.SetAttributes(
+			attribute.String("OrderUuid", orderID),
+		)
+
+		if strings.TrimSpace(orderID) == "" {
+			err := errors.New("Invalid order id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		order, err := db.FetchSellerOrder(orderID, userID, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrSubOrderNotFound) {
+				span.SetStatus(codes.Error, err.Error())
+				tools.NotFoundErrorHandler(w, "Order not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Order found successfully")
+
+		resp := tools.Message {
+			Message: "Order details",
+			Data: order,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionOrdersFulfil)).Put("/orders/{order}/fulfillment", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./orders/fulfillment", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		orderID := chi.URLParam(r, "order")
+
+		span.SetAttributes(
+			attribute.String("OrderUuid", orderID),
+		)
+
+		if strings.TrimSpace(orderID) == "" {
+			err := errors.New("Invalid order id")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, err)
+			return
+		}
+
+		var fulfillment requests.UpdateFulfillment
+		if err := json.NewDecoder(r.Body).Decode(&fulfillment); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := fulfillment.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		if err := db.UpdateFulfillment(orderID, userID, &fulfillment, ctx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+
+			if errors.Is(err, db.ErrSubOrderNotFound) {
+				tools.NotFoundErrorHandler(w, "Order not found")
+				return
+			}
+
+			if errors.Is(err, db.ErrSubOrderCancelled) || errors.Is(err, db.ErrFulfillmentBackwards) || errors.Is(err, db.ErrOrderNotPaid) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fulfillment updated successfully")
+
+		resp := tools.Message {
+			Message: "The fulfillment was updated successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Get("/stock-alerts", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./stock-alerts", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		settings, err := db.FetchStockAlertSettings(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch stock alert settings successfully")
+
+		resp := tools.Message {
+			Message: "Stock alert settings",
+			Data: settings,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Put("/stock-alerts", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./stock-alerts", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var settings requests.SaveStockAlertSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := settings.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		saved, err := db.SaveStockAlertSettings(userID, &settings, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Stock alert settings saved successfully")
+
+		resp := tools.Message {
+			Message: "The stock alert settings were saved",
+			Data: saved,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Get("/webhooks", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./webhooks", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		webhooks, err := db.FetchSellerWebhooks(userID, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Fetch webhooks successfully")
+
+		resp := tools.Message {
+			Message: "Webhooks",
+			Data: webhooks,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Post("/webhooks", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./webhooks", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		var webhook requests.CreateSellerWebhook
+		if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+			return
+		}
+
+		if err := webhook.Validate(); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.ValidationErrorHandler(w, err)
+			return
+		}
+
+		created, err := db.CreateSellerWebhook(userID, &webhook, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrSellerWebhooksFull) {
+				tools.UnprocessableContent(w, err.Error())
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		// The secret is only shown once, it signs the X-Stock-Signature header
+		span.SetStatus(codes.Ok, "Webhook created successfully")
+
+		resp := tools.Message {
+			Message: "Webhook created successfully, keep the secret to verify the deliveries",
+			Data: created,
+		}
+
+		resp.WriteMessageWithCode(w, http.StatusCreated)
+	})
+
+	router.With(middleware.RequirePermissions(dao.PermissionProductsWrite)).Delete("/webhooks/{webhook}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(SellerRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./webhooks", SellerRouterName))
+		defer span.End()
+
+		userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+		span.SetAttributes(
+			attribute.String("uuid", userID),
+		)
+
+		if !ok || userID == ""{
+			err := errors.New("Missing user uuid")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.UnauthorizedErrorHandler(w, nil)
+			return
+		}
+
+		webhookID := chi.URLParam(r, "webhook")
+
+		span.SetAttributes(
+			attribute.String("WebhookUuid", webhookID),
+		)
+
+		if err := db.DeleteSellerWebhook(webhookID, userID, ctx); err != nil {
+			if errors.Is(err, db.ErrSellerWebhookNotFound) {
+				tools.NotFoundErrorHandler(w, "Webhook not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Webhook deleted successfully")
+
+		resp := tools.Message {
+			Message: "Webhook deleted successfully",
+			Data: true,
+		}
+
+		resp.WriteMessage(w)
+	})
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const WellKnownRouterName = "well-known-router"
+
+func WellKnownRouter(router chi.Router) {
+	// The public keys that verify our tokens, old versions stay until the
+	// tokens they signed expire
+	router.Get("/jwks.json", func (w http.ResponseWriter, r *http.Request) {
+		tr := otel.Tracer(WellKnownRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./jwks.json", WellKnownRouterName))
+		defer span.End()
+
+		jwks := tools.JWKS(ctx)
+
+		span.SetAttributes(
+			attribute.Int("Keys", len(jwks.Keys)),
+		)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+
+		if err := json.NewEncoder(w).Encode(jwks); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		}
+
+		span.SetStatus(codes.Ok, "JWKS published")
+	})
+}
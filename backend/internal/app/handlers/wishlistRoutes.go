@@ -0,0 +1,677 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/middleware"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/go-chi/chi/v5"
+)
+
+const WishlistRouterName = "wishlist-router"
+
+func WishlistRouter(router chi.Router) {
+	// Anyone with the link can read a shared list
+	router.Get("/shared/{token}", func (w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tr := otel.Tracer(WishlistRouterName)
+		ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./shared", WishlistRouterName))
+		defer span.End()
+
+		token := chi.URLParam(r, "token")
+
+		claims, err := tools.IsValidToken(token, tools.ShareTokenAudience, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Invalid share token")
+			tools.NotFoundErrorHandler(w, "Wishlist not found")
+			return
+		}
+
+		data, _ := claims["data"].(map[string]any)
+		wishlistID, _ := data["wishlist"].(string)
+		shareID, _ := data["share"].(string)
+
+		if wishlistID == "" || shareID == "" {
+			span.SetStatus(codes.Error, "The token is not a share token")
+			tools.NotFoundErrorHandler(w, "Wishlist not found")
+			return
+		}
+
+		span.SetAttributes(
+			attribute.String("WishlistUuid", wishlistID),
+		)
+
+		wishlist, err := db.FetchSharedWishlist(wishlistID, shareID, ctx)
+		if err != nil {
+			if errors.Is(err, db.ErrWishlistNotFound) {
+				tools.NotFoundErrorHandler(w, "Wishlist not found")
+				return
+			}
+
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			tools.InternalServerErrorHandler(w, nil)
+			return
+		}
+
+		span.SetStatus(codes.Ok, "Shared wishlist found successfully")
+
+		resp := tools.Message {
+			Message: "Wishlist",
+			Data: wishlist,
+		}
+
+		resp.WriteMessage(w)
+	})
+
+	router.Group(func (router chi.Router) {
+		router.Use(middleware.Authorization)
+
+		router.Get("/", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlists, err := db.FetchWishlists(userID, ctx)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Fetch wishlists successfully")
+
+			resp := tools.Message {
+				Message: "Wishlists",
+				Data: wishlists,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Post("/", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			var wishlist requests.SaveWishlist
+			if err := json.NewDecoder(r.Body).Decode(&wishlist); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+				return
+			}
+
+			if err := wishlist.Validate(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ValidationErrorHandler(w, err)
+				return
+			}
+
+			created, err := db.CreateWishlist(userID, &wishlist, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrWishlistNameTaken) {
+					tools.UnprocessableContent(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Wishlist created successfully")
+
+			resp := tools.Message {
+				Message: "Wishlist created successfully",
+				Data: created,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Get("/{wishlist}", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.GET./{wishlist}", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			wishlist, err := db.FetchWishlist(wishlistID, userID, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Wishlist found successfully")
+
+			resp := tools.Message {
+				Message: "Wishlist",
+				Data: wishlist,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Put("/{wishlist}", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.PUT./{wishlist}", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			var wishlist requests.SaveWishlist
+			if err := json.NewDecoder(r.Body).Decode(&wishlist); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+				return
+			}
+
+			if err := wishlist.Validate(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ValidationErrorHandler(w, err)
+				return
+			}
+
+			if err := db.RenameWishlist(wishlistID, userID, &wishlist, ctx); err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				if errors.Is(err, db.ErrWishlistNameTaken) {
+					tools.UnprocessableContent(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Wishlist renamed successfully")
+
+			resp := tools.Message {
+				Message: "Wishlist renamed successfully",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Delete("/{wishlist}", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{wishlist}", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			if err := db.DeleteWishlist(wishlistID, userID, ctx); err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Wishlist deleted successfully")
+
+			resp := tools.Message {
+				Message: "Wishlist deleted successfully",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Post("/{wishlist}/items", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./{wishlist}/items", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			var item requests.AddWishlistItem
+			if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+				return
+			}
+
+			if err := item.Validate(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ValidationErrorHandler(w, err)
+				return
+			}
+
+			added, err := db.AddWishlistItem(wishlistID, userID, item.Product, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				if errors.Is(err, db.ErrProductNotFound) || errors.Is(err, db.ErrWishlistFull) {
+					tools.UnprocessableContent(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Product added to the wishlist successfully")
+
+			resp := tools.Message {
+				Message: "Product added to the wishlist",
+				Data: added,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Delete("/{wishlist}/items/{product}", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{wishlist}/items", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			productID := chi.URLParam(r, "product")
+
+			span.SetAttributes(
+				attribute.String("ProductUuid", productID),
+			)
+
+			if err := db.RemoveWishlistItem(wishlistID, userID, productID, ctx); err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				if errors.Is(err, db.ErrWishlistItemNotFound) {
+					tools.NotFoundErrorHandler(w, err.Error())
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Product removed from the wishlist successfully")
+
+			resp := tools.Message {
+				Message: "Product removed from the wishlist",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Post("/{wishlist}/share", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.POST./{wishlist}/share", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			var share requests.ShareWishlist
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&share); err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+					tools.BadRequestErrorHandler(w, errors.New("Invalid body request"))
+					return
+				}
+			}
+
+			if err := share.Validate(); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.ValidationErrorHandler(w, err)
+				return
+			}
+
+			expiresAt := time.Now().UTC().AddDate(0, 0, share.ExpiresInDays)
+
+			shareID, err := db.ShareWishlist(wishlistID, userID, expiresAt, ctx)
+			if err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			// The link is a signed token, changing the share id revokes it
+			claims := tools.TokenClaims{
+				ExpiresAt: expiresAt,
+				Audience: []string{tools.ShareTokenAudience},
+			}
+
+			token, err := tools.GenerateJWT(claims, map[string]any{
+				"wishlist": wishlistID,
+				"share": shareID,
+			}, ctx)
+
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			link := requests.WishlistShareLink{
+				Token: token,
+				Url: fmt.Sprintf("/wishlists/shared/%s", token),
+				ExpiresAt: expiresAt,
+			}
+
+			span.SetStatus(codes.Ok, "Wishlist shared successfully")
+
+			resp := tools.Message {
+				Message: "Wishlist shared successfully",
+				Data: link,
+			}
+
+			resp.WriteMessage(w)
+		})
+
+		router.Delete("/{wishlist}/share", func (w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+
+			tr := otel.Tracer(WishlistRouterName)
+			ctx, span := tr.Start(r.Context(), fmt.Sprintf("%s.DELETE./{wishlist}/share", WishlistRouterName))
+			defer span.End()
+
+			userID, ok := ctx.Value(middleware.UserUUIDKey).(string)
+
+			span.SetAttributes(
+				attribute.String("uuid", userID),
+			)
+
+			if !ok || userID == ""{
+				err := errors.New("Missing user uuid")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.UnauthorizedErrorHandler(w, nil)
+				return
+			}
+
+			wishlistID := chi.URLParam(r, "wishlist")
+
+			span.SetAttributes(
+				attribute.String("WishlistUuid", wishlistID),
+			)
+
+			if strings.TrimSpace(wishlistID) == "" {
+				err := errors.New("Invalid wishlist id")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.BadRequestErrorHandler(w, err)
+				return
+			}
+
+			if err := db.UnshareWishlist(wishlistID, userID, ctx); err != nil {
+				if errors.Is(err, db.ErrWishlistNotFound) {
+					tools.NotFoundErrorHandler(w, "Wishlist not found")
+					return
+				}
+
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				tools.InternalServerErrorHandler(w, nil)
+				return
+			}
+
+			span.SetStatus(codes.Ok, "Wishlist unshared successfully")
+
+			resp := tools.Message {
+				Message: "The share link was revoked",
+				Data: true,
+			}
+
+			resp.WriteMessage(w)
+		})
+	})
+}
@@ -0,0 +1,566 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var AccountDeletionRepositoryName = "account-deletion-repository"
+
+var (
+	ErrAccountDeletionNotFound = errors.New("The account has no pending deletion")
+	ErrAccountHasOpenOrders = errors.New("The account has orders that aren't delivered or cancelled yet")
+)
+
+// DeletedUserName replaces the name of the anonymized accounts, the reviews
+// and the purchases of the sellers still point to them
+const DeletedUserName = "Deleted user"
+
+// RequestAccountDeletion schedules the deletion after the cooling-off period
+// and enqueues the notice in the same transaction. Asking again returns the
+// pending request without moving its date
+func RequestAccountDeletion(user dao.User, locale string, ctx context.Context) (*dao.AccountDeletion, error) {
+	tr := otel.Tracer(AccountDeletionRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RequestAccountDeletion", AccountDeletionRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", user.Uuid),
+	)
+
+	now := time.Now().UTC()
+	deletion := dao.AccountDeletion{
+		UserUuid: user.Uuid,
+		RequestedAt: now,
+		ScheduledFor: now.Add(tools.AccountDeletionCoolingOff()),
+	}
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var pending dao.AccountDeletion
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_uuid = ? AND completed_at IS NULL", user.Uuid).
+			First(&pending).
+			Error
+
+		if err == nil {
+			deletion = pending
+			return nil
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if err := ensureNoOpenOrders(tx, user.Uuid); err != nil {
+			return err
+		}
+
+		if err := tx.Create(&deletion).Error; err != nil {
+			return err
+		}
+
+		data := emails.AccountDeletionData{
+			Name: user.Name,
+			ScheduledFor: deletion.ScheduledFor.Format("2006-01-02 15:04 MST"),
+		}
+
+		email, err := emails.Compose(emails.AccountDeletion, locale, []string{user.Email}, data)
+		if err != nil {
+			return err
+		}
+
+		return enqueueEmail(tx, emails.AccountDeletion, email)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("ScheduledFor", deletion.ScheduledFor.Format(time.RFC3339)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RequestAccountDeletion successfully", AccountDeletionRepositoryName))
+
+	return &deletion, nil
+}
+
+// CancelAccountDeletion removes the pending request, a completed deletion
+// can't be cancelled
+func CancelAccountDeletion(userId string, ctx context.Context) error {
+	tr := otel.Tracer(AccountDeletionRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CancelAccountDeletion", AccountDeletionRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	result := db.WithContext(trContext).
+		Where("user_uuid = ? AND completed_at IS NULL", userId).
+		Delete(&dao.AccountDeletion{})
+
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, result.Error.Error())
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		span.RecordError(ErrAccountDeletionNotFound)
+		span.SetStatus(codes.Error, ErrAccountDeletionNotFound.Error())
+		return ErrAccountDeletionNotFound
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CancelAccountDeletion successfully", AccountDeletionRepositoryName))
+
+	return nil
+}
+
+func FetchAccountDeletion(userId string, ctx context.Context) (*dao.AccountDeletion, error) {
+	tr := otel.Tracer(AccountDeletionRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchAccountDeletion", AccountDeletionRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	var deletion dao.AccountDeletion
+	err := db.WithContext(trContext).
+		Where("user_uuid = ? AND completed_at IS NULL", userId).
+		First(&deletion).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAccountDeletionNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchAccountDeletion successfully", AccountDeletionRepositoryName))
+
+	return &deletion, nil
+}
+
+// FetchDueAccountDeletions returns the pending requests whose cooling-off
+// period already ended, the oldest first
+func FetchDueAccountDeletions(limit int, ctx context.Context) ([]dao.AccountDeletion, error) {
+	tr := otel.Tracer(AccountDeletionRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchDueAccountDeletions", AccountDeletionRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	deletions := make([]dao.AccountDeletion, 0)
+	err := db.WithContext(trContext).
+		Where("completed_at IS NULL AND scheduled_for <= ?", time.Now().UTC()).
+		Order("scheduled_for, user_uuid").
+		Limit(limit).
+		Find(&deletions).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Deletions", len(deletions)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchDueAccountDeletions successfully", AccountDeletionRepositoryName))
+
+	return deletions, nil
+}
+
+// FinalizeAccountDeletion anonymizes the account in a single transaction and
+// returns the objects of the images to remove from the bucket once it
+// commits.
+//
+// The rows the sellers need for their accounting stay: the purchases, the
+// sub-orders and the invoices keep pointing to the anonymized user, only the
+// shipping address and the notes of the tickets are removed. The products are
+// archived instead of deleted, their quantity and stock ledger don't change
+// so a later cancellation still restores the stock. The outbox emails sent to
+// the user are deleted with the rest of the personal rows
+func FinalizeAccountDeletion(userId string, ctx context.Context) ([]string, error) {
+	tr := otel.Tracer(AccountDeletionRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FinalizeAccountDeletion", AccountDeletionRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	objects := make([]string, 0)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		// A cancellation after the job fetched the request leaves nothing to lock
+		var deletion dao.AccountDeletion
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_uuid = ? AND completed_at IS NULL AND scheduled_for <= ?", userId, now).
+			First(&deletion).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAccountDeletionNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The products are locked before looking for open orders, so a checkout
+		// of them either committed already or waits and finds them archived
+		products := make([]dao.Product, 0)
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("belongs_to = ?", userId).
+			Order("uuid").
+			Find(&products).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		if err := ensureNoOpenOrders(tx, userId); err != nil {
+			return err
+		}
+
+		for _, product := range products {
+			if product.Image != nil {
+				objects = append(objects, platform.ImageObjectName(*product.Image))
+			}
+
+			if product.ArchivedAt != nil {
+				continue
+			}
+
+			if err := flagRemovedWishlistItems(tx, product.Uuid); err != nil {
+				return err
+			}
+		}
+
+		err = tx.Model(&dao.Product{}).
+			Where("belongs_to = ?", userId).
+			Updates(map[string]interface{}{
+				"image": nil,
+				"archived_at": gorm.Expr("COALESCE(archived_at, ?)", now),
+			}).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		// The purchases keep the name and price of the product but not the
+		// image that is removed from the bucket
+		err = tx.Model(&dao.Purchase{}).
+			Where("seller = ? AND product_image IS NOT NULL", userId).
+			Update("product_image", nil).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		images := make([]dao.ReviewImage, 0)
+		err = tx.Model(&dao.ReviewImage{}).
+			Joins("JOIN reviews ON reviews.uuid = review_images.review_id").
+			Where("reviews.author = ?", userId).
+			Find(&images).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		for _, image := range images {
+			objects = append(objects, image.ObjectName)
+
+			if err := tx.Where("uuid = ?", image.Uuid).Delete(&dao.ReviewImage{}).Error; err != nil {
+				return err
+			}
+		}
+
+		err = tx.Model(&dao.Ticket{}).
+			Where("buyer = ?", userId).
+			Updates(map[string]interface{}{
+				"shipping_address": nil,
+				"notes": nil,
+			}).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("wishlist_id IN (?)", tx.Model(&dao.Wishlist{}).Select("uuid").Where("owner = ?", userId)).
+			Delete(&dao.WishlistItem{}).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		// The emails already sent or still queued carry the address and the
+		// body written for the user, the ones to a pending new address too
+		var user dao.User
+		if err := tx.Select("uuid", "email").Where("uuid = ?", userId).First(&user).Error; err != nil {
+			return err
+		}
+
+		addresses := make([]string, 0)
+		err = tx.Model(&dao.Magic{}).
+			Where("belongs_to = ? AND purpose = ? AND new_email <> ''", userId, dao.MagicPurposeChangeEmail).
+			Pluck("new_email", &addresses).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		for _, address := range append(addresses, user.Email) {
+			err := tx.Where("JSON_CONTAINS(recipients, JSON_QUOTE(?))", address).
+				Delete(&dao.OutboxEmail{}).
+				Error
+
+			if err != nil {
+				return err
+			}
+		}
+
+		personal := []struct {
+			query string
+			model interface{}
+		}{
+			{"owner = ?", &dao.Wishlist{}},
+			{"owner = ?", &dao.Address{}},
+			{"belongs_to = ?", &dao.Magic{}},
+			{"user_uuid = ?", &dao.ApiKey{}},
+			{"user_uuid = ?", &dao.OidcIdentity{}},
+			{"user_uuid = ?", &dao.RefreshToken{}},
+			{"user_uuid = ?", &dao.UserRole{}},
+			{"seller = ?", &dao.SellerWebhook{}},
+			{"seller = ?", &dao.SellerSettings{}},
+		}
+
+		for _, rows := range personal {
+			if err := tx.Where(rows.query, userId).Delete(rows.model).Error; err != nil {
+				return err
+			}
+		}
+
+		err = tx.Model(&dao.User{}).
+			Where("uuid = ?", userId).
+			Updates(map[string]interface{}{
+				"name": DeletedUserName,
+				"email": fmt.Sprintf("deleted-%s@deleted.invalid", userId),
+				"verified": false,
+			}).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&dao.AccountDeletion{}).
+			Where("user_uuid = ?", userId).
+			Update("completed_at", now).
+			Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Images", len(objects)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FinalizeAccountDeletion successfully", AccountDeletionRepositoryName))
+
+	return objects, nil
+}
+
+// FetchAccountExport collects the personal data of the user, the archived
+// products are included
+func FetchAccountExport(userId string, ctx context.Context) (*requests.AccountExport, error) {
+	tr := otel.Tracer(AccountDeletionRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchAccountExport", AccountDeletionRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	export := requests.AccountExport{
+		Addresses: make([]dao.Address, 0),
+		Products: make([]dao.Product, 0),
+		Reviews: make([]dao.Review, 0),
+		ReviewImages: make([]dao.ReviewImage, 0),
+	}
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var user dao.User
+		if err := tx.Where("uuid = ?", userId).First(&user).Error; err != nil {
+			return err
+		}
+
+		export.Profile = requests.Profile{
+			Uuid: user.Uuid,
+			Name: user.Name,
+			Email: user.Email,
+			Verified: user.Verified,
+			CreatedAt: user.CreatedAt,
+		}
+
+		if err := tx.Where("owner = ?", userId).Order("created_at, uuid").Find(&export.Addresses).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("belongs_to = ?", userId).Order("created_at, uuid").Find(&export.Products).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("author = ?", userId).Order("created_at, uuid").Find(&export.Reviews).Error; err != nil {
+			return err
+		}
+
+		err := tx.Model(&dao.ReviewImage{}).
+			Joins("JOIN reviews ON reviews.uuid = review_images.review_id").
+			Where("reviews.author = ?", userId).
+			Order("review_images.created_at, review_images.uuid").
+			Find(&export.ReviewImages).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		var deletion dao.AccountDeletion
+		err = tx.Where("user_uuid = ? AND completed_at IS NULL", userId).First(&deletion).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		export.Deletion = &deletion
+		export.Profile.DeletionScheduledFor = &deletion.ScheduledFor
+
+		return nil
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Products", len(export.Products)),
+		attribute.Int("Reviews", len(export.Reviews)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchAccountExport successfully", AccountDeletionRepositoryName))
+
+	return &export, nil
+}
+
+// ensureNoOpenOrders keeps the account while a sub-order where the user is
+// the buyer or the seller can still be fulfilled, the seller needs the
+// shipping address until it's delivered
+func ensureNoOpenOrders(tx *gorm.DB, userId string) error {
+	var open int64
+	err := tx.Model(&dao.SubOrder{}).
+		Where("(buyer = ? OR seller = ?) AND status = ? AND fulfillment_status <> ?", userId, userId, dao.SubOrderPlaced, dao.FulfillmentDelivered).
+		Count(&open).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	if open > 0 {
+		return ErrAccountHasOpenOrders
+	}
+
+	return nil
+}
@@ -6,9 +6,9 @@ import (
 	"errors"
 	"context"
 
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
 	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
 	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
-	"github.com/OscarVillanueva/goapi/internal/app/tools"
 	"github.com/OscarVillanueva/goapi/internal/platform"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -20,7 +20,9 @@ import (
 
 var AccountRepositoryName = "account-repository"
 
-func CreateAccount(account requests.CreateAccount, ctx context.Context) (string, error)  {
+// CreateAccount enqueues the verification email in the same transaction, in
+// the locale the user asked for
+func CreateAccount(account requests.CreateAccount, locale string, ctx context.Context) error  {
 	tr := otel.Tracer(AccountRepositoryName)
 	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateAccount", AccountRepositoryName))
 	defer span.End()
@@ -31,10 +33,9 @@ func CreateAccount(account requests.CreateAccount, ctx context.Context) (string,
 		dbErr := errors.New("We couldn't connect to the database")
 		span.RecordError(dbErr)
 		span.SetStatus(codes.Error, dbErr.Error())
-		return "", dbErr
+		return dbErr
 	}
 
-	var token string
 	err := db.WithContext(trContext).Transaction(func (tx *gorm.DB) error {
 		user := dao.User{
 			Uuid: uuid.New().String(),
@@ -55,16 +56,25 @@ func CreateAccount(account requests.CreateAccount, ctx context.Context) (string,
 			return err
 		}
 
-		token = tools.GenerateSecureToken(3)
-		magic := dao.Magic {
-			Token: token,
-			ExpirationDate: time.Now().UTC().Add(15 * time.Minute),
-			BelongsTo: user.Uuid,
+		member := dao.UserRole{
+			UserUuid: user.Uuid,
+			Role: dao.RoleMember,
+			CreatedAt: user.CreatedAt,
 		}
 
-		if err := tx.Create(&magic).Error; err != nil {
+		if err := tx.Create(&member).Error; err != nil {
+			span.SetAttributes(
+				attribute.String("Uuid", user.Uuid),
+				attribute.String("Role", member.Role),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, fmt.Sprintf("%s: %v", "AssignRole", err.Error()))
+			return err
+		}
+
+		magic, link, err := newMagicLink(tx, user, dao.MagicPurposeVerify, "")
+		if err != nil {
 			span.SetAttributes(
-				attribute.String("Token", magic.Token),
 				attribute.String("ExpirationDate", magic.ExpirationDate.String()),
 				attribute.String("BelongsTo", user.Uuid),
 			)
@@ -73,8 +83,26 @@ func CreateAccount(account requests.CreateAccount, ctx context.Context) (string,
 			return err
 		}
 
+		code := emails.CodeData{
+			Name: user.Name,
+			Code: magic.Token,
+			Link: link,
+			ExpiresInMinutes: int(MagicLinkTTL.Minutes()),
+		}
+
+		email, err := emails.Compose(emails.Verification, locale, []string{user.Email}, code)
+		if err != nil {
+			return err
+		}
+
+		if err := enqueueEmail(tx, emails.Verification, email); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, fmt.Sprintf("%s: %v", "EnqueueEmail", err.Error()))
+			return err
+		}
+
 		return nil
 	})
 
-  return token, err
+  return err
 }
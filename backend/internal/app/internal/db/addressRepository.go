@@ -0,0 +1,377 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrAddressNotFound = errors.New("Address Not Found")
+
+const AddressRepositoryName = "address-repository"
+
+func FetchAddresses(owner string, ctx context.Context) ([]dao.Address, error) {
+	tr := otel.Tracer(AddressRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchAddresses", AddressRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Owner", owner),
+	)
+
+	addresses := make([]dao.Address, 0)
+	err := db.WithContext(trContext).
+		Where("owner = ?", owner).
+		Order("is_default DESC, created_at, uuid").
+		Find(&addresses).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return addresses, err
+}
+
+func FetchAddress(addressId string, owner string, ctx context.Context) (*dao.Address, error) {
+	tr := otel.Tracer(AddressRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchAddress", AddressRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("AddressUuid", addressId),
+		attribute.String("Owner", owner),
+	)
+
+	address, err := findAddress(db.WithContext(trContext), addressId, owner)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return address, nil
+}
+
+func CreateAddress(owner string, data *requests.SaveAddress, ctx context.Context) (*dao.Address, error) {
+	tr := otel.Tracer(AddressRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateAddress", AddressRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	address := dao.Address{
+		Uuid: uuid.New().String(),
+		Owner: owner,
+		CreatedAt: time.Now().UTC(),
+	}
+	applyAddress(&address, data)
+
+	span.SetAttributes(
+		attribute.String("AddressUuid", address.Uuid),
+		attribute.String("Owner", owner),
+		attribute.String("Country", address.Country),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := lockAddressBook(tx, owner).Count(&count).Error; err != nil {
+			return err
+		}
+
+		// The first address of the book is always the default one
+		address.IsDefault = data.IsDefault || count == 0
+
+		if address.IsDefault {
+			if err := clearDefaultAddress(tx, owner); err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&address).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreateAddress successfully", AddressRepositoryName))
+
+	return &address, nil
+}
+
+func UpdateAddress(addressId string, owner string, data *requests.SaveAddress, ctx context.Context) (*dao.Address, error) {
+	tr := otel.Tracer(AddressRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UpdateAddress", AddressRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("AddressUuid", addressId),
+		attribute.String("Owner", owner),
+	)
+
+	var address *dao.Address
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if address, err = findAddress(tx.Clauses(clause.Locking{Strength: "UPDATE"}), addressId, owner); err != nil {
+			return err
+		}
+
+		applyAddress(address, data)
+
+		now := time.Now().UTC()
+		address.UpdatedAt = &now
+
+		// Unsetting the default is done by choosing another address
+		if data.IsDefault && !address.IsDefault {
+			if err := clearDefaultAddress(tx, owner); err != nil {
+				return err
+			}
+
+			address.IsDefault = true
+		}
+
+		return tx.Save(address).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UpdateAddress successfully", AddressRepositoryName))
+
+	return address, nil
+}
+
+func SetDefaultAddress(addressId string, owner string, ctx context.Context) error {
+	tr := otel.Tracer(AddressRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.SetDefaultAddress", AddressRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("AddressUuid", addressId),
+		attribute.String("Owner", owner),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, owner).Find(&[]dao.Address{}).Error; err != nil {
+			return err
+		}
+
+		if _, err := findAddress(tx, addressId, owner); err != nil {
+			return err
+		}
+
+		if err := clearDefaultAddress(tx, owner); err != nil {
+			return err
+		}
+
+		return tx.Model(&dao.Address{}).Where("uuid = ?", addressId).Update("is_default", true).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.SetDefaultAddress successfully", AddressRepositoryName))
+
+	return nil
+}
+
+// DeleteAddress removes the address from the book, when it was the default
+// one the most recent of the remaining addresses takes its place. Tickets
+// keep their own copy so they are not affected
+func DeleteAddress(addressId string, owner string, ctx context.Context) error {
+	tr := otel.Tracer(AddressRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteAddress", AddressRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("AddressUuid", addressId),
+		attribute.String("Owner", owner),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := lockAddressBook(tx, owner).Find(&[]dao.Address{}).Error; err != nil {
+			return err
+		}
+
+		address, err := findAddress(tx, addressId, owner)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("uuid = ?", address.Uuid).Delete(&dao.Address{}).Error; err != nil {
+			return err
+		}
+
+		if !address.IsDefault {
+			return nil
+		}
+
+		var next dao.Address
+		err = tx.Where("owner = ?", owner).Order("created_at DESC, uuid").First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&dao.Address{}).Where("uuid = ?", next.Uuid).Update("is_default", true).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.DeleteAddress successfully", AddressRepositoryName))
+
+	return nil
+}
+
+// resolveShippingAddress picks the address a ticket is sent to, it runs in
+// the checkout transaction so the copy matches the book at that moment
+func resolveShippingAddress(tx *gorm.DB, ticket requests.CreateTicket, buyer string) (*dao.TicketAddress, error) {
+	if ticket.Address != nil {
+		snapshot := ticket.Address.Snapshot()
+		return &snapshot, nil
+	}
+
+	if ticket.AddressId != nil {
+		address, err := findAddress(tx, *ticket.AddressId, buyer)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot := address.Snapshot()
+		return &snapshot, nil
+	}
+
+	var address dao.Address
+	err := tx.Where("owner = ? AND is_default = ?", buyer, true).First(&address).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := address.Snapshot()
+	return &snapshot, nil
+}
+
+func findAddress(db *gorm.DB, addressId string, owner string) (*dao.Address, error) {
+	var address dao.Address
+	err := db.Where("uuid = ? AND owner = ?", addressId, owner).First(&address).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAddressNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &address, nil
+}
+
+// lockAddressBook locks every address of the owner, two requests changing the
+// default address at the same time would leave two defaults otherwise
+func lockAddressBook(tx *gorm.DB, owner string) *gorm.DB {
+	return tx.Model(&dao.Address{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("owner = ?", owner)
+}
+
+func clearDefaultAddress(tx *gorm.DB, owner string) error {
+	return tx.Model(&dao.Address{}).
+		Where("owner = ? AND is_default = ?", owner, true).
+		Update("is_default", false).
+		Error
+}
+
+func applyAddress(address *dao.Address, data *requests.SaveAddress) {
+	address.Label = data.Label
+	address.Recipient = data.Recipient
+	address.Line1 = data.Line1
+	address.Line2 = data.Line2
+	address.City = data.City
+	address.Region = data.Region
+	address.PostalCode = data.PostalCode
+	address.Country = data.Country
+	address.Phone = data.Phone
+}
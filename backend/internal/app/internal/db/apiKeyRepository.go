@@ -0,0 +1,376 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"slices"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrApiKeyNotFound = errors.New("API Key Not Found")
+var ErrApiKeyInvalid = errors.New("Invalid API key")
+var ErrApiKeyExpired = errors.New("The API key expired")
+var ErrApiKeysFull = errors.New("You can't create more API keys")
+var ErrApiKeyScopes = errors.New("The API key can't have permissions that you don't have")
+
+const ApiKeyRepositoryName = "api-key-repository"
+
+const (
+	apiKeyPrefix = "ak_"
+	maxApiKeys = 20
+	defaultApiKeyDays = 90
+	// The last use is written at most once per minute for each key
+	apiKeyTouchInterval = time.Minute
+)
+
+func FetchApiKeys(userId string, ctx context.Context) ([]dao.ApiKey, error) {
+	tr := otel.Tracer(ApiKeyRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchApiKeys", ApiKeyRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	keys := make([]dao.ApiKey, 0)
+	err := db.WithContext(trContext).Where("user_uuid = ?", userId).Order("created_at DESC, uuid").Find(&keys).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func FetchApiKey(keyId string, userId string, ctx context.Context) (*dao.ApiKey, error) {
+	tr := otel.Tracer(ApiKeyRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchApiKey", ApiKeyRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ApiKeyUuid", keyId),
+		attribute.String("UserUuid", userId),
+	)
+
+	var key dao.ApiKey
+	err := db.WithContext(trContext).Where("uuid = ? AND user_uuid = ?", keyId, userId).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrApiKeyNotFound)
+		span.SetStatus(codes.Error, ErrApiKeyNotFound.Error())
+		return nil, ErrApiKeyNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// CreateApiKey returns the key with its plain value, it's the only moment it
+// exists
+func CreateApiKey(userId string, data *requests.CreateApiKey, ctx context.Context) (*requests.ApiKeyCreated, error) {
+	tr := otel.Tracer(ApiKeyRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateApiKey", ApiKeyRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+		attribute.String("Name", data.Name),
+		attribute.StringSlice("Scopes", data.Scopes),
+	)
+
+	if err := ensureScopesGranted(userId, data.Scopes, trContext); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	plain := tools.GenerateSecureToken(32)
+	if plain == "" {
+		err := errors.New("We couldn't generate the API key")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	plain = apiKeyPrefix + plain
+
+	days := defaultApiKeyDays
+	if data.ExpiresInDays != nil {
+		days = *data.ExpiresInDays
+	}
+
+	now := time.Now().UTC()
+	key := dao.ApiKey{
+		Uuid: uuid.New().String(),
+		UserUuid: userId,
+		Name: data.Name,
+		Prefix: plain[:len(apiKeyPrefix) + 8],
+		KeyHash: tools.HashToken(plain),
+		Scopes: dao.ApiKeyScopes(slices.Compact(slices.Sorted(slices.Values(data.Scopes)))),
+		ExpiresAt: now.AddDate(0, 0, days),
+		CreatedAt: now,
+	}
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		// The user row serializes the creations so the limit holds
+		var user dao.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", userId).First(&user).Error
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&dao.ApiKey{}).Where("user_uuid = ?", userId).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count >= maxApiKeys {
+			return ErrApiKeysFull
+		}
+
+		return tx.Create(&key).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreateApiKey successfully", ApiKeyRepositoryName))
+
+	return &requests.ApiKeyCreated{
+		ApiKey: key,
+		Key: plain,
+	}, nil
+}
+
+func UpdateApiKey(keyId string, userId string, data *requests.UpdateApiKey, ctx context.Context) (*dao.ApiKey, error) {
+	tr := otel.Tracer(ApiKeyRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UpdateApiKey", ApiKeyRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ApiKeyUuid", keyId),
+		attribute.String("UserUuid", userId),
+	)
+
+	updatedKey := map[string]interface{}{
+		"updated_at": time.Now().UTC(),
+	}
+
+	if data.Name != nil {
+		updatedKey["name"] = *data.Name
+	}
+
+	if data.Scopes != nil {
+		if err := ensureScopesGranted(userId, *data.Scopes, trContext); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+
+		updatedKey["scopes"] = dao.ApiKeyScopes(slices.Compact(slices.Sorted(slices.Values(*data.Scopes))))
+	}
+
+	var key dao.ApiKey
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&dao.ApiKey{}).Where("uuid = ? AND user_uuid = ?", keyId, userId).Updates(updatedKey)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrApiKeyNotFound
+		}
+
+		return tx.Where("uuid = ?", keyId).First(&key).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UpdateApiKey successfully", ApiKeyRepositoryName))
+
+	return &key, nil
+}
+
+func DeleteApiKey(keyId string, userId string, ctx context.Context) error {
+	tr := otel.Tracer(ApiKeyRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteApiKey", ApiKeyRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ApiKeyUuid", keyId),
+		attribute.String("UserUuid", userId),
+	)
+
+	result := db.WithContext(trContext).Where("uuid = ? AND user_uuid = ?", keyId, userId).Delete(&dao.ApiKey{})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, result.Error.Error())
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		span.RecordError(ErrApiKeyNotFound)
+		span.SetStatus(codes.Error, ErrApiKeyNotFound.Error())
+		return ErrApiKeyNotFound
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.DeleteApiKey successfully", ApiKeyRepositoryName))
+
+	return nil
+}
+
+// AuthenticateApiKey finds the key and returns it with the roles of its user
+// and the permissions it can use, the scopes of the key that the user still
+// has
+func AuthenticateApiKey(plain string, ctx context.Context) (*dao.ApiKey, []string, []string, error) {
+	tr := otel.Tracer(ApiKeyRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.AuthenticateApiKey", ApiKeyRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, nil, nil, dbErr
+	}
+
+	var key dao.ApiKey
+	err := db.WithContext(trContext).Where("key_hash = ?", tools.HashToken(plain)).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrApiKeyInvalid)
+		span.SetStatus(codes.Error, ErrApiKeyInvalid.Error())
+		return nil, nil, nil, ErrApiKeyInvalid
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("ApiKeyUuid", key.Uuid),
+		attribute.String("UserUuid", key.UserUuid),
+	)
+
+	now := time.Now().UTC()
+	if !key.ExpiresAt.After(now) {
+		span.RecordError(ErrApiKeyExpired)
+		span.SetStatus(codes.Error, ErrApiKeyExpired.Error())
+		return nil, nil, nil, ErrApiKeyExpired
+	}
+
+	roles, granted, err := FetchUserAccess(key.UserUuid, trContext)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, nil, err
+	}
+
+	permissions := make([]string, 0, len(key.Scopes))
+	for _, scope := range key.Scopes {
+		if slices.Contains(granted, scope) {
+			permissions = append(permissions, scope)
+		}
+	}
+
+	// A failed write of the last use doesn't reject the request
+	err = db.WithContext(trContext).
+		Model(&dao.ApiKey{}).
+		Where("uuid = ? AND (last_used_at IS NULL OR last_used_at < ?)", key.Uuid, now.Add(-apiKeyTouchInterval)).
+		Update("last_used_at", now).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	return &key, roles, permissions, nil
+}
+
+func ensureScopesGranted(userId string, scopes []string, ctx context.Context) error {
+	_, permissions, err := FetchUserAccess(userId, ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(permissions, scope) {
+			return ErrApiKeyScopes
+		}
+	}
+
+	return nil
+}
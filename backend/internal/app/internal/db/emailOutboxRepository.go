@@ -0,0 +1,468 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrOutboxEmailNotFound = errors.New("Email not found")
+	ErrOutboxEmailNotFailed = errors.New("Only the failed emails can be retried")
+)
+
+const EmailOutboxRepositoryName = "email-outbox-repository"
+
+// After this many attempts the email goes to the failed state
+const MaxOutboxEmailAttempts = 8
+
+// A claimed email isn't picked again in this window, when the worker dies in
+// the middle of a send the email is retried after it with the same Message-ID
+const outboxEmailLease = 2 * time.Minute
+
+// enqueueEmail writes the email in the transaction of the change that sends
+// it, so the email exists only if the change was committed
+func enqueueEmail(tx *gorm.DB, template string, email platform.Email) error {
+	now := time.Now().UTC()
+
+	messageId := email.MessageId
+	if messageId == "" {
+		messageId = platform.NewMessageId()
+	}
+
+	attachments := make(dao.OutboxAttachments, 0, len(email.Attachments))
+	for _, attachment := range email.Attachments {
+		attachments = append(attachments, dao.OutboxAttachment{
+			Name: attachment.Name,
+			ContentType: attachment.ContentType,
+			Content: attachment.Content,
+		})
+	}
+
+	return tx.Create(&dao.OutboxEmail{
+		Uuid: uuid.New().String(),
+		Template: template,
+		MessageId: messageId,
+		Recipients: email.To,
+		Subject: email.Subject,
+		TextBody: email.Text,
+		HtmlBody: email.HTML,
+		Attachments: attachments,
+		Status: dao.OutboxEmailPending,
+		NextAttemptAt: now,
+		CreatedAt: now,
+	}).Error
+}
+
+// EnqueueEmail adds an email that doesn't belong to a transaction
+func EnqueueEmail(template string, email platform.Email, ctx context.Context) error {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.EnqueueEmail", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Template", template),
+	)
+
+	if err := enqueueEmail(db.WithContext(trContext), template, email); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.EnqueueEmail successfully", EmailOutboxRepositoryName))
+
+	return nil
+}
+
+// ClaimOutboxEmails takes the due emails and counts the attempt, the lease
+// moves their next attempt so another worker skips them meanwhile
+func ClaimOutboxEmails(limit int, ctx context.Context) ([]dao.OutboxEmail, error) {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.ClaimOutboxEmails", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	claimed := make([]dao.OutboxEmail, 0)
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", dao.OutboxEmailPending, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&claimed).
+			Error
+
+		if err != nil || len(claimed) == 0 {
+			return err
+		}
+
+		uuids := make([]string, 0, len(claimed))
+		for i := range claimed {
+			uuids = append(uuids, claimed[i].Uuid)
+			claimed[i].Attempts++
+		}
+
+		return tx.Model(&dao.OutboxEmail{}).
+			Where("uuid IN ?", uuids).
+			Updates(map[string]any{
+				"attempts": gorm.Expr("attempts + 1"),
+				"next_attempt_at": now.Add(outboxEmailLease),
+				"updated_at": now,
+			}).
+			Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Claimed", len(claimed)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.ClaimOutboxEmails successfully", EmailOutboxRepositoryName))
+
+	return claimed, nil
+}
+
+// MarkOutboxEmailSent only changes the attempt that was claimed, a late
+// worker can't overwrite the result of a newer one
+func MarkOutboxEmailSent(email dao.OutboxEmail, ctx context.Context) error {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.MarkOutboxEmailSent", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("OutboxEmailUuid", email.Uuid),
+		attribute.Int("Attempts", email.Attempts),
+	)
+
+	now := time.Now().UTC()
+	err := db.WithContext(trContext).Model(&dao.OutboxEmail{}).
+		Where("uuid = ? AND status = ? AND attempts = ?", email.Uuid, dao.OutboxEmailPending, email.Attempts).
+		Updates(map[string]any{
+			"status": dao.OutboxEmailSent,
+			"sent_at": now,
+			"last_error": nil,
+			"updated_at": now,
+		}).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.MarkOutboxEmailSent successfully", EmailOutboxRepositoryName))
+
+	return nil
+}
+
+// MarkOutboxEmailFailed schedules the next attempt with an exponential
+// backoff, or moves the email to the failed state after the last attempt
+func MarkOutboxEmailFailed(email dao.OutboxEmail, sendErr error, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.MarkOutboxEmailFailed", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return false, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("OutboxEmailUuid", email.Uuid),
+		attribute.Int("Attempts", email.Attempts),
+	)
+
+	now := time.Now().UTC()
+	deadLetter := email.Attempts >= MaxOutboxEmailAttempts
+
+	updates := map[string]any{
+		"last_error": sendErr.Error(),
+		"next_attempt_at": now.Add(outboxEmailBackoff(email.Attempts)),
+		"updated_at": now,
+	}
+
+	if deadLetter {
+		updates["status"] = dao.OutboxEmailFailed
+	}
+
+	err := db.WithContext(trContext).Model(&dao.OutboxEmail{}).
+		Where("uuid = ? AND status = ? AND attempts = ?", email.Uuid, dao.OutboxEmailPending, email.Attempts).
+		Updates(updates).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.MarkOutboxEmailFailed successfully", EmailOutboxRepositoryName))
+
+	return deadLetter, nil
+}
+
+// outboxEmailBackoff waits 30 seconds after the first attempt and doubles it
+// after every other one, up to an hour
+func outboxEmailBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+	for i := 1; i < attempts && backoff < time.Hour; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, time.Hour)
+}
+
+func FetchOutboxEmails(status string, page int, ctx context.Context) (*requests.OutboxEmailsResponse, error) {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchOutboxEmails", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Status", status),
+		attribute.Int("Page", page),
+	)
+
+	limit := 30
+	offset := (page - 1) * limit
+
+	query := db.WithContext(trContext).Model(&dao.OutboxEmail{}).Where("status = ?", status)
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	emails := make([]dao.OutboxEmail, 0)
+	err := query.Omit("text_body", "html_body", "attachments").
+		Order("created_at DESC, uuid").
+		Limit(limit).
+		Offset(offset).
+		Find(&emails).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchOutboxEmails successfully", EmailOutboxRepositoryName))
+
+	response := requests.OutboxEmailsResponse{
+		Emails: emails,
+		PageSize: limit,
+		Pages: int(math.Ceil(float64(count) / float64(limit))),
+	}
+
+	return &response, nil
+}
+
+// CountOutboxEmails returns how many emails are in each state
+func CountOutboxEmails(ctx context.Context) (map[string]int64, error) {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CountOutboxEmails", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	var rows []struct {
+		Status string
+		Total int64
+	}
+
+	err := db.WithContext(trContext).Model(&dao.OutboxEmail{}).
+		Select("status, COUNT(*) AS total").
+		Group("status").
+		Scan(&rows).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	counts := map[string]int64{
+		dao.OutboxEmailPending: 0,
+		dao.OutboxEmailSent: 0,
+		dao.OutboxEmailFailed: 0,
+	}
+
+	for _, row := range rows {
+		counts[row.Status] = row.Total
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CountOutboxEmails successfully", EmailOutboxRepositoryName))
+
+	return counts, nil
+}
+
+// RetryOutboxEmail gives a failed email a new round of attempts, it keeps its
+// Message-ID
+func RetryOutboxEmail(emailId string, ctx context.Context) (*dao.OutboxEmail, error) {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RetryOutboxEmail", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("OutboxEmailUuid", emailId),
+	)
+
+	var email dao.OutboxEmail
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Omit("text_body", "html_body", "attachments").
+			Where("uuid = ?", emailId).
+			First(&email).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrOutboxEmailNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if email.Status != dao.OutboxEmailFailed {
+			return ErrOutboxEmailNotFailed
+		}
+
+		now := time.Now().UTC()
+		email.Status = dao.OutboxEmailPending
+		email.Attempts = 0
+		email.NextAttemptAt = now
+		email.UpdatedAt = &now
+
+		return tx.Model(&dao.OutboxEmail{}).
+			Where("uuid = ?", email.Uuid).
+			Updates(map[string]any{
+				"status": email.Status,
+				"attempts": email.Attempts,
+				"next_attempt_at": email.NextAttemptAt,
+				"updated_at": now,
+			}).
+			Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RetryOutboxEmail successfully", EmailOutboxRepositoryName))
+
+	return &email, nil
+}
+
+// PurgeSentOutboxEmails deletes the sent emails older than the date, they
+// still have the codes of the users
+func PurgeSentOutboxEmails(before time.Time, ctx context.Context) (int64, error) {
+	tr := otel.Tracer(EmailOutboxRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.PurgeSentOutboxEmails", EmailOutboxRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return 0, dbErr
+	}
+
+	result := db.WithContext(trContext).
+		Where("status = ? AND sent_at < ?", dao.OutboxEmailSent, before).
+		Delete(&dao.OutboxEmail{})
+
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, result.Error.Error())
+		return 0, result.Error
+	}
+
+	span.SetAttributes(
+		attribute.Int64("Deleted", result.RowsAffected),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.PurgeSentOutboxEmails successfully", EmailOutboxRepositoryName))
+
+	return result.RowsAffected, nil
+}
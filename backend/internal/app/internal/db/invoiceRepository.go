@@ -0,0 +1,70 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+// issueInvoices gives every seller in the ticket the next number of its own
+// invoice sequence. It must run inside the transaction that captures the
+// payment so a declined or rolled back purchase never consumes a number.
+func issueInvoices(tx *gorm.DB, ticketID string, sellers []string, span trace.Span) error {
+	for _, seller := range sellers {
+		seq := dao.InvoiceSequence{Seller: seller, LastNumber: 1}
+
+		// The upsert locks the sequence row until the transaction ends
+		err := tx.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"last_number": gorm.Expr("last_number + 1"),
+			}),
+		}).Create(&seq).Error
+
+		if err != nil {
+			span.SetAttributes(
+				attribute.String("Seller", seller),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, fmt.Sprintf("Unable to increment the invoice sequence of: %s", seller))
+			return err
+		}
+
+		if err := tx.Where("seller = ?", seller).First(&seq).Error; err != nil {
+			span.SetAttributes(
+				attribute.String("Seller", seller),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		invoice := dao.Invoice{
+			Uuid: uuid.New().String(),
+			TicketId: ticketID,
+			Seller: seller,
+			Number: seq.LastNumber,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		if err := tx.Create(&invoice).Error; err != nil {
+			span.SetAttributes(
+				attribute.String("TicketId", ticketID),
+				attribute.String("Seller", seller),
+				attribute.Int64("Number", invoice.Number),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"time"
+	"errors"
+	"context"
+	"math/rand/v2"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	mysql "github.com/go-sql-driver/mysql"
+)
+
+const (
+	lockRetryAttempts = 5
+	lockRetryBackoff = 25 * time.Millisecond
+)
+
+// isLockError reports a MySQL deadlock (1213) or lock wait timeout (1205),
+// both roll back the statement and are safe to retry with a new transaction
+func isLockError(err error) (uint16, bool) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && (mysqlErr.Number == 1213 || mysqlErr.Number == 1205) {
+		return mysqlErr.Number, true
+	}
+
+	return 0, false
+}
+
+// withLockRetry runs the transaction again with exponential backoff and
+// jitter while it keeps failing because of a lock, each retry is an event of
+// the given span
+func withLockRetry(ctx context.Context, span trace.Span, transaction func() error) error {
+	backoff := lockRetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := transaction()
+
+		code, retryable := isLockError(err)
+		if !retryable || attempt == lockRetryAttempts {
+			if attempt > 1 {
+				span.SetAttributes(attribute.Int("db.lock_retry.attempts", attempt))
+			}
+
+			return err
+		}
+
+		wait := backoff + rand.N(backoff)
+		span.AddEvent("db.lock_retry", trace.WithAttributes(
+			attribute.Int("db.lock_retry.attempt", attempt),
+			attribute.Int("db.mysql.error_code", int(code)),
+			attribute.String("db.lock_retry.wait", wait.String()),
+			attribute.String("db.lock_retry.error", err.Error()),
+		))
+
+		select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return errors.Join(err, ctx.Err())
+		}
+
+		backoff *= 2
+	}
+}
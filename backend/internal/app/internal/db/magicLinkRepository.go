@@ -3,19 +3,40 @@ package db
 
 import (
 	"fmt"
+	"time"
 	"errors"
 	"context"
+	"strings"
 
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
 	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
 	"github.com/OscarVillanueva/goapi/internal/platform"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel"
+	mysql "github.com/go-sql-driver/mysql"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
 )
 
 var RepositoryName = "magic-link-repository"
 
+var (
+	ErrMagicLinkNotFound = errors.New("The link was used or replaced by a new code")
+	ErrEmailTaken = errors.New("The email already exists")
+	ErrEmailUnchanged = errors.New("The new email is the current one")
+	ErrEmailChangeInvalid = errors.New("The code is invalid or expired")
+)
+
+// MaxMagicLinkAttempts is the number of wrong codes a user can send before
+// the current code stops working
+const MaxMagicLinkAttempts = 5
+
+// MagicLinkTTL is how long a code works after it's sent
+const MagicLinkTTL = 15 * time.Minute
+
 func FindMagicLinkForUser(token string, email string, magic *dao.Magic, ctx context.Context) error {
 	tr := otel.Tracer(RepositoryName)
 	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FindMagicLinkForUser", RepositoryName))
@@ -32,7 +53,10 @@ func FindMagicLinkForUser(token string, email string, magic *dao.Magic, ctx cont
 
 	userSubQuery := db.Model(&dao.User{}).Select("uuid").Where("email = ?", email)
 
-	err := db.WithContext(trContext).Where("token = ? AND belongs_to = (?)", token, userSubQuery).First(magic).Error
+	err := db.WithContext(trContext).
+		Where("token = ? AND belongs_to = (?) AND purpose <> ?", token, userSubQuery, dao.MagicPurposeChangeEmail).
+		First(magic).
+		Error
 	if err != nil {
 		span.SetAttributes(
 			attribute.String("Token", token),
@@ -69,7 +93,12 @@ func FetchMagicLink(userUuid string, token string, magic *dao.Magic, ctx context
 		return dbErr
 	}
 
-	if err := db.WithContext(trContext).Where("token = ? AND belongs_to = ?", token, userUuid).First(magic).Error; err != nil {
+	err := db.WithContext(trContext).
+		Where("token = ? AND belongs_to = ? AND purpose <> ?", token, userUuid, dao.MagicPurposeChangeEmail).
+		First(magic).
+		Error
+
+	if err != nil {
 		span.SetAttributes(
 			attribute.String("Token", token),
 			attribute.String("UserUuid", userUuid),
@@ -84,6 +113,8 @@ func FetchMagicLink(userUuid string, token string, magic *dao.Magic, ctx context
 	return nil
 }
 
+// DeleteMagicLink deletes the sign in codes of the user, a pending email
+// change keeps its code
 func DeleteMagicLink(userUuid string, ctx context.Context) error {
 	tr := otel.Tracer(RepositoryName)
 	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteMagicLink", RepositoryName))
@@ -98,7 +129,12 @@ func DeleteMagicLink(userUuid string, ctx context.Context) error {
 		return dbErr
 	}
 
-	if err := db.WithContext(trContext).Where("belongs_to = (?)", userUuid).Delete(&dao.Magic{}).Error; err != nil {
+	err := db.WithContext(trContext).
+		Where("belongs_to = (?) AND purpose <> ?", userUuid, dao.MagicPurposeChangeEmail).
+		Delete(&dao.Magic{}).
+		Error
+
+	if err != nil {
 		span.SetAttributes(
 			attribute.String("BelongsTo", userUuid),
 		)
@@ -112,3 +148,374 @@ func DeleteMagicLink(userUuid string, ctx context.Context) error {
 	return nil
 }
 
+
+// RecordMagicLinkFailure counts a wrong code against the current codes of the
+// email with one of the purposes and deletes them when they reach
+// MaxMagicLinkAttempts, it reports if a code was invalidated. The codes of
+// the other purposes keep their attempts
+func RecordMagicLinkFailure(email string, purposes []string, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(RepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RecordMagicLinkFailure", RepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return false, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Email", email),
+		attribute.StringSlice("Purposes", purposes),
+	)
+
+	invalidated := false
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		userSubQuery := tx.Model(&dao.User{}).Select("uuid").Where("email = ?", email)
+
+		magics := make([]dao.Magic, 0)
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("belongs_to = (?) AND purpose IN ?", userSubQuery, purposes).
+			Find(&magics).
+			Error
+
+		if err != nil || len(magics) == 0 {
+			return err
+		}
+
+		tokens := make([]string, 0, len(magics))
+		for _, magic := range magics {
+			tokens = append(tokens, magic.Token)
+		}
+
+		belongsTo := magics[0].BelongsTo
+
+		err = tx.Model(&dao.Magic{}).
+			Where("token IN ? AND belongs_to = ? AND purpose IN ?", tokens, belongsTo, purposes).
+			Update("attempts", gorm.Expr("attempts + 1")).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		result := tx.Where("token IN ? AND belongs_to = ? AND purpose IN ? AND attempts >= ?", tokens, belongsTo, purposes, MaxMagicLinkAttempts).Delete(&dao.Magic{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		invalidated = result.RowsAffected > 0
+
+		return nil
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	if invalidated {
+		span.AddEvent(fmt.Sprintf("Invalidated the code of %s after %d failed attempts", email, MaxMagicLinkAttempts))
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RecordMagicLinkFailure successfully", RepositoryName))
+
+	return invalidated, nil
+}
+
+// newMagicLink creates the code of the user and the signed link of the same
+// code, the link is empty when MAGIC_LINK_SECRET isn't set and only the code
+// is sent
+func newMagicLink(tx *gorm.DB, user dao.User, purpose string, newEmail string) (dao.Magic, string, error) {
+	nonce := tools.GenerateSecureToken(16)
+
+	magic := dao.Magic {
+		Token: tools.GenerateSecureToken(3),
+		ExpirationDate: time.Now().UTC().Add(MagicLinkTTL),
+		BelongsTo: user.Uuid,
+		Purpose: purpose,
+		LinkHash: tools.HashToken(nonce),
+		NewEmail: newEmail,
+	}
+
+	if err := tx.Create(&magic).Error; err != nil {
+		return magic, "", err
+	}
+
+	link, err := tools.MagicLinkURL(tools.MagicLinkClaims{
+		Subject: user.Uuid,
+		Purpose: purpose,
+		Nonce: nonce,
+		ExpiresAt: magic.ExpirationDate.Unix(),
+	})
+
+	if errors.Is(err, tools.ErrMagicLinkDisabled) {
+		return magic, "", nil
+	}
+
+	return magic, link, err
+}
+
+// UseMagicLink consumes the code of a signed link, the code has to be the
+// current one of the user and have the purpose of the link. A verify link
+// verifies the account and a change_email link switches the email in the
+// same transaction
+func UseMagicLink(claims tools.MagicLinkClaims, locale string, ctx context.Context) (*dao.User, error) {
+	tr := otel.Tracer(RepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UseMagicLink", RepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", claims.Subject),
+		attribute.String("Purpose", claims.Purpose),
+	)
+
+	var user dao.User
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var magic dao.Magic
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("belongs_to = ? AND link_hash = ? AND purpose = ?", claims.Subject, tools.HashToken(claims.Nonce), claims.Purpose).
+			First(&magic).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrMagicLinkNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if magic.ExpirationDate.Before(time.Now().UTC()) {
+			return tools.ErrMagicLinkExpired
+		}
+
+		if err := tx.Where("token = ? AND belongs_to = ?", magic.Token, magic.BelongsTo).Delete(&dao.Magic{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("uuid = ?", claims.Subject).First(&user).Error; err != nil {
+			return err
+		}
+
+		switch claims.Purpose {
+			case dao.MagicPurposeVerify:
+				if err := tx.Model(&dao.User{}).Where("uuid = ?", user.Uuid).Update("verified", true).Error; err != nil {
+					return err
+				}
+
+				user.Verified = true
+			case dao.MagicPurposeLogin:
+				if !user.Verified {
+					return ErrMagicLinkNotFound
+				}
+			case dao.MagicPurposeChangeEmail:
+				return applyEmailChange(tx, &user, magic, locale)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UseMagicLink successfully", RepositoryName))
+
+	return &user, nil
+}
+
+// RequestEmailChange replaces the pending email change of the user and
+// enqueues its code to the new email, the account keeps the current email
+// until the code is confirmed
+func RequestEmailChange(user dao.User, newEmail string, locale string, ctx context.Context) error {
+	tr := otel.Tracer(RepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RequestEmailChange", RepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", user.Uuid),
+		attribute.String("NewEmail", newEmail),
+	)
+
+	if strings.EqualFold(user.Email, newEmail) {
+		span.SetStatus(codes.Error, ErrEmailUnchanged.Error())
+		return ErrEmailUnchanged
+	}
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := ensureEmailAvailable(tx, newEmail); err != nil {
+			return err
+		}
+
+		err := tx.Where("belongs_to = ? AND purpose = ?", user.Uuid, dao.MagicPurposeChangeEmail).Delete(&dao.Magic{}).Error
+		if err != nil {
+			return err
+		}
+
+		magic, link, err := newMagicLink(tx, user, dao.MagicPurposeChangeEmail, newEmail)
+		if err != nil {
+			return err
+		}
+
+		data := emails.EmailChangeData{
+			Name: user.Name,
+			NewEmail: newEmail,
+			Code: magic.Token,
+			Link: link,
+			ExpiresInMinutes: int(MagicLinkTTL.Minutes()),
+		}
+
+		email, err := emails.Compose(emails.EmailChange, locale, []string{newEmail}, data)
+		if err != nil {
+			return err
+		}
+
+		return enqueueEmail(tx, emails.EmailChange, email)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RequestEmailChange successfully", RepositoryName))
+
+	return nil
+}
+
+// ConfirmEmailChange switches the email of the user with the code sent to
+// the new address and returns the updated user
+func ConfirmEmailChange(userId string, token string, locale string, ctx context.Context) (*dao.User, error) {
+	tr := otel.Tracer(RepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.ConfirmEmailChange", RepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	var user dao.User
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var magic dao.Magic
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token = ? AND belongs_to = ? AND purpose = ?", token, userId, dao.MagicPurposeChangeEmail).
+			First(&magic).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrEmailChangeInvalid
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if magic.ExpirationDate.Before(time.Now().UTC()) {
+			return ErrEmailChangeInvalid
+		}
+
+		if err := tx.Where("uuid = ?", userId).First(&user).Error; err != nil {
+			return err
+		}
+
+		return applyEmailChange(tx, &user, magic, locale)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.ConfirmEmailChange successfully", RepositoryName))
+
+	return &user, nil
+}
+
+// applyEmailChange moves the user to the email of the code, deletes every
+// code of the user because they went to the old address and enqueues the
+// notice to that address
+func applyEmailChange(tx *gorm.DB, user *dao.User, magic dao.Magic, locale string) error {
+	if err := ensureEmailAvailable(tx, magic.NewEmail); err != nil {
+		return err
+	}
+
+	oldEmail := user.Email
+
+	err := tx.Model(&dao.User{}).Where("uuid = ?", user.Uuid).Update("email", magic.NewEmail).Error
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		return ErrEmailTaken
+	}
+
+	if err != nil {
+		return err
+	}
+
+	user.Email = magic.NewEmail
+
+	if err := tx.Where("belongs_to = ?", user.Uuid).Delete(&dao.Magic{}).Error; err != nil {
+		return err
+	}
+
+	data := emails.EmailChangeData{
+		Name: user.Name,
+		NewEmail: user.Email,
+	}
+
+	email, err := emails.Compose(emails.EmailChanged, locale, []string{oldEmail}, data)
+	if err != nil {
+		return err
+	}
+
+	return enqueueEmail(tx, emails.EmailChanged, email)
+}
+
+func ensureEmailAvailable(tx *gorm.DB, email string) error {
+	var count int64
+	if err := tx.Model(&dao.User{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return ErrEmailTaken
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"strings"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrOidcEmailNotVerified = errors.New("The provider didn't verify the email of the account")
+
+const OidcIdentityRepositoryName = "oidc-identity-repository"
+
+// LinkOidcIdentity returns the user of the identity. The first login of a
+// subject links it to the user with the same email, which has to be verified
+// by the provider, or creates the user when there is none
+func LinkOidcIdentity(identity platform.OidcIdentity, ctx context.Context) (*dao.User, error) {
+	tr := otel.Tracer(OidcIdentityRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.LinkOidcIdentity", OidcIdentityRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Issuer", identity.Issuer),
+		attribute.String("Subject", identity.Subject),
+		attribute.String("Email", identity.Email),
+	)
+
+	var user dao.User
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+
+		var linked dao.OidcIdentity
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("issuer = ? AND subject = ?", identity.Issuer, identity.Subject).
+			First(&linked).
+			Error
+
+		if err == nil {
+			err = tx.Model(&dao.OidcIdentity{}).
+				Where("issuer = ? AND subject = ?", linked.Issuer, linked.Subject).
+				Update("last_login_at", now).
+				Error
+
+			if err != nil {
+				return err
+			}
+
+			return tx.Where("uuid = ?", linked.UserUuid).First(&user).Error
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if !identity.EmailVerified || identity.Email == "" {
+			return ErrOidcEmailNotVerified
+		}
+
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("email = ?", identity.Email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user = dao.User{
+				Uuid: uuid.New().String(),
+				Name: oidcUserName(identity),
+				Email: identity.Email,
+				Verified: true,
+				CreatedAt: now,
+			}
+
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+
+			member := dao.UserRole{
+				UserUuid: user.Uuid,
+				Role: dao.RoleMember,
+				CreatedAt: now,
+			}
+
+			if err := tx.Create(&member).Error; err != nil {
+				return err
+			}
+
+			span.AddEvent(fmt.Sprintf("Created the user %s", user.Uuid))
+		} else if err != nil {
+			return err
+		} else if !user.Verified {
+			// The provider already verified the email of the pending account
+			if err := tx.Model(&dao.User{}).Where("uuid = ?", user.Uuid).Update("verified", true).Error; err != nil {
+				return err
+			}
+
+			user.Verified = true
+		}
+
+		return tx.Create(&dao.OidcIdentity{
+			Issuer: identity.Issuer,
+			Subject: identity.Subject,
+			UserUuid: user.Uuid,
+			Email: identity.Email,
+			CreatedAt: now,
+			LastLoginAt: now,
+		}).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", user.Uuid),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.LinkOidcIdentity successfully", OidcIdentityRepositoryName))
+
+	return &user, nil
+}
+
+// oidcUserName follows the rules of the accounts, 3 to 50 characters
+func oidcUserName(identity platform.OidcIdentity) string {
+	name := strings.TrimSpace(identity.Name)
+	if len([]rune(name)) < 3 {
+		name = identity.Email
+	}
+
+	if runes := []rune(name); len(runes) > 50 {
+		name = string(runes[:50])
+	}
+
+	return name
+}
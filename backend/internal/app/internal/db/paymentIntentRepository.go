@@ -0,0 +1,352 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrPaymentIntentNotFound = errors.New("Payment Intent Not Found")
+
+const PaymentIntentRepositoryName = "payment-intent-repository"
+
+func CreatePaymentIntent(ticketId string, buyer string, provider string, currency string, ctx context.Context) (*dao.PaymentIntent, error) {
+	tr := otel.Tracer(PaymentIntentRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreatePaymentIntent", PaymentIntentRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("TicketId", ticketId),
+		attribute.String("Provider", provider),
+	)
+
+	var ticket dao.Ticket
+	err := db.WithContext(trContext).Select("uuid", "total").Where("uuid = ?", ticketId).First(&ticket).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrTicketNotFound)
+		span.SetStatus(codes.Error, ErrTicketNotFound.Error())
+		return nil, ErrTicketNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	amount := ticket.Total
+
+	intent := dao.PaymentIntent{
+		Uuid: uuid.New().String(),
+		TicketId: ticketId,
+		Buyer: buyer,
+		Provider: provider,
+		Amount: amount,
+		Currency: currency,
+		Status: dao.PaymentIntentPending,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := db.WithContext(trContext).Create(&intent).Error; err != nil {
+		span.SetAttributes(
+			attribute.String("Uuid", intent.Uuid),
+			attribute.Float64("Amount", float64(amount)),
+		)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreatePaymentIntent successfully", PaymentIntentRepositoryName))
+
+	return &intent, nil
+}
+
+func FetchPaymentIntent(ticketId string, ctx context.Context) (*dao.PaymentIntent, error) {
+	return fetchPaymentIntentWhere("FetchPaymentIntent", "ticket_id = ?", ticketId, ctx)
+}
+
+func FetchPaymentIntentByUuid(intentId string, ctx context.Context) (*dao.PaymentIntent, error) {
+	return fetchPaymentIntentWhere("FetchPaymentIntentByUuid", "uuid = ?", intentId, ctx)
+}
+
+func fetchPaymentIntentWhere(name string, where string, value string, ctx context.Context) (*dao.PaymentIntent, error) {
+	tr := otel.Tracer(PaymentIntentRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.%s", PaymentIntentRepositoryName, name))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Value", value),
+	)
+
+	var intent dao.PaymentIntent
+	err := db.WithContext(trContext).Where(where, value).Order("created_at DESC").First(&intent).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrPaymentIntentNotFound)
+		span.SetStatus(codes.Error, ErrPaymentIntentNotFound.Error())
+		return nil, ErrPaymentIntentNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return &intent, nil
+}
+
+// TransitionPaymentIntent moves the intent to the given status only when it's
+// in one of the expected statuses, it returns false when another request or a
+// repeated webhook already moved it. The payment status of the ticket and its
+// invoices change in the same transaction
+func TransitionPaymentIntent(intentId string, from []string, to string, providerRef *string, reason *string, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(PaymentIntentRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.TransitionPaymentIntent", PaymentIntentRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return false, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Uuid", intentId),
+		attribute.StringSlice("From", from),
+		attribute.String("To", to),
+	)
+
+	changed := false
+	err := withLockRetry(trContext, span, func() error {
+		return db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+			var err error
+			_, changed, err = transitionIntent(tx, intentId, from, to, providerRef, reason, span)
+			return err
+		})
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.TransitionPaymentIntent successfully", PaymentIntentRepositoryName))
+
+	return changed, nil
+}
+
+// FetchUnrefundedTickets returns the cancelled tickets, closed before the
+// given time, whose payment is still held by the provider
+func FetchUnrefundedTickets(before time.Time, limit int, ctx context.Context) ([]string, error) {
+	tr := otel.Tracer(PaymentIntentRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchUnrefundedTickets", PaymentIntentRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	held := []string{dao.PaymentIntentPending, dao.PaymentIntentAuthorized, dao.PaymentIntentCaptured}
+
+	tickets := make([]string, 0)
+	err := db.WithContext(trContext).
+		Model(&dao.PaymentIntent{}).
+		Joins("JOIN tickets ON tickets.uuid = payment_intents.ticket_id").
+		Where("tickets.status = ? AND tickets.updated_at <= ? AND payment_intents.status IN ?", dao.TicketCancelled, before, held).
+		Order("tickets.updated_at, tickets.uuid").
+		Limit(limit).
+		Pluck("tickets.uuid", &tickets).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Tickets", len(tickets)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchUnrefundedTickets successfully", PaymentIntentRepositoryName))
+
+	return tickets, nil
+}
+
+// FailPaymentIntent moves the intent to a failed status and gives the stock
+// of its ticket back in the same transaction, a failure in between can't
+// leave a declined payment with the units still reserved
+func FailPaymentIntent(intentId string, from []string, to string, providerRef *string, reason *string, actor string, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(PaymentIntentRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FailPaymentIntent", PaymentIntentRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return false, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Uuid", intentId),
+		attribute.StringSlice("From", from),
+		attribute.String("To", to),
+	)
+
+	changed := false
+	err := withLockRetry(trContext, span, func() error {
+		return db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+			ticketId, moved, err := transitionIntent(tx, intentId, from, to, providerRef, reason, span)
+			if err != nil || !moved {
+				return err
+			}
+
+			changed = true
+
+			// A ticket the buyer already cancelled has nothing left to release
+			err = closeTicketTx(tx, ticketId, dao.TicketPaymentFailed, actor, span)
+			if errors.Is(err, ErrTicketClosed) {
+				return nil
+			}
+
+			// The units already left, the failure is recorded but the stock
+			// isn't given back. Rolling back would make the provider retry
+			// the same event forever
+			if errors.Is(err, ErrOrderShipped) {
+				span.AddEvent("payment.failed_after_shipment", trace.WithAttributes(
+					attribute.String("TicketId", ticketId),
+				))
+				return nil
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FailPaymentIntent successfully", PaymentIntentRepositoryName))
+
+	return changed, nil
+}
+
+// transitionIntent moves the intent and the payment status of its ticket, a
+// captured payment marks the ticket as paid and gives it its invoices so the
+// declined ones never consume a number
+func transitionIntent(tx *gorm.DB, intentId string, from []string, to string, providerRef *string, reason *string, span trace.Span) (string, bool, error) {
+	updatedIntent := map[string]interface{}{
+		"status": to,
+		"updated_at": time.Now().UTC(),
+	}
+
+	if providerRef != nil {
+		updatedIntent["provider_ref"] = *providerRef
+	}
+
+	if reason != nil {
+		updatedIntent["failure_reason"] = *reason
+	}
+
+	result := tx.Model(&dao.PaymentIntent{}).
+		Where("uuid = ? AND status IN ?", intentId, from).
+		Updates(updatedIntent)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return "", false, result.Error
+	}
+
+	var intent dao.PaymentIntent
+	if err := tx.Select("uuid", "ticket_id").Where("uuid = ?", intentId).First(&intent).Error; err != nil {
+		return "", false, err
+	}
+
+	updatedTicket := map[string]interface{}{
+		"payment_status": to,
+		"updated_at": time.Now().UTC(),
+	}
+
+	if err := tx.Model(&dao.Ticket{}).Where("uuid = ?", intent.TicketId).Updates(updatedTicket).Error; err != nil {
+		return "", false, err
+	}
+
+	if to != dao.PaymentIntentCaptured {
+		return intent.TicketId, true, nil
+	}
+
+	paid := tx.Model(&dao.Ticket{}).
+		Where("uuid = ? AND status = ?", intent.TicketId, dao.TicketPendingPayment).
+		Update("status", dao.TicketPaid)
+
+	if paid.Error != nil {
+		return "", false, paid.Error
+	}
+
+	// Only the first capture of the ticket issues the invoices
+	if paid.RowsAffected == 0 {
+		return intent.TicketId, true, nil
+	}
+
+	// Sorted like in the checkout, the invoice sequences are locked in this order
+	sellers := make([]string, 0)
+	err := tx.Model(&dao.SubOrder{}).
+		Where("ticket_id = ?", intent.TicketId).
+		Order("seller").
+		Pluck("seller", &sellers).
+		Error
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := issueInvoices(tx, intent.TicketId, sellers, span); err != nil {
+		return "", false, err
+	}
+
+	return intent.TicketId, true, nil
+}
@@ -16,6 +16,7 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel"
 	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm"
 )
 
@@ -43,20 +44,29 @@ func InsertProduct(product *requests.CreateProduct, belongTo string, ctx context
 		Quantity: product.Quantity,
 		Image: nil,
 		BelongsTo: belongTo,
+		LowStockThreshold: product.LowStockThreshold,
 		CreatedAt: time.Now().UTC(),
 		UpdatedAt: nil,
 	}
 
-	if err := gorm.G[dao.Product](db).Create(trContext, &p); err != nil {
-		span.SetAttributes(
-			attribute.String("Uuid", p.Uuid),
-			attribute.String("Name", product.Name),
-			attribute.Int("Quantity", int(product.Quantity)),
-			attribute.Float64("Price", float64(product.Price)),
-			attribute.String("BelongsTo", belongTo),
-		)
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := gorm.G[dao.Product](tx).Create(trContext, &p); err != nil {
+			span.SetAttributes(
+				attribute.String("Uuid", p.Uuid),
+				attribute.String("Name", product.Name),
+				attribute.Int("Quantity", int(product.Quantity)),
+				attribute.Float64("Price", float64(product.Price)),
+				attribute.String("BelongsTo", belongTo),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		return recordStockMovement(tx, p.Uuid, p.Quantity, p.Quantity, dao.StockImport, nil, belongTo, span)
+	})
+
+	if err != nil {
 		return nil, err
 	}
 	
@@ -78,20 +88,32 @@ func DeleteProduct(uuid string, user string, ctx context.Context) error  {
 		return dbErr
 	}
 
-	result := db.WithContext(trContext).Where("uuid = (?) AND belongs_to = (?)", uuid, user).Delete(&dao.Product{})
-	if result.Error != nil {
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("uuid = (?) AND belongs_to = (?)", uuid, user).Delete(&dao.Product{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrProductNotFound
+		}
+
+		return flagRemovedWishlistItems(tx, uuid)
+	})
+
+	if errors.Is(err, ErrProductNotFound) {
+		span.RecordError(ErrProductNotFound)
+		return ErrProductNotFound
+	}
+
+	if err != nil {
 		span.SetAttributes(
 			attribute.String("ProductUuid", uuid),
 			attribute.String("BelongsTo", user),
 		)
-		span.RecordError(result.Error)
-		span.SetStatus(codes.Error, result.Error.Error())
-		return result.Error
-	}
-
-	if result.RowsAffected == 0 {
-		span.RecordError(ErrProductNotFound)
-		return ErrProductNotFound
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
 	}
 
 	span.SetStatus(codes.Ok, fmt.Sprintf("%s.DeleteProduct successfully", ProductRepositoryName))
@@ -117,29 +139,48 @@ func UpdateProduct(productID string, product *requests.CreateProduct, belongTo s
 		"name": product.Name,
 		"price": product.Price,
 		"quantity": product.Quantity,
+		"low_stock_threshold": product.LowStockThreshold,
 		"updated_at": time.Now().UTC(),
 	}
 
-	result := db.Model(&dao.Product{}).
-		WithContext(trContext).
-		Where("uuid = (?) AND belongs_to = (?)", productID, belongTo).
-		Updates(updatedProduct)
-	
-	if result.Error != nil {
-		span.SetAttributes(
-			attribute.String("ProductUuid", productID),
-			attribute.String("Name", product.Name),
-			attribute.Int("Quantity", int(product.Quantity)),
-			attribute.Float64("Price", float64(product.Price)),
-			attribute.String("BelongsTo", belongTo),
-		)
-		span.RecordError(result.Error)
-		span.SetStatus(codes.Error, result.Error.Error())
-		return result.Error
-	}
-
-	if result.RowsAffected == 0 {
-		return ErrProductNotFound
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var current dao.Product
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("uuid = (?) AND belongs_to = (?)", productID, belongTo).
+			First(&current).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrProductNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&dao.Product{}).
+			Where("uuid = (?) AND belongs_to = (?)", productID, belongTo).
+			Updates(updatedProduct)
+
+		if result.Error != nil {
+			span.SetAttributes(
+				attribute.String("ProductUuid", productID),
+				attribute.String("Name", product.Name),
+				attribute.Int("Quantity", int(product.Quantity)),
+				attribute.Float64("Price", float64(product.Price)),
+				attribute.String("BelongsTo", belongTo),
+			)
+			span.RecordError(result.Error)
+			span.SetStatus(codes.Error, result.Error.Error())
+			return result.Error
+		}
+
+		delta := product.Quantity - current.Quantity
+		return recordStockMovement(tx, productID, delta, product.Quantity, dao.StockManualAdjustment, nil, belongTo, span)
+	})
+
+	if err != nil {
+		return err
 	}
 
 	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UpdateProduct successfully", ProductRepositoryName))
@@ -181,6 +222,21 @@ func GetProducts(params parameters.GetProductsParams) (*requests.ProductsRespons
 		)
 	}
 
+	// Products without threshold use the default of the seller
+	if params.OnlyLowStock {
+		query = query.Where("quantity < COALESCE(low_stock_threshold, (SELECT s.low_stock_threshold FROM seller_settings s WHERE s.seller = products.belongs_to), 0)")
+		span.SetAttributes(
+			attribute.Bool("OnlyLowStock", true),
+		)
+	}
+
+	if params.SortByRating {
+		query = query.Order("rating_average DESC, rating_count DESC, uuid")
+		span.SetAttributes(
+			attribute.String("Sort", "rating"),
+		)
+	}
+
 	products := make([]dao.Product, 0)
 	err := query.Limit(limit).Offset(offset).Find(&products).Error
 
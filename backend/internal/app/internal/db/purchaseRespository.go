@@ -2,6 +2,8 @@ package db
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"time"
 	"errors"
 	"context"
@@ -9,9 +11,11 @@ import (
 	"github.com/OscarVillanueva/goapi/internal/platform"
 	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
 	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/parameters"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.opentelemetry.io/otel"
 	"github.com/google/uuid"
 	"gorm.io/gorm/clause"
@@ -26,9 +30,23 @@ func (e *ErrInsufficientStock) Error() string {
     return fmt.Sprintf("insufficient stock for %s", e.Product)
 }
 
+type ErrSelfPurchase struct {
+    Product string
+}
+
+func (e *ErrSelfPurchase) Error() string {
+    return fmt.Sprintf("you can't buy your own product %s", e.Product)
+}
+
+var ErrOrderShipped = errors.New("Part of the purchase was already shipped")
+var ErrTicketClosed = errors.New("The purchase was already cancelled")
+var ErrInvalidQuantity = errors.New("The quantity of a product must be greater than zero")
+
 const PurchaseRepositoryName = "purchase-repository"
 
-func BatchPurchase(purchases []requests.CreatePurchase, buyer string, ctx context.Context) (string, error) {
+// BatchPurchase creates the ticket and returns the stock alerts raised by the
+// sale, they should be sent once the transaction is committed
+func BatchPurchase(ticket requests.CreateTicket, buyer string, options parameters.CheckoutOptions, ctx context.Context) (string, []requests.StockAlert, error) {
 	tr := otel.Tracer(PurchaseRepositoryName)
 	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.BatchPurchase", PurchaseRepositoryName))
 	defer span.End()
@@ -39,94 +57,271 @@ func BatchPurchase(purchases []requests.CreatePurchase, buyer string, ctx contex
 		dbErr := errors.New("We couldn't connect to the database")
 		span.RecordError(dbErr)
 		span.SetStatus(codes.Error, dbErr.Error())
-		return "", dbErr
+		return "", nil, dbErr
+	}
+
+	lines, err := mergePurchaseLines(ticket.Items)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", nil, err
+	}
+
+	productIDs := make([]string, 0, len(lines))
+	for _, line := range lines {
+		productIDs = append(productIDs, line.Product)
 	}
 
+	span.SetAttributes(
+		attribute.Int("Lines", len(ticket.Items)),
+		attribute.Int("Products", len(productIDs)),
+	)
+
 	purchaseID := uuid.New().String()
 
-	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
-		for _, purchase := range purchases {
-			if purchase.Quantity < 0 {
-				quantityErr := errors.New("Quantity must be greater than zero: " + purchase.Product)
-				span.RecordError(quantityErr)
-				span.SetStatus(codes.Error, quantityErr.Error())
-				return quantityErr
-			}
+	var alerts []requests.StockAlert
+	err = withLockRetry(trContext, span, func() error {
+		alerts = nil
 
-			var product dao.Product
-			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
-				Where("uuid = ?", purchase.Product).First(&product).Error; err != nil {
-				span.SetAttributes(
-					attribute.String("ProductUuid", purchase.Product),
-				)
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
-				return err
-			}
+		return db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+			return batchPurchase(tx, purchaseID, ticket, lines, productIDs, buyer, options, &alerts, span)
+		})
+	})
 
-			if product.Quantity < purchase.Quantity {
-				msgErr := ErrInsufficientStock{Product: product.Name}
-				span.SetAttributes(
-					attribute.String("ProductUuid", product.Uuid),
-					attribute.Int("PurchaseQuantity", int(purchase.Quantity)),
-				)
-				span.RecordError(errors.New(msgErr.Error()))
-				span.SetStatus(codes.Error, msgErr.Error())
-				return &msgErr
-			}
+	if err != nil {
+		return purchaseID, nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("StockAlerts", len(alerts)),
+	)
+
+	return purchaseID, alerts, nil
+}
+
+// mergePurchaseLines adds up the lines of the same product and sorts them by
+// product uuid, so every ticket locks the rows in the same order. The sum is
+// made in int64 so lines of the same product can't overflow the quantity
+func mergePurchaseLines(purchases []requests.CreatePurchase) ([]requests.CreatePurchase, error) {
+	quantities := map[string]int64{}
+	for _, purchase := range purchases {
+		quantities[purchase.Product] += int64(purchase.Quantity)
+	}
+
+	lines := make([]requests.CreatePurchase, 0, len(quantities))
+	for product, quantity := range quantities {
+		if quantity <= 0 || quantity > math.MaxInt32 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidQuantity, product)
+		}
 
-			newPurchase := dao.Purchase{
+		lines = append(lines, requests.CreatePurchase{Product: product, Quantity: int32(quantity)})
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i].Product < lines[j].Product
+	})
+
+	return lines, nil
+}
+
+func batchPurchase(tx *gorm.DB, purchaseID string, ticket requests.CreateTicket, lines []requests.CreatePurchase, productIDs []string, buyer string, options parameters.CheckoutOptions, alerts *[]requests.StockAlert, span trace.Span) error {
+	shippingAddress, err := resolveShippingAddress(tx, ticket, buyer)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	// The archived products aren't sold, they are reported as not found
+	products := make([]dao.Product, 0, len(productIDs))
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("uuid IN ? AND archived_at IS NULL", productIDs).
+		Order("uuid").
+		Find(&products).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	locked := make(map[string]dao.Product, len(products))
+	productSellers := make([]string, 0, len(products))
+	for _, product := range products {
+		locked[product.Uuid] = product
+		productSellers = append(productSellers, product.BelongsTo)
+	}
+
+	thresholds, err := sellerThresholds(tx, productSellers)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	paymentStatus := dao.PaymentIntentPending
+	newTicket := dao.Ticket{
+		Uuid: purchaseID,
+		Buyer: buyer,
+		Status: dao.TicketPendingPayment,
+		PaymentStatus: &paymentStatus,
+		Lines: int32(len(lines)),
+		Notes: ticket.Notes,
+		ShippingAddress: shippingAddress,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	sellers := make([]string, 0)
+	subOrders := map[string]*dao.SubOrder{}
+
+	for _, purchase := range lines {
+		product, ok := locked[purchase.Product]
+		if !ok {
+			span.SetAttributes(
+				attribute.String("ProductUuid", purchase.Product),
+			)
+			span.RecordError(ErrProductNotFound)
+			span.SetStatus(codes.Error, ErrProductNotFound.Error())
+			return fmt.Errorf("%w: %s", ErrProductNotFound, purchase.Product)
+		}
+
+		if options.BlockSelfPurchase && product.BelongsTo == buyer {
+			msgErr := ErrSelfPurchase{Product: product.Name}
+			span.SetAttributes(
+				attribute.String("ProductUuid", product.Uuid),
+				attribute.String("Seller", product.BelongsTo),
+			)
+			span.RecordError(errors.New(msgErr.Error()))
+			span.SetStatus(codes.Error, msgErr.Error())
+			return &msgErr
+		}
+
+		if product.Quantity < purchase.Quantity {
+			msgErr := ErrInsufficientStock{Product: product.Name}
+			span.SetAttributes(
+				attribute.String("ProductUuid", product.Uuid),
+				attribute.Int("PurchaseQuantity", int(purchase.Quantity)),
+			)
+			span.RecordError(errors.New(msgErr.Error()))
+			span.SetStatus(codes.Error, msgErr.Error())
+			return &msgErr
+		}
+
+		subOrder, ok := subOrders[product.BelongsTo]
+		if !ok {
+			subOrder = &dao.SubOrder{
 				Uuid: uuid.New().String(),
 				TicketId: purchaseID,
-				Product: product.Uuid,
-				Quantity: purchase.Quantity,
-				Price: product.Price,
-				PurchasedBy: buyer,
+				Seller: product.BelongsTo,
+				Buyer: buyer,
+				Status: dao.SubOrderPlaced,
+				FulfillmentStatus: dao.FulfillmentUnfulfilled,
 				CreatedAt: time.Now().UTC(),
 			}
 
-			if err := tx.Create(&newPurchase).Error; err != nil {
-				span.SetAttributes(
-					attribute.String("Uuid", newPurchase.Uuid),
-					attribute.String("TicketId", newPurchase.TicketId),
-					attribute.String("ProductUuid", newPurchase.Product),
-					attribute.Float64("Price", float64(newPurchase.Price)),
-					attribute.Int("Quantity", int(newPurchase.Quantity)),
-					attribute.String("PurchasedBy", newPurchase.PurchasedBy),
-				)
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
-				return err
-			}
+			subOrders[product.BelongsTo] = subOrder
+			sellers = append(sellers, product.BelongsTo)
+		}
 
-			quantity := product.Quantity - purchase.Quantity
+		newPurchase := dao.Purchase{
+			Uuid: uuid.New().String(),
+			TicketId: purchaseID,
+			SubOrderId: subOrder.Uuid,
+			Product: product.Uuid,
+			ProductName: product.Name,
+			ProductImage: product.Image,
+			Seller: product.BelongsTo,
+			Quantity: purchase.Quantity,
+			Price: product.Price,
+			PurchasedBy: buyer,
+			CreatedAt: time.Now().UTC(),
+		}
 
-			updatedProduct := map[string]interface{}{
-				"quantity": quantity,
-				"updated_at": time.Now().UTC(),
-			}
+		if err := tx.Create(&newPurchase).Error; err != nil {
+			span.SetAttributes(
+				attribute.String("Uuid", newPurchase.Uuid),
+				attribute.String("TicketId", newPurchase.TicketId),
+				attribute.String("ProductUuid", newPurchase.Product),
+				attribute.Float64("Price", float64(newPurchase.Price)),
+				attribute.Int("Quantity", int(newPurchase.Quantity)),
+				attribute.String("PurchasedBy", newPurchase.PurchasedBy),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
 
-			result := tx.Model(&product).Where("uuid = ?", product.Uuid).Updates(updatedProduct)
-			if result.Error != nil {
-				span.SetAttributes(
-					attribute.String("ProductUuid", product.Uuid),
-					attribute.Int("Quantity", int(quantity)),
-				)
-				span.RecordError(result.Error)
-				span.SetStatus(codes.Error, fmt.Sprintf("Unable to update the quantity of product: %s", product.Uuid))
-				return result.Error
-			}
+		quantity := product.Quantity - purchase.Quantity
+
+		updatedProduct := map[string]interface{}{
+			"quantity": quantity,
+			"updated_at": time.Now().UTC(),
 		}
 
-		return nil
-	})
+		result := tx.Model(&product).Where("uuid = ?", product.Uuid).Updates(updatedProduct)
+		if result.Error != nil {
+			span.SetAttributes(
+				attribute.String("ProductUuid", product.Uuid),
+				attribute.Int("Quantity", int(quantity)),
+			)
+			span.RecordError(result.Error)
+			span.SetStatus(codes.Error, fmt.Sprintf("Unable to update the quantity of product: %s", product.Uuid))
+			return result.Error
+		}
+
+		if err := recordStockMovement(tx, product.Uuid, -purchase.Quantity, quantity, dao.StockSale, &purchaseID, buyer, span); err != nil {
+			return err
+		}
+
+		if alert := stockAlert(product, quantity, thresholds); alert != nil {
+			*alerts = append(*alerts, *alert)
+		}
+
+		subOrder.Units += purchase.Quantity
+		subOrder.Subtotal += newPurchase.Price * float32(purchase.Quantity)
+		newTicket.Units += purchase.Quantity
+		newTicket.Subtotal += newPurchase.Price * float32(purchase.Quantity)
+	}
+
+	newTicket.Total = newTicket.Subtotal
 
-	return purchaseID, err
+	if err := tx.Create(&newTicket).Error; err != nil {
+		span.SetAttributes(
+			attribute.String("TicketId", newTicket.Uuid),
+			attribute.Float64("Total", float64(newTicket.Total)),
+		)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	// Sellers are sorted too, the invoice sequences are locked in this order
+	sort.Strings(sellers)
+
+	for _, seller := range sellers {
+		subOrder := subOrders[seller]
+		subOrder.Total = subOrder.Subtotal
+
+		if err := tx.Create(subOrder).Error; err != nil {
+			span.SetAttributes(
+				attribute.String("SubOrderUuid", subOrder.Uuid),
+				attribute.String("TicketId", subOrder.TicketId),
+				attribute.String("Seller", subOrder.Seller),
+			)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	}
+
+	// The invoices are issued once the payment is captured
+	return nil
 }
 
-func FetchTickets(page int, buyer string, ctx context.Context) ([]dao.Ticket, error) {
+func FetchTickets(params parameters.GetTicketsParams) (*requests.TicketsResponse, error) {
 	tr := otel.Tracer(PurchaseRepositoryName)
-	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchTickets", PurchaseRepositoryName))
+	trContext, span := tr.Start(params.Context, fmt.Sprintf("%s.FetchTickets", PurchaseRepositoryName))
 	defer span.End()
 
 	db := platform.GetInstance()
@@ -139,27 +334,174 @@ func FetchTickets(page int, buyer string, ctx context.Context) ([]dao.Ticket, er
 	}
 
 	limit := 30
-	offset := (page - 1) * limit
+	offset := (params.Page - 1) * limit
 
-	span.SetAttributes(
-		attribute.String("PurchasedBy", buyer),
-	)
+	query := filterTickets(db.WithContext(trContext).Model(&dao.Ticket{}), params, span)
 
-	ticket := make([]dao.Ticket, 0)
-	err := db.Model(&dao.Purchase{}).
-		WithContext(trContext).
-		Where("purchased_by = ?", buyer).
-		Select("MAX(created_at) as created_at, SUM(price * quantity) as total, ticket_id").
-		Group("ticket_id").
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	tickets := make([]dao.Ticket, 0)
+	err := query.
+		Order(ticketsOrder(params.Sort)).
 		Limit(limit).
 		Offset(offset).
-		Scan(&ticket).
+		Find(&tickets).
 		Error
 
-	return ticket, err
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchTickets successfully", PurchaseRepositoryName))
+
+	response := requests.TicketsResponse{
+		Tickets: tickets,
+		PageSize: limit,
+		Pages: int(math.Ceil(float64(count) / float64(limit))),
+	}
+
+	return &response, nil
+}
+
+// StreamTicketLines walks the lines of every ticket that matches the filters
+// with a database cursor, so the whole history never has to be in memory
+func StreamTicketLines(params parameters.GetTicketsParams, yield func(line requests.TicketExportLine) error) error {
+	tr := otel.Tracer(PurchaseRepositoryName)
+	trContext, span := tr.Start(params.Context, fmt.Sprintf("%s.StreamTicketLines", PurchaseRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	query := filterTickets(db.WithContext(trContext).Table("tickets"), params, span)
+
+	rows, err := query.
+		Select("tickets.uuid AS ticket_id, tickets.created_at, tickets.status, tickets.payment_status, purchases.product, purchases.product_name, purchases.seller, purchases.quantity, purchases.price AS unit_price, tickets.total AS ticket_total").
+		Joins("JOIN purchases ON purchases.ticket_id = tickets.uuid").
+		Order(ticketsOrder(params.Sort) + ", purchases.created_at, purchases.uuid").
+		Rows()
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	defer rows.Close()
+
+	exported := 0
+	for rows.Next() {
+		var line requests.TicketExportLine
+		if err := db.ScanRows(rows, &line); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		line.LineTotal = line.UnitPrice * float32(line.Quantity)
+
+		if err := yield(line); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		exported += 1
+	}
+
+	if err := rows.Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Lines", exported),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.StreamTicketLines successfully", PurchaseRepositoryName))
+
+	return nil
 }
 
-func FetchPurchase(purchaseId string, buyer string, ctx context.Context) ([]dao.Purchase, error) {
+func filterTickets(query *gorm.DB, params parameters.GetTicketsParams, span trace.Span) *gorm.DB {
+	span.SetAttributes(
+		attribute.String("PurchasedBy", params.Buyer),
+	)
+
+	query = query.Where("tickets.buyer = ?", params.Buyer)
+
+	if params.From != nil {
+		query = query.Where("tickets.created_at >= ?", *params.From)
+		span.SetAttributes(
+			attribute.String("From", params.From.Format(time.RFC3339)),
+		)
+	}
+
+	if params.To != nil {
+		query = query.Where("tickets.created_at < ?", *params.To)
+		span.SetAttributes(
+			attribute.String("To", params.To.Format(time.RFC3339)),
+		)
+	}
+
+	if params.MinTotal != nil {
+		query = query.Where("tickets.total >= ?", *params.MinTotal)
+		span.SetAttributes(
+			attribute.Float64("MinTotal", *params.MinTotal),
+		)
+	}
+
+	if params.MaxTotal != nil {
+		query = query.Where("tickets.total <= ?", *params.MaxTotal)
+		span.SetAttributes(
+			attribute.Float64("MaxTotal", *params.MaxTotal),
+		)
+	}
+
+	if params.Product != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM purchases contained WHERE contained.ticket_id = tickets.uuid AND contained.product = ?)", params.Product)
+		span.SetAttributes(
+			attribute.String("ProductUuid", params.Product),
+		)
+	}
+
+	if params.Seller != "" {
+		query = query.Where("EXISTS (SELECT 1 FROM purchases contained WHERE contained.ticket_id = tickets.uuid AND contained.seller = ?)", params.Seller)
+		span.SetAttributes(
+			attribute.String("Seller", params.Seller),
+		)
+	}
+
+	return query
+}
+
+func ticketsOrder(value string) string {
+	switch value {
+		case parameters.TicketsOldestFirst:
+			return "tickets.created_at, tickets.uuid"
+		case parameters.TicketsCheapestFirst:
+			return "tickets.total, tickets.created_at DESC, tickets.uuid"
+		case parameters.TicketsPriciestFirst:
+			return "tickets.total DESC, tickets.created_at DESC, tickets.uuid"
+		default:
+			return "tickets.created_at DESC, tickets.uuid"
+	}
+}
+
+func FetchPurchase(purchaseId string, buyer string, ctx context.Context) (*dao.Ticket, []dao.Purchase, error) {
 	tr := otel.Tracer(PurchaseRepositoryName)
 	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchPurchase", PurchaseRepositoryName))
 	defer span.End()
@@ -170,7 +512,7 @@ func FetchPurchase(purchaseId string, buyer string, ctx context.Context) ([]dao.
 		dbErr := errors.New("We couldn't connect to the database")
 		span.RecordError(dbErr)
 		span.SetStatus(codes.Error, dbErr.Error())
-		return nil, dbErr
+		return nil, nil, dbErr
 	}
 
 	span.SetAttributes(
@@ -178,21 +520,98 @@ func FetchPurchase(purchaseId string, buyer string, ctx context.Context) ([]dao.
 		attribute.String("PurchasedBy", buyer),
 	)
 
+	var ticket dao.Ticket
+	err := db.WithContext(trContext).Where("uuid = ? AND buyer = ?", purchaseId, buyer).First(&ticket).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrTicketNotFound)
+		span.SetStatus(codes.Error, ErrTicketNotFound.Error())
+		return nil, nil, ErrTicketNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, err
+	}
+
 	purchases := make([]dao.Purchase, 0)
-	err := db.Model(&dao.Purchase{}).
+	err = db.Model(&dao.Purchase{}).
 		WithContext(trContext).
-		Where("ticket_id = ? AND purchased_by = ?", purchaseId, buyer).
+		Where("ticket_id = ?", purchaseId).
+		Order("created_at, uuid").
 		Find(&purchases).
 		Error
 
-	return purchases, err
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, err
+	}
+
+	return &ticket, purchases, nil
 }
 
-func DeletePurchase(purchases []dao.Purchase, ctx context.Context) error  {
+// DeletePurchase cancels the ticket and gives back its stock, the lines are
+// kept so the history of the buyer and the sellers stays complete
+func DeletePurchase(ticketId string, actor string, ctx context.Context) error  {
 	tr := otel.Tracer(PurchaseRepositoryName)
 	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeletePurchase", PurchaseRepositoryName))
 	defer span.End()
 
+	return closeTicket(ticketId, dao.TicketCancelled, actor, trContext)
+}
+
+// ReleaseTicket closes a ticket whose payment never went through, its units
+// return to the stock
+func ReleaseTicket(ticketId string, actor string, ctx context.Context) error {
+	tr := otel.Tracer(PurchaseRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.ReleaseTicket", PurchaseRepositoryName))
+	defer span.End()
+
+	return closeTicket(ticketId, dao.TicketPaymentFailed, actor, trContext)
+}
+
+// FetchStalePendingTickets returns the tickets still waiting for their
+// payment that were created before the given time, oldest first
+func FetchStalePendingTickets(before time.Time, limit int, ctx context.Context) ([]dao.Ticket, error) {
+	tr := otel.Tracer(PurchaseRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchStalePendingTickets", PurchaseRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	tickets := make([]dao.Ticket, 0)
+	err := db.WithContext(trContext).
+		Where("status = ? AND created_at <= ?", dao.TicketPendingPayment, before).
+		Order("created_at, uuid").
+		Limit(limit).
+		Find(&tickets).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Tickets", len(tickets)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchStalePendingTickets successfully", PurchaseRepositoryName))
+
+	return tickets, nil
+}
+
+func closeTicket(ticketID string, status string, actor string, ctx context.Context) error {
+	span := trace.SpanFromContext(ctx)
+
 	db := platform.GetInstance()
 
 	if db == nil {
@@ -202,50 +621,111 @@ func DeletePurchase(purchases []dao.Purchase, ctx context.Context) error  {
 		return dbErr
 	}
 
-	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
-		for _, purchase := range purchases {
-			var product dao.Product
-			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
-				Where("uuid = ?", purchase.Product).First(&product).Error; err != nil {
-				span.SetAttributes(
-					attribute.String("ProductUuid", purchase.Product),
-				)
-				span.RecordError(err)
-				span.SetStatus(codes.Error, err.Error())
-				return err
-			}
+	span.SetAttributes(
+		attribute.String("TicketId", ticketID),
+		attribute.String("Status", status),
+	)
 
-			quantity := product.Quantity + purchase.Quantity
+	err := withLockRetry(ctx, span, func() error {
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return closeTicketTx(tx, ticketID, status, actor, span)
+		})
+	})
 
-			updatedProduct := map[string]interface{}{
-				"quantity": quantity,
-				"updated_at": time.Now().UTC(),
-			}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
 
-			result := tx.Model(&product).Where("uuid = ?", product.Uuid).Updates(updatedProduct)
-			if result.Error != nil {
-				span.SetAttributes(
-					attribute.String("ProductUuid", product.Uuid),
-				)
-				span.RecordError(result.Error)
-				span.SetStatus(codes.Error, fmt.Sprintf("We couldn't update the quantity of the product: %s", purchase.Product))
-				return result.Error
-			}
+	return nil
+}
 
-			err := tx.Where("uuid = ? AND ticket_id = ?", purchase.Uuid, purchase.TicketId).Delete(&purchase).Error
-			if err != nil {
-				span.SetAttributes(
-					attribute.String("PurchaseUuid", purchase.Uuid),
-					attribute.String("TicketId", purchase.TicketId),
-				)
-				span.RecordError(err)
-				span.SetStatus(codes.Error, fmt.Sprintf("We couldn't the purchase: %s", purchase.Uuid))
-				return err
-			}
+// closeTicketTx gives the stock of the ticket back and closes it with the
+// given status inside the transaction of the caller
+func closeTicketTx(tx *gorm.DB, ticketID string, status string, actor string, span trace.Span) error {
+	// The units of a failed payment were never sold, they return to the stock
+	reason := dao.StockCancellation
+	if status == dao.TicketPaymentFailed {
+		reason = dao.StockReturn
+	}
+
+	var ticket dao.Ticket
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", ticketID).First(&ticket).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrTicketNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if ticket.Status == dao.TicketCancelled || ticket.Status == dao.TicketPaymentFailed {
+		return ErrTicketClosed
+	}
+
+	var shipped int64
+	err = tx.Model(&dao.SubOrder{}).
+		Where("ticket_id = ? AND fulfillment_status IN ?", ticketID, []string{dao.FulfillmentShipped, dao.FulfillmentDelivered}).
+		Count(&shipped).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	if shipped > 0 {
+		return ErrOrderShipped
+	}
+
+	purchases := make([]dao.Purchase, 0)
+	if err := tx.Where("ticket_id = ?", ticketID).Order("product").Find(&purchases).Error; err != nil {
+		return err
+	}
+
+	for _, purchase := range purchases {
+		var product dao.Product
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("uuid = ?", purchase.Product).First(&product).Error; err != nil {
+			span.SetAttributes(
+				attribute.String("ProductUuid", purchase.Product),
+			)
+			return err
 		}
 
-		return nil
-	})
+		quantity := product.Quantity + purchase.Quantity
+
+		updatedProduct := map[string]interface{}{
+			"quantity": quantity,
+			"updated_at": time.Now().UTC(),
+		}
+
+		result := tx.Model(&product).Where("uuid = ?", product.Uuid).Updates(updatedProduct)
+		if result.Error != nil {
+			span.SetAttributes(
+				attribute.String("ProductUuid", product.Uuid),
+			)
+			return fmt.Errorf("We couldn't update the quantity of the product %s: %w", purchase.Product, result.Error)
+		}
+
+		if err := recordStockMovement(tx, product.Uuid, purchase.Quantity, quantity, reason, &ticketID, actor, span); err != nil {
+			return err
+		}
+	}
+
+	cancelled := map[string]interface{}{
+		"status": dao.SubOrderCancelled,
+		"updated_at": time.Now().UTC(),
+	}
+
+	if err := tx.Model(&dao.SubOrder{}).Where("ticket_id = ?", ticketID).Updates(cancelled).Error; err != nil {
+		return fmt.Errorf("We couldn't cancel the sub orders of %s: %w", ticketID, err)
+	}
+
+	closed := map[string]interface{}{
+		"status": status,
+		"updated_at": time.Now().UTC(),
+	}
 
-	return err
+	return tx.Model(&dao.Ticket{}).Where("uuid = ?", ticketID).Updates(closed).Error
 }
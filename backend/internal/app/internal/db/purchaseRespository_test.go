@@ -0,0 +1,52 @@
+package db
+
+import (
+	"math"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+func TestMergePurchaseLines(t *testing.T) {
+	line := func(product string, quantity int32) requests.CreatePurchase {
+		return requests.CreatePurchase{Product: product, Quantity: quantity}
+	}
+
+	cases := []struct {
+		name string
+		lines []requests.CreatePurchase
+		want []requests.CreatePurchase
+		fails bool
+	}{
+		{"single line", []requests.CreatePurchase{line("a", 2)}, []requests.CreatePurchase{line("a", 2)}, false},
+		{"same product merged", []requests.CreatePurchase{line("a", 2), line("a", 3)}, []requests.CreatePurchase{line("a", 5)}, false},
+		{"sorted by product", []requests.CreatePurchase{line("c", 1), line("a", 1), line("b", 1)}, []requests.CreatePurchase{line("a", 1), line("b", 1), line("c", 1)}, false},
+		{"sum at the limit", []requests.CreatePurchase{line("a", math.MaxInt32 - 1), line("a", 1)}, []requests.CreatePurchase{line("a", math.MaxInt32)}, false},
+		{"sum overflows", []requests.CreatePurchase{line("a", math.MaxInt32), line("a", math.MaxInt32), line("a", 1)}, nil, true},
+		{"sum above the limit", []requests.CreatePurchase{line("a", math.MaxInt32), line("a", 1)}, nil, true},
+		{"zero quantity", []requests.CreatePurchase{line("a", 0)}, nil, true},
+		{"negative quantity", []requests.CreatePurchase{line("a", 3), line("a", -3)}, nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := mergePurchaseLines(c.lines)
+			if c.fails {
+				if !errors.Is(err, ErrInvalidQuantity) {
+					t.Fatalf("mergePurchaseLines() = %v, %v, want %v", got, err, ErrInvalidQuantity)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("mergePurchaseLines() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
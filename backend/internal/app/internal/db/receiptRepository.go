@@ -0,0 +1,119 @@
+package db
+
+import (
+	"fmt"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+)
+
+var ErrTicketNotFound = errors.New("Ticket Not Found")
+
+const ReceiptRepositoryName = "receipt-repository"
+
+func FetchReceipt(ticketId string, buyer string, ctx context.Context) (*requests.Receipt, error) {
+	tr := otel.Tracer(ReceiptRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchReceipt", ReceiptRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("TicketId", ticketId),
+		attribute.String("PurchasedBy", buyer),
+	)
+
+	var user dao.User
+	err := db.WithContext(trContext).Where("uuid = ?", buyer).First(&user).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	var ticket dao.Ticket
+	err = db.WithContext(trContext).Where("uuid = ? AND buyer = ?", ticketId, buyer).First(&ticket).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrTicketNotFound)
+		span.SetStatus(codes.Error, ErrTicketNotFound.Error())
+		return nil, ErrTicketNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	lines := make([]requests.ReceiptLine, 0)
+
+	err = db.WithContext(trContext).
+		Table("purchases").
+		Select("purchases.product, purchases.product_name AS name, purchases.seller, purchases.price AS unit_price, purchases.quantity").
+		Where("purchases.ticket_id = ?", ticketId).
+		Order("purchases.created_at, purchases.uuid").
+		Scan(&lines).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	invoices := make([]requests.ReceiptInvoice, 0)
+	err = db.WithContext(trContext).
+		Table("invoices").
+		Select("invoices.seller, users.name AS seller_name, invoices.number").
+		Joins("LEFT JOIN users ON users.uuid = invoices.seller").
+		Where("invoices.ticket_id = ?", ticketId).
+		Order("invoices.number").
+		Scan(&invoices).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	receipt := requests.Receipt{
+		TicketId: ticketId,
+		CreatedAt: ticket.CreatedAt,
+		Buyer: user.Name,
+		BuyerEmail: user.Email,
+		Lines: make([]requests.ReceiptLine, 0, len(lines)),
+		Invoices: invoices,
+	}
+
+	for _, line := range lines {
+		if line.Name == "" {
+			line.Name = "Unavailable product"
+		}
+
+		line.Total = line.UnitPrice * float32(line.Quantity)
+		receipt.Lines = append(receipt.Lines, line)
+	}
+
+	receipt.Subtotal = ticket.Subtotal
+	receipt.Total = ticket.Total
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchReceipt successfully", ReceiptRepositoryName))
+
+	return &receipt, nil
+}
@@ -0,0 +1,303 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrRefreshTokenInvalid = errors.New("Invalid refresh token")
+var ErrRefreshTokenExpired = errors.New("The refresh token expired")
+var ErrRefreshTokenReused = errors.New("The refresh token was already used, the session was closed")
+
+const RefreshTokenRepositoryName = "refresh-token-repository"
+
+// CreateRefreshToken starts a new family for the user and returns the token,
+// it's the only moment the plain token exists
+func CreateRefreshToken(userId string, ctx context.Context) (string, error) {
+	tr := otel.Tracer(RefreshTokenRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateRefreshToken", RefreshTokenRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return "", dbErr
+	}
+
+	familyId := uuid.New().String()
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+		attribute.String("FamilyId", familyId),
+	)
+
+	token, refreshToken, err := newRefreshToken(userId, familyId, time.Now().UTC().Add(tools.RefreshTokenTTL()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	if err := db.WithContext(trContext).Create(&refreshToken).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreateRefreshToken successfully", RefreshTokenRepositoryName))
+
+	return token, nil
+}
+
+// RotateRefreshToken uses the token and returns the next one of its family
+// with the user it belongs to. A token that was already used means it was
+// stolen, so the whole family is revoked
+func RotateRefreshToken(token string, ctx context.Context) (string, string, error) {
+	tr := otel.Tracer(RefreshTokenRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RotateRefreshToken", RefreshTokenRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return "", "", dbErr
+	}
+
+	var next string
+	var current dao.RefreshToken
+	var reused error
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", tools.HashToken(token)).
+			First(&current).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrRefreshTokenInvalid
+		}
+
+		if err != nil {
+			return err
+		}
+
+		span.SetAttributes(
+			attribute.String("UserUuid", current.UserUuid),
+			attribute.String("FamilyId", current.FamilyId),
+		)
+
+		now := time.Now().UTC()
+
+		rotation := rotateRefreshToken(current, now)
+
+		// The revocation has to be committed, so the error is returned after
+		// the transaction
+		if rotation.revokeFamily {
+			reused = rotation.err
+			return revokeRefreshTokens(tx.Where("family_id = ?", current.FamilyId), now)
+		}
+
+		if rotation.err != nil {
+			return rotation.err
+		}
+
+		if err := tx.Create(&rotation.next).Error; err != nil {
+			return err
+		}
+
+		err = tx.Model(&dao.RefreshToken{}).
+			Where("uuid = ?", current.Uuid).
+			Updates(rotation.used).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		next = rotation.plain
+		return nil
+	})
+
+	if err == nil && reused != nil {
+		err = reused
+		span.AddEvent(fmt.Sprintf("Revoked the refresh token family %s", current.FamilyId))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", "", err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RotateRefreshToken successfully", RefreshTokenRepositoryName))
+
+	return next, current.UserUuid, nil
+}
+
+// refreshRotation is what presenting a refresh token does, the next token of
+// the family and the update of the current one, or the family revoked when
+// the token was already used
+type refreshRotation struct {
+	revokeFamily bool
+	err error
+	plain string
+	next dao.RefreshToken
+	used map[string]interface{}
+}
+
+// rotateRefreshToken decides the rotation of the current token. A used or
+// revoked token is a reuse, it revokes the family even when it's expired
+func rotateRefreshToken(current dao.RefreshToken, now time.Time) refreshRotation {
+	if current.UsedAt != nil || current.RevokedAt != nil {
+		return refreshRotation{revokeFamily: true, err: ErrRefreshTokenReused}
+	}
+
+	if current.ExpiresAt.Before(now) {
+		return refreshRotation{err: ErrRefreshTokenExpired}
+	}
+
+	// The next token keeps the expiration of the family, rotating doesn't
+	// make the session last longer
+	plain, next, err := newRefreshToken(current.UserUuid, current.FamilyId, current.ExpiresAt)
+	if err != nil {
+		return refreshRotation{err: err}
+	}
+
+	return refreshRotation{
+		plain: plain,
+		next: next,
+		used: map[string]interface{}{
+			"used_at": now,
+			"replaced_by": next.Uuid,
+		},
+	}
+}
+
+func newRefreshToken(userId string, familyId string, expiresAt time.Time) (string, dao.RefreshToken, error) {
+	token := tools.GenerateSecureToken(32)
+	if token == "" {
+		return "", dao.RefreshToken{}, errors.New("We couldn't generate the refresh token")
+	}
+
+	now := time.Now().UTC()
+	refreshToken := dao.RefreshToken{
+		Uuid: uuid.New().String(),
+		FamilyId: familyId,
+		UserUuid: userId,
+		TokenHash: tools.HashToken(token),
+		ExpiresAt: expiresAt,
+		CreatedAt: now,
+	}
+
+	return token, refreshToken, nil
+}
+
+// revokeRefreshTokens revokes the tokens matched by the query that are still
+// active
+func revokeRefreshTokens(query *gorm.DB, at time.Time) error {
+	return query.Model(&dao.RefreshToken{}).
+		Where("revoked_at IS NULL").
+		Update("revoked_at", at).
+		Error
+}
+
+// RevokeRefreshTokenFamily closes the session of a refresh token of the user
+func RevokeRefreshTokenFamily(token string, userId string, ctx context.Context) error {
+	tr := otel.Tracer(RefreshTokenRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RevokeRefreshTokenFamily", RefreshTokenRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	var current dao.RefreshToken
+	err := db.WithContext(trContext).
+		Where("token_hash = ? AND user_uuid = ?", tools.HashToken(token), userId).
+		First(&current).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrRefreshTokenInvalid)
+		span.SetStatus(codes.Error, ErrRefreshTokenInvalid.Error())
+		return ErrRefreshTokenInvalid
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetAttributes(
+		attribute.String("FamilyId", current.FamilyId),
+	)
+
+	if err := revokeRefreshTokens(db.WithContext(trContext).Where("family_id = ?", current.FamilyId), time.Now().UTC()); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RevokeRefreshTokenFamily successfully", RefreshTokenRepositoryName))
+
+	return nil
+}
+
+// RevokeUserRefreshTokens closes every session of the user
+func RevokeUserRefreshTokens(userId string, ctx context.Context) error {
+	tr := otel.Tracer(RefreshTokenRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RevokeUserRefreshTokens", RefreshTokenRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	if err := revokeRefreshTokens(db.WithContext(trContext).Where("user_uuid = ?", userId), time.Now().UTC()); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RevokeUserRefreshTokens successfully", RefreshTokenRepositoryName))
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"time"
+	"errors"
+	"testing"
+
+	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+// A rotation passes the expiration of the token it uses, the next one can't
+// outlive the session
+func TestNewRefreshTokenKeepsTheExpiration(t *testing.T) {
+	expiresAt := time.Now().UTC().Add(time.Hour)
+
+	token, refreshToken, err := newRefreshToken("user-1", "family-1", expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !refreshToken.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expires at %s, want %s", refreshToken.ExpiresAt, expiresAt)
+	}
+
+	if refreshToken.TokenHash != tools.HashToken(token) {
+		t.Fatalf("stores %s, want the hash of the token", refreshToken.TokenHash)
+	}
+
+	if refreshToken.FamilyId != "family-1" || refreshToken.UserUuid != "user-1" {
+		t.Fatalf("left the family: %+v", refreshToken)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	now := time.Now().UTC()
+	before := now.Add(-time.Minute)
+	replacement := "token-0"
+
+	token := func(change func(token *dao.RefreshToken)) dao.RefreshToken {
+		current := dao.RefreshToken{
+			Uuid: "token-1",
+			UserUuid: "user-1",
+			FamilyId: "family-1",
+			ExpiresAt: now.Add(time.Hour),
+		}
+
+		change(&current)
+		return current
+	}
+
+	cases := []struct {
+		name string
+		current dao.RefreshToken
+		revokeFamily bool
+		err error
+	}{
+		{"unused token rotates", token(func(token *dao.RefreshToken) {}), false, nil},
+		{"token expiring right now rotates", token(func(token *dao.RefreshToken) { token.ExpiresAt = now }), false, nil},
+		{"expired token", token(func(token *dao.RefreshToken) { token.ExpiresAt = before }), false, ErrRefreshTokenExpired},
+		{"used token revokes the family", token(func(token *dao.RefreshToken) { token.UsedAt = &before; token.ReplacedBy = &replacement }), true, ErrRefreshTokenReused},
+		{"revoked token revokes the family", token(func(token *dao.RefreshToken) { token.RevokedAt = &before }), true, ErrRefreshTokenReused},
+		{"expired reuse still revokes the family", token(func(token *dao.RefreshToken) { token.UsedAt = &before; token.ExpiresAt = before }), true, ErrRefreshTokenReused},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rotation := rotateRefreshToken(c.current, now)
+
+			if rotation.revokeFamily != c.revokeFamily {
+				t.Fatalf("revokeFamily = %t, want %t", rotation.revokeFamily, c.revokeFamily)
+			}
+
+			if !errors.Is(rotation.err, c.err) {
+				t.Fatalf("err = %v, want %v", rotation.err, c.err)
+			}
+
+			if c.err != nil {
+				if rotation.plain != "" || rotation.used != nil {
+					t.Fatalf("a failed rotation issued a token: %+v", rotation)
+				}
+				return
+			}
+
+			next := rotation.next
+			if next.FamilyId != c.current.FamilyId || next.UserUuid != c.current.UserUuid || !next.ExpiresAt.Equal(c.current.ExpiresAt) {
+				t.Fatalf("next token left the session: %+v", next)
+			}
+
+			if next.TokenHash != tools.HashToken(rotation.plain) || next.Uuid == c.current.Uuid {
+				t.Fatalf("next token isn't a new token: %+v", next)
+			}
+
+			if rotation.used["used_at"] != now || rotation.used["replaced_by"] != next.Uuid {
+				t.Fatalf("current token update = %v", rotation.used)
+			}
+		})
+	}
+}
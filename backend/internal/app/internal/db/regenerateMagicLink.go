@@ -4,10 +4,9 @@ package db
 import (
 	"errors"
 	"context"
-	"time"
 
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
 	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
-	"github.com/OscarVillanueva/goapi/internal/app/tools"
 	"github.com/OscarVillanueva/goapi/internal/platform"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -16,7 +15,9 @@ import (
 	"gorm.io/gorm"
 )
 
-func RegenerateMagicLink(ctx context.Context, uuid string, magic *dao.Magic) error  {
+// RegenerateMagicLink replaces the code of the user and enqueues it in the
+// same transaction, the code verifies a new account or signs in a verified one
+func RegenerateMagicLink(ctx context.Context, user dao.User, locale string, magic *dao.Magic) error  {
 	tr := otel.Tracer(PurchaseRepositoryName)
 	trContext, span := tr.Start(ctx, "RegenerateMagicLink")
 	defer span.End()
@@ -30,8 +31,11 @@ func RegenerateMagicLink(ctx context.Context, uuid string, magic *dao.Magic) err
 		return dbErr
 	}
 
+	uuid := user.Uuid
+
 	err := db.WithContext(trContext).Transaction(func (tx *gorm.DB) error  {
-		if userError := tx.Where("belongs_to = (?)", uuid).Delete(&dao.Magic{}).Error; userError != nil {
+		userError := tx.Where("belongs_to = (?) AND purpose <> ?", uuid, dao.MagicPurposeChangeEmail).Delete(&dao.Magic{}).Error
+		if userError != nil {
 			span.SetAttributes(
 				attribute.String("MagicUuid", uuid),
 			)
@@ -40,24 +44,42 @@ func RegenerateMagicLink(ctx context.Context, uuid string, magic *dao.Magic) err
 			return userError
 		}
 
-		token := tools.GenerateSecureToken(3)
-
-		*magic = dao.Magic {
-			Token: token,
-			ExpirationDate: time.Now().UTC().Add(15 * time.Minute),
-			BelongsTo: uuid,
+		template, purpose := emails.Verification, dao.MagicPurposeVerify
+		if user.Verified {
+			template, purpose = emails.Login, dao.MagicPurposeLogin
 		}
 
-		if magicError := tx.Create(&magic).Error; magicError != nil {
+		created, link, magicError := newMagicLink(tx, user, purpose, "")
+		if magicError != nil {
 			span.SetAttributes(
-				attribute.String("Token", magic.Token),
-				attribute.String("BelongsTo", magic.BelongsTo),
+				attribute.String("Token", created.Token),
+				attribute.String("BelongsTo", created.BelongsTo),
 			)
 			span.RecordError(magicError)
 			span.SetStatus(codes.Error, magicError.Error())
 			return magicError
 		}
 
+		*magic = created
+
+		code := emails.CodeData{
+			Name: user.Name,
+			Code: magic.Token,
+			Link: link,
+			ExpiresInMinutes: int(MagicLinkTTL.Minutes()),
+		}
+
+		email, err := emails.Compose(template, locale, []string{user.Email}, code)
+		if err != nil {
+			return err
+		}
+
+		if err := enqueueEmail(tx, template, email); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
 		return nil
 	})
 
@@ -0,0 +1,742 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrReviewNotFound = errors.New("Review Not Found")
+var ErrReviewExists = errors.New("You already reviewed this product")
+var ErrNotVerifiedPurchase = errors.New("Only buyers of the product can review it")
+var ErrNotReviewAuthor = errors.New("Only the author can change the review")
+var ErrNotProductSeller = errors.New("Only the seller of the product can reply")
+var ErrOwnReviewFlag = errors.New("You can't flag your own review")
+var ErrReviewAlreadyFlagged = errors.New("You already flagged this review")
+var ErrReviewImagesFull = errors.New("A review can't have more than 4 images")
+
+const ReviewRepositoryName = "review-repository"
+
+const (
+	ReviewsNewestFirst = "newest"
+	ReviewsOldestFirst = "oldest"
+	ReviewsBestRated = "rating"
+)
+
+// reviewFlagThreshold is how many reports hide a review until it's moderated
+const reviewFlagThreshold = 3
+
+const maxReviewImages = 4
+
+func FetchReviews(productId string, page int, sort string, ctx context.Context) (*requests.ReviewsResponse, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchReviews", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ProductUuid", productId),
+		attribute.String("Sort", sort),
+	)
+
+	var product dao.Product
+	err := db.WithContext(trContext).Where("uuid = ?", productId).First(&product).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrProductNotFound)
+		span.SetStatus(codes.Error, ErrProductNotFound.Error())
+		return nil, ErrProductNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	limit := 30
+	offset := (page - 1) * limit
+
+	query := db.WithContext(trContext).Model(&dao.Review{}).Where("product = ? AND status = ?", productId, dao.ReviewPublished)
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	order := "created_at DESC, uuid"
+	switch sort {
+		case ReviewsOldestFirst:
+			order = "created_at, uuid"
+		case ReviewsBestRated:
+			order = "rating DESC, created_at DESC, uuid"
+	}
+
+	reviews := make([]dao.Review, 0)
+	if err := query.Order(order).Limit(limit).Offset(offset).Find(&reviews).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	views, err := attachReviewDetails(db.WithContext(trContext), reviews)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchReviews successfully", ReviewRepositoryName))
+
+	response := requests.ReviewsResponse{
+		Reviews: views,
+		RatingAverage: product.RatingAverage,
+		RatingCount: product.RatingCount,
+		PageSize: limit,
+		Pages: int(math.Ceil(float64(count) / float64(limit))),
+	}
+
+	return &response, nil
+}
+
+func FetchReview(reviewId string, productId string, ctx context.Context) (*dao.Review, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchReview", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("ProductUuid", productId),
+	)
+
+	review, err := findReview(db.WithContext(trContext), reviewId, productId)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return review, nil
+}
+
+// CreateReview only accepts buyers with a paid ticket that contains the
+// product, the rating of the product changes in the same transaction
+func CreateReview(productId string, author string, data *requests.SaveReview, ctx context.Context) (*dao.Review, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateReview", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	review := dao.Review{
+		Uuid: uuid.New().String(),
+		Product: productId,
+		Author: author,
+		Rating: data.Rating,
+		Title: data.Title,
+		Body: data.Body,
+		Status: dao.ReviewPublished,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", review.Uuid),
+		attribute.String("ProductUuid", productId),
+		attribute.String("Author", author),
+		attribute.Int("Rating", int(data.Rating)),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := lockReviewedProduct(tx, productId); err != nil {
+			return err
+		}
+
+		var purchases int64
+		err := tx.Table("purchases").
+			Joins("JOIN tickets ON tickets.uuid = purchases.ticket_id").
+			Where("purchases.product = ? AND purchases.purchased_by = ? AND tickets.status = ?", productId, author, dao.TicketPaid).
+			Count(&purchases).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		if purchases == 0 {
+			return ErrNotVerifiedPurchase
+		}
+
+		var reviews int64
+		if err := tx.Model(&dao.Review{}).Where("product = ? AND author = ?", productId, author).Count(&reviews).Error; err != nil {
+			return err
+		}
+
+		if reviews > 0 {
+			return ErrReviewExists
+		}
+
+		if err := tx.Create(&review).Error; err != nil {
+			return err
+		}
+
+		return adjustProductRating(tx, productId, int64(review.Rating), 1)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreateReview successfully", ReviewRepositoryName))
+
+	return &review, nil
+}
+
+func UpdateReview(reviewId string, productId string, author string, data *requests.SaveReview, ctx context.Context) (*dao.Review, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UpdateReview", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("ProductUuid", productId),
+		attribute.Int("Rating", int(data.Rating)),
+	)
+
+	var review *dao.Review
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := lockReviewedProduct(tx, productId); err != nil {
+			return err
+		}
+
+		var err error
+		if review, err = findReview(tx, reviewId, productId); err != nil {
+			return err
+		}
+
+		if review.Author != author {
+			return ErrNotReviewAuthor
+		}
+
+		delta := int64(data.Rating - review.Rating)
+		now := time.Now().UTC()
+
+		review.Rating = data.Rating
+		review.Title = data.Title
+		review.Body = data.Body
+		review.UpdatedAt = &now
+
+		updatedReview := map[string]interface{}{
+			"rating": review.Rating,
+			"title": review.Title,
+			"body": review.Body,
+			"updated_at": now,
+		}
+
+		if err := tx.Model(&dao.Review{}).Where("uuid = ?", review.Uuid).Updates(updatedReview).Error; err != nil {
+			return err
+		}
+
+		if review.Status != dao.ReviewPublished {
+			return nil
+		}
+
+		return adjustProductRating(tx, productId, delta, 0)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UpdateReview successfully", ReviewRepositoryName))
+
+	return review, nil
+}
+
+// DeleteReview returns the object names of the images so they can be removed
+// from the bucket once the rows are gone
+func DeleteReview(reviewId string, productId string, author string, ctx context.Context) ([]string, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteReview", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("ProductUuid", productId),
+	)
+
+	objects := make([]string, 0)
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := lockReviewedProduct(tx, productId); err != nil {
+			return err
+		}
+
+		review, err := findReview(tx, reviewId, productId)
+		if err != nil {
+			return err
+		}
+
+		if review.Author != author {
+			return ErrNotReviewAuthor
+		}
+
+		images := make([]dao.ReviewImage, 0)
+		if err := tx.Where("review_id = ?", review.Uuid).Find(&images).Error; err != nil {
+			return err
+		}
+
+		for _, image := range images {
+			objects = append(objects, image.ObjectName)
+		}
+
+		if err := tx.Where("review_id = ?", review.Uuid).Delete(&dao.ReviewImage{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("review_id = ?", review.Uuid).Delete(&dao.ReviewFlag{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("uuid = ?", review.Uuid).Delete(&dao.Review{}).Error; err != nil {
+			return err
+		}
+
+		if review.Status != dao.ReviewPublished {
+			return nil
+		}
+
+		return adjustProductRating(tx, productId, -int64(review.Rating), -1)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.DeleteReview successfully", ReviewRepositoryName))
+
+	return objects, nil
+}
+
+func AddReviewImage(reviewId string, author string, objectName string, url string, ctx context.Context) (*dao.ReviewImage, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.AddReviewImage", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	image := dao.ReviewImage{
+		Uuid: uuid.New().String(),
+		ReviewId: reviewId,
+		ObjectName: objectName,
+		Url: url,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("ImageUuid", image.Uuid),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var review dao.Review
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", reviewId).First(&review).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrReviewNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if review.Author != author {
+			return ErrNotReviewAuthor
+		}
+
+		var images int64
+		if err := tx.Model(&dao.ReviewImage{}).Where("review_id = ?", reviewId).Count(&images).Error; err != nil {
+			return err
+		}
+
+		if images >= maxReviewImages {
+			return ErrReviewImagesFull
+		}
+
+		return tx.Create(&image).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.AddReviewImage successfully", ReviewRepositoryName))
+
+	return &image, nil
+}
+
+// RemoveReviewImage returns the object name of the deleted image
+func RemoveReviewImage(imageId string, reviewId string, author string, ctx context.Context) (string, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RemoveReviewImage", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return "", dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("ImageUuid", imageId),
+	)
+
+	var image dao.ReviewImage
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		err := tx.Table("review_images").
+			Select("review_images.*").
+			Joins("JOIN reviews ON reviews.uuid = review_images.review_id").
+			Where("review_images.uuid = ? AND review_images.review_id = ? AND reviews.author = ?", imageId, reviewId, author).
+			Take(&image).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrReviewNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("uuid = ?", image.Uuid).Delete(&dao.ReviewImage{}).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RemoveReviewImage successfully", ReviewRepositoryName))
+
+	return image.ObjectName, nil
+}
+
+// ReplyToReview sets or removes, with a nil reply, the answer of the seller
+func ReplyToReview(reviewId string, productId string, seller string, reply *string, ctx context.Context) error {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.ReplyToReview", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("ProductUuid", productId),
+		attribute.String("Seller", seller),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var product dao.Product
+		err := tx.Where("uuid = ?", productId).First(&product).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrProductNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if product.BelongsTo != seller {
+			return ErrNotProductSeller
+		}
+
+		if _, err := findReview(tx, reviewId, productId); err != nil {
+			return err
+		}
+
+		var repliedAt *time.Time
+		if reply != nil {
+			now := time.Now().UTC()
+			repliedAt = &now
+		}
+
+		replied := map[string]interface{}{
+			"reply": reply,
+			"replied_at": repliedAt,
+		}
+
+		return tx.Model(&dao.Review{}).Where("uuid = ?", reviewId).Updates(replied).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.ReplyToReview successfully", ReviewRepositoryName))
+
+	return nil
+}
+
+// FlagReview records the report and hides the review when it reaches the
+// threshold, hidden reviews don't count in the rating of the product
+func FlagReview(reviewId string, productId string, reporter string, reason string, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(ReviewRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FlagReview", ReviewRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return false, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ReviewUuid", reviewId),
+		attribute.String("Reporter", reporter),
+		attribute.String("Reason", reason),
+	)
+
+	hidden := false
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := lockReviewedProduct(tx, productId); err != nil {
+			return err
+		}
+
+		review, err := findReview(tx.Clauses(clause.Locking{Strength: "UPDATE"}), reviewId, productId)
+		if err != nil {
+			return err
+		}
+
+		if review.Author == reporter {
+			return ErrOwnReviewFlag
+		}
+
+		var flags int64
+		if err := tx.Model(&dao.ReviewFlag{}).Where("review_id = ? AND reporter = ?", reviewId, reporter).Count(&flags).Error; err != nil {
+			return err
+		}
+
+		if flags > 0 {
+			return ErrReviewAlreadyFlagged
+		}
+
+		flag := dao.ReviewFlag{
+			Uuid: uuid.New().String(),
+			ReviewId: reviewId,
+			Reporter: reporter,
+			Reason: reason,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		if err := tx.Create(&flag).Error; err != nil {
+			return err
+		}
+
+		flagged := map[string]interface{}{
+			"flag_count": review.FlagCount + 1,
+		}
+
+		hidden = review.Status == dao.ReviewPublished && review.FlagCount + 1 >= reviewFlagThreshold
+		if hidden {
+			flagged["status"] = dao.ReviewHidden
+		}
+
+		if err := tx.Model(&dao.Review{}).Where("uuid = ?", reviewId).Updates(flagged).Error; err != nil {
+			return err
+		}
+
+		if !hidden {
+			return nil
+		}
+
+		return adjustProductRating(tx, productId, -int64(review.Rating), -1)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	span.SetAttributes(
+		attribute.Bool("Hidden", hidden),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FlagReview successfully", ReviewRepositoryName))
+
+	return hidden, nil
+}
+
+// adjustProductRating moves the rating of the product by a delta instead of
+// recomputing it. MySQL evaluates the assignments from left to right, so the
+// average already sees the new sum and count
+func adjustProductRating(tx *gorm.DB, productId string, sum int64, count int32) error {
+	return tx.Exec(
+		"UPDATE products SET rating_sum = rating_sum + ?, rating_count = rating_count + ?, rating_average = IF(rating_count = 0, 0, rating_sum / rating_count) WHERE uuid = ?",
+		sum, count, productId,
+	).Error
+}
+
+// lockReviewedProduct serializes the changes to the rating of a product
+func lockReviewedProduct(tx *gorm.DB, productId string) (*dao.Product, error) {
+	var product dao.Product
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", productId).First(&product).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrProductNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &product, nil
+}
+
+func findReview(db *gorm.DB, reviewId string, productId string) (*dao.Review, error) {
+	var review dao.Review
+	err := db.Where("uuid = ? AND product = ?", reviewId, productId).First(&review).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrReviewNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &review, nil
+}
+
+func attachReviewDetails(db *gorm.DB, reviews []dao.Review) ([]requests.ReviewView, error) {
+	views := make([]requests.ReviewView, 0, len(reviews))
+	if len(reviews) == 0 {
+		return views, nil
+	}
+
+	ids := make([]string, 0, len(reviews))
+	authorIDs := make([]string, 0, len(reviews))
+	for _, review := range reviews {
+		ids = append(ids, review.Uuid)
+		authorIDs = append(authorIDs, review.Author)
+	}
+
+	images := make([]dao.ReviewImage, 0)
+	if err := db.Where("review_id IN ?", ids).Order("created_at, uuid").Find(&images).Error; err != nil {
+		return nil, err
+	}
+
+	authors := make([]dao.User, 0)
+	if err := db.Where("uuid IN ?", authorIDs).Find(&authors).Error; err != nil {
+		return nil, err
+	}
+
+	imagesByReview := map[string][]dao.ReviewImage{}
+	for _, image := range images {
+		imagesByReview[image.ReviewId] = append(imagesByReview[image.ReviewId], image)
+	}
+
+	names := map[string]string{}
+	for _, author := range authors {
+		names[author.Uuid] = author.Name
+	}
+
+	for _, review := range reviews {
+		reviewImages := imagesByReview[review.Uuid]
+		if reviewImages == nil {
+			reviewImages = make([]dao.ReviewImage, 0)
+		}
+
+		views = append(views, requests.ReviewView{
+			Review: review,
+			AuthorName: names[review.Author],
+			Images: reviewImages,
+		})
+	}
+
+	return views, nil
+}
@@ -0,0 +1,349 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrRoleNotFound = errors.New("Role Not Found")
+var ErrRoleUserNotFound = errors.New("User Not Found")
+var ErrUserRoleNotFound = errors.New("The user doesn't have the role")
+var ErrLastAdmin = errors.New("The last admin can't lose the admin role")
+var ErrAdminExists = errors.New("There is already an admin")
+
+const RoleRepositoryName = "role-repository"
+
+func FetchRoles(ctx context.Context) ([]dao.Role, error) {
+	tr := otel.Tracer(RoleRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchRoles", RoleRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	roles := make([]dao.Role, 0)
+	if err := db.WithContext(trContext).Order("name").Find(&roles).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	grants := make([]dao.RolePermission, 0)
+	if err := db.WithContext(trContext).Order("role, permission").Find(&grants).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	permissions := map[string][]string{}
+	for _, grant := range grants {
+		permissions[grant.Role] = append(permissions[grant.Role], grant.Permission)
+	}
+
+	for i := range roles {
+		roles[i].Permissions = permissions[roles[i].Name]
+		if roles[i].Permissions == nil {
+			roles[i].Permissions = []string{}
+		}
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchRoles successfully", RoleRepositoryName))
+
+	return roles, nil
+}
+
+// FetchUserAccess returns the roles of the user and the permissions of all of
+// them without repeats, both go in the access token
+func FetchUserAccess(userId string, ctx context.Context) ([]string, []string, error) {
+	tr := otel.Tracer(RoleRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchUserAccess", RoleRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	roles := make([]string, 0)
+	err := db.WithContext(trContext).
+		Model(&dao.UserRole{}).
+		Where("user_uuid = ?", userId).
+		Order("role").
+		Pluck("role", &roles).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, nil, err
+	}
+
+	permissions := make([]string, 0)
+	if len(roles) > 0 {
+		err = db.WithContext(trContext).
+			Model(&dao.RolePermission{}).
+			Distinct("permission").
+			Where("role IN ?", roles).
+			Order("permission").
+			Pluck("permission", &permissions).
+			Error
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, nil, err
+		}
+	}
+
+	return roles, permissions, nil
+}
+
+func FetchUserRoles(userId string, ctx context.Context) ([]dao.UserRole, error) {
+	tr := otel.Tracer(RoleRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchUserRoles", RoleRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	if err := ensureUserExists(db.WithContext(trContext), userId); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	userRoles := make([]dao.UserRole, 0)
+	err := db.WithContext(trContext).Where("user_uuid = ?", userId).Order("role").Find(&userRoles).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return userRoles, nil
+}
+
+// AssignRole gives the role to the user, assigning a role that the user
+// already has keeps the first assignment
+func AssignRole(userId string, role string, assignedBy string, ctx context.Context) (*dao.UserRole, error) {
+	tr := otel.Tracer(RoleRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.AssignRole", RoleRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+		attribute.String("Role", role),
+		attribute.String("AssignedBy", assignedBy),
+	)
+
+	var userRole dao.UserRole
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := ensureUserExists(tx, userId); err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&dao.Role{}).Where("name = ?", role).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count == 0 {
+			return ErrRoleNotFound
+		}
+
+		userRole = dao.UserRole{
+			UserUuid: userId,
+			Role: role,
+			AssignedBy: &assignedBy,
+			CreatedAt: time.Now().UTC(),
+		}
+
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&userRole).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("user_uuid = ? AND role = ?", userId, role).First(&userRole).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.AssignRole successfully", RoleRepositoryName))
+
+	return &userRole, nil
+}
+
+func RevokeRole(userId string, role string, ctx context.Context) error {
+	tr := otel.Tracer(RoleRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RevokeRole", RoleRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+		attribute.String("Role", role),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		// The admins are locked so two admins can't remove each other at the
+		// same time
+		if role == dao.RoleAdmin {
+			admins := make([]dao.UserRole, 0)
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("role = ?", dao.RoleAdmin).
+				Find(&admins).
+				Error
+
+			if err != nil {
+				return err
+			}
+
+			if len(admins) == 1 && admins[0].UserUuid == userId {
+				return ErrLastAdmin
+			}
+		}
+
+		result := tx.Where("user_uuid = ? AND role = ?", userId, role).Delete(&dao.UserRole{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrUserRoleNotFound
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RevokeRole successfully", RoleRepositoryName))
+
+	return nil
+}
+
+// BootstrapAdmin makes the user the first admin, it fails once any user has
+// the admin role
+func BootstrapAdmin(userId string, ctx context.Context) error {
+	tr := otel.Tracer(RoleRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.BootstrapAdmin", RoleRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("UserUuid", userId),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		admins := make([]dao.UserRole, 0)
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("role = ?", dao.RoleAdmin).
+			Limit(1).
+			Find(&admins).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		if len(admins) > 0 {
+			return ErrAdminExists
+		}
+
+		return tx.Create(&dao.UserRole{
+			UserUuid: userId,
+			Role: dao.RoleAdmin,
+			CreatedAt: time.Now().UTC(),
+		}).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.BootstrapAdmin successfully", RoleRepositoryName))
+
+	return nil
+}
+
+func ensureUserExists(tx *gorm.DB, userId string) error {
+	var count int64
+	if err := tx.Model(&dao.User{}).Where("uuid = ?", userId).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrRoleUserNotFound
+	}
+
+	return nil
+}
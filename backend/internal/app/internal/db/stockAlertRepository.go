@@ -0,0 +1,282 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrSellerWebhookNotFound = errors.New("Webhook Not Found")
+var ErrSellerWebhooksFull = errors.New("You can't register more webhooks")
+
+const StockAlertRepositoryName = "stock-alert-repository"
+
+const maxSellerWebhooks = 10
+
+func FetchStockAlertSettings(seller string, ctx context.Context) (*dao.SellerSettings, error) {
+	tr := otel.Tracer(StockAlertRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchStockAlertSettings", StockAlertRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Seller", seller),
+	)
+
+	// Sellers without settings get the empty defaults
+	settings := dao.SellerSettings{Seller: seller}
+	err := db.WithContext(trContext).Where("seller = ?", seller).Limit(1).Find(&settings).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return &settings, nil
+}
+
+func SaveStockAlertSettings(seller string, data *requests.SaveStockAlertSettings, ctx context.Context) (*dao.SellerSettings, error) {
+	tr := otel.Tracer(StockAlertRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.SaveStockAlertSettings", StockAlertRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Seller", seller),
+	)
+
+	now := time.Now().UTC()
+	settings := dao.SellerSettings{
+		Seller: seller,
+		LowStockThreshold: data.LowStockThreshold,
+		UpdatedAt: &now,
+	}
+
+	err := db.WithContext(trContext).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "seller"}},
+		DoUpdates: clause.AssignmentColumns([]string{"low_stock_threshold", "updated_at"}),
+	}).Create(&settings).Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.SaveStockAlertSettings successfully", StockAlertRepositoryName))
+
+	return &settings, nil
+}
+
+func FetchSellerWebhooks(seller string, ctx context.Context) ([]dao.SellerWebhook, error) {
+	tr := otel.Tracer(StockAlertRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchSellerWebhooks", StockAlertRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Seller", seller),
+	)
+
+	webhooks := make([]dao.SellerWebhook, 0)
+	err := db.WithContext(trContext).Where("seller = ?", seller).Order("created_at, uuid").Find(&webhooks).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func CreateSellerWebhook(seller string, data *requests.CreateSellerWebhook, ctx context.Context) (*requests.SellerWebhookCreated, error) {
+	tr := otel.Tracer(StockAlertRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateSellerWebhook", StockAlertRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Seller", seller),
+		attribute.String("Url", data.Url),
+	)
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	webhook := dao.SellerWebhook{
+		Uuid: uuid.New().String(),
+		Seller: seller,
+		Url: data.Url,
+		Secret: hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&dao.SellerWebhook{}).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("seller = ?", seller).
+			Count(&count).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		if count >= maxSellerWebhooks {
+			return ErrSellerWebhooksFull
+		}
+
+		return tx.Create(&webhook).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreateSellerWebhook successfully", StockAlertRepositoryName))
+
+	return &requests.SellerWebhookCreated{
+		SellerWebhook: webhook,
+		Secret: webhook.Secret,
+	}, nil
+}
+
+func DeleteSellerWebhook(webhookId string, seller string, ctx context.Context) error {
+	tr := otel.Tracer(StockAlertRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteSellerWebhook", StockAlertRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WebhookUuid", webhookId),
+		attribute.String("Seller", seller),
+	)
+
+	result := db.WithContext(trContext).Where("uuid = ? AND seller = ?", webhookId, seller).Delete(&dao.SellerWebhook{})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		span.SetStatus(codes.Error, result.Error.Error())
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		span.RecordError(ErrSellerWebhookNotFound)
+		span.SetStatus(codes.Error, ErrSellerWebhookNotFound.Error())
+		return ErrSellerWebhookNotFound
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.DeleteSellerWebhook successfully", StockAlertRepositoryName))
+
+	return nil
+}
+
+// sellerThresholds returns the default low stock threshold of the sellers
+// that configured one
+func sellerThresholds(tx *gorm.DB, sellers []string) (map[string]int32, error) {
+	thresholds := map[string]int32{}
+	if len(sellers) == 0 {
+		return thresholds, nil
+	}
+
+	settings := make([]dao.SellerSettings, 0, len(sellers))
+	err := tx.Where("seller IN ? AND low_stock_threshold IS NOT NULL", sellers).Find(&settings).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, setting := range settings {
+		thresholds[setting.Seller] = *setting.LowStockThreshold
+	}
+
+	return thresholds, nil
+}
+
+// stockAlert checks if a sale crossed the threshold of the product, only the
+// sale that crosses it raises an alert
+func stockAlert(product dao.Product, quantity int32, defaults map[string]int32) *requests.StockAlert {
+	threshold, ok := defaults[product.BelongsTo]
+	if product.LowStockThreshold != nil {
+		threshold, ok = *product.LowStockThreshold, true
+	}
+
+	alert := requests.StockAlert{
+		Product: product.Uuid,
+		Name: product.Name,
+		Seller: product.BelongsTo,
+		Quantity: quantity,
+		Threshold: threshold,
+		At: time.Now().UTC(),
+	}
+
+	switch {
+		case quantity == 0 && product.Quantity > 0:
+			alert.Kind = requests.StockAlertOut
+		case ok && quantity < threshold && product.Quantity >= threshold:
+			alert.Kind = requests.StockAlertLow
+		default:
+			return nil
+	}
+
+	return &alert
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const StockMovementRepositoryName = "stock-movement-repository"
+
+// recordStockMovement appends a row to the ledger, it has to receive the
+// transaction that changed the quantity of the product
+func recordStockMovement(tx *gorm.DB, product string, delta int32, resulting int32, reason string, reference *string, actor string, span trace.Span) error {
+	if delta == 0 {
+		return nil
+	}
+
+	movement := dao.StockMovement{
+		Uuid: uuid.New().String(),
+		Product: product,
+		Delta: delta,
+		ResultingQuantity: resulting,
+		Reason: reason,
+		ReferenceId: reference,
+		Actor: actor,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := tx.Create(&movement).Error; err != nil {
+		span.SetAttributes(
+			attribute.String("ProductUuid", product),
+			attribute.Int("Delta", int(delta)),
+			attribute.String("Reason", reason),
+		)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, fmt.Sprintf("Unable to record the stock movement of: %s", product))
+		return err
+	}
+
+	return nil
+}
+
+func FetchStockMovements(productId string, seller string, page int, ctx context.Context) (*requests.StockMovementsResponse, error) {
+	tr := otel.Tracer(StockMovementRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchStockMovements", StockMovementRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("ProductUuid", productId),
+		attribute.String("Seller", seller),
+	)
+
+	if _, err := GetProduct(seller, productId, trContext); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	limit := 50
+	offset := (page - 1) * limit
+
+	query := db.WithContext(trContext).Model(&dao.StockMovement{}).Where("product = ?", productId)
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	movements := make([]dao.StockMovement, 0)
+	err := query.Order("created_at DESC, uuid").Limit(limit).Offset(offset).Find(&movements).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchStockMovements successfully", StockMovementRepositoryName))
+
+	response := requests.StockMovementsResponse{
+		Movements: movements,
+		PageSize: limit,
+		Pages: int(math.Ceil(float64(count) / float64(limit))),
+	}
+
+	return &response, nil
+}
+
+// ReconcileStock compares the quantity column of every product with the sum
+// of its ledger and returns the products where they don't match
+func ReconcileStock(ctx context.Context) ([]requests.StockDrift, error) {
+	tr := otel.Tracer(StockMovementRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.ReconcileStock", StockMovementRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	drifts := make([]requests.StockDrift, 0)
+	err := db.WithContext(trContext).
+		Table("products").
+		Select("products.uuid AS product, products.name, products.quantity, COALESCE(ledger.total, 0) AS ledger_quantity, products.quantity - COALESCE(ledger.total, 0) AS drift").
+		Joins("LEFT JOIN (SELECT product, SUM(delta) AS total FROM stock_movements GROUP BY product) ledger ON ledger.product = products.uuid").
+		Where("products.quantity <> COALESCE(ledger.total, 0)").
+		Order("products.uuid").
+		Scan(&drifts).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Drifts", len(drifts)),
+	)
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.ReconcileStock successfully", StockMovementRepositoryName))
+
+	return drifts, nil
+}
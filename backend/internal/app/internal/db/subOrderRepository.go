@@ -0,0 +1,317 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/parameters"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm"
+)
+
+var ErrSubOrderNotFound = errors.New("Order Not Found")
+var ErrSubOrderCancelled = errors.New("The order was cancelled")
+var ErrFulfillmentBackwards = errors.New("The fulfillment can't go back to a previous status")
+var ErrOrderNotPaid = errors.New("The order isn't paid yet")
+
+const SubOrderRepositoryName = "sub-order-repository"
+
+func FetchTicketSubOrders(ticketId string, ctx context.Context) ([]dao.SubOrder, error) {
+	tr := otel.Tracer(SubOrderRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchTicketSubOrders", SubOrderRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("TicketId", ticketId),
+	)
+
+	subOrders := make([]dao.SubOrder, 0)
+	err := db.WithContext(trContext).
+		Where("ticket_id = ?", ticketId).
+		Order("created_at, uuid").
+		Find(&subOrders).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return subOrders, err
+}
+
+func FetchSellerOrders(params parameters.GetSellerOrdersParams) (*requests.SellerOrdersResponse, error) {
+	tr := otel.Tracer(SubOrderRepositoryName)
+	ctx, span := tr.Start(params.Context, fmt.Sprintf("%s.FetchSellerOrders", SubOrderRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	limit := 30
+	offset := (params.Page - 1) * limit
+
+	span.SetAttributes(
+		attribute.String("Seller", params.Seller),
+	)
+
+	query := db.WithContext(ctx).Model(&dao.SubOrder{}).Where("seller = ?", params.Seller)
+
+	if params.Status != "" {
+		query = query.Where("status = ?", params.Status)
+		span.SetAttributes(
+			attribute.String("Status", params.Status),
+		)
+	}
+
+	if params.FulfillmentStatus != "" {
+		query = query.Where("fulfillment_status = ?", params.FulfillmentStatus)
+		span.SetAttributes(
+			attribute.String("FulfillmentStatus", params.FulfillmentStatus),
+		)
+	}
+
+	var count int64
+	if err := query.Session(&gorm.Session{}).Count(&count).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	subOrders := make([]dao.SubOrder, 0)
+	err := query.Order("created_at DESC, uuid").Limit(limit).Offset(offset).Find(&subOrders).Error
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	orders, err := attachSellerOrderLines(db.WithContext(ctx), subOrders)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchSellerOrders successfully", SubOrderRepositoryName))
+
+	response := requests.SellerOrdersResponse{
+		Orders: orders,
+		PageSize: limit,
+		Pages: int(math.Ceil(float64(count) / float64(limit))),
+	}
+
+	return &response, nil
+}
+
+func FetchSellerOrder(orderId string, seller string, ctx context.Context) (*requests.SellerOrder, error) {
+	tr := otel.Tracer(SubOrderRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchSellerOrder", SubOrderRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("SubOrderUuid", orderId),
+		attribute.String("Seller", seller),
+	)
+
+	var subOrder dao.SubOrder
+	err := db.WithContext(trContext).Where("uuid = ? AND seller = ?", orderId, seller).First(&subOrder).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrSubOrderNotFound)
+		span.SetStatus(codes.Error, ErrSubOrderNotFound.Error())
+		return nil, ErrSubOrderNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	orders, err := attachSellerOrderLines(db.WithContext(trContext), []dao.SubOrder{subOrder})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return &orders[0], nil
+}
+
+func UpdateFulfillment(orderId string, seller string, fulfillment *requests.UpdateFulfillment, ctx context.Context) error {
+	tr := otel.Tracer(SubOrderRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UpdateFulfillment", SubOrderRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("SubOrderUuid", orderId),
+		attribute.String("Seller", seller),
+		attribute.String("FulfillmentStatus", fulfillment.Status),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		var subOrder dao.SubOrder
+		err := tx.Select("uuid", "ticket_id").
+			Where("uuid = ? AND seller = ?", orderId, seller).
+			First(&subOrder).
+			Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSubOrderNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// The ticket is locked before the sub order like when it's closed, a
+		// cancellation or a failed payment waits for the shipment or the other
+		// way around
+		var ticket dao.Ticket
+		err = tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Select("uuid", "status").
+			Where("uuid = ?", subOrder.TicketId).
+			First(&ticket).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("uuid = ?", subOrder.Uuid).
+			First(&subOrder).
+			Error
+
+		if err != nil {
+			return err
+		}
+
+		if subOrder.Status == dao.SubOrderCancelled {
+			return ErrSubOrderCancelled
+		}
+
+		// Nothing leaves the warehouse before the payment is captured
+		if ticket.Status != dao.TicketPaid {
+			return ErrOrderNotPaid
+		}
+
+		if !dao.CanAdvanceFulfillment(subOrder.FulfillmentStatus, fulfillment.Status) {
+			return ErrFulfillmentBackwards
+		}
+
+		now := time.Now().UTC()
+		updatedOrder := map[string]interface{}{
+			"fulfillment_status": fulfillment.Status,
+			"updated_at": now,
+		}
+
+		if fulfillment.TrackingNumber != nil {
+			updatedOrder["tracking_number"] = *fulfillment.TrackingNumber
+		}
+
+		if fulfillment.Status == dao.FulfillmentDelivered && subOrder.FulfillmentStatus != dao.FulfillmentDelivered {
+			updatedOrder["fulfilled_at"] = now
+		}
+
+		return tx.Model(&subOrder).Where("uuid = ?", subOrder.Uuid).Updates(updatedOrder).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UpdateFulfillment successfully", SubOrderRepositoryName))
+
+	return nil
+}
+
+func attachSellerOrderLines(db *gorm.DB, subOrders []dao.SubOrder) ([]requests.SellerOrder, error) {
+	orders := make([]requests.SellerOrder, 0, len(subOrders))
+	if len(subOrders) == 0 {
+		return orders, nil
+	}
+
+	ids := make([]string, 0, len(subOrders))
+	ticketIDs := make([]string, 0, len(subOrders))
+	for _, subOrder := range subOrders {
+		ids = append(ids, subOrder.Uuid)
+		ticketIDs = append(ticketIDs, subOrder.TicketId)
+	}
+
+	tickets := make([]dao.Ticket, 0, len(ticketIDs))
+	if err := db.Select("uuid", "shipping_address").Where("uuid IN ?", ticketIDs).Find(&tickets).Error; err != nil {
+		return nil, err
+	}
+
+	addresses := map[string]*dao.TicketAddress{}
+	for _, ticket := range tickets {
+		addresses[ticket.Uuid] = ticket.ShippingAddress
+	}
+
+	purchases := make([]dao.Purchase, 0)
+	err := db.Where("sub_order_id IN ?", ids).Order("created_at, uuid").Find(&purchases).Error
+	if err != nil {
+		return nil, err
+	}
+
+	lines := map[string][]dao.Purchase{}
+	for _, purchase := range purchases {
+		lines[purchase.SubOrderId] = append(lines[purchase.SubOrderId], purchase)
+	}
+
+	for _, subOrder := range subOrders {
+		orders = append(orders, requests.SellerOrder{
+			SubOrder: subOrder,
+			ShippingAddress: addresses[subOrder.TicketId],
+			Lines: requests.NewTicketLines(lines[subOrder.Uuid]),
+		})
+	}
+
+	return orders, nil
+}
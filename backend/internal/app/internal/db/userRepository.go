@@ -83,3 +83,68 @@ func VerifyUserAccount(magic dao.Magic, ctx context.Context) error  {
 	return err
 }
 
+
+func FetchUserByUuid(userId string, ctx context.Context) (*dao.User, error) {
+	tr := otel.Tracer(UserRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchUserByUuid", UserRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	var user dao.User
+	if err := db.WithContext(trContext).Where("uuid = ?", userId).First(&user).Error; err != nil {
+		span.SetAttributes(
+			attribute.String("Uuid", userId),
+		)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func UpdateUserName(userId string, name string, ctx context.Context) (*dao.User, error) {
+	tr := otel.Tracer(UserRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UpdateUserName", UserRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Uuid", userId),
+	)
+
+	var user dao.User
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&dao.User{}).Where("uuid = ?", userId).Update("name", name).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("uuid = ?", userId).First(&user).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UpdateUserName successfully", UserRepositoryName))
+
+	return &user, nil
+}
@@ -0,0 +1,651 @@
+package db
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	mysql "github.com/go-sql-driver/mysql"
+)
+
+var ErrWishlistNotFound = errors.New("Wishlist Not Found")
+var ErrWishlistItemNotFound = errors.New("The product is not in the wishlist")
+var ErrWishlistNameTaken = errors.New("There is already a wishlist with that name")
+var ErrWishlistFull = errors.New("The wishlist can't have more products")
+
+const WishlistRepositoryName = "wishlist-repository"
+
+const maxWishlistItems = 200
+
+func FetchWishlists(owner string, ctx context.Context) ([]requests.WishlistSummary, error) {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchWishlists", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("Owner", owner),
+	)
+
+	wishlists := make([]dao.Wishlist, 0)
+	if err := db.WithContext(trContext).Where("owner = ?", owner).Order("created_at, uuid").Find(&wishlists).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	counts := make([]struct {
+		WishlistId string
+		Items int
+	}, 0)
+
+	err := db.WithContext(trContext).
+		Table("wishlist_items").
+		Select("wishlist_items.wishlist_id, COUNT(*) AS items").
+		Joins("JOIN wishlists ON wishlists.uuid = wishlist_items.wishlist_id").
+		Where("wishlists.owner = ?", owner).
+		Group("wishlist_items.wishlist_id").
+		Scan(&counts).
+		Error
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	items := map[string]int{}
+	for _, count := range counts {
+		items[count.WishlistId] = count.Items
+	}
+
+	summaries := make([]requests.WishlistSummary, 0, len(wishlists))
+	for _, wishlist := range wishlists {
+		summaries = append(summaries, requests.WishlistSummary{
+			Wishlist: wishlist,
+			Shared: isShared(wishlist),
+			Items: items[wishlist.Uuid],
+		})
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchWishlists successfully", WishlistRepositoryName))
+
+	return summaries, nil
+}
+
+func CreateWishlist(owner string, data *requests.SaveWishlist, ctx context.Context) (*dao.Wishlist, error) {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.CreateWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	wishlist := dao.Wishlist{
+		Uuid: uuid.New().String(),
+		Owner: owner,
+		Name: data.Name,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlist.Uuid),
+		attribute.String("Owner", owner),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if err := ensureWishlistName(tx, owner, data.Name, ""); err != nil {
+			return err
+		}
+
+		return wishlistNameError(tx.Create(&wishlist).Error)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.CreateWishlist successfully", WishlistRepositoryName))
+
+	return &wishlist, nil
+}
+
+func FetchWishlist(wishlistId string, owner string, ctx context.Context) (*requests.WishlistDetail, error) {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("Owner", owner),
+	)
+
+	wishlist, err := findWishlist(db.WithContext(trContext), wishlistId, owner)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	items, err := fetchWishlistItems(db.WithContext(trContext), wishlist.Uuid)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchWishlist successfully", WishlistRepositoryName))
+
+	detail := requests.WishlistDetail{
+		Wishlist: *wishlist,
+		Shared: isShared(*wishlist),
+		Items: items,
+	}
+
+	return &detail, nil
+}
+
+func RenameWishlist(wishlistId string, owner string, data *requests.SaveWishlist, ctx context.Context) error {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RenameWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("Owner", owner),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := findWishlist(tx, wishlistId, owner); err != nil {
+			return err
+		}
+
+		if err := ensureWishlistName(tx, owner, data.Name, wishlistId); err != nil {
+			return err
+		}
+
+		renamed := map[string]interface{}{
+			"name": data.Name,
+			"updated_at": time.Now().UTC(),
+		}
+
+		return wishlistNameError(tx.Model(&dao.Wishlist{}).Where("uuid = ?", wishlistId).Updates(renamed).Error)
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RenameWishlist successfully", WishlistRepositoryName))
+
+	return nil
+}
+
+func DeleteWishlist(wishlistId string, owner string, ctx context.Context) error {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("Owner", owner),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := findWishlist(tx, wishlistId, owner); err != nil {
+			return err
+		}
+
+		if err := tx.Where("wishlist_id = ?", wishlistId).Delete(&dao.WishlistItem{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("uuid = ?", wishlistId).Delete(&dao.Wishlist{}).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.DeleteWishlist successfully", WishlistRepositoryName))
+
+	return nil
+}
+
+// AddWishlistItem saves the product with its current price, adding a product
+// that is already in the list returns the existing item
+func AddWishlistItem(wishlistId string, owner string, productId string, ctx context.Context) (*dao.WishlistItem, error) {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.AddWishlistItem", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("ProductUuid", productId),
+	)
+
+	var item dao.WishlistItem
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := findWishlist(tx, wishlistId, owner); err != nil {
+			return err
+		}
+
+		err := tx.Where("wishlist_id = ? AND product = ?", wishlistId, productId).First(&item).Error
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&dao.WishlistItem{}).Where("wishlist_id = ?", wishlistId).Count(&count).Error; err != nil {
+			return err
+		}
+
+		if count >= maxWishlistItems {
+			return ErrWishlistFull
+		}
+
+		var product dao.Product
+		err = tx.Where("uuid = ? AND archived_at IS NULL", productId).First(&product).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrProductNotFound
+		}
+
+		if err != nil {
+			return err
+		}
+
+		item = dao.WishlistItem{
+			Uuid: uuid.New().String(),
+			WishlistId: wishlistId,
+			Product: product.Uuid,
+			ProductName: product.Name,
+			PriceAtAdd: product.Price,
+			AddedAt: time.Now().UTC(),
+		}
+
+		return tx.Create(&item).Error
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.AddWishlistItem successfully", WishlistRepositoryName))
+
+	return &item, nil
+}
+
+func RemoveWishlistItem(wishlistId string, owner string, productId string, ctx context.Context) error {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.RemoveWishlistItem", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("ProductUuid", productId),
+	)
+
+	err := db.WithContext(trContext).Transaction(func(tx *gorm.DB) error {
+		if _, err := findWishlist(tx, wishlistId, owner); err != nil {
+			return err
+		}
+
+		result := tx.Where("wishlist_id = ? AND product = ?", wishlistId, productId).Delete(&dao.WishlistItem{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrWishlistItemNotFound
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.RemoveWishlistItem successfully", WishlistRepositoryName))
+
+	return nil
+}
+
+// ShareWishlist creates a new share id, the links signed with the previous
+// one stop working
+func ShareWishlist(wishlistId string, owner string, until time.Time, ctx context.Context) (string, error) {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.ShareWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return "", dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("Owner", owner),
+	)
+
+	shareID := uuid.New().String()
+	shared := map[string]interface{}{
+		"share_id": shareID,
+		"shared_until": until,
+		"updated_at": time.Now().UTC(),
+	}
+
+	if err := updateWishlistShare(db.WithContext(trContext), wishlistId, owner, shared); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.ShareWishlist successfully", WishlistRepositoryName))
+
+	return shareID, nil
+}
+
+func UnshareWishlist(wishlistId string, owner string, ctx context.Context) error {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.UnshareWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+		attribute.String("Owner", owner),
+	)
+
+	unshared := map[string]interface{}{
+		"share_id": nil,
+		"shared_until": nil,
+		"updated_at": time.Now().UTC(),
+	}
+
+	if err := updateWishlistShare(db.WithContext(trContext), wishlistId, owner, unshared); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.UnshareWishlist successfully", WishlistRepositoryName))
+
+	return nil
+}
+
+// FetchSharedWishlist reads a list through its share link, it's only found
+// while the share id of the link is the current one and it hasn't expired
+func FetchSharedWishlist(wishlistId string, shareId string, ctx context.Context) (*requests.SharedWishlist, error) {
+	tr := otel.Tracer(WishlistRepositoryName)
+	trContext, span := tr.Start(ctx, fmt.Sprintf("%s.FetchSharedWishlist", WishlistRepositoryName))
+	defer span.End()
+
+	db := platform.GetInstance()
+
+	if db == nil {
+		dbErr := errors.New("We couldn't connect to the database")
+		span.RecordError(dbErr)
+		span.SetStatus(codes.Error, dbErr.Error())
+		return nil, dbErr
+	}
+
+	span.SetAttributes(
+		attribute.String("WishlistUuid", wishlistId),
+	)
+
+	var wishlist dao.Wishlist
+	err := db.WithContext(trContext).
+		Where("uuid = ? AND share_id = ? AND shared_until > ?", wishlistId, shareId, time.Now().UTC()).
+		First(&wishlist).
+		Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(ErrWishlistNotFound)
+		span.SetStatus(codes.Error, ErrWishlistNotFound.Error())
+		return nil, ErrWishlistNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	var owner dao.User
+	if err := db.WithContext(trContext).Where("uuid = ?", wishlist.Owner).First(&owner).Error; err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	items, err := fetchWishlistItems(db.WithContext(trContext), wishlist.Uuid)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetStatus(codes.Ok, fmt.Sprintf("%s.FetchSharedWishlist successfully", WishlistRepositoryName))
+
+	shared := requests.SharedWishlist{
+		Name: wishlist.Name,
+		Owner: owner.Name,
+		Items: items,
+	}
+
+	return &shared, nil
+}
+
+// flagRemovedWishlistItems marks the items of a product that is no longer
+// sold, it has to receive the transaction that removes the product
+func flagRemovedWishlistItems(tx *gorm.DB, productId string) error {
+	return tx.Model(&dao.WishlistItem{}).
+		Where("product = ? AND product_removed_at IS NULL", productId).
+		Update("product_removed_at", time.Now().UTC()).
+		Error
+}
+
+func fetchWishlistItems(db *gorm.DB, wishlistId string) ([]requests.WishlistItemView, error) {
+	rows := make([]struct {
+		dao.WishlistItem
+		Name *string
+		Image *string
+		Price *float32
+		Quantity *int32
+	}, 0)
+
+	err := db.Table("wishlist_items").
+		Select("wishlist_items.*, products.name, products.image, products.price, products.quantity").
+		Joins("LEFT JOIN products ON products.uuid = wishlist_items.product").
+		Where("wishlist_items.wishlist_id = ?", wishlistId).
+		Order("wishlist_items.added_at, wishlist_items.uuid").
+		Scan(&rows).
+		Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]requests.WishlistItemView, 0, len(rows))
+	for _, row := range rows {
+		item := requests.WishlistItemView{
+			Uuid: row.Uuid,
+			Product: row.Product,
+			Name: row.ProductName,
+			PriceAtAdd: row.PriceAtAdd,
+			Removed: row.ProductRemovedAt != nil || row.Price == nil,
+			AddedAt: row.AddedAt,
+		}
+
+		if !item.Removed {
+			change := *row.Price - row.PriceAtAdd
+
+			item.Name = *row.Name
+			item.Image = row.Image
+			item.CurrentPrice = row.Price
+			item.PriceChange = &change
+			item.Available = row.Quantity != nil && *row.Quantity > 0
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func findWishlist(db *gorm.DB, wishlistId string, owner string) (*dao.Wishlist, error) {
+	var wishlist dao.Wishlist
+	err := db.Where("uuid = ? AND owner = ?", wishlistId, owner).First(&wishlist).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWishlistNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &wishlist, nil
+}
+
+func ensureWishlistName(tx *gorm.DB, owner string, name string, except string) error {
+	var count int64
+	err := tx.Model(&dao.Wishlist{}).
+		Where("owner = ? AND name = ? AND uuid <> ?", owner, name, except).
+		Count(&count).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return ErrWishlistNameTaken
+	}
+
+	return nil
+}
+
+// wishlistNameError catches the request that took the name after
+// ensureWishlistName, the unique key of the owner and the name rejects it
+func wishlistNameError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		return ErrWishlistNameTaken
+	}
+
+	return err
+}
+
+func updateWishlistShare(db *gorm.DB, wishlistId string, owner string, values map[string]interface{}) error {
+	result := db.Model(&dao.Wishlist{}).Where("uuid = ? AND owner = ?", wishlistId, owner).Updates(values)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrWishlistNotFound
+	}
+
+	return nil
+}
+
+func isShared(wishlist dao.Wishlist) bool {
+	return wishlist.ShareId != nil && wishlist.SharedUntil != nil && wishlist.SharedUntil.After(time.Now())
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"fmt"
+	"errors"
+	"testing"
+
+	mysql "github.com/go-sql-driver/mysql"
+)
+
+func TestWishlistNameError(t *testing.T) {
+	other := errors.New("connection lost")
+	lockWait := &mysql.MySQLError{Number: 1205}
+
+	cases := []struct {
+		name string
+		err error
+		want error
+	}{
+		{"no error", nil, nil},
+		{"duplicate name", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, ErrWishlistNameTaken},
+		{"wrapped duplicate name", fmt.Errorf("create: %w", &mysql.MySQLError{Number: 1062}), ErrWishlistNameTaken},
+		{"lock wait", lockWait, lockWait},
+		{"other error", other, other},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := wishlistNameError(c.err); !errors.Is(got, c.want) {
+				t.Fatalf("wishlistNameError() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
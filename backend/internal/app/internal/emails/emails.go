@@ -0,0 +1,172 @@
+package emails
+
+import (
+	"fmt"
+	"path"
+	"bytes"
+	"embed"
+	"errors"
+	"strings"
+	"io/fs"
+	texttemplate "text/template"
+	htmltemplate "html/template"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+)
+
+// Every template has three files in the folder of each locale, the subject
+// and text bodies use text/template and the html body fills the layout
+//
+//	<name>.subject.txt
+//	<name>.txt
+//	<name>.html
+//
+// The order confirmation takes the *requests.Receipt of the ticket
+const (
+	Verification = "verification"
+	Login = "login"
+	OrderConfirmation = "order_confirmation"
+	LowStock = "low_stock"
+	OutOfStock = "out_of_stock"
+	EmailChange = "email_change"
+	EmailChanged = "email_changed"
+	AccountDeletion = "account_deletion"
+)
+
+var Names = []string{Verification, Login, OrderConfirmation, LowStock, OutOfStock, EmailChange, EmailChanged, AccountDeletion}
+
+const DefaultLocale = "en"
+
+var ErrUnknownTemplate = errors.New("Unknown email template")
+
+// CodeData is the data of the verification and login emails, the Link is
+// empty when the signed links are disabled
+type CodeData struct {
+	Name string
+	Code string
+	Link string
+	ExpiresInMinutes int
+}
+
+// EmailChangeData is the data of the code sent to the new email and of the
+// notice sent to the old one, the notice doesn't use the code
+type EmailChangeData struct {
+	Name string
+	NewEmail string
+	Code string
+	Link string
+	ExpiresInMinutes int
+}
+
+// AccountDeletionData is the data of the notice sent when the deletion is
+// scheduled, the date is already formatted in UTC
+type AccountDeletionData struct {
+	Name string
+	ScheduledFor string
+}
+
+// StockAlertData is the data of the low_stock and out_of_stock emails
+type StockAlertData struct {
+	Seller string
+	Alert requests.StockAlert
+}
+
+//go:embed templates
+var files embed.FS
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var funcs = map[string]any{
+	"money": func(value float32) string { return fmt.Sprintf("%.2f", value) },
+}
+
+// The templates are parsed once, a broken file stops the API on start like
+// the receipt templates
+var templates = loadTemplates()
+
+func loadTemplates() map[string]map[string]emailTemplate {
+	entries, err := fs.ReadDir(files, "templates")
+	if err != nil {
+		panic(err)
+	}
+
+	locales := map[string]map[string]emailTemplate{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		locale := entry.Name()
+		locales[locale] = map[string]emailTemplate{}
+
+		for _, name := range Names {
+			base := path.Join("templates", locale, name)
+			if _, err := fs.Stat(files, base + ".html"); err != nil && locale != DefaultLocale {
+				// The locale falls back to the default one for this template
+				continue
+			}
+
+			locales[locale][name] = emailTemplate{
+				subject: texttemplate.Must(texttemplate.New(name + ".subject.txt").Funcs(funcs).ParseFS(files, base + ".subject.txt")),
+				text: texttemplate.Must(texttemplate.New(name + ".txt").Funcs(funcs).ParseFS(files, base + ".txt")),
+				html: htmltemplate.Must(htmltemplate.New(name).Funcs(funcs).ParseFS(files, "templates/layout.html", base + ".html")),
+			}
+		}
+	}
+
+	return locales
+}
+
+// Locale picks the first supported language of an Accept-Language header,
+// the weights are ignored because the clients send them in order
+func Locale(acceptLanguage string) string {
+	for _, language := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(language), ";")
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+
+		if _, ok := templates[primary]; ok {
+			return primary
+		}
+	}
+
+	return DefaultLocale
+}
+
+// Compose renders the named template in the locale, or in the default locale
+// when it doesn't have a translation
+func Compose(name string, locale string, to []string, data any, attachments ...platform.EmailAttachment) (platform.Email, error) {
+	tmpl, ok := templates[locale][name]
+	if !ok {
+		tmpl, ok = templates[DefaultLocale][name]
+	}
+
+	if !ok {
+		return platform.Email{}, fmt.Errorf("%w: %s", ErrUnknownTemplate, name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return platform.Email{}, err
+	}
+
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return platform.Email{}, err
+	}
+
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return platform.Email{}, err
+	}
+
+	return platform.Email{
+		To: to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text: text.String(),
+		HTML: html.String(),
+		Attachments: attachments,
+	}, nil
+}
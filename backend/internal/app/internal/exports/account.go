@@ -0,0 +1,61 @@
+package exports
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"path"
+	"archive/zip"
+	"encoding/json"
+)
+
+// AccountArchive is the zip with the personal data of a user, the entries
+// are written one after the other straight to the client
+type AccountArchive struct {
+	zip *zip.Writer
+}
+
+func NewAccountArchive(w io.Writer) *AccountArchive {
+	return &AccountArchive{zip: zip.NewWriter(w)}
+}
+
+func AccountArchiveName(at time.Time) string {
+	return fmt.Sprintf("account-%s.zip", at.Format("20060102"))
+}
+
+func (a *AccountArchive) WriteJSON(name string, value interface{}) error {
+	entry, err := a.zip.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Create starts an entry that is written until the next one is created
+func (a *AccountArchive) Create(name string) (io.Writer, error) {
+	return a.zip.Create(name)
+}
+
+// AddImage stores the image in the images folder without compressing it
+// again
+func (a *AccountArchive) AddImage(folder string, name string, image io.Reader) error {
+	entry, err := a.zip.CreateHeader(&zip.FileHeader{
+		Name: path.Join("images", folder, path.Base(name)),
+		Method: zip.Store,
+		Modified: time.Now().UTC(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, image)
+	return err
+}
+
+func (a *AccountArchive) Close() error {
+	return a.zip.Close()
+}
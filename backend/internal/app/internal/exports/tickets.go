@@ -0,0 +1,206 @@
+package exports
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"encoding/csv"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+type Format string
+
+const (
+	FormatCSV Format = "csv"
+	FormatJSON Format = "json"
+)
+
+var ErrUnknownFormat = errors.New("Unknown export format, use csv or json")
+
+// flushEvery is how many lines are buffered before they are sent to the client
+const flushEvery = 100
+
+func ParseFormat(value string) (Format, error) {
+	switch Format(value) {
+		case "", FormatCSV:
+			return FormatCSV, nil
+		case FormatJSON:
+			return FormatJSON, nil
+		default:
+			return "", ErrUnknownFormat
+	}
+}
+
+func (f Format) ContentType() string {
+	if f == FormatJSON {
+		return "application/json"
+	}
+
+	return "text/csv; charset=utf-8"
+}
+
+func FileName(format Format, at time.Time) string {
+	return fmt.Sprintf("purchases-%s.%s", at.Format("20060102"), format)
+}
+
+// TicketLineWriter writes the export one line at a time, Close has to be
+// called even when no line was written so the document is complete
+type TicketLineWriter interface {
+	Write(line requests.TicketExportLine) error
+	Close() error
+}
+
+type flusher interface {
+	Flush()
+}
+
+func NewTicketLineWriter(w io.Writer, format Format) (TicketLineWriter, error) {
+	switch format {
+		case FormatCSV:
+			return &csvWriter{out: w, csv: csv.NewWriter(w)}, nil
+		case FormatJSON:
+			return &jsonWriter{out: w}, nil
+		default:
+			return nil, ErrUnknownFormat
+	}
+}
+
+var csvHeader = []string{
+	"ticket_id", "created_at", "status", "payment_status", "product",
+	"product_name", "seller", "quantity", "unit_price", "line_total", "ticket_total",
+}
+
+type csvWriter struct {
+	out io.Writer
+	csv *csv.Writer
+	lines int
+}
+
+func (c *csvWriter) Write(line requests.TicketExportLine) error {
+	if c.lines == 0 {
+		if err := c.csv.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	paymentStatus := ""
+	if line.PaymentStatus != nil {
+		paymentStatus = *line.PaymentStatus
+	}
+
+	record := []string{
+		line.TicketId,
+		line.CreatedAt.UTC().Format(time.RFC3339),
+		line.Status,
+		paymentStatus,
+		line.Product,
+		line.ProductName,
+		line.Seller,
+		strconv.Itoa(int(line.Quantity)),
+		money(line.UnitPrice),
+		money(line.LineTotal),
+		money(line.TicketTotal),
+	}
+
+	for i, cell := range record {
+		record[i] = escapeCell(cell)
+	}
+
+	if err := c.csv.Write(record); err != nil {
+		return err
+	}
+
+	c.lines += 1
+	if c.lines % flushEvery == 0 {
+		return c.flush()
+	}
+
+	return nil
+}
+
+// escapeCell keeps a spreadsheet from running a product name as a formula,
+// the cells that start like one get a quote in front
+func escapeCell(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+
+	return cell
+}
+
+func (c *csvWriter) Close() error {
+	if c.lines == 0 {
+		if err := c.csv.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+
+	return c.flush()
+}
+
+func (c *csvWriter) flush() error {
+	c.csv.Flush()
+	if f, ok := c.out.(flusher); ok {
+		f.Flush()
+	}
+
+	return c.csv.Error()
+}
+
+type jsonWriter struct {
+	out io.Writer
+	lines int
+}
+
+func (j *jsonWriter) Write(line requests.TicketExportLine) error {
+	separator := ","
+	if j.lines == 0 {
+		separator = "["
+	}
+
+	if _, err := io.WriteString(j.out, separator); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.out.Write(encoded); err != nil {
+		return err
+	}
+
+	j.lines += 1
+	if f, ok := j.out.(flusher); ok && j.lines % flushEvery == 0 {
+		f.Flush()
+	}
+
+	return nil
+}
+
+func (j *jsonWriter) Close() error {
+	closing := "]"
+	if j.lines == 0 {
+		closing = "[]"
+	}
+
+	if _, err := io.WriteString(j.out, closing); err != nil {
+		return err
+	}
+
+	if f, ok := j.out.(flusher); ok {
+		f.Flush()
+	}
+
+	return nil
+}
+
+func money(value float32) string {
+	return strconv.FormatFloat(float64(value), 'f', 2, 32)
+}
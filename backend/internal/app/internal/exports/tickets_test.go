@@ -0,0 +1,72 @@
+package exports
+
+import (
+	"time"
+	"bytes"
+	"testing"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+func TestEscapeCell(t *testing.T) {
+	cases := []struct {
+		cell string
+		want string
+	}{
+		{"", ""},
+		{"Mechanical keyboard", "Mechanical keyboard"},
+		{"=HYPERLINK(\"http://evil.example\")", "'=HYPERLINK(\"http://evil.example\")"},
+		{"+1+1", "'+1+1"},
+		{"-2+3", "'-2+3"},
+		{"@SUM(A1:A2)", "'@SUM(A1:A2)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"a=b", "a=b"},
+		{"12.50", "12.50"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.cell, func(t *testing.T) {
+			if got := escapeCell(c.cell); got != c.want {
+				t.Fatalf("escapeCell(%q) = %q, want %q", c.cell, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCsvWriter(t *testing.T) {
+	var out bytes.Buffer
+
+	writer, err := NewTicketLineWriter(&out, FormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := requests.TicketExportLine{
+		TicketId: "t-1",
+		CreatedAt: time.Date(2026, time.March, 14, 9, 26, 53, 0, time.UTC),
+		Status: "paid",
+		Product: "p-1",
+		ProductName: "=cmd|' /C calc'!A0",
+		Seller: "s-1",
+		Quantity: 2,
+		UnitPrice: 12.5,
+		LineTotal: 25,
+		TicketTotal: 25,
+	}
+
+	if err := writer.Write(line); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "ticket_id,created_at,status,payment_status,product,product_name,seller,quantity,unit_price,line_total,ticket_total\n" +
+		"t-1,2026-03-14T09:26:53Z,paid,,p-1,'=cmd|' /C calc'!A0,s-1,2,12.50,25.00,25.00\n"
+
+	if out.String() != want {
+		t.Fatalf("csv = %q, want %q", out.String(), want)
+	}
+}
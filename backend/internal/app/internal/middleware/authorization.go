@@ -1,14 +1,22 @@
 package middleware
 
 import (
+	"fmt"
+	"time"
+	"slices"
 	"errors"
 	"context"
 	"strings"
 	"net/http"
 
 	"github.com/OscarVillanueva/goapi/internal/app/tools"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/sessions"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/platform"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.opentelemetry.io/otel"
 )
 
@@ -16,6 +24,21 @@ import (
 type contextKey string
 const UserUUIDKey contextKey = "user_uuid"
 
+// The jti and expiration of the token, used to revoke it in the logout
+const TokenIdKey contextKey = "token_id"
+const TokenExpiresAtKey contextKey = "token_expires_at"
+
+// The roles and permissions of the data claim
+const RolesKey contextKey = "roles"
+const PermissionsKey contextKey = "permissions"
+
+// The uuid of the key when the request used the ApiKey scheme
+const ApiKeyIdKey contextKey = "api_key_id"
+
+// The owner of the key, it only becomes the user of the request on the
+// routes that declare the permissions of the key
+const apiKeyUserKey contextKey = "api_key_user"
+
 func Authorization(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request)  {
 		tr := otel.Tracer("auth-middleware")
@@ -26,12 +49,17 @@ func Authorization(next http.Handler) http.Handler {
 		authHeader := r.Header.Get("Authorization")
 
 		parts := strings.Split(authHeader, " ")
+		if len(parts) == 2 && parts[0] == "ApiKey" {
+			authorizeApiKey(next, w, r.WithContext(trContext), parts[1])
+			return
+		}
+
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			tools.UnauthorizedErrorHandler(w, nil)
 			return
 		}
 
-		claims, err := tools.IsValidToken(parts[1], trContext)
+		claims, err := tools.IsValidToken(parts[1], tools.AccessTokenAudience, trContext)
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, "Invalid Token")
@@ -55,11 +83,149 @@ func Authorization(next http.Handler) http.Handler {
 			return
 		}
 
+		tokenID, _ := claims["jti"].(string)
+		issuedAt, _ := claims["iat"].(float64)
+		expiresAt, _ := claims["exp"].(float64)
+
+		// Redis being down doesn't stop the API, the error stays in the trace
+		revoked, err := sessions.IsRevoked(tokenID, uuid, time.Unix(int64(issuedAt), 0), trContext)
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		if revoked {
+			msg := "The session was closed"
+			span.SetStatus(codes.Error, msg)
+			tools.UnauthorizedErrorHandler(w, &msg)
+			return
+		}
+
 		// Create a context based in the request context
 		ctx := context.WithValue(trContext, UserUUIDKey, uuid)
+		ctx = context.WithValue(ctx, TokenIdKey, tokenID)
+		ctx = context.WithValue(ctx, TokenExpiresAtKey, time.Unix(int64(expiresAt), 0))
+		ctx = context.WithValue(ctx, RolesKey, claimStrings(data["roles"]))
+		ctx = context.WithValue(ctx, PermissionsKey, claimStrings(data["permissions"]))
 		modified := r.WithContext(ctx)
 
 		span.SetStatus(codes.Ok, "Valid token")
 		next.ServeHTTP(w, modified)
 	})
 }
+
+// authorizeApiKey keeps the user of the key apart from UserUUIDKey, so the
+// routes are closed to the keys by default and only RequirePermissions lets
+// them in. The permissions are the scopes of the key that the user still has
+func authorizeApiKey(next http.Handler, w http.ResponseWriter, r *http.Request, key string) {
+	span := trace.SpanFromContext(r.Context())
+
+	apiKey, roles, permissions, err := db.AuthenticateApiKey(key, r.Context())
+	if errors.Is(err, db.ErrApiKeyInvalid) || errors.Is(err, db.ErrApiKeyExpired) {
+		msg := err.Error()
+		span.SetStatus(codes.Error, msg)
+		tools.UnauthorizedErrorHandler(w, &msg)
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		tools.InternalServerErrorHandler(w, nil)
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("ApiKeyUuid", apiKey.Uuid),
+	)
+
+	ctx := context.WithValue(r.Context(), apiKeyUserKey, apiKey.UserUuid)
+	ctx = context.WithValue(ctx, ApiKeyIdKey, apiKey.Uuid)
+	ctx = context.WithValue(ctx, RolesKey, roles)
+	ctx = context.WithValue(ctx, PermissionsKey, permissions)
+
+	span.SetStatus(codes.Ok, "Valid API key")
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RejectApiKeys keeps the routes that only a signed in user can use, like
+// the management of the keys themselves
+func RejectApiKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if keyId, _ := r.Context().Value(ApiKeyIdKey).(string); keyId != "" {
+			tools.ForbiddenErrorHandler(w, "This route can't be used with an API key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermissions declares the permissions of a route, it goes after
+// Authorization and rejects the tokens without every one of them. An API key
+// that holds all of them becomes the user of the request
+func RequirePermissions(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tr := otel.Tracer("auth-middleware")
+
+			_, span := tr.Start(r.Context(), "permissions-handler")
+			defer span.End()
+
+			span.SetAttributes(
+				attribute.StringSlice("RequiredPermissions", permissions),
+			)
+
+			granted, _ := r.Context().Value(PermissionsKey).([]string)
+			for _, permission := range permissions {
+				if !slices.Contains(granted, permission) {
+					msg := fmt.Sprintf("Missing the %s permission", permission)
+					span.RecordError(errors.New(msg))
+					span.SetStatus(codes.Error, msg)
+					tools.ForbiddenErrorHandler(w, msg)
+					return
+				}
+			}
+
+			if keyUser, _ := r.Context().Value(apiKeyUserKey).(string); keyUser != "" {
+				r = r.WithContext(context.WithValue(r.Context(), UserUUIDKey, keyUser))
+			}
+
+			span.SetStatus(codes.Ok, "Granted permissions")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HasPermission is for the handlers that only change their behavior with a
+// permission instead of rejecting the request
+func HasPermission(ctx context.Context, permission string) bool {
+	granted, _ := ctx.Value(PermissionsKey).([]string)
+	return slices.Contains(granted, permission)
+}
+
+// DevelopmentOnly hides the routes that drive the simulator outside of
+// development
+func DevelopmentOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !platform.IsDevelopment() {
+			tools.NotFoundErrorHandler(w, "This route is only available in development")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The claims come from json so the lists are []any
+func claimStrings(claim any) []string {
+	values, _ := claim.([]any)
+
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if text, ok := value.(string); ok {
+			result = append(result, text)
+		}
+	}
+
+	return result
+}
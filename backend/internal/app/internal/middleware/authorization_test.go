@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"net/http/httptest"
+)
+
+func TestApiKeyScopes(t *testing.T) {
+	session := func(permissions ...string) context.Context {
+		ctx := context.WithValue(context.Background(), UserUUIDKey, "user-1")
+		return context.WithValue(ctx, PermissionsKey, permissions)
+	}
+
+	apiKey := func(permissions ...string) context.Context {
+		ctx := context.WithValue(context.Background(), apiKeyUserKey, "user-1")
+		ctx = context.WithValue(ctx, ApiKeyIdKey, "key-1")
+		return context.WithValue(ctx, PermissionsKey, permissions)
+	}
+
+	cases := []struct {
+		name string
+		ctx context.Context
+		route func(http.Handler) http.Handler
+		status int
+		user string
+	}{
+		{"session on an open route", session(), nil, http.StatusOK, "user-1"},
+		{"session with the permission", session("orders:fulfil"), RequirePermissions("orders:fulfil"), http.StatusOK, "user-1"},
+		{"session without the permission", session("products:write"), RequirePermissions("orders:fulfil"), http.StatusForbidden, ""},
+		{"key on an open route has no user", apiKey("orders:fulfil"), nil, http.StatusOK, ""},
+		{"key with the scope", apiKey("orders:fulfil"), RequirePermissions("orders:fulfil"), http.StatusOK, "user-1"},
+		{"key without the scope", apiKey("orders:fulfil"), RequirePermissions("products:write"), http.StatusForbidden, ""},
+		{"key with only some scopes", apiKey("orders:fulfil"), RequirePermissions("orders:fulfil", "products:write"), http.StatusForbidden, ""},
+		{"key on a session route", apiKey("orders:fulfil"), RejectApiKeys, http.StatusForbidden, ""},
+		{"session on a session route", session(), RejectApiKeys, http.StatusOK, "user-1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			user := ""
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user, _ = r.Context().Value(UserUUIDKey).(string)
+			})
+
+			if c.route != nil {
+				handler = c.route(handler)
+			}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(c.ctx)
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != c.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, c.status)
+			}
+
+			if user != c.user {
+				t.Fatalf("user = %q, want %q", user, c.user)
+			}
+		})
+	}
+}
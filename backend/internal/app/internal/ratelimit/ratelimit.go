@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"time"
+	"context"
+	"strings"
+	"net/http"
+
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel"
+)
+
+const RateLimitName = "rate-limit"
+
+const (
+	ScopeGlobal = "global"
+	ScopeIP = "ip"
+	ScopeEmail = "email"
+)
+
+// Rule allows Max hits in every Window
+type Rule struct {
+	Max int64
+	Window time.Duration
+}
+
+// Policy groups the rules of a route, the global rule counts every client
+type Policy struct {
+	Global Rule
+	IP Rule
+	Email Rule
+}
+
+// The codes have 16.7 million values, these limits together with the failed
+// attempts of each code keep the guesses far from that
+var Policies = map[string]Policy{
+	"login": {
+		Global: Rule{ Max: 1000, Window: time.Minute },
+		IP: Rule{ Max: 20, Window: 15 * time.Minute },
+		Email: Rule{ Max: 5, Window: 15 * time.Minute },
+	},
+	"verify-account": {
+		Global: Rule{ Max: 1000, Window: time.Minute },
+		IP: Rule{ Max: 20, Window: 15 * time.Minute },
+		Email: Rule{ Max: 5, Window: 15 * time.Minute },
+	},
+	"resend-code": {
+		Global: Rule{ Max: 300, Window: time.Minute },
+		IP: Rule{ Max: 10, Window: 15 * time.Minute },
+		Email: Rule{ Max: 3, Window: 15 * time.Minute },
+	},
+	// The email is the new address, so a user can't flood other inboxes
+	"change-email": {
+		Global: Rule{ Max: 300, Window: time.Minute },
+		IP: Rule{ Max: 10, Window: 15 * time.Minute },
+		Email: Rule{ Max: 3, Window: 15 * time.Minute },
+	},
+	"confirm-email": {
+		Global: Rule{ Max: 1000, Window: time.Minute },
+		IP: Rule{ Max: 20, Window: 15 * time.Minute },
+		Email: Rule{ Max: 5, Window: 15 * time.Minute },
+	},
+	// Every export reads all the images of the user from the bucket, the
+	// email rule counts the user uuid instead
+	"account-export": {
+		Global: Rule{ Max: 60, Window: time.Minute },
+		IP: Rule{ Max: 10, Window: time.Hour },
+		Email: Rule{ Max: 3, Window: time.Hour },
+	},
+	// The links are signed, the limit only slows down the clients that
+	// replay them
+	"magic-link": {
+		Global: Rule{ Max: 1000, Window: time.Minute },
+		IP: Rule{ Max: 20, Window: 15 * time.Minute },
+	},
+	"create-account": {
+		Global: Rule{ Max: 300, Window: time.Minute },
+		IP: Rule{ Max: 10, Window: time.Hour },
+		Email: Rule{ Max: 3, Window: time.Hour },
+	},
+}
+
+// LimitedError tells which limit was exceeded and when the client can retry
+type LimitedError struct {
+	Route string
+	Scope string
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("Too many requests to %s by %s, retry in %s", e.Route, e.Scope, e.RetryAfter)
+}
+
+func counterKey(route string, scope string, subject string) string {
+	return fmt.Sprintf("rate-limit:%s:%s:%s", route, scope, subject)
+}
+
+// Check counts the request against the global, ip and email limits of the
+// route, it returns a *LimitedError when one of them is exceeded. When redis
+// fails the request is allowed so the login doesn't depend on it
+func Check(route string, email string, ip string, ctx context.Context) error {
+	tr := otel.Tracer(RateLimitName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.Check", RateLimitName))
+	defer span.End()
+
+	policy, ok := Policies[route]
+	if !ok {
+		return nil
+	}
+
+	span.SetAttributes(
+		attribute.String("Route", route),
+		attribute.String("Email", email),
+		attribute.String("IP", ip),
+	)
+
+	checks := []struct {
+		scope string
+		subject string
+		rule Rule
+	}{
+		{ ScopeGlobal, "all", policy.Global },
+		{ ScopeIP, ip, policy.IP },
+		{ ScopeEmail, strings.ToLower(email), policy.Email },
+	}
+
+	for _, check := range checks {
+		if check.subject == "" || check.rule.Max <= 0 {
+			continue
+		}
+
+		key := counterKey(route, check.scope, check.subject)
+		count, retryAfter, err := platform.IncrementCounter(key, check.rule.Window, ctx)
+		if err != nil {
+			span.RecordError(err)
+			return nil
+		}
+
+		if count > check.rule.Max {
+			limitErr := &LimitedError{
+				Route: route,
+				Scope: check.scope,
+				RetryAfter: retryAfter,
+			}
+
+			span.AddEvent("rate_limit.lockout", trace.WithAttributes(
+				attribute.String("Route", route),
+				attribute.String("Scope", check.scope),
+				attribute.String("Subject", check.subject),
+				attribute.Int64("Count", count),
+				attribute.Int64("RetryAfterSeconds", int64(retryAfter.Seconds())),
+			))
+			span.SetStatus(codes.Error, limitErr.Error())
+
+			return limitErr
+		}
+	}
+
+	return nil
+}
+
+// ClientIP is the address of the connection, the forwarded headers are
+// ignored because anyone can send them to get a fresh counter
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,65 @@
+package receipts
+
+import (
+	"fmt"
+	"errors"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+type Format string
+
+const (
+	FormatPDF Format = "pdf"
+	FormatHTML Format = "html"
+	FormatText Format = "txt"
+)
+
+var ErrUnknownFormat = errors.New("Unknown receipt format, use pdf, html or txt")
+
+func ParseFormat(value string) (Format, error) {
+	switch Format(value) {
+		case "", FormatPDF:
+			return FormatPDF, nil
+		case FormatHTML:
+			return FormatHTML, nil
+		case FormatText:
+			return FormatText, nil
+		default:
+			return "", ErrUnknownFormat
+	}
+}
+
+func (f Format) ContentType() string {
+	switch f {
+		case FormatHTML:
+			return "text/html; charset=utf-8"
+		case FormatText:
+			return "text/plain; charset=utf-8"
+		default:
+			return "application/pdf"
+	}
+}
+
+func FileName(receipt *requests.Receipt, format Format) string {
+	return fmt.Sprintf("receipt-%s.%s", receipt.TicketId, format)
+}
+
+// Render builds the receipt document in memory, it doesn't touch the network
+// or the database so the same bytes can be served or attached to an email
+func Render(receipt *requests.Receipt, format Format) ([]byte, error) {
+	switch format {
+		case FormatPDF:
+			return renderPDF(receipt)
+		case FormatHTML:
+			return renderHTML(receipt)
+		case FormatText:
+			return renderText(receipt), nil
+		default:
+			return nil, ErrUnknownFormat
+	}
+}
+
+func invoiceNumber(number int64) string {
+	return fmt.Sprintf("%06d", number)
+}
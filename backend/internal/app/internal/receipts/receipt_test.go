@@ -0,0 +1,113 @@
+package receipts
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"time"
+	"bytes"
+	"testing"
+	"path/filepath"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+// go test ./internal/app/internal/receipts -update rewrites the golden files
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func sampleReceipt() *requests.Receipt {
+	return &requests.Receipt{
+		TicketId: "0efa4fb1-f584-429c-ba89-e3b15654d857",
+		CreatedAt: time.Date(2026, time.March, 14, 9, 26, 53, 0, time.UTC),
+		Buyer: "John Doe",
+		Lines: []requests.ReceiptLine{
+			{Product: "p-1", Name: "Mechanical keyboard (ISO)", Seller: "Acme <Tools>", UnitPrice: 89.9, Quantity: 1, Total: 89.9},
+			{Product: "p-2", Name: "Café & crème mug", Seller: "Bean \"Co\"", UnitPrice: 12.5, Quantity: 3, Total: 37.5},
+			{Product: "p-3", Name: "Cable 2m \\ USB-C ✓", Seller: "Acme <Tools>", UnitPrice: 7.25, Quantity: 2, Total: 14.5},
+		},
+		Invoices: []requests.ReceiptInvoice{
+			{Seller: "s-1", SellerName: "Acme <Tools>", Number: 42},
+			{Seller: "s-2", SellerName: "Bean \"Co\"", Number: 7},
+		},
+		Subtotal: 141.9,
+		Total: 141.9,
+	}
+}
+
+// Enough lines to spread the PDF over more than one page
+func longReceipt() *requests.Receipt {
+	receipt := sampleReceipt()
+	receipt.Lines = nil
+	receipt.Subtotal = 0
+
+	for i := 1; i <= 70; i++ {
+		receipt.Lines = append(receipt.Lines, requests.ReceiptLine{
+			Product: fmt.Sprintf("p-%d", i),
+			Name: fmt.Sprintf("Item %02d", i),
+			Seller: "Acme <Tools>",
+			UnitPrice: 1,
+			Quantity: 1,
+			Total: 1,
+		})
+		receipt.Subtotal += 1
+	}
+
+	receipt.Total = receipt.Subtotal
+	return receipt
+}
+
+func TestRenderGolden(t *testing.T) {
+	receipts := map[string]*requests.Receipt{
+		"receipt": sampleReceipt(),
+		"long": longReceipt(),
+	}
+
+	for name, receipt := range receipts {
+		for _, format := range []Format{FormatPDF, FormatHTML, FormatText} {
+			t.Run(fmt.Sprintf("%s.%s", name, format), func(t *testing.T) {
+				got, err := Render(receipt, format)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				golden := filepath.Join("testdata", fmt.Sprintf("%s.%s.golden", name, format))
+				if *update {
+					if err := os.WriteFile(golden, got, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !bytes.Equal(got, want) {
+					t.Fatalf("%s doesn't match the golden file, run the tests with -update if the change is expected\n%s", golden, got)
+				}
+			})
+		}
+	}
+}
+
+func TestEscapePDF(t *testing.T) {
+	cases := []struct {
+		value string
+		want string
+	}{
+		{"plain", "plain"},
+		{"(ISO)", "\\(ISO\\)"},
+		{"a\\b", "a\\\\b"},
+		{"tab\there", "tab here"},
+		{"café", "caf\\351"},
+		{"✓", "?"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			if got := escapePDF(c.value); got != c.want {
+				t.Fatalf("escapePDF(%q) = %q, want %q", c.value, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package receipts
+
+import (
+	"fmt"
+	"bytes"
+	"html/template"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+var receiptTemplate = template.Must(template.New("receipt").Funcs(template.FuncMap{
+	"money": func(value float32) string { return fmt.Sprintf("%.2f", value) },
+	"invoice": invoiceNumber,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Receipt {{.TicketId}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: 4px 8px; border-bottom: 1px solid #ddd; }
+td.number, th.number { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Receipt</h1>
+<p>
+Ticket: {{.TicketId}}<br>
+Date: {{.CreatedAt.UTC.Format "2006-01-02 15:04:05 MST"}}<br>
+Buyer: {{.Buyer}}
+</p>
+{{if .Invoices}}<ul>
+{{range .Invoices}}<li>Invoice {{invoice .Number}} - {{.SellerName}}</li>
+{{end}}</ul>{{end}}
+<table>
+<thead>
+<tr><th>Product</th><th class="number">Unit price</th><th class="number">Qty</th><th class="number">Amount</th></tr>
+</thead>
+<tbody>
+{{range .Lines}}<tr><td>{{.Name}}</td><td class="number">{{money .UnitPrice}}</td><td class="number">{{.Quantity}}</td><td class="number">{{money .Total}}</td></tr>
+{{end}}</tbody>
+<tfoot>
+<tr><td colspan="3">Subtotal</td><td class="number">{{money .Subtotal}}</td></tr>
+<tr><td colspan="3"><strong>Total</strong></td><td class="number"><strong>{{money .Total}}</strong></td></tr>
+</tfoot>
+</table>
+</body>
+</html>
+`))
+
+func renderHTML(receipt *requests.Receipt) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := receiptTemplate.Execute(&buf, receipt); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
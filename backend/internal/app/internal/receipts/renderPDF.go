@@ -0,0 +1,101 @@
+package receipts
+
+import (
+	"fmt"
+	"bytes"
+	"strings"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+const (
+	pageWidth = 612
+	pageHeight = 792
+	pageMargin = 56
+	fontSize = 9
+	lineHeight = 12
+	linesPerPage = (pageHeight - 2 * pageMargin) / lineHeight
+)
+
+// renderPDF writes a minimal PDF 1.4 document by hand, one Courier text
+// stream per page, so receipts don't need cgo or an external renderer
+func renderPDF(receipt *requests.Receipt) ([]byte, error) {
+	lines := textLines(receipt)
+
+	pages := make([][]string, 0)
+	for start := 0; start < len(lines); start += linesPerPage {
+		end := min(start + linesPerPage, len(lines))
+		pages = append(pages, lines[start:end])
+	}
+
+	// Objects: 1 catalog, 2 pages tree, 3 font, then a page and its content per page
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	}
+
+	kids := make([]string, 0, len(pages))
+	for _, page := range pages {
+		pageID := len(objects) + 1
+		contentID := pageID + 1
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+
+		var stream strings.Builder
+		fmt.Fprintf(&stream, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", fontSize, lineHeight, pageMargin, pageHeight - pageMargin)
+		for _, line := range page {
+			fmt.Fprintf(&stream, "(%s) Tj T*\n", escapePDF(line))
+		}
+		stream.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, contentID),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", stream.Len(), stream.String()),
+		)
+	}
+
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i + 1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects) + 1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects) + 1, xref)
+
+	return buf.Bytes(), nil
+}
+
+// escapePDF keeps the line inside a PDF literal string, the standard fonts
+// only cover Latin-1 so anything else is replaced
+func escapePDF(value string) string {
+	var b strings.Builder
+
+	for _, r := range value {
+		switch {
+			case r == '(' || r == ')' || r == '\\':
+				b.WriteRune('\\')
+				b.WriteRune(r)
+			case r < 32:
+				b.WriteRune(' ')
+			case r > 255:
+				b.WriteRune('?')
+			case r > 126:
+				fmt.Fprintf(&b, "\\%03o", r)
+			default:
+				b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,57 @@
+package receipts
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+)
+
+const textWidth = 72
+
+// textLines lays out the receipt as fixed width lines, the pdf renderer
+// prints the same lines with a monospaced font
+func textLines(receipt *requests.Receipt) []string {
+	lines := []string{
+		"RECEIPT",
+		strings.Repeat("=", textWidth),
+		fmt.Sprintf("Ticket: %s", receipt.TicketId),
+		fmt.Sprintf("Date:   %s", receipt.CreatedAt.UTC().Format("2006-01-02 15:04:05 MST")),
+		fmt.Sprintf("Buyer:  %s", receipt.Buyer),
+	}
+
+	for _, invoice := range receipt.Invoices {
+		lines = append(lines, fmt.Sprintf("Invoice %s - %s", invoiceNumber(invoice.Number), invoice.SellerName))
+	}
+
+	lines = append(lines,
+		strings.Repeat("-", textWidth),
+		fmt.Sprintf("%-36s %11s %8s %13s", "Product", "Unit price", "Qty", "Amount"),
+		strings.Repeat("-", textWidth),
+	)
+
+	for _, line := range receipt.Lines {
+		lines = append(lines, fmt.Sprintf("%-36s %11.2f %8d %13.2f", truncate(line.Name, 36), line.UnitPrice, line.Quantity, line.Total))
+	}
+
+	lines = append(lines,
+		strings.Repeat("-", textWidth),
+		fmt.Sprintf("%-57s %14.2f", "Subtotal", receipt.Subtotal),
+		fmt.Sprintf("%-57s %14.2f", "Total", receipt.Total),
+	)
+
+	return lines
+}
+
+func renderText(receipt *requests.Receipt) []byte {
+	return []byte(strings.Join(textLines(receipt), "\n") + "\n")
+}
+
+func truncate(value string, size int) string {
+	runes := []rune(value)
+	if len(runes) <= size {
+		return value
+	}
+
+	return string(runes[:size-3]) + "..."
+}
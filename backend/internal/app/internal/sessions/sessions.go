@@ -0,0 +1,172 @@
+package sessions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+)
+
+const SessionsName = "sessions"
+
+// The revocations are cached for a few seconds so the middleware doesn't
+// call redis on every request, another instance may take this long to see a
+// logout
+const (
+	cacheTTL = 5 * time.Second
+	maxCacheEntries = 10000
+)
+
+type cacheEntry struct {
+	value string
+	expiresAt time.Time
+}
+
+var (
+	cache = map[string]cacheEntry{}
+	cacheMutex sync.Mutex
+)
+
+func revokedTokenKey(tokenId string) string {
+	return fmt.Sprintf("revoked-token:%s", tokenId)
+}
+
+func tokensBeforeKey(user string) string {
+	return fmt.Sprintf("tokens-before:%s", user)
+}
+
+// RevokeToken adds the jti of a token to the revocation list until the token
+// expires
+func RevokeToken(tokenId string, expiresAt time.Time, ctx context.Context) error {
+	tr := otel.Tracer(SessionsName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.RevokeToken", SessionsName))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("TokenId", tokenId),
+	)
+
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	key := revokedTokenKey(tokenId)
+	if err := platform.SaveSecretWithTTL(key, "1", ttl, ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	remember(key, "1")
+
+	return nil
+}
+
+// RevokeUserTokens rejects every token of the user issued until at
+func RevokeUserTokens(user string, at time.Time, ctx context.Context) error {
+	tr := otel.Tracer(SessionsName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.RevokeUserTokens", SessionsName))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("UserUuid", user),
+	)
+
+	key := tokensBeforeKey(user)
+	value := strconv.FormatInt(at.Unix(), 10)
+
+	if err := platform.SaveSecret(key, value, ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	remember(key, value)
+
+	return nil
+}
+
+// IsRevoked checks the jti in the revocation list and the issue date against
+// the last logout of every session of the user
+func IsRevoked(tokenId string, user string, issuedAt time.Time, ctx context.Context) (bool, error) {
+	if tokenId != "" {
+		revoked, err := lookup(revokedTokenKey(tokenId), ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if revoked != "" {
+			return true, nil
+		}
+	}
+
+	before, err := lookup(tokensBeforeKey(user), ctx)
+	if err != nil || before == "" {
+		return false, err
+	}
+
+	seconds, err := strconv.ParseInt(before, 10, 64)
+	if err != nil {
+		return false, err
+	}
+
+	// iat has seconds, a token of the same second as the logout is rejected
+	return issuedAt.Unix() <= seconds, nil
+}
+
+func lookup(key string, ctx context.Context) (string, error) {
+	cacheMutex.Lock()
+	entry, ok := cache[key]
+	cacheMutex.Unlock()
+
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+
+	value, err := platform.GetSecret(key, ctx)
+	if errors.Is(err, platform.ErrSecretNotFound) {
+		value, err = "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	remember(key, value)
+
+	return value, nil
+}
+
+func remember(key string, value string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	now := time.Now()
+
+	if len(cache) >= maxCacheEntries {
+		for cached, entry := range cache {
+			if now.After(entry.expiresAt) {
+				delete(cache, cached)
+			}
+		}
+
+		// Everything is still fresh, start again
+		if len(cache) >= maxCacheEntries {
+			cache = map[string]cacheEntry{}
+		}
+	}
+
+	cache[key] = cacheEntry{
+		value: value,
+		expiresAt: now.Add(cacheTTL),
+	}
+}
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/sessions"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	log "github.com/sirupsen/logrus"
+)
+
+const AccountDeletionsJobName = "account-deletions-job"
+
+const (
+	accountDeletionsInterval = 10 * time.Minute
+	accountDeletionsBatchSize = 20
+)
+
+// StartAccountDeletions finalizes the deletions whose cooling-off period
+// ended. Each one is its own transaction, a request that is cancelled or
+// finalized by another instance in the meantime is skipped
+func StartAccountDeletions(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(accountDeletionsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := finalizeAccountDeletions(ctx); err != nil {
+						log.Error(err)
+					}
+			}
+		}
+	}()
+}
+
+func finalizeAccountDeletions(ctx context.Context) error {
+	tr := otel.Tracer(AccountDeletionsJobName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.FinalizeAccountDeletions", AccountDeletionsJobName))
+	defer span.End()
+
+	due, err := db.FetchDueAccountDeletions(accountDeletionsBatchSize, ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	finalized := 0
+	for _, deletion := range due {
+		objects, err := db.FinalizeAccountDeletion(deletion.UserUuid, ctx)
+
+		// The orders still open are waited on, the request is tried again on
+		// the next run
+		if errors.Is(err, db.ErrAccountDeletionNotFound) || errors.Is(err, db.ErrAccountHasOpenOrders) {
+			log.WithField("user", deletion.UserUuid).Info(err)
+			continue
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			log.WithField("user", deletion.UserUuid).Error(err)
+			continue
+		}
+
+		finalized += 1
+
+		// The account is already anonymized, an image left in the bucket or a
+		// token that lives until it expires is only logged
+		for _, object := range objects {
+			if err := platform.RemoveImage(object, ctx); err != nil {
+				span.RecordError(err)
+				log.WithFields(log.Fields{
+					"user": deletion.UserUuid,
+					"object": object,
+				}).Error(err)
+			}
+		}
+
+		if err := sessions.RevokeUserTokens(deletion.UserUuid, time.Now().UTC(), ctx); err != nil {
+			span.RecordError(err)
+			log.WithField("user", deletion.UserUuid).Error(err)
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("Due", len(due)),
+		attribute.Int("Finalized", finalized),
+	)
+	span.SetStatus(codes.Ok, "Account deletions processed")
+
+	return nil
+}
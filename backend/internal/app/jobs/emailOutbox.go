@@ -0,0 +1,214 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	log "github.com/sirupsen/logrus"
+)
+
+const EmailOutboxJobName = "email-outbox-job"
+
+const (
+	outboxPollInterval = 5 * time.Second
+	outboxBatchSize = 20
+	// The sent emails are kept this long for the support questions
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+type outboxMetrics struct {
+	sent metric.Int64Counter
+	failures metric.Int64Counter
+	deadLettered metric.Int64Counter
+	delay metric.Float64Histogram
+}
+
+// StartEmailOutbox delivers the emails of the outbox in the background, every
+// instance of the API can run it because the claims skip the locked rows
+func StartEmailOutbox(ctx context.Context) {
+	metrics, err := newOutboxMetrics()
+	if err != nil {
+		log.Error(err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+
+		lastPurge := time.Time{}
+
+		for {
+			select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					// A full batch means there could be more due emails
+					for {
+						claimed, err := deliverOutboxEmails(metrics, ctx)
+						if err != nil {
+							log.Error(err)
+						}
+
+						if err != nil || claimed < outboxBatchSize {
+							break
+						}
+					}
+
+					if time.Since(lastPurge) >= time.Hour {
+						lastPurge = time.Now()
+						if _, err := db.PurgeSentOutboxEmails(time.Now().UTC().Add(-outboxRetention), ctx); err != nil {
+							log.Error(err)
+						}
+					}
+			}
+		}
+	}()
+}
+
+func newOutboxMetrics() (*outboxMetrics, error) {
+	meter := otel.Meter(EmailOutboxJobName)
+
+	sent, err := meter.Int64Counter("email.outbox.sent", metric.WithDescription("Emails delivered to the SMTP server"))
+	if err != nil {
+		return nil, err
+	}
+
+	failures, err := meter.Int64Counter("email.outbox.failures", metric.WithDescription("Failed delivery attempts"))
+	if err != nil {
+		return nil, err
+	}
+
+	deadLettered, err := meter.Int64Counter("email.outbox.dead_lettered", metric.WithDescription("Emails that ran out of attempts"))
+	if err != nil {
+		return nil, err
+	}
+
+	delay, err := meter.Float64Histogram(
+		"email.outbox.delivery_delay",
+		metric.WithDescription("Time between the enqueue and the delivery"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// The size of each state is read from the table on every collection
+	_, err = meter.Int64ObservableGauge(
+		"email.outbox.emails",
+		metric.WithDescription("Emails of the outbox by status"),
+		metric.WithInt64Callback(func(ctx context.Context, observer metric.Int64Observer) error {
+			counts, err := db.CountOutboxEmails(ctx)
+			if err != nil {
+				return err
+			}
+
+			for status, count := range counts {
+				observer.Observe(count, metric.WithAttributes(attribute.String("status", status)))
+			}
+
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &outboxMetrics{
+		sent: sent,
+		failures: failures,
+		deadLettered: deadLettered,
+		delay: delay,
+	}, nil
+}
+
+// deliverOutboxEmails sends one batch of due emails and returns how many it
+// claimed, the metrics are optional
+func deliverOutboxEmails(metrics *outboxMetrics, ctx context.Context) (int, error) {
+	tr := otel.Tracer(EmailOutboxJobName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.DeliverOutboxEmails", EmailOutboxJobName))
+	defer span.End()
+
+	claimed, err := db.ClaimOutboxEmails(outboxBatchSize, ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("Claimed", len(claimed)),
+	)
+
+	for _, email := range claimed {
+		template := metric.WithAttributes(attribute.String("template", email.Template))
+
+		if sendErr := platform.SendEmail(outboxEmailMessage(email)); sendErr != nil {
+			span.RecordError(sendErr)
+
+			deadLetter, err := db.MarkOutboxEmailFailed(email, sendErr, ctx)
+			if err != nil {
+				span.RecordError(err)
+			}
+
+			if metrics != nil {
+				metrics.failures.Add(ctx, 1, template)
+				if deadLetter {
+					metrics.deadLettered.Add(ctx, 1, template)
+				}
+			}
+
+			log.WithFields(log.Fields{
+				"email": email.Uuid,
+				"template": email.Template,
+				"attempts": email.Attempts,
+				"dead_letter": deadLetter,
+			}).Error(sendErr)
+			continue
+		}
+
+		if err := db.MarkOutboxEmailSent(email, ctx); err != nil {
+			// The email is sent again after the lease with the same
+			// Message-ID, so the copy is discarded
+			span.RecordError(err)
+			log.WithField("email", email.Uuid).Error(err)
+		}
+
+		if metrics != nil {
+			metrics.sent.Add(ctx, 1, template)
+			metrics.delay.Record(ctx, time.Since(email.CreatedAt).Seconds(), template)
+		}
+	}
+
+	span.SetStatus(codes.Ok, "Outbox emails processed")
+
+	return len(claimed), nil
+}
+
+func outboxEmailMessage(email dao.OutboxEmail) platform.Email {
+	attachments := make([]platform.EmailAttachment, 0, len(email.Attachments))
+	for _, attachment := range email.Attachments {
+		attachments = append(attachments, platform.EmailAttachment{
+			Name: attachment.Name,
+			ContentType: attachment.ContentType,
+			Content: attachment.Content,
+		})
+	}
+
+	return platform.Email{
+		To: email.Recipients,
+		Subject: email.Subject,
+		Text: email.TextBody,
+		HTML: email.HtmlBody,
+		Attachments: attachments,
+		MessageId: email.MessageId,
+	}
+}
@@ -0,0 +1,207 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	log "github.com/sirupsen/logrus"
+)
+
+const PendingPaymentsJobName = "pending-payments-job"
+
+const (
+	pendingPaymentsInterval = 5 * time.Minute
+	pendingPaymentsTTL = 30 * time.Minute
+	pendingPaymentsBatchSize = 20
+)
+
+// StartPendingPaymentsExpiry closes the tickets that are still waiting for
+// their payment after the ttl, the provider never confirmed them or the
+// database couldn't record what it answered. The payment is voided or
+// refunded and the units return to the stock.
+//
+// The cancelled tickets whose refund failed are refunded again on every run
+func StartPendingPaymentsExpiry(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(pendingPaymentsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := expirePendingPayments(ctx); err != nil {
+						log.Error(err)
+					}
+			}
+		}
+	}()
+}
+
+func expirePendingPayments(ctx context.Context) error {
+	tr := otel.Tracer(PendingPaymentsJobName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.ExpirePendingPayments", PendingPaymentsJobName))
+	defer span.End()
+
+	stale, err := db.FetchStalePendingTickets(time.Now().UTC().Add(-pendingPaymentsTTL), pendingPaymentsBatchSize, ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	expired := 0
+	for _, ticket := range stale {
+		err := expireTicket(ticket.Uuid, ctx)
+
+		// Paid, cancelled or shipped in the meantime, there is nothing to expire
+		if errors.Is(err, db.ErrTicketClosed) || errors.Is(err, db.ErrTicketNotFound) || errors.Is(err, db.ErrOrderShipped) {
+			log.WithField("ticket", ticket.Uuid).Info(err)
+			continue
+		}
+
+		if err != nil {
+			span.RecordError(err)
+			log.WithField("ticket", ticket.Uuid).Error(err)
+			continue
+		}
+
+		expired += 1
+	}
+
+	unrefunded, err := db.FetchUnrefundedTickets(time.Now().UTC().Add(-pendingPaymentsInterval), pendingPaymentsBatchSize, ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	refunded := 0
+	for _, ticketID := range unrefunded {
+		if err := RefundTicket(ticketID, ctx); err != nil {
+			span.RecordError(err)
+			log.WithField("ticket", ticketID).Error(err)
+			continue
+		}
+
+		refunded += 1
+	}
+
+	span.SetAttributes(
+		attribute.Int("Stale", len(stale)),
+		attribute.Int("Expired", expired),
+		attribute.Int("Unrefunded", len(unrefunded)),
+		attribute.Int("Refunded", refunded),
+	)
+	span.SetStatus(codes.Ok, "Pending payments processed")
+
+	return nil
+}
+
+// expireTicket gives back the payment of the ticket, if any, and closes it
+func expireTicket(ticketID string, ctx context.Context) error {
+	intent, err := db.FetchPaymentIntent(ticketID, ctx)
+	if errors.Is(err, db.ErrPaymentIntentNotFound) {
+		return db.ReleaseTicket(ticketID, dao.StockActorPayments, ctx)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if intent.Status != dao.PaymentIntentPending && intent.Status != dao.PaymentIntentAuthorized {
+		// The intent already failed but its ticket wasn't closed
+		if intent.Status != dao.PaymentIntentCaptured {
+			return db.ReleaseTicket(ticketID, dao.StockActorPayments, ctx)
+		}
+
+		return nil
+	}
+
+	status := dao.PaymentIntentTimedOut
+	if intent.ProviderRef != nil {
+		provider := platform.GetPaymentProvider()
+		if provider == nil {
+			return errors.New("Empty payment provider")
+		}
+
+		// A capture the database never recorded can only be refunded
+		status = dao.PaymentIntentVoided
+		if _, err := provider.Void(*intent.ProviderRef, ctx); err != nil {
+			if _, refundErr := provider.Refund(*intent.ProviderRef, intent.Amount, ctx); refundErr != nil {
+				return fmt.Errorf("The payment %s needs a manual review: %w", *intent.ProviderRef, errors.Join(err, refundErr))
+			}
+
+			status = dao.PaymentIntentRefunded
+		}
+	}
+
+	reason := "expired"
+	_, err = db.FailPaymentIntent(intent.Uuid, []string{dao.PaymentIntentPending, dao.PaymentIntentAuthorized}, status, nil, &reason, dao.StockActorPayments, ctx)
+	return err
+}
+
+// RefundTicket gives the money of a cancelled ticket back, captured payments
+// are refunded and the ones still in flight are voided
+func RefundTicket(ticketID string, ctx context.Context) error {
+	tr := otel.Tracer(PendingPaymentsJobName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.RefundTicket", PendingPaymentsJobName))
+	defer span.End()
+
+	intent, err := db.FetchPaymentIntent(ticketID, ctx)
+	if errors.Is(err, db.ErrPaymentIntentNotFound) {
+		// Tickets created before the payment step
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	provider := platform.GetPaymentProvider()
+	if provider == nil {
+		return errors.New("Empty payment provider")
+	}
+
+	span.SetAttributes(
+		attribute.String("IntentId", intent.Uuid),
+		attribute.String("PaymentStatus", intent.Status),
+	)
+
+	switch intent.Status {
+		case dao.PaymentIntentCaptured:
+			if _, err := provider.Refund(*intent.ProviderRef, intent.Amount, ctx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return err
+			}
+
+			_, err = db.TransitionPaymentIntent(intent.Uuid, []string{dao.PaymentIntentCaptured}, dao.PaymentIntentRefunded, nil, nil, ctx)
+			return err
+
+		case dao.PaymentIntentAuthorized, dao.PaymentIntentPending:
+			if intent.ProviderRef != nil {
+				if _, err := provider.Void(*intent.ProviderRef, ctx); err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+					return err
+				}
+			}
+
+			_, err = db.TransitionPaymentIntent(intent.Uuid, []string{dao.PaymentIntentAuthorized, dao.PaymentIntentPending}, dao.PaymentIntentVoided, nil, nil, ctx)
+			return err
+
+		default:
+			return nil
+	}
+}
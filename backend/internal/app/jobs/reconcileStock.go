@@ -0,0 +1,30 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReconcileStock logs every product whose quantity doesn't match the sum of
+// its stock ledger and reports if any drifted
+func ReconcileStock(ctx context.Context) (bool, error) {
+	drifts, err := db.ReconcileStock(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, drift := range drifts {
+		log.WithFields(log.Fields{
+			"product": drift.Product,
+			"name": drift.Name,
+			"quantity": drift.Quantity,
+			"ledger_quantity": drift.LedgerQuantity,
+			"drift": drift.Drift,
+		}).Warn("Stock drift")
+	}
+
+	return len(drifts) > 0, nil
+}
@@ -0,0 +1,141 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"net/http"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/internal/db"
+	"github.com/OscarVillanueva/goapi/internal/app/internal/emails"
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/models/requests"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	log "github.com/sirupsen/logrus"
+)
+
+const StockAlertsJobName = "stock-alerts-job"
+
+// A product sends the same kind of alert at most once in this window
+const stockAlertDebounce = 6 * time.Hour
+
+// The urls are given by the sellers, the client only reaches public addresses
+var webhookClient = platform.NewPublicClient(5 * time.Second)
+
+// NotifyStockAlerts emails the seller and calls its webhooks for every alert
+// raised by a purchase, failures are logged because the sale already happened
+func NotifyStockAlerts(alerts []requests.StockAlert, ctx context.Context) {
+	tr := otel.Tracer(StockAlertsJobName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.NotifyStockAlerts", StockAlertsJobName))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.Int("Alerts", len(alerts)),
+	)
+
+	for _, alert := range alerts {
+		if !acquireStockAlert(alert, ctx) {
+			span.AddEvent(fmt.Sprintf("Debounced %s alert of %s", alert.Kind, alert.Product))
+			continue
+		}
+
+		if err := emailStockAlert(alert, ctx); err != nil {
+			span.RecordError(err)
+			log.WithFields(log.Fields{
+				"product": alert.Product,
+				"kind": alert.Kind,
+			}).Error(err)
+		}
+
+		webhooks, err := db.FetchSellerWebhooks(alert.Seller, ctx)
+		if err != nil {
+			span.RecordError(err)
+			continue
+		}
+
+		for _, webhook := range webhooks {
+			if err := deliverStockAlert(webhook, alert, ctx); err != nil {
+				span.RecordError(err)
+				log.WithFields(log.Fields{
+					"product": alert.Product,
+					"kind": alert.Kind,
+					"webhook": webhook.Uuid,
+				}).Error(err)
+			}
+		}
+	}
+
+	span.SetStatus(codes.Ok, "Stock alerts processed")
+}
+
+// acquireStockAlert reserves the alert in redis for the debounce window, if
+// redis is down the alert is sent anyway
+func acquireStockAlert(alert requests.StockAlert, ctx context.Context) bool {
+	key := fmt.Sprintf("stock-alert:%s:%s", alert.Kind, alert.Product)
+
+	acquired, err := platform.SaveSecretIfAbsent(key, alert.At.Format(time.RFC3339), stockAlertDebounce, ctx)
+	if err != nil {
+		return true
+	}
+
+	return acquired
+}
+
+func emailStockAlert(alert requests.StockAlert, ctx context.Context) error {
+	seller, err := db.FetchUserByUuid(alert.Seller, ctx)
+	if err != nil {
+		return err
+	}
+
+	template := emails.LowStock
+	if alert.Kind == requests.StockAlertOut {
+		template = emails.OutOfStock
+	}
+
+	data := emails.StockAlertData{
+		Seller: seller.Name,
+		Alert: alert,
+	}
+
+	email, err := emails.Compose(template, emails.DefaultLocale, []string{seller.Email}, data)
+	if err != nil {
+		return err
+	}
+
+	return db.EnqueueEmail(template, email, ctx)
+}
+
+func deliverStockAlert(webhook dao.SellerWebhook, alert requests.StockAlert, ctx context.Context) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Stock-Event", alert.Kind)
+	req.Header.Set("X-Stock-Signature", platform.SignWebhookWith(webhook.Secret, body, time.Now()))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+package dao
+
+import "time"
+
+// AccountDeletion is the request of a user to delete the account, it's
+// completed by the account deletions job after the scheduled date
+type AccountDeletion struct {
+	UserUuid string `json:"-" gorm:"primaryKey"`
+	RequestedAt time.Time `json:"requested_at"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
@@ -0,0 +1,35 @@
+package dao
+
+import "time"
+
+type Address struct {
+	Uuid string `json:"uuid"`
+	Owner string `json:"owner"`
+	Label *string `json:"label"`
+	Recipient string `json:"recipient"`
+	Line1 string `json:"line1"`
+	Line2 *string `json:"line2"`
+	City string `json:"city"`
+	Region string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Country string `json:"country"`
+	Phone *string `json:"phone"`
+	IsDefault bool `json:"is_default"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// Snapshot copies the fields a ticket keeps, so editing or deleting the
+// address later doesn't change where an order was sent
+func (a Address) Snapshot() TicketAddress {
+	return TicketAddress{
+		Recipient: a.Recipient,
+		Line1: a.Line1,
+		Line2: a.Line2,
+		City: a.City,
+		Region: a.Region,
+		PostalCode: a.PostalCode,
+		Country: a.Country,
+		Phone: a.Phone,
+	}
+}
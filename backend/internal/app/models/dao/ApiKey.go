@@ -0,0 +1,46 @@
+package dao
+
+import (
+	"fmt"
+	"time"
+	"encoding/json"
+	"database/sql/driver"
+)
+
+// ApiKey lets an integration act as its user without the email login, only
+// the hash of the key is stored and the prefix identifies it in the lists
+type ApiKey struct {
+	Uuid string `json:"uuid"`
+	UserUuid string `json:"user_uuid"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	KeyHash string `json:"-"`
+	Scopes ApiKeyScopes `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// ApiKeyScopes are the permissions the key can use, never more than the
+// permissions of its user
+type ApiKeyScopes []string
+
+func (s ApiKeyScopes) Value() (driver.Value, error) {
+	if s == nil {
+		return json.Marshal([]string{})
+	}
+
+	return json.Marshal([]string(s))
+}
+
+func (s *ApiKeyScopes) Scan(value interface{}) error {
+	switch data := value.(type) {
+		case []byte:
+			return json.Unmarshal(data, s)
+		case string:
+			return json.Unmarshal([]byte(data), s)
+		default:
+			return fmt.Errorf("Unsupported scopes value: %T", value)
+	}
+}
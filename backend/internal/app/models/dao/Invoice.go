@@ -0,0 +1,16 @@
+package dao
+
+import "time"
+
+type Invoice struct {
+	Uuid string `json:"uuid"`
+	TicketId string `json:"ticket_id"`
+	Seller string `json:"seller"`
+	Number int64 `json:"number"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type InvoiceSequence struct {
+	Seller string `gorm:"primaryKey"`
+	LastNumber int64
+}
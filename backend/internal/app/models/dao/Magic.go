@@ -2,9 +2,22 @@ package dao
 
 import "time"
 
+// The purpose of a code, a link can only do what its email asked for. The
+// change_email codes never sign in
+const (
+	MagicPurposeVerify = "verify"
+	MagicPurposeLogin = "login"
+	MagicPurposeChangeEmail = "change_email"
+)
+
 type Magic struct {
 	Token string
 	ExpirationDate time.Time
 	BelongsTo string
+	Attempts int
+	Purpose string
+	// LinkHash is the hash of the nonce of the signed link sent with the code
+	LinkHash string
+	// NewEmail is the address a change_email code confirms
+	NewEmail string
 }
-
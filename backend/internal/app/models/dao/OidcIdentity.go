@@ -0,0 +1,13 @@
+package dao
+
+import "time"
+
+// OidcIdentity links the subject of an OIDC provider to a user
+type OidcIdentity struct {
+	Issuer string `gorm:"primaryKey"`
+	Subject string `gorm:"primaryKey"`
+	UserUuid string
+	Email string
+	CreatedAt time.Time
+	LastLoginAt time.Time
+}
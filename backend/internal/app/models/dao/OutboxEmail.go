@@ -0,0 +1,87 @@
+package dao
+
+import (
+	"fmt"
+	"time"
+	"encoding/json"
+	"database/sql/driver"
+)
+
+const (
+	OutboxEmailPending = "pending"
+	OutboxEmailSent = "sent"
+	// OutboxEmailFailed is the dead letter state, the worker stopped trying
+	// and only an admin sends it again
+	OutboxEmailFailed = "failed"
+)
+
+// OutboxEmail is a rendered email waiting for the worker, the bodies and the
+// attachments aren't listed because they carry the codes of the users
+type OutboxEmail struct {
+	Uuid string `json:"uuid"`
+	Template string `json:"template"`
+	MessageId string `json:"message_id"`
+	Recipients JSONStrings `json:"recipients"`
+	Subject string `json:"subject"`
+	TextBody string `json:"-"`
+	HtmlBody string `json:"-"`
+	Attachments OutboxAttachments `json:"-"`
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError *string `json:"last_error"`
+	SentAt *time.Time `json:"sent_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+type OutboxAttachment struct {
+	Name string `json:"name"`
+	ContentType string `json:"content_type"`
+	Content []byte `json:"content"`
+}
+
+type JSONStrings []string
+
+func (s JSONStrings) Value() (driver.Value, error) {
+	if s == nil {
+		return json.Marshal([]string{})
+	}
+
+	return json.Marshal([]string(s))
+}
+
+func (s *JSONStrings) Scan(value interface{}) error {
+	switch data := value.(type) {
+		case []byte:
+			return json.Unmarshal(data, s)
+		case string:
+			return json.Unmarshal([]byte(data), s)
+		default:
+			return fmt.Errorf("Unsupported recipients value: %T", value)
+	}
+}
+
+type OutboxAttachments []OutboxAttachment
+
+func (a OutboxAttachments) Value() (driver.Value, error) {
+	if a == nil {
+		return json.Marshal([]OutboxAttachment{})
+	}
+
+	return json.Marshal([]OutboxAttachment(a))
+}
+
+func (a *OutboxAttachments) Scan(value interface{}) error {
+	switch data := value.(type) {
+		case nil:
+			*a = nil
+			return nil
+		case []byte:
+			return json.Unmarshal(data, a)
+		case string:
+			return json.Unmarshal([]byte(data), a)
+		default:
+			return fmt.Errorf("Unsupported attachments value: %T", value)
+	}
+}
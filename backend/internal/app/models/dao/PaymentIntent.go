@@ -0,0 +1,27 @@
+package dao
+
+import "time"
+
+const (
+	PaymentIntentPending = "pending"
+	PaymentIntentAuthorized = "authorized"
+	PaymentIntentCaptured = "captured"
+	PaymentIntentDeclined = "declined"
+	PaymentIntentTimedOut = "timed_out"
+	PaymentIntentRefunded = "refunded"
+	PaymentIntentVoided = "voided"
+)
+
+type PaymentIntent struct {
+	Uuid string `json:"uuid"`
+	TicketId string `json:"ticket_id"`
+	Buyer string `json:"buyer"`
+	Provider string `json:"provider"`
+	ProviderRef *string `json:"provider_ref"`
+	Amount float32 `json:"amount"`
+	Currency string `json:"currency"`
+	Status string `json:"status"`
+	FailureReason *string `json:"failure_reason"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
@@ -9,6 +9,11 @@ type Product struct {
 	Quantity int32 `json:"quantity"`
 	Image *string `json:"image"`
 	BelongsTo string `json:"belongs_to"`
+	LowStockThreshold *int32 `json:"low_stock_threshold"`
+	RatingAverage float32 `json:"rating_average"`
+	RatingCount int32 `json:"rating_count"`
+	RatingSum int64 `json:"-"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt *time.Time `json:"updated_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
 }
@@ -3,11 +3,15 @@ package dao
 import "time"
 
 type Purchase struct {
-	Uuid string
-	TicketId string
-	Product string
-	Quantity int32
-	Price float32
-	PurchasedBy string
-	CreatedAt time.Time
+	Uuid string `json:"uuid"`
+	TicketId string `json:"ticket_id"`
+	SubOrderId string `json:"sub_order_id"`
+	Product string `json:"product"`
+	ProductName string `json:"product_name"`
+	ProductImage *string `json:"product_image"`
+	Seller string `json:"seller"`
+	Quantity int32 `json:"quantity"`
+	Price float32 `json:"price"`
+	PurchasedBy string `json:"purchased_by"`
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,17 @@
+package dao
+
+import "time"
+
+// RefreshToken is one link of a family, every rotation uses the token and
+// creates the next one. Only the hash of the token is stored
+type RefreshToken struct {
+	Uuid string
+	FamilyId string
+	UserUuid string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt *time.Time
+	RevokedAt *time.Time
+	ReplacedBy *string
+	CreatedAt time.Time
+}
@@ -0,0 +1,41 @@
+package dao
+
+import "time"
+
+const (
+	ReviewPublished = "published"
+	ReviewHidden = "hidden"
+)
+
+type Review struct {
+	Uuid string `json:"uuid"`
+	Product string `json:"product"`
+	Author string `json:"author"`
+	Rating int32 `json:"rating"`
+	Title string `json:"title"`
+	Body string `json:"body"`
+	Status string `json:"status"`
+	FlagCount int32 `json:"-"`
+	Reply *string `json:"reply"`
+	RepliedAt *time.Time `json:"replied_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+type ReviewImage struct {
+	Uuid string `json:"uuid"`
+	ReviewId string `json:"review_id"`
+	ObjectName string `json:"-"`
+	Url string `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReviewFlag is a report of a user about a review, enough reports hide it
+// until it's moderated
+type ReviewFlag struct {
+	Uuid string `json:"uuid"`
+	ReviewId string `json:"review_id"`
+	Reporter string `json:"reporter"`
+	Reason string `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,37 @@
+package dao
+
+import "time"
+
+// Permissions checked by the routes, the roles group them
+const (
+	PermissionProductsWrite = "products:write"
+	PermissionOrdersFulfil = "orders:fulfil"
+	PermissionAdminUsers = "admin:users"
+	PermissionAdminEmails = "admin:emails"
+	PermissionAdminPayments = "admin:payments"
+)
+
+// Every account gets the member role, it keeps what any user could do before
+// the roles existed
+const (
+	RoleMember = "member"
+	RoleAdmin = "admin"
+)
+
+type Role struct {
+	Name string `json:"name" gorm:"primaryKey"`
+	Description string `json:"description"`
+	Permissions []string `json:"permissions" gorm:"-"`
+}
+
+type RolePermission struct {
+	Role string
+	Permission string
+}
+
+type UserRole struct {
+	UserUuid string `json:"user_uuid"`
+	Role string `json:"role"`
+	AssignedBy *string `json:"assigned_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,18 @@
+package dao
+
+import "time"
+
+// SellerSettings keeps the defaults of a seller for all of its products
+type SellerSettings struct {
+	Seller string `json:"seller" gorm:"primaryKey"`
+	LowStockThreshold *int32 `json:"low_stock_threshold"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+type SellerWebhook struct {
+	Uuid string `json:"uuid"`
+	Seller string `json:"seller"`
+	Url string `json:"url"`
+	Secret string `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,28 @@
+package dao
+
+import "time"
+
+const (
+	StockSale = "sale"
+	StockCancellation = "cancellation"
+	StockManualAdjustment = "manual_adjustment"
+	StockReturn = "return"
+	StockImport = "import"
+)
+
+// StockActorPayments is the actor of the movements that come from the
+// payment provider instead of a user
+const StockActorPayments = "system:payments"
+
+// StockMovement is an append only row of the inventory ledger, every change
+// of Product.Quantity writes one in the same transaction
+type StockMovement struct {
+	Uuid string `json:"uuid"`
+	Product string `json:"product"`
+	Delta int32 `json:"delta"`
+	ResultingQuantity int32 `json:"resulting_quantity"`
+	Reason string `json:"reason"`
+	ReferenceId *string `json:"reference_id"`
+	Actor string `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
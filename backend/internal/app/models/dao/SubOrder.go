@@ -0,0 +1,52 @@
+package dao
+
+import (
+	"time"
+	"slices"
+)
+
+const (
+	SubOrderPlaced = "placed"
+	SubOrderCancelled = "cancelled"
+)
+
+const (
+	FulfillmentUnfulfilled = "unfulfilled"
+	FulfillmentPacked = "packed"
+	FulfillmentShipped = "shipped"
+	FulfillmentDelivered = "delivered"
+)
+
+// The fulfillment only moves forward, a step can be skipped but never undone
+var fulfillmentSteps = []string{
+	FulfillmentUnfulfilled,
+	FulfillmentPacked,
+	FulfillmentShipped,
+	FulfillmentDelivered,
+}
+
+// CanAdvanceFulfillment reports if the fulfillment can go from one status to
+// the other, keeping the same status only updates the tracking number
+func CanAdvanceFulfillment(from string, to string) bool {
+	current := slices.Index(fulfillmentSteps, from)
+	next := slices.Index(fulfillmentSteps, to)
+
+	return current >= 0 && next >= current
+}
+
+// SubOrder is the part of a ticket that a single seller has to fulfil
+type SubOrder struct {
+	Uuid string `json:"uuid"`
+	TicketId string `json:"ticket_id"`
+	Seller string `json:"seller"`
+	Buyer string `json:"buyer"`
+	Status string `json:"status"`
+	Units int32 `json:"units"`
+	Subtotal float32 `json:"subtotal"`
+	Total float32 `json:"total"`
+	FulfillmentStatus string `json:"fulfillment_status"`
+	TrackingNumber *string `json:"tracking_number"`
+	FulfilledAt *time.Time `json:"fulfilled_at"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
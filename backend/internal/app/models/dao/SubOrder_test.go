@@ -0,0 +1,31 @@
+package dao
+
+import "testing"
+
+func TestCanAdvanceFulfillment(t *testing.T) {
+	cases := []struct {
+		from string
+		to string
+		allowed bool
+	}{
+		{FulfillmentUnfulfilled, FulfillmentPacked, true},
+		{FulfillmentPacked, FulfillmentShipped, true},
+		{FulfillmentShipped, FulfillmentDelivered, true},
+		{FulfillmentUnfulfilled, FulfillmentShipped, true},
+		{FulfillmentShipped, FulfillmentShipped, true},
+		{FulfillmentPacked, FulfillmentUnfulfilled, false},
+		{FulfillmentShipped, FulfillmentPacked, false},
+		{FulfillmentDelivered, FulfillmentShipped, false},
+		{FulfillmentDelivered, FulfillmentUnfulfilled, false},
+		{"", FulfillmentPacked, false},
+		{FulfillmentPacked, "returned", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.from + "->" + c.to, func(t *testing.T) {
+			if allowed := CanAdvanceFulfillment(c.from, c.to); allowed != c.allowed {
+				t.Fatalf("CanAdvanceFulfillment(%q, %q) = %v, want %v", c.from, c.to, allowed, c.allowed)
+			}
+		})
+	}
+}
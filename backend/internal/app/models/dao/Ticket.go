@@ -1,9 +1,60 @@
 package dao
 
-import "time"
+import (
+	"fmt"
+	"time"
+	"encoding/json"
+	"database/sql/driver"
+)
 
+const (
+	TicketPendingPayment = "pending_payment"
+	TicketPaid = "paid"
+	TicketPaymentFailed = "payment_failed"
+	TicketCancelled = "cancelled"
+)
+
+// Ticket is the parent order of a checkout, it's written in the same
+// transaction as its purchase lines
 type Ticket struct {
-	TicketId string `json:"ticket_id"`
+	Uuid string `json:"ticket_id"`
+	Buyer string `json:"buyer"`
+	Status string `json:"status"`
+	PaymentStatus *string `json:"payment_status"`
+	Lines int32 `json:"lines"`
+	Units int32 `json:"units"`
+	Subtotal float32 `json:"subtotal"`
 	Total float32 `json:"total"`
+	Notes *string `json:"notes"`
+	ShippingAddress *TicketAddress `json:"shipping_address"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// TicketAddress is the copy of the address the ticket was shipped to, it's
+// stored as json so later changes to the address book don't rewrite it
+type TicketAddress struct {
+	Recipient string `json:"recipient"`
+	Line1 string `json:"line1"`
+	Line2 *string `json:"line2"`
+	City string `json:"city"`
+	Region string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Country string `json:"country"`
+	Phone *string `json:"phone"`
+}
+
+func (a TicketAddress) Value() (driver.Value, error) {
+	return json.Marshal(a)
+}
+
+func (a *TicketAddress) Scan(value interface{}) error {
+	switch data := value.(type) {
+		case []byte:
+			return json.Unmarshal(data, a)
+		case string:
+			return json.Unmarshal([]byte(data), a)
+		default:
+			return fmt.Errorf("Unsupported address value: %T", value)
+	}
 }
@@ -0,0 +1,25 @@
+package dao
+
+import "time"
+
+type Wishlist struct {
+	Uuid string `json:"uuid"`
+	Owner string `json:"owner"`
+	Name string `json:"name"`
+	ShareId *string `json:"-"`
+	SharedUntil *time.Time `json:"shared_until"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// WishlistItem keeps the name and price the product had when it was added,
+// ProductRemovedAt is set when the seller deletes the product
+type WishlistItem struct {
+	Uuid string `json:"uuid"`
+	WishlistId string `json:"wishlist_id"`
+	Product string `json:"product"`
+	ProductName string `json:"product_name"`
+	PriceAtAdd float32 `json:"price_at_add"`
+	ProductRemovedAt *time.Time `json:"product_removed_at"`
+	AddedAt time.Time `json:"added_at"`
+}
@@ -0,0 +1,6 @@
+package parameters
+
+type CheckoutOptions struct {
+	// BlockSelfPurchase rejects tickets where the buyer owns any of the products
+	BlockSelfPurchase bool
+}
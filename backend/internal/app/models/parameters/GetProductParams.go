@@ -8,5 +8,7 @@ type GetProductsParams struct {
 	Context context.Context
 	OnlyAvailable bool
 	SearchName string
+	SortByRating bool
+	OnlyLowStock bool
 }
 
@@ -0,0 +1,11 @@
+package parameters
+
+import "context"
+
+type GetSellerOrdersParams struct {
+	Seller string
+	Page int
+	Context context.Context
+	Status string
+	FulfillmentStatus string
+}
@@ -0,0 +1,26 @@
+package parameters
+
+import (
+	"time"
+	"context"
+)
+
+const (
+	TicketsNewestFirst = "-created_at"
+	TicketsOldestFirst = "created_at"
+	TicketsCheapestFirst = "total"
+	TicketsPriciestFirst = "-total"
+)
+
+type GetTicketsParams struct {
+	Buyer string
+	Page int
+	Context context.Context
+	From *time.Time
+	To *time.Time
+	MinTotal *float64
+	MaxTotal *float64
+	Product string
+	Seller string
+	Sort string
+}
@@ -0,0 +1,14 @@
+package requests
+
+import "github.com/OscarVillanueva/goapi/internal/app/models/dao"
+
+// AccountExport is the personal data of a user, the purchases are streamed
+// apart because they can be too many to keep in memory
+type AccountExport struct {
+	Profile Profile `json:"profile"`
+	Addresses []dao.Address `json:"addresses"`
+	Products []dao.Product `json:"products"`
+	Reviews []dao.Review `json:"reviews"`
+	ReviewImages []dao.ReviewImage `json:"review_images"`
+	Deletion *dao.AccountDeletion `json:"account_deletion"`
+}
@@ -0,0 +1,72 @@
+package requests
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+)
+
+// ApiKeyScopes are the permissions that can be given to a key
+var ApiKeyScopes = []string{
+	dao.PermissionProductsWrite,
+	dao.PermissionOrdersFulfil,
+}
+
+type CreateApiKey struct {
+	Name string `json:"name" validate:"required,trim,max=100"`
+	Scopes []string `json:"scopes" validate:"required,max=10"`
+	// The keys expire in 90 days when it's empty
+	ExpiresInDays *int `json:"expires_in_days" validate:"min=1,max=365"`
+}
+
+func (c *CreateApiKey) Validate() error {
+	return validation.Struct(c).Err()
+}
+
+func (c *CreateApiKey) Check(path string, errs *validation.Errors) {
+	checkScopes(validation.Join(path, "scopes"), c.Scopes, errs)
+}
+
+// UpdateApiKey only changes the fields that are sent
+type UpdateApiKey struct {
+	Name *string `json:"name" validate:"trim,max=100"`
+	Scopes *[]string `json:"scopes" validate:"max=10"`
+}
+
+func (u *UpdateApiKey) Validate() error {
+	return validation.Struct(u).Err()
+}
+
+// Check rejects the empty values, a key needs a name and at least one scope
+func (u *UpdateApiKey) Check(path string, errs *validation.Errors) {
+	if u.Name != nil && *u.Name == "" {
+		errs.Add(validation.Join(path, "name"), "required", "name is required")
+	}
+
+	if u.Scopes == nil {
+		return
+	}
+
+	if len(*u.Scopes) == 0 {
+		errs.Add(validation.Join(path, "scopes"), "required", "scopes is required")
+		return
+	}
+
+	checkScopes(validation.Join(path, "scopes"), *u.Scopes, errs)
+}
+
+// ApiKeyCreated is the only response that includes the key
+type ApiKeyCreated struct {
+	dao.ApiKey
+	Key string `json:"key"`
+}
+
+func checkScopes(path string, scopes []string, errs *validation.Errors) {
+	for i, scope := range scopes {
+		if !slices.Contains(ApiKeyScopes, scope) {
+			errs.Add(validation.Index(path, i), "one_of", "scopes should be one of " + strings.Join(ApiKeyScopes, ", "))
+		}
+	}
+}
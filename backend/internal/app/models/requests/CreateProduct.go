@@ -1,14 +1,13 @@
 package requests
 
-import (
-	"strings"
-	"errors"
-)
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
 
 type CreateProduct struct {
-	Name string `json:"name"`
-	Price float32 `json:"price"`
-	Quantity int32 `json:"quantity`
+	Name string `json:"name" validate:"required,trim,min=3,max=50"`
+	Price float32 `json:"price" validate:"min=0"`
+	Quantity int32 `json:"quantity" validate:"min=0"`
+	// Empty uses the default threshold of the seller
+	LowStockThreshold *int32 `json:"low_stock_threshold" validate:"min=0"`
 }
 
 type RequestSchema interface {
@@ -16,18 +15,5 @@ type RequestSchema interface {
 }
 
 func (c *CreateProduct) Validate() error {
-	trimedName := strings.TrimSpace(c.Name)
-
-	if trimedName == "" || (len(trimedName) < 3 && len(trimedName) > 50) {
-		return errors.New("The product name should be greater than 3 and less that 50")
-	}
-	if c.Price < 0 {
-		return errors.New("Price cannot be negative")
-	}
-	if c.Quantity < 0 {
-		return errors.New("Quantity cannot be negative")
-	}
-
-	return nil
+	return validation.Struct(c).Err()
 }
-
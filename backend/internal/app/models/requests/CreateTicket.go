@@ -0,0 +1,52 @@
+package requests
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+)
+
+// CreateTicket is the body of POST /purchase, the old body with only the
+// array of lines is still accepted. Without address_id or address the
+// default address of the buyer is used
+type CreateTicket struct {
+	Items []CreatePurchase `json:"items" validate:"required"`
+	Notes *string `json:"notes" validate:"trim,max=500"`
+	AddressId *string `json:"address_id" validate:"trim,uuid"`
+	Address *SaveAddress `json:"address"`
+
+	// The body was the old array, the failures are reported from the root
+	legacy bool
+}
+
+func (c *CreateTicket) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		c.Items = nil
+		c.legacy = true
+		return json.Unmarshal(trimmed, &c.Items)
+	}
+
+	type ticket CreateTicket
+	return json.Unmarshal(data, (*ticket)(c))
+}
+
+func (c *CreateTicket) Validate() error {
+	errs := validation.Struct(c)
+
+	if c.legacy {
+		errs = errs.Rebase("items", "")
+	}
+
+	return errs.Err()
+}
+
+func (c *CreateTicket) Check(path string, errs *validation.Errors) {
+	if c.Notes != nil && *c.Notes == "" {
+		c.Notes = nil
+	}
+
+	if c.AddressId != nil && c.Address != nil {
+		errs.Add(validation.Join(path, "address"), "conflict", "Send an address_id or an address, not both")
+	}
+}
@@ -0,0 +1,13 @@
+package requests
+
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
+
+// RedeemMagicLink comes from the confirmation page as a form or from an app
+// as json
+type RedeemMagicLink struct {
+	Token string `json:"token" validate:"required,trim"`
+}
+
+func (m *RedeemMagicLink) Validate() error {
+	return validation.Struct(m).Err()
+}
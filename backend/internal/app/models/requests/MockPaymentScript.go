@@ -0,0 +1,22 @@
+package requests
+
+import (
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+)
+
+type MockPaymentScript struct {
+	Outcomes []string `json:"outcomes" validate:"required"`
+}
+
+func (m *MockPaymentScript) Validate() error {
+	return validation.Struct(m).Err()
+}
+
+func (m *MockPaymentScript) Check(path string, errs *validation.Errors) {
+	for i, outcome := range m.Outcomes {
+		if !platform.IsMockOutcome(outcome) {
+			errs.Add(validation.Index(validation.Join(path, "outcomes"), i), "one_of", "The outcomes should be approve, decline, timeout, late or late_decline")
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package requests
+
+// OidcLoginState is kept in redis between the redirect to the provider and
+// the callback, the state of the query is its key. The binding is the hash of
+// the cookie given to the browser that started the login
+type OidcLoginState struct {
+	Nonce string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Binding string `json:"binding"`
+}
@@ -0,0 +1,11 @@
+package requests
+
+import (
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+type OutboxEmailsResponse struct {
+	Emails []dao.OutboxEmail `json:"emails"`
+	PageSize int `json:"page_size"`
+	Pages int `json:"pages"`
+}
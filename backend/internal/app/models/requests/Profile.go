@@ -0,0 +1,46 @@
+package requests
+
+import (
+	"time"
+
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+)
+
+// Profile is the user with the data of the token of the request
+type Profile struct {
+	Uuid string `json:"uuid"`
+	Name string `json:"name"`
+	Email string `json:"email"`
+	Verified bool `json:"verified"`
+	CreatedAt time.Time `json:"created_at"`
+	Roles []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+	TokenExpiresAt *time.Time `json:"token_expires_at,omitempty"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+}
+
+type UpdateProfile struct {
+	Name string `json:"name" validate:"required,trim,min=3,max=50"`
+}
+
+func (update *UpdateProfile) Validate() error {
+	return validation.Struct(update).Err()
+}
+
+// ChangeEmail sends a code to the new email, the account keeps the current
+// one until the code is confirmed
+type ChangeEmail struct {
+	Email string `json:"email" validate:"required,trim,email"`
+}
+
+func (change *ChangeEmail) Validate() error {
+	return validation.Struct(change).Err()
+}
+
+type ConfirmEmailChange struct {
+	Token string `json:"token" validate:"required,trim,len=6"`
+}
+
+func (confirm *ConfirmEmailChange) Validate() error {
+	return validation.Struct(confirm).Err()
+}
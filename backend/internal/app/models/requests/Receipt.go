@@ -0,0 +1,29 @@
+package requests
+
+import "time"
+
+type ReceiptLine struct {
+	Product string `json:"product"`
+	Name string `json:"name"`
+	Seller string `json:"seller"`
+	UnitPrice float32 `json:"unit_price"`
+	Quantity int32 `json:"quantity"`
+	Total float32 `json:"total"`
+}
+
+type ReceiptInvoice struct {
+	Seller string `json:"seller"`
+	SellerName string `json:"seller_name"`
+	Number int64 `json:"number"`
+}
+
+type Receipt struct {
+	TicketId string `json:"ticket_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Buyer string `json:"buyer"`
+	BuyerEmail string `json:"-"`
+	Lines []ReceiptLine `json:"lines"`
+	Invoices []ReceiptInvoice `json:"invoices"`
+	Subtotal float32 `json:"subtotal"`
+	Total float32 `json:"total"`
+}
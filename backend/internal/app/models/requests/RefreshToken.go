@@ -0,0 +1,28 @@
+package requests
+
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
+
+type RefreshToken struct {
+	RefreshToken string `json:"refresh_token" validate:"required,trim"`
+}
+
+func (r *RefreshToken) Validate() error {
+	return validation.Struct(r).Err()
+}
+
+// TokenPair is the session returned by the login and every refresh
+type TokenPair struct {
+	AccessToken string `json:"access_token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int64 `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Logout can close the refresh token of the session too
+type Logout struct {
+	RefreshToken *string `json:"refresh_token" validate:"trim"`
+}
+
+func (l *Logout) Validate() error {
+	return validation.Struct(l).Err()
+}
@@ -1,25 +1,11 @@
 package requests
 
-import (
-	"errors"
-	"strings"
-	"net/mail"
-)
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
 
 type ResendCode struct {
-	Email string `json:"email"`
+	Email string `json:"email" validate:"required,trim,email"`
 }
 
-func (resend ResendCode) Validate() error {
-	trimedEmail := strings.TrimSpace(resend.Email)
-
-	if trimedEmail == "" {
-		return errors.New("The email is required")
-	}
-
-	if _, err := mail.ParseAddress(trimedEmail); err != nil {
-		return errors.New("Invalid email")
-	}
-
-	return nil
+func (resend *ResendCode) Validate() error {
+	return validation.Struct(resend).Err()
 }
@@ -0,0 +1,19 @@
+package requests
+
+import (
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+type ReviewView struct {
+	dao.Review
+	AuthorName string `json:"author_name"`
+	Images []dao.ReviewImage `json:"images"`
+}
+
+type ReviewsResponse struct {
+	Reviews []ReviewView `json:"reviews"`
+	RatingAverage float32 `json:"rating_average"`
+	RatingCount int32 `json:"rating_count"`
+	PageSize int `json:"page_size"`
+	Pages int `json:"pages"`
+}
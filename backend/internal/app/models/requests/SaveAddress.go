@@ -0,0 +1,103 @@
+package requests
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+)
+
+type SaveAddress struct {
+	Label *string `json:"label" validate:"trim,max=40"`
+	Recipient string `json:"recipient" validate:"required,trim,max=100"`
+	Line1 string `json:"line1" validate:"required,trim,max=120"`
+	Line2 *string `json:"line2" validate:"trim,max=120"`
+	City string `json:"city" validate:"required,trim,max=80"`
+	Region string `json:"region" validate:"trim,upper,max=80"`
+	PostalCode string `json:"postal_code" validate:"required,trim,upper"`
+	Country string `json:"country" validate:"required,trim,upper"`
+	Phone *string `json:"phone" validate:"trim"`
+	IsDefault bool `json:"is_default"`
+}
+
+// countryRule is the postal code format of a supported country and whether it
+// needs a region, the state, province or prefecture of the address
+type countryRule struct {
+	postalCode *regexp.Regexp
+	regionRequired bool
+}
+
+var countryRules = map[string]countryRule{
+	"US": {regexp.MustCompile(`^\d{5}(-\d{4})?$`), true},
+	"MX": {regexp.MustCompile(`^\d{5}$`), true},
+	"CA": {regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), true},
+	"BR": {regexp.MustCompile(`^\d{5}-?\d{3}$`), true},
+	"JP": {regexp.MustCompile(`^\d{3}-?\d{4}$`), true},
+	"GB": {regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`), false},
+	"DE": {regexp.MustCompile(`^\d{5}$`), false},
+	"FR": {regexp.MustCompile(`^\d{5}$`), false},
+	"ES": {regexp.MustCompile(`^\d{5}$`), false},
+}
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9 ()-]{7,20}$`)
+
+func (s *SaveAddress) Validate() error {
+	return validation.Struct(s).Err()
+}
+
+// Check applies the rules of the country, the tags already trimmed the fields
+func (s *SaveAddress) Check(path string, errs *validation.Errors) {
+	s.Label = trimOptional(s.Label)
+	s.Line2 = trimOptional(s.Line2)
+	s.Phone = trimOptional(s.Phone)
+
+	if s.Country == "" {
+		return
+	}
+
+	rule, ok := countryRules[s.Country]
+	if !ok {
+		errs.Add(validation.Join(path, "country"), "unsupported_country", fmt.Sprintf("Unsupported country: %q", s.Country))
+		return
+	}
+
+	if rule.regionRequired && s.Region == "" {
+		errs.Add(validation.Join(path, "region"), "required", fmt.Sprintf("The region is required for %s addresses", s.Country))
+	}
+
+	if s.PostalCode != "" && !rule.postalCode.MatchString(s.PostalCode) {
+		errs.Add(validation.Join(path, "postal_code"), "postal_code", fmt.Sprintf("Invalid postal code for %s", s.Country))
+	}
+
+	if s.Phone != nil && !phonePattern.MatchString(*s.Phone) {
+		errs.Add(validation.Join(path, "phone"), "phone", "Invalid phone number")
+	}
+}
+
+func (s *SaveAddress) Snapshot() dao.TicketAddress {
+	return dao.TicketAddress{
+		Recipient: s.Recipient,
+		Line1: s.Line1,
+		Line2: s.Line2,
+		City: s.City,
+		Region: s.Region,
+		PostalCode: s.PostalCode,
+		Country: s.Country,
+		Phone: s.Phone,
+	}
+}
+
+func trimOptional(value *string) *string {
+	if value == nil {
+		return nil
+	}
+
+	trimmed := strings.TrimSpace(*value)
+	if trimmed == "" {
+		return nil
+	}
+
+	return &trimmed
+}
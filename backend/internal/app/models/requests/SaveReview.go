@@ -0,0 +1,29 @@
+package requests
+
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
+
+type SaveReview struct {
+	Rating int32 `json:"rating" validate:"min=1,max=5"`
+	Title string `json:"title" validate:"required,trim,max=120"`
+	Body string `json:"body" validate:"trim,max=5000"`
+}
+
+func (s *SaveReview) Validate() error {
+	return validation.Struct(s).Err()
+}
+
+type ReviewReply struct {
+	Body string `json:"body" validate:"required,trim,max=2000"`
+}
+
+func (r *ReviewReply) Validate() error {
+	return validation.Struct(r).Err()
+}
+
+type FlagReview struct {
+	Reason string `json:"reason" validate:"required,oneof=spam offensive off_topic fake other"`
+}
+
+func (f *FlagReview) Validate() error {
+	return validation.Struct(f).Err()
+}
@@ -0,0 +1,31 @@
+package requests
+
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
+
+type SaveWishlist struct {
+	Name string `json:"name" validate:"required,trim,max=60"`
+}
+
+func (s *SaveWishlist) Validate() error {
+	return validation.Struct(s).Err()
+}
+
+type AddWishlistItem struct {
+	Product string `json:"product" validate:"required,trim,uuid"`
+}
+
+func (a *AddWishlistItem) Validate() error {
+	return validation.Struct(a).Err()
+}
+
+type ShareWishlist struct {
+	ExpiresInDays int `json:"expires_in_days" validate:"min=1,max=365"`
+}
+
+func (s *ShareWishlist) Validate() error {
+	if s.ExpiresInDays == 0 {
+		s.ExpiresInDays = 90
+	}
+
+	return validation.Struct(s).Err()
+}
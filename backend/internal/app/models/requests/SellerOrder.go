@@ -0,0 +1,17 @@
+package requests
+
+import (
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+type SellerOrder struct {
+	dao.SubOrder
+	ShippingAddress *dao.TicketAddress `json:"shipping_address"`
+	Lines []TicketLine `json:"lines"`
+}
+
+type SellerOrdersResponse struct {
+	Orders []SellerOrder `json:"orders"`
+	PageSize int `json:"page_size"`
+	Pages int `json:"pages"`
+}
@@ -0,0 +1,75 @@
+package requests
+
+import (
+	"time"
+	"strings"
+	"net/url"
+	"net/netip"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+	"github.com/OscarVillanueva/goapi/internal/platform"
+)
+
+const (
+	StockAlertLow = "low_stock"
+	StockAlertOut = "out_of_stock"
+)
+
+// StockAlert is sent to the seller when a sale leaves a product under its
+// threshold or without units
+type StockAlert struct {
+	Kind string `json:"kind"`
+	Product string `json:"product"`
+	Name string `json:"name"`
+	Seller string `json:"seller"`
+	Quantity int32 `json:"quantity"`
+	Threshold int32 `json:"threshold"`
+	At time.Time `json:"at"`
+}
+
+type SaveStockAlertSettings struct {
+	// Empty disables the low stock alerts of the products without threshold
+	LowStockThreshold *int32 `json:"low_stock_threshold" validate:"min=0"`
+}
+
+func (s *SaveStockAlertSettings) Validate() error {
+	return validation.Struct(s).Err()
+}
+
+type CreateSellerWebhook struct {
+	Url string `json:"url" validate:"required,trim,max=500,url"`
+}
+
+func (c *CreateSellerWebhook) Validate() error {
+	return validation.Struct(c).Err()
+}
+
+// Check only takes public http urls, the names are checked again with the
+// resolved address on every delivery
+func (c *CreateSellerWebhook) Check(path string, errs *validation.Errors) {
+	field := validation.Join(path, "url")
+
+	// The url rule of the tag already rejects the rest
+	target, err := url.Parse(c.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return
+	}
+
+	host := strings.ToLower(target.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		errs.Add(field, "url", "url must be a public address")
+		return
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil && !platform.IsPublicAddress(addr) {
+		errs.Add(field, "url", "url must be a public address")
+	}
+}
+
+// SellerWebhookCreated is the only response that includes the secret used to
+// sign the deliveries
+type SellerWebhookCreated struct {
+	dao.SellerWebhook
+	Secret string `json:"secret"`
+}
@@ -0,0 +1,31 @@
+package requests
+
+import "testing"
+
+func TestCreateSellerWebhookUrl(t *testing.T) {
+	cases := []struct {
+		url string
+		valid bool
+	}{
+		{"https://hooks.example.com/stock", true},
+		{"http://93.184.216.34/stock", true},
+		{"http://localhost:4321/payments/webhook", false},
+		{"http://api.localhost/admin", false},
+		{"http://127.0.0.1/", false},
+		{"http://[::1]/", false},
+		{"http://10.0.0.5/", false},
+		{"http://192.168.0.1/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://0.0.0.0/", false},
+		{"ftp://hooks.example.com/", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			webhook := CreateSellerWebhook{Url: c.url}
+			if err := webhook.Validate(); (err == nil) != c.valid {
+				t.Fatalf("Validate() = %v, want valid %v", err, c.valid)
+			}
+		})
+	}
+}
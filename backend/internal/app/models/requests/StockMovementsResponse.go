@@ -0,0 +1,19 @@
+package requests
+
+import (
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+type StockMovementsResponse struct {
+	Movements []dao.StockMovement `json:"movements"`
+	PageSize int `json:"page_size"`
+	Pages int `json:"pages"`
+}
+
+type StockDrift struct {
+	Product string `json:"product"`
+	Name string `json:"name"`
+	Quantity int32 `json:"quantity"`
+	LedgerQuantity int32 `json:"ledger_quantity"`
+	Drift int32 `json:"drift"`
+}
@@ -0,0 +1,91 @@
+package requests
+
+import (
+	"time"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+type TicketLine struct {
+	Uuid string `json:"uuid"`
+	SubOrderId string `json:"sub_order_id"`
+	Product string `json:"product"`
+	Name string `json:"name"`
+	Image *string `json:"image"`
+	Seller string `json:"seller"`
+	Quantity int32 `json:"quantity"`
+	UnitPrice float32 `json:"unit_price"`
+	LineTotal float32 `json:"line_total"`
+}
+
+type TicketSummary struct {
+	Lines int `json:"lines"`
+	Units int32 `json:"units"`
+	Sellers int `json:"sellers"`
+	Subtotal float32 `json:"subtotal"`
+	Total float32 `json:"total"`
+}
+
+type TicketDetail struct {
+	TicketId string `json:"ticket_id"`
+	Status string `json:"status"`
+	PaymentStatus *string `json:"payment_status"`
+	Notes *string `json:"notes"`
+	ShippingAddress *dao.TicketAddress `json:"shipping_address"`
+	CreatedAt time.Time `json:"created_at"`
+	Lines []TicketLine `json:"lines"`
+	SubOrders []dao.SubOrder `json:"sub_orders"`
+	Payment *dao.PaymentIntent `json:"payment"`
+	Summary TicketSummary `json:"summary"`
+}
+
+// NewTicketLines builds the lines from the product snapshots stored on each
+// purchase, so renamed or deleted products keep the name, image and seller
+// they had at checkout
+func NewTicketLines(purchases []dao.Purchase) []TicketLine {
+	lines := make([]TicketLine, 0, len(purchases))
+
+	for _, purchase := range purchases {
+		lines = append(lines, TicketLine{
+			Uuid: purchase.Uuid,
+			SubOrderId: purchase.SubOrderId,
+			Product: purchase.Product,
+			Name: purchase.ProductName,
+			Image: purchase.ProductImage,
+			Seller: purchase.Seller,
+			Quantity: purchase.Quantity,
+			UnitPrice: purchase.Price,
+			LineTotal: purchase.Price * float32(purchase.Quantity),
+		})
+	}
+
+	return lines
+}
+
+func NewTicketDetail(ticket dao.Ticket, purchases []dao.Purchase) TicketDetail {
+	detail := TicketDetail{
+		TicketId: ticket.Uuid,
+		Status: ticket.Status,
+		PaymentStatus: ticket.PaymentStatus,
+		Notes: ticket.Notes,
+		ShippingAddress: ticket.ShippingAddress,
+		CreatedAt: ticket.CreatedAt,
+		Lines: NewTicketLines(purchases),
+		SubOrders: make([]dao.SubOrder, 0),
+		Summary: TicketSummary{
+			Units: ticket.Units,
+			Subtotal: ticket.Subtotal,
+			Total: ticket.Total,
+		},
+	}
+
+	sellers := map[string]bool{}
+	for _, line := range detail.Lines {
+		sellers[line.Seller] = true
+	}
+
+	detail.Summary.Lines = len(detail.Lines)
+	detail.Summary.Sellers = len(sellers)
+
+	return detail
+}
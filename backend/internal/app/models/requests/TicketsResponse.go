@@ -0,0 +1,29 @@
+package requests
+
+import (
+	"time"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+type TicketsResponse struct {
+	Tickets []dao.Ticket `json:"tickets"`
+	PageSize int `json:"page_size"`
+	Pages int `json:"pages"`
+}
+
+// TicketExportLine is one row of the purchase history export, the ticket
+// columns repeat on every line of the same ticket
+type TicketExportLine struct {
+	TicketId string `json:"ticket_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Status string `json:"status"`
+	PaymentStatus *string `json:"payment_status"`
+	Product string `json:"product"`
+	ProductName string `json:"product_name"`
+	Seller string `json:"seller"`
+	Quantity int32 `json:"quantity"`
+	UnitPrice float32 `json:"unit_price"`
+	LineTotal float32 `json:"line_total"`
+	TicketTotal float32 `json:"ticket_total"`
+}
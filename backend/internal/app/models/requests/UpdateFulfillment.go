@@ -0,0 +1,21 @@
+package requests
+
+import (
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
+)
+
+type UpdateFulfillment struct {
+	Status string `json:"status" validate:"required,oneof=unfulfilled packed shipped delivered"`
+	TrackingNumber *string `json:"tracking_number" validate:"trim,max=64"`
+}
+
+func (u *UpdateFulfillment) Validate() error {
+	return validation.Struct(u).Err()
+}
+
+func (u *UpdateFulfillment) Check(path string, errs *validation.Errors) {
+	if u.Status == dao.FulfillmentShipped && (u.TrackingNumber == nil || *u.TrackingNumber == "") {
+		errs.Add(validation.Join(path, "tracking_number"), "required", "The tracking number is required to ship an order")
+	}
+}
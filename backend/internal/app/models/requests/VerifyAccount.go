@@ -1,32 +1,12 @@
 package requests
 
-import (
-	"errors"
-	"strings"
-	"net/mail"
-)
+import "github.com/OscarVillanueva/goapi/internal/app/validation"
 
 type VerifyAccount struct {
-	Email string `json:"email"`
-	Token string `json:"token"`
+	Email string `json:"email" validate:"required,trim,email"`
+	Token string `json:"token" validate:"required,trim,len=6"`
 }
 
-func (verify VerifyAccount) Validate() error {
-	trimedToken := strings.TrimSpace(verify.Token)
-	trimedEmail := strings.TrimSpace(verify.Email)
-
-	if trimedEmail == "" {
-		return errors.New("The email is required")
-	}
-
-	if _, err := mail.ParseAddress(trimedEmail); err != nil {
-		return errors.New("Invalid email")
-	}
-	
-	if trimedToken == "" || len(trimedToken) != 6{
-		return errors.New("The token is required")
-	}
-
-	return nil
+func (verify *VerifyAccount) Validate() error {
+	return validation.Struct(verify).Err()
 }
-
@@ -0,0 +1,47 @@
+package requests
+
+import (
+	"time"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+// WishlistItemView compares the item with the product as it is now, the
+// current price is empty when the product was deleted
+type WishlistItemView struct {
+	Uuid string `json:"uuid"`
+	Product string `json:"product"`
+	Name string `json:"name"`
+	Image *string `json:"image"`
+	PriceAtAdd float32 `json:"price_at_add"`
+	CurrentPrice *float32 `json:"current_price"`
+	PriceChange *float32 `json:"price_change"`
+	Available bool `json:"available"`
+	Removed bool `json:"removed"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type WishlistSummary struct {
+	dao.Wishlist
+	Shared bool `json:"shared"`
+	Items int `json:"items"`
+}
+
+type WishlistDetail struct {
+	dao.Wishlist
+	Shared bool `json:"shared"`
+	Items []WishlistItemView `json:"items"`
+}
+
+// SharedWishlist is what anyone with the share link can see
+type SharedWishlist struct {
+	Name string `json:"name"`
+	Owner string `json:"owner"`
+	Items []WishlistItemView `json:"items"`
+}
+
+type WishlistShareLink struct {
+	Token string `json:"token"`
+	Url string `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,9 @@
+package tools
+
+import "time"
+
+// AccountDeletionCoolingOff is read from ACCOUNT_DELETION_COOLING_OFF, 14
+// days by default. The user can cancel the deletion during this period
+func AccountDeletionCoolingOff() time.Duration {
+	return durationFromEnv("ACCOUNT_DELETION_COOLING_OFF", 14 * 24 * time.Hour)
+}
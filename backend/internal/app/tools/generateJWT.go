@@ -1,123 +1,60 @@
 package tools
 
 import (
-	"fmt"
-	"sync"
 	"time"
 	"errors"
 	"context"
-	"crypto/ecdsa"
 
-	"github.com/OscarVillanueva/goapi/internal/platform"
-
-	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-type JWTKeyManager struct {
-	PrivateKey *ecdsa.PrivateKey
-	PublicKey *ecdsa.PublicKey
-}
-
-var (
-	instance *JWTKeyManager
-	once sync.Once
-)
-
-func getKeyManager(ctx context.Context) *JWTKeyManager  {
-	once.Do(func() {
-		instance = &JWTKeyManager{}
-		instance.initialize(ctx)
-	})
-
-	return instance
+// TokenClaims are the registered claims of a token, the jti, iat and nbf get
+// a new uuid and the current time when they are empty
+type TokenClaims struct {
+	ExpiresAt time.Time
+	Subject string
+	Audience []string
+	Id string
+	NotBefore time.Time
 }
 
-const GenJWT = "generate-jwt"
-
-func (manager *JWTKeyManager) initialize(c context.Context)  {
-	tr := otel.Tracer(GenJWT)
-	ctx, span := tr.Start(c, fmt.Sprintf("%s-initialize", GenJWT))
-	defer span.End()
-
-	err := loadExistingKeys(manager, ctx)
-	if err == nil {
-		span.SetStatus(codes.Ok, "Loading JWT Keys successfully")
-		return
-	}
-
-	span.RecordError(err)
-	span.SetStatus(codes.Error, "Unable to load secrets: " + err.Error())
-
-	result, err := generateJWTKeys(ctx)
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, "Unable to create secrets: " + err.Error())
-		return
-	}
-
-
-	manager.PublicKey = result.Verify
-	manager.PrivateKey = result.Sign
-
-	err = handleSaveCredentials(result.Public, result.Private, ctx)
+func GenerateJWT(claims TokenClaims, data map[string]any, ctx context.Context) (string, error) {
+	kid, privateKey := getKeyManager(ctx).signingKey()
 
-	if err != nil {
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return
+	if privateKey == nil {
+		return "", errors.New("We couldn't sing the token")
 	}
 
-	span.SetStatus(codes.Ok, "JWT keys generated")
-}
+	now := time.Now().UTC()
 
-func loadExistingKeys(manager *JWTKeyManager, ctx context.Context) error {
-	privateStr, err := platform.GetSecret("private-key", ctx)
-	if err != nil {
-		return err
+	if claims.Id == "" {
+		claims.Id = uuid.New().String()
 	}
 
-	publicStr, err := platform.GetSecret("public-key", ctx)
-	if err != nil {
-		return err
+	if claims.NotBefore.IsZero() {
+		claims.NotBefore = now
 	}
 
-	priv, err := parsePrivatePemToKey(privateStr)
-	if err != nil {
-		return err
+	mapClaims := jwt.MapClaims {
+		"data": data,
+		"exp": claims.ExpiresAt.Unix(),
+		"iat": now.Unix(),
+		"nbf": claims.NotBefore.Unix(),
+		"jti": claims.Id,
+		"iss": TokenIssuer(),
 	}
 
-	pub, err := parsePublicPemToKey(publicStr)
-	if err != nil {
-		return err
+	if claims.Subject != "" {
+		mapClaims["sub"] = claims.Subject
 	}
 
-	manager.PublicKey = pub
-	manager.PrivateKey = priv
-	return nil
-}
-
-func handleSaveCredentials(public string, private string, ctx context.Context) error {
-	errPr := platform.SaveSecret("private-key", private, ctx)
-	errPub := platform.SaveSecret("public-key", public, ctx)
-
-	return errors.Join(errPr, errPub)
-}
-
-func GenerateJWT(expirationDate time.Time, data map[string]any, ctx context.Context) (string, error) {
-	manager := getKeyManager(ctx)
-
-	if manager.PrivateKey == nil {
-		return "", errors.New("We couldn't sing the token")
+	if len(claims.Audience) > 0 {
+		mapClaims["aud"] = claims.Audience
 	}
 
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodES256,
-		jwt.MapClaims {
-			"data": data,
-			"exp": expirationDate.Unix(),
-		})
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, mapClaims)
+	token.Header["kid"] = kid
 
-	return token.SignedString(manager.PrivateKey)
+	return token.SignedString(privateKey)
 }
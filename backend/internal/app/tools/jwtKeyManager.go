@@ -0,0 +1,483 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"encoding/base64"
+
+	"github.com/OscarVillanueva/goapi/internal/platform"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	log "github.com/sirupsen/logrus"
+)
+
+const GenJWT = "generate-jwt"
+
+const (
+	// keyringSecret keeps every version of the keys, the instances sign with
+	// the current one and verify with all of them
+	keyringSecret = "jwt-keys"
+	keyringLock = "jwt-keys-lock"
+	keyringLockTTL = 30 * time.Second
+
+	// The keys of the first version, before the rotation
+	legacyPrivateSecret = "private-key"
+	legacyPublicSecret = "public-key"
+
+	// A retired key still verifies the tokens it signed, the share links of
+	// the wishlists last up to a year
+	keyRetention = 366 * 24 * time.Hour
+
+	// How often the instances read the keyring to find the new versions
+	keyringRefresh = time.Minute
+)
+
+type storedKey struct {
+	Kid string `json:"kid"`
+	Version int `json:"version"`
+	// Empty once the key is retired, it only verifies
+	Private string `json:"private,omitempty"`
+	Public string `json:"public"`
+	Legacy bool `json:"legacy,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+type storedKeyring struct {
+	Current string `json:"current"`
+	Keys []storedKey `json:"keys"`
+}
+
+type JWTKeyManager struct {
+	mutex sync.RWMutex
+	currentKid string
+	currentCreatedAt time.Time
+	privateKey *ecdsa.PrivateKey
+	publicKeys map[string]*ecdsa.PublicKey
+	legacyKid string
+	loadedAt time.Time
+}
+
+// JSONWebKey is a public key of the JWKS document
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X string `json:"x"`
+	Y string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+var (
+	instance *JWTKeyManager
+	once sync.Once
+)
+
+func getKeyManager(ctx context.Context) *JWTKeyManager  {
+	once.Do(func() {
+		instance = &JWTKeyManager{publicKeys: map[string]*ecdsa.PublicKey{}}
+		instance.initialize(ctx)
+	})
+
+	return instance
+}
+
+func (manager *JWTKeyManager) initialize(c context.Context)  {
+	tr := otel.Tracer(GenJWT)
+	ctx, span := tr.Start(c, fmt.Sprintf("%s-initialize", GenJWT))
+	defer span.End()
+
+	if err := manager.ensureKeyring(false, ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Unable to load the JWT keys: " + err.Error())
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("Kid", manager.currentKid),
+	)
+	span.SetStatus(codes.Ok, "Loading JWT Keys successfully")
+}
+
+// StartJWTKeyRotation reloads the keyring every minute and rotates the
+// signing key once it's older than JWT_KEY_ROTATION, 30 days by default
+func StartJWTKeyRotation(ctx context.Context) {
+	manager := getKeyManager(ctx)
+
+	go func() {
+		ticker := time.NewTicker(keyringRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					rotate := time.Since(manager.createdAt()) >= KeyRotationPeriod()
+					if err := manager.ensureKeyring(rotate, ctx); err != nil {
+						log.WithField("rotate", rotate).Error(err)
+					}
+			}
+		}
+	}()
+}
+
+// KeyRotationPeriod is read from JWT_KEY_ROTATION
+func KeyRotationPeriod() time.Duration {
+	return durationFromEnv("JWT_KEY_ROTATION", 30 * 24 * time.Hour)
+}
+
+// JWKS returns the public keys that still verify tokens
+func JWKS(ctx context.Context) JSONWebKeySet {
+	manager := getKeyManager(ctx)
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	kids := make([]string, 0, len(manager.publicKeys))
+	for kid := range manager.publicKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(kids))}
+	for _, kid := range kids {
+		point, err := manager.publicKeys[kid].ECDH()
+		if err != nil {
+			continue
+		}
+
+		// Uncompressed point, 0x04 followed by the 32 bytes of x and y
+		raw := point.Bytes()
+		set.Keys = append(set.Keys, JSONWebKey{
+			Kty: "EC",
+			Crv: "P-256",
+			X: base64.RawURLEncoding.EncodeToString(raw[1:33]),
+			Y: base64.RawURLEncoding.EncodeToString(raw[33:]),
+			Kid: kid,
+			Use: "sig",
+			Alg: "ES256",
+		})
+	}
+
+	return set
+}
+
+func (manager *JWTKeyManager) signingKey() (string, *ecdsa.PrivateKey) {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return manager.currentKid, manager.privateKey
+}
+
+func (manager *JWTKeyManager) createdAt() time.Time {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return manager.currentCreatedAt
+}
+
+// publicKey finds the key of a kid, an unknown kid may come from a rotation
+// in another instance so the keyring is read again
+func (manager *JWTKeyManager) publicKey(kid string, ctx context.Context) *ecdsa.PublicKey {
+	manager.mutex.RLock()
+	if kid == "" {
+		kid = manager.legacyKid
+	}
+	key, ok := manager.publicKeys[kid]
+	stale := time.Since(manager.loadedAt) > time.Second
+	manager.mutex.RUnlock()
+
+	if ok || kid == "" || !stale {
+		return key
+	}
+
+	if err := manager.reload(ctx); err != nil {
+		return nil
+	}
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	return manager.publicKeys[kid]
+}
+
+// releaseKeyringLock only deletes the lock while this instance holds it, a
+// rotation slower than keyringLockTTL leaves the lock of the next one alone
+func releaseKeyringLock(token string, ctx context.Context) {
+	released, err := platform.DeleteSecretIfEqual(keyringLock, token, ctx)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if !released {
+		log.Warn("The lock of the JWT keys expired before the rotation finished")
+	}
+}
+
+// ensureKeyring loads the keyring and, when it's empty or a rotation is
+// due, creates the next key while holding the lock of every instance
+func (manager *JWTKeyManager) ensureKeyring(rotate bool, ctx context.Context) error {
+	tr := otel.Tracer(GenJWT)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s-ensureKeyring", GenJWT))
+	defer span.End()
+
+	keyring, err := readKeyring(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	if keyring != nil && !rotate {
+		return manager.apply(*keyring)
+	}
+
+	// The token tells this instance's lock apart from the one another
+	// instance takes after it expires
+	lockToken := GenerateSecureToken(32)
+
+	// Other instances wait for the one holding the lock and read its keys
+	for attempt := 0; attempt < 50; attempt++ {
+		acquired, err := platform.SaveSecretIfAbsent(keyringLock, lockToken, keyringLockTTL, ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		if acquired {
+			defer releaseKeyringLock(lockToken, ctx)
+
+			keyring, err := nextKeyring(rotate, ctx)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return err
+			}
+
+			span.SetAttributes(
+				attribute.String("Kid", keyring.Current),
+			)
+			span.SetStatus(codes.Ok, "JWT keyring saved")
+
+			return manager.apply(*keyring)
+		}
+
+		// Another instance is rotating, the next refresh reads its key
+		if rotate {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+
+		if keyring, err := readKeyring(ctx); err == nil && keyring != nil {
+			return manager.apply(*keyring)
+		}
+	}
+
+	err = errors.New("We couldn't get the lock of the JWT keys")
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
+}
+
+func (manager *JWTKeyManager) reload(ctx context.Context) error {
+	keyring, err := readKeyring(ctx)
+	if err != nil {
+		return err
+	}
+
+	if keyring == nil {
+		return errors.New("Empty JWT keyring")
+	}
+
+	return manager.apply(*keyring)
+}
+
+func (manager *JWTKeyManager) apply(keyring storedKeyring) error {
+	publicKeys := map[string]*ecdsa.PublicKey{}
+	var privateKey *ecdsa.PrivateKey
+	var createdAt time.Time
+	legacyKid := ""
+
+	for _, stored := range keyring.Keys {
+		public, err := parsePublicPemToKey(stored.Public)
+		if err != nil {
+			return err
+		}
+
+		publicKeys[stored.Kid] = public
+
+		if stored.Legacy {
+			legacyKid = stored.Kid
+		}
+
+		if stored.Kid == keyring.Current {
+			privateKey, err = parsePrivatePemToKey(stored.Private)
+			if err != nil {
+				return err
+			}
+
+			createdAt = stored.CreatedAt
+		}
+	}
+
+	if privateKey == nil {
+		return fmt.Errorf("The current JWT key %q is missing", keyring.Current)
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.currentKid = keyring.Current
+	manager.currentCreatedAt = createdAt
+	manager.privateKey = privateKey
+	manager.publicKeys = publicKeys
+	manager.legacyKid = legacyKid
+	manager.loadedAt = time.Now()
+
+	return nil
+}
+
+func readKeyring(ctx context.Context) (*storedKeyring, error) {
+	value, err := platform.GetSecret(keyringSecret, ctx)
+	if errors.Is(err, platform.ErrSecretNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring storedKeyring
+	if err := json.Unmarshal([]byte(value), &keyring); err != nil {
+		return nil, err
+	}
+
+	return &keyring, nil
+}
+
+// nextKeyring runs with the lock, it starts the keyring with the keys of the
+// first version or adds a new version, retiring the current one
+func nextKeyring(rotate bool, ctx context.Context) (*storedKeyring, error) {
+	keyring, err := readKeyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if keyring == nil {
+		keyring = &storedKeyring{}
+
+		if legacy := loadLegacyKey(ctx); legacy != nil {
+			keyring.Keys = append(keyring.Keys, *legacy)
+			keyring.Current = legacy.Kid
+			rotate = false
+		} else {
+			rotate = true
+		}
+	} else if rotate {
+		// Another instance rotated while this one waited for the lock
+		for _, stored := range keyring.Keys {
+			if stored.Kid == keyring.Current && now.Sub(stored.CreatedAt) < KeyRotationPeriod() {
+				rotate = false
+			}
+		}
+	}
+
+	if rotate {
+		generated, err := generateJWTKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		version := 1
+		for i := range keyring.Keys {
+			if keyring.Keys[i].Version >= version {
+				version = keyring.Keys[i].Version + 1
+			}
+
+			if keyring.Keys[i].RetiredAt == nil {
+				keyring.Keys[i].RetiredAt = &now
+				keyring.Keys[i].Private = ""
+			}
+		}
+
+		kid := fmt.Sprintf("v%d", version)
+		keyring.Keys = append(keyring.Keys, storedKey{
+			Kid: kid,
+			Version: version,
+			Private: generated.Private,
+			Public: generated.Public,
+			CreatedAt: now,
+		})
+		keyring.Current = kid
+	}
+
+	// The retired keys are dropped once every token they signed expired
+	keys := make([]storedKey, 0, len(keyring.Keys))
+	for _, stored := range keyring.Keys {
+		if stored.RetiredAt == nil || now.Sub(*stored.RetiredAt) < keyRetention {
+			keys = append(keys, stored)
+		}
+	}
+	keyring.Keys = keys
+
+	value, err := json.Marshal(keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := platform.SaveSecret(keyringSecret, string(value), ctx); err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+// loadLegacyKey imports the pair used before the keys had versions, so the
+// tokens it signed keep working
+func loadLegacyKey(ctx context.Context) *storedKey {
+	private, err := platform.GetSecret(legacyPrivateSecret, ctx)
+	if err != nil {
+		return nil
+	}
+
+	public, err := platform.GetSecret(legacyPublicSecret, ctx)
+	if err != nil {
+		return nil
+	}
+
+	if _, err := parsePrivatePemToKey(private); err != nil {
+		return nil
+	}
+
+	if _, err := parsePublicPemToKey(public); err != nil {
+		return nil
+	}
+
+	return &storedKey{
+		Kid: "v1",
+		Version: 1,
+		Private: private,
+		Public: public,
+		Legacy: true,
+		CreatedAt: time.Now().UTC(),
+	}
+}
@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"os"
+	"time"
+	"errors"
+	"strings"
+	"net/url"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/base64"
+)
+
+var (
+	ErrMagicLinkDisabled = errors.New("MAGIC_LINK_SECRET environment variable is empty")
+	ErrMagicLinkInvalid = errors.New("The link is invalid")
+	ErrMagicLinkExpired = errors.New("The link expired")
+)
+
+// MagicLinkClaims is the signed content of a magic link. The nonce is stored
+// hashed next to the code, so the link works once and stops with the code
+type MagicLinkClaims struct {
+	Subject string `json:"sub"`
+	Purpose string `json:"purpose"`
+	Nonce string `json:"nonce"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// MagicLinkBaseURL is read from MAGIC_LINK_BASE_URL, an app can use its own
+// deep link as long as it sends the token to POST /auth/magic
+func MagicLinkBaseURL() string {
+	if base := os.Getenv("MAGIC_LINK_BASE_URL"); base != "" {
+		return base
+	}
+
+	return "http://api.localhost/auth/magic"
+}
+
+// MagicLinkURL signs the claims and adds them to the base URL as the token
+// parameter
+func MagicLinkURL(claims MagicLinkClaims) (string, error) {
+	token, err := SignMagicLink(claims)
+	if err != nil {
+		return "", err
+	}
+
+	link, err := url.Parse(MagicLinkBaseURL())
+	if err != nil {
+		return "", err
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return link.String(), nil
+}
+
+// SignMagicLink returns the payload and its HMAC-SHA256 with the
+// MAGIC_LINK_SECRET, both base64url encoded and joined by a dot
+func SignMagicLink(claims MagicLinkClaims) (string, error) {
+	secret := os.Getenv("MAGIC_LINK_SECRET")
+	if secret == "" {
+		return "", ErrMagicLinkDisabled
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + magicLinkMAC(secret, encoded), nil
+}
+
+// ParseMagicLink checks the signature and the expiration of a token, the
+// caller still has to find its code
+func ParseMagicLink(token string) (*MagicLinkClaims, error) {
+	secret := os.Getenv("MAGIC_LINK_SECRET")
+	if secret == "" {
+		return nil, ErrMagicLinkDisabled
+	}
+
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(magicLinkMAC(secret, encoded))) {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	var claims MagicLinkClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" || claims.Nonce == "" {
+		return nil, ErrMagicLinkInvalid
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrMagicLinkExpired
+	}
+
+	return &claims, nil
+}
+
+func magicLinkMAC(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,46 @@
+package tools
+
+import (
+	"net/http"
+	"html/template"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+var magicLinkPage = template.Must(template.New("magic-link").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Action}}</title>
+</head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">{{.Action}}</button>
+</form>
+</body>
+</html>
+`))
+
+// WriteMagicLinkPage answers the GET of a magic link with a button that
+// posts the token back. Opening the link doesn't use it, so the mail scanners
+// and the previews that fetch every link can't burn it
+func WriteMagicLinkPage(w http.ResponseWriter, token string, purpose string) error {
+	action := "Sign in"
+	switch purpose {
+		case dao.MagicPurposeVerify:
+			action = "Verify my account"
+		case dao.MagicPurposeChangeEmail:
+			action = "Confirm my new email"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	return magicLinkPage.Execute(w, map[string]string{
+		"Action": action,
+		"Token": token,
+	})
+}
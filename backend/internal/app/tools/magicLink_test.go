@@ -0,0 +1,105 @@
+package tools
+
+import (
+	"time"
+	"errors"
+	"strings"
+	"testing"
+	"net/http/httptest"
+
+	"github.com/OscarVillanueva/goapi/internal/app/models/dao"
+)
+
+func TestParseMagicLink(t *testing.T) {
+	t.Setenv("MAGIC_LINK_SECRET", "test-secret")
+
+	valid := MagicLinkClaims{
+		Subject: "user-1",
+		Purpose: dao.MagicPurposeLogin,
+		Nonce: "nonce-1",
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}
+
+	sign := func(claims MagicLinkClaims) string {
+		token, err := SignMagicLink(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	expired := valid
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	withoutNonce := valid
+	withoutNonce.Nonce = ""
+
+	token := sign(valid)
+	payload, signature, _ := strings.Cut(token, ".")
+
+	// Another purpose signed with the same secret can't reuse the signature
+	verify := valid
+	verify.Purpose = dao.MagicPurposeVerify
+	verifyPayload, _, _ := strings.Cut(sign(verify), ".")
+
+	cases := []struct {
+		name string
+		token string
+		err error
+	}{
+		{"valid", token, nil},
+		{"expired", sign(expired), ErrMagicLinkExpired},
+		{"without nonce", sign(withoutNonce), ErrMagicLinkInvalid},
+		{"without signature", payload, ErrMagicLinkInvalid},
+		{"tampered signature", payload + "." + signature[:len(signature) - 2] + "AA", ErrMagicLinkInvalid},
+		{"purpose swapped", verifyPayload + "." + signature, ErrMagicLinkInvalid},
+		{"empty", "", ErrMagicLinkInvalid},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims, err := ParseMagicLink(c.token)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err = %v, want %v", err, c.err)
+			}
+
+			if c.err == nil && *claims != valid {
+				t.Fatalf("claims = %+v, want %+v", *claims, valid)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("MAGIC_LINK_SECRET", "")
+
+		if _, err := ParseMagicLink(token); !errors.Is(err, ErrMagicLinkDisabled) {
+			t.Fatalf("err = %v, want %v", err, ErrMagicLinkDisabled)
+		}
+	})
+}
+
+func TestWriteMagicLinkPage(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	if err := WriteMagicLinkPage(recorder, `token"><script>`, dao.MagicPurposeVerify); err != nil {
+		t.Fatal(err)
+	}
+
+	body := recorder.Body.String()
+
+	if !strings.Contains(body, `<form method="post">`) {
+		t.Fatalf("the page doesn't post the token back:\n%s", body)
+	}
+
+	if strings.Contains(body, "<script>") {
+		t.Fatalf("the token isn't escaped:\n%s", body)
+	}
+
+	if !strings.Contains(body, "Verify my account") {
+		t.Fatalf("the page doesn't follow the purpose:\n%s", body)
+	}
+
+	if recorder.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Cache-Control = %q", recorder.Header().Get("Cache-Control"))
+	}
+}
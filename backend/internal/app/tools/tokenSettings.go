@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// AccessTokenAudience is the audience of the tokens accepted by the
+	// Authorization middleware
+	AccessTokenAudience = "api"
+	ShareTokenAudience = "wishlist-share"
+)
+
+func TokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+
+	return "ecommerce-simulator"
+}
+
+// AccessTokenTTL is read from ACCESS_TOKEN_TTL, 15 minutes by default
+func AccessTokenTTL() time.Duration {
+	return durationFromEnv("ACCESS_TOKEN_TTL", 15 * time.Minute)
+}
+
+// RefreshTokenTTL is read from REFRESH_TOKEN_TTL, 30 days by default. The
+// session ends that long after the sign in, the rotations keep its expiration
+func RefreshTokenTTL() time.Duration {
+	return durationFromEnv("REFRESH_TOKEN_TTL", 30 * 24 * time.Hour)
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || duration <= 0 {
+		return fallback
+	}
+
+	return duration
+}
@@ -8,13 +8,11 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func IsValidToken(tokenString string, ctx context.Context) (map[string]any, error)  {
+// IsValidToken checks the signature, the dates, the issuer and that the token
+// was issued for the audience
+func IsValidToken(tokenString string, audience string, ctx context.Context) (map[string]any, error)  {
 	manager := getKeyManager(ctx)
 
-	if manager.PublicKey == nil {
-		return nil, errors.New("Public key not found")
-	}
-
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Check if the token has a method pointer of type ECDSA
 		// variable.(Type) is called Type assertion like a typeof of JS
@@ -22,8 +20,20 @@ func IsValidToken(tokenString string, ctx context.Context) (map[string]any, erro
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return manager.PublicKey, nil
-	})
+		// Tokens signed before the rotation don't have a kid
+		kid, _ := token.Header["kid"].(string)
+
+		publicKey := manager.publicKey(kid, ctx)
+		if publicKey == nil {
+			return nil, fmt.Errorf("unknown signing key: %q", kid)
+		}
+
+		return publicKey, nil
+	},
+		jwt.WithIssuer(TokenIssuer()),
+		jwt.WithAudience(audience),
+		jwt.WithIssuedAt(),
+	)
 
 	if err != nil {
 		return nil, err
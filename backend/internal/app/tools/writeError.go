@@ -1,8 +1,14 @@
 package tools
 
 import (
+	"math"
+	"time"
+	"errors"
+	"strconv"
 	"net/http"
 	"encoding/json"
+
+	"github.com/OscarVillanueva/goapi/internal/app/validation"
 )
 
 type Error struct {
@@ -10,6 +16,13 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+// ValidationError lists every field of the body that failed its rules
+type ValidationError struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+	Errors validation.Errors `json:"errors"`
+}
+
 func writeError(w http.ResponseWriter, message string, code int){
 	resp := Error {
 		Code: code,
@@ -29,6 +42,24 @@ var (
 	UnprocessableContent = func(w http.ResponseWriter, message string) {
 		writeError(w, message, http.StatusUnprocessableEntity)
 	}
+	ValidationErrorHandler = func(w http.ResponseWriter, err error) {
+		var failures validation.Errors
+		if !errors.As(err, &failures) {
+			writeError(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		resp := ValidationError {
+			Code: http.StatusUnprocessableEntity,
+			Message: "The request has invalid fields",
+			Errors: failures,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+
+		json.NewEncoder(w).Encode(resp)
+	}
 	InternalServerErrorHandler = func(w http.ResponseWriter, message *string) {
 		msg := "An unexpected expected error occured"
 
@@ -50,7 +81,25 @@ var (
 
 		writeError(w, msg, http.StatusUnauthorized)
 	}
+	ForbiddenErrorHandler = func(w http.ResponseWriter, message string) {
+		writeError(w, message, http.StatusForbidden)
+	}
 	NotFoundErrorHandler = func(w http.ResponseWriter, message string) {
 		writeError(w, message, http.StatusNotFound)
 	}
+	ConflictErrorHandler = func(w http.ResponseWriter, message string) {
+		writeError(w, message, http.StatusConflict)
+	}
+	PaymentRequiredErrorHandler = func(w http.ResponseWriter, message string) {
+		writeError(w, message, http.StatusPaymentRequired)
+	}
+	TooManyRequestsErrorHandler = func(w http.ResponseWriter, retryAfter time.Duration) {
+		seconds := int64(math.Ceil(retryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		writeError(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+	}
 )
@@ -15,8 +15,12 @@ type Interactions interface {
 }
 
 func (m Message) WriteMessage(w http.ResponseWriter){
+	m.WriteMessageWithCode(w, http.StatusOK)
+}
+
+func (m Message) WriteMessageWithCode(w http.ResponseWriter, code int){
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(code)
 
 	json.NewEncoder(w).Encode(m)
 }
@@ -0,0 +1,343 @@
+package validation
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"net/url"
+	"net/mail"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// FieldError is one failed rule, the path follows the names of the json body,
+// for example items[2].quantity
+type FieldError struct {
+	Path string `json:"path"`
+	Code string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errors gathers every failure of a request
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, failure := range e {
+		messages = append(messages, failure.Message)
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// Err returns nil when nothing failed, a nil Errors inside an error interface
+// isn't nil
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e *Errors) Add(path string, code string, message string) {
+	*e = append(*e, FieldError{
+		Path: path,
+		Code: code,
+		Message: message,
+	})
+}
+
+// Rebase moves the failures under the from path to the to path, an empty to
+// leaves the index of a list at the root, like [2].quantity
+func (e Errors) Rebase(from string, to string) Errors {
+	for i := range e {
+		rest, ok := strings.CutPrefix(e[i].Path, from)
+		if !ok || (rest != "" && rest[0] != '.' && rest[0] != '[') {
+			continue
+		}
+
+		if to == "" {
+			rest = strings.TrimPrefix(rest, ".")
+		}
+
+		e[i].Path = to + rest
+	}
+
+	return e
+}
+
+// Checker is implemented by the requests with rules that involve more than
+// one field, Check runs after the tags of the struct
+type Checker interface {
+	Check(path string, errs *Errors)
+}
+
+// Join builds the path of a field inside path
+func Join(path string, field string) string {
+	if path == "" {
+		return field
+	}
+
+	return path + "." + field
+}
+
+// Index builds the path of an element of the list in path
+func Index(path string, index int) string {
+	return fmt.Sprintf("%s[%d]", path, index)
+}
+
+// Struct validates a pointer to a struct with the rules of its validate tags:
+//
+//	required  the value can't be empty, nil or zero
+//	trim      removes the spaces around a string before the other rules
+//	upper     uppercases a string before the other rules
+//	min=N     minimum length of a string, items of a list or value of a number
+//	max=N     maximum length of a string, items of a list or value of a number
+//	len=N     exact length of a string
+//	uuid, email, url
+//	oneof=a b c
+//
+// Empty strings and lists only fail the required rule. Nested structs and
+// lists of structs are validated too, and every struct implementing Checker
+// runs its own checks
+func Struct(value any) Errors {
+	errs := Errors{}
+	walk(reflect.ValueOf(value), "", &errs)
+	return errs
+}
+
+func walk(value reflect.Value, path string, errs *Errors) {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < value.Len(); i++ {
+				walk(value.Index(i), Index(path, i), errs)
+			}
+			return
+
+		case reflect.Struct:
+		default:
+			return
+	}
+
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+
+		fieldPath := Join(path, name)
+		fieldValue := value.Field(i)
+
+		if tag := field.Tag.Get("validate"); tag != "" && tag != "-" {
+			if !applyRules(fieldValue, fieldPath, tag, errs) {
+				continue
+			}
+		}
+
+		walk(fieldValue, fieldPath, errs)
+	}
+
+	if value.CanAddr() {
+		if checker, ok := value.Addr().Interface().(Checker); ok {
+			checker.Check(path, errs)
+			return
+		}
+	}
+
+	if checker, ok := value.Interface().(Checker); ok {
+		checker.Check(path, errs)
+	}
+}
+
+func jsonName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+
+	return name, true
+}
+
+// applyRules reports if the value passed, nested values are only walked
+// when their own field is valid
+func applyRules(value reflect.Value, path string, tag string, errs *Errors) bool {
+	rules := strings.Split(tag, ",")
+	required := false
+	for _, rule := range rules {
+		if rule == "required" {
+			required = true
+		}
+	}
+
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if required {
+				errs.Add(path, "required", fmt.Sprintf("%s is required", label(path)))
+				return false
+			}
+
+			return true
+		}
+
+		value = value.Elem()
+	}
+
+	for _, rule := range rules {
+		if value.Kind() != reflect.String || !value.CanSet() {
+			break
+		}
+
+		switch rule {
+			case "trim":
+				value.SetString(strings.TrimSpace(value.String()))
+			case "upper":
+				value.SetString(strings.ToUpper(value.String()))
+		}
+	}
+
+	if isEmpty(value) {
+		if required {
+			errs.Add(path, "required", fmt.Sprintf("%s is required", label(path)))
+			return false
+		}
+
+		if value.Kind() == reflect.String || value.Kind() == reflect.Slice {
+			return true
+		}
+	}
+
+	valid := true
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		var failure *FieldError
+		switch name {
+			case "min", "max", "len":
+				failure = checkSize(value, path, name, arg)
+			case "uuid":
+				if _, err := uuid.Parse(value.String()); err != nil {
+					failure = &FieldError{path, "uuid", fmt.Sprintf("%s should be a valid uuid", label(path))}
+				}
+			case "email":
+				if _, err := mail.ParseAddress(value.String()); err != nil {
+					failure = &FieldError{path, "email", fmt.Sprintf("%s should be a valid email", label(path))}
+				}
+			case "url":
+				parsed, err := url.Parse(value.String())
+				if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+					failure = &FieldError{path, "url", fmt.Sprintf("%s should be a valid http or https url", label(path))}
+				}
+			case "oneof":
+				options := strings.Fields(arg)
+				found := false
+				for _, option := range options {
+					if fmt.Sprint(value.Interface()) == option {
+						found = true
+					}
+				}
+
+				if !found {
+					failure = &FieldError{path, "one_of", fmt.Sprintf("%s should be one of %s", label(path), strings.Join(options, ", "))}
+				}
+		}
+
+		if failure != nil {
+			*errs = append(*errs, *failure)
+			valid = false
+		}
+	}
+
+	return valid
+}
+
+func checkSize(value reflect.Value, path string, rule string, arg string) *FieldError {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validation: invalid %s rule of %s: %q", rule, path, arg))
+	}
+
+	var size float64
+	var unit, code string
+
+	switch value.Kind() {
+		case reflect.String:
+			size, unit, code = float64(utf8.RuneCountInString(value.String())), " characters", "_length"
+		case reflect.Slice, reflect.Array, reflect.Map:
+			size, unit, code = float64(value.Len()), " items", "_items"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			size = float64(value.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			size = float64(value.Uint())
+		case reflect.Float32, reflect.Float64:
+			size = value.Float()
+		default:
+			return nil
+	}
+
+	bound := strconv.FormatFloat(limit, 'f', -1, 64)
+
+	switch {
+		case rule == "min" && size < limit:
+			if unit == "" {
+				return &FieldError{path, "min", fmt.Sprintf("%s should be at least %s", label(path), bound)}
+			}
+			return &FieldError{path, "min" + code, fmt.Sprintf("%s should have at least %s%s", label(path), bound, unit)}
+
+		case rule == "max" && size > limit:
+			if unit == "" {
+				return &FieldError{path, "max", fmt.Sprintf("%s should be at most %s", label(path), bound)}
+			}
+			return &FieldError{path, "max" + code, fmt.Sprintf("%s should have at most %s%s", label(path), bound, unit)}
+
+		case rule == "len" && size != limit:
+			return &FieldError{path, "length", fmt.Sprintf("%s should have %s%s", label(path), bound, unit)}
+	}
+
+	return nil
+}
+
+// label is the name of the field in the messages, the path has the location
+func label(path string) string {
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		path = path[i+1:]
+	}
+
+	if i := strings.Index(path, "["); i >= 0 {
+		path = path[:i]
+	}
+
+	return path
+}
+
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+		case reflect.String:
+			return value.String() == ""
+		case reflect.Slice, reflect.Map, reflect.Array:
+			return value.Len() == 0
+		default:
+			return value.IsZero()
+	}
+}
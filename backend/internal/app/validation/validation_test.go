@@ -0,0 +1,232 @@
+package validation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJoinAndIndex(t *testing.T) {
+	cases := []struct {
+		name string
+		got string
+		want string
+	}{
+		{"field at the root", Join("", "name"), "name"},
+		{"nested field", Join("address", "city"), "address.city"},
+		{"element of a list", Index("items", 2), "items[2]"},
+		{"element at the root", Index("", 2), "[2]"},
+		{"field of an element", Join(Index("items", 0), "quantity"), "items[0].quantity"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.got != c.want {
+				t.Fatalf("path = %q, want %q", c.got, c.want)
+			}
+		})
+	}
+}
+
+func TestRebase(t *testing.T) {
+	paths := []string{"line.quantity", "line[1].product", "line", "lines.quantity", "other"}
+
+	cases := []struct {
+		name string
+		to string
+		want []string
+	}{
+		{"to another path", "items", []string{"items.quantity", "items[1].product", "items", "lines.quantity", "other"}},
+		{"to the root", "", []string{"quantity", "[1].product", "", "lines.quantity", "other"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := Errors{}
+			for _, path := range paths {
+				errs.Add(path, "code", "message")
+			}
+
+			got := make([]string, 0, len(errs))
+			for _, failure := range errs.Rebase("line", c.to) {
+				got = append(got, failure.Path)
+			}
+
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("Rebase() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestErr(t *testing.T) {
+	if err := (Errors{}).Err(); err != nil {
+		t.Fatalf("Err() = %v, want nil", err)
+	}
+
+	errs := Errors{}
+	errs.Add("name", "required", "name is required")
+	errs.Add("code", "length", "code should have 3 characters")
+
+	err := errs.Err()
+	if err == nil || err.Error() != "name is required; code should have 3 characters" {
+		t.Fatalf("Err() = %v", err)
+	}
+}
+
+type rulesRequest struct {
+	Name string `json:"name" validate:"required,trim,min=2,max=5"`
+	Code string `json:"code" validate:"trim,upper,len=3"`
+	Note *string `json:"note" validate:"required"`
+	Tags []string `json:"tags" validate:"required,max=2"`
+	Count int `json:"count" validate:"min=1,max=10"`
+	Price float64 `json:"price" validate:"max=9.5"`
+	Kind string `json:"kind" validate:"oneof=a b"`
+	Ignored string `json:"-" validate:"required"`
+}
+
+func validRulesRequest() rulesRequest {
+	note := "note"
+
+	return rulesRequest{
+		Name: "ana",
+		Code: "mxn",
+		Note: &note,
+		Tags: []string{"a"},
+		Count: 1,
+		Price: 9.5,
+		Kind: "a",
+	}
+}
+
+// failures returns the path and code of every failure, in order
+func failures(errs Errors) []string {
+	got := make([]string, 0, len(errs))
+	for _, failure := range errs {
+		got = append(got, failure.Path + ":" + failure.Code)
+	}
+
+	return got
+}
+
+func TestStructRules(t *testing.T) {
+	cases := []struct {
+		name string
+		change func(request *rulesRequest)
+		want []string
+	}{
+		{"valid", func(request *rulesRequest) {}, []string{}},
+		{"nil pointer", func(request *rulesRequest) { request.Note = nil }, []string{"note:required"}},
+		{"empty string", func(request *rulesRequest) { request.Name = "" }, []string{"name:required"}},
+		{"blank string is trimmed to empty", func(request *rulesRequest) { request.Name = "   " }, []string{"name:required"}},
+		{"empty slice", func(request *rulesRequest) { request.Tags = []string{} }, []string{"tags:required"}},
+		{"nil slice", func(request *rulesRequest) { request.Tags = nil }, []string{"tags:required"}},
+		{"string too short", func(request *rulesRequest) { request.Name = "a" }, []string{"name:min_length"}},
+		{"string too long", func(request *rulesRequest) { request.Name = "abcdef" }, []string{"name:max_length"}},
+		{"length counts runes", func(request *rulesRequest) { request.Name = "ñáéíó" }, []string{}},
+		{"exact length", func(request *rulesRequest) { request.Code = "mx" }, []string{"code:length"}},
+		{"optional empty string skips the rules", func(request *rulesRequest) { request.Code = ""; request.Kind = "" }, []string{}},
+		{"too many items", func(request *rulesRequest) { request.Tags = []string{"a", "b", "c"} }, []string{"tags:max_items"}},
+		{"number below min", func(request *rulesRequest) { request.Count = 0 }, []string{"count:min"}},
+		{"number above max", func(request *rulesRequest) { request.Count = 11 }, []string{"count:max"}},
+		{"float above max", func(request *rulesRequest) { request.Price = 9.6 }, []string{"price:max"}},
+		{"not one of the options", func(request *rulesRequest) { request.Kind = "c" }, []string{"kind:one_of"}},
+		{"every failure is reported", func(request *rulesRequest) { request.Name = ""; request.Count = 0; request.Kind = "c" }, []string{"name:required", "count:min", "kind:one_of"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := validRulesRequest()
+			c.change(&request)
+
+			got := failures(Struct(&request))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("Struct() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestStructMutatesStrings(t *testing.T) {
+	cases := []struct {
+		name string
+		change func(request *rulesRequest)
+		field func(request rulesRequest) string
+		want string
+	}{
+		{"trim", func(request *rulesRequest) { request.Name = "  ana  " }, func(request rulesRequest) string { return request.Name }, "ana"},
+		{"trim then upper", func(request *rulesRequest) { request.Code = " mxn " }, func(request rulesRequest) string { return request.Code }, "MXN"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			request := validRulesRequest()
+			c.change(&request)
+
+			if errs := Struct(&request); len(errs) > 0 {
+				t.Fatalf("Struct() = %v", failures(errs))
+			}
+
+			if got := c.field(request); got != c.want {
+				t.Fatalf("value = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+type checkedLine struct {
+	Quantity int `json:"quantity" validate:"min=1"`
+}
+
+func (l *checkedLine) Check(path string, errs *Errors) {
+	errs.Add(path, "line_checked", "checked")
+}
+
+type checkedAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+func (a checkedAddress) Check(path string, errs *Errors) {
+	errs.Add(path, "address_checked", "checked")
+}
+
+type checkedOrder struct {
+	Lines []checkedLine `json:"lines" validate:"required"`
+	Address *checkedAddress `json:"address"`
+}
+
+func (o *checkedOrder) Check(path string, errs *Errors) {
+	errs.Add(path, "order_checked", "checked")
+}
+
+func TestStructCheckers(t *testing.T) {
+	cases := []struct {
+		name string
+		order checkedOrder
+		want []string
+	}{
+		{
+			"every struct and element is checked",
+			checkedOrder{Lines: []checkedLine{{Quantity: 1}, {Quantity: 2}}, Address: &checkedAddress{City: "Puebla"}},
+			[]string{"lines[0]:line_checked", "lines[1]:line_checked", "address:address_checked", ":order_checked"},
+		},
+		{
+			"failures of the elements keep their index",
+			checkedOrder{Lines: []checkedLine{{Quantity: 1}, {Quantity: 0}}, Address: &checkedAddress{}},
+			[]string{"lines[0]:line_checked", "lines[1].quantity:min", "lines[1]:line_checked", "address.city:required", "address:address_checked", ":order_checked"},
+		},
+		{
+			"a failed field isn't walked",
+			checkedOrder{},
+			[]string{"lines:required", ":order_checked"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := failures(Struct(&c.order))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("Struct() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"io"
 	"fmt"
+	"strings"
 
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel"
@@ -115,3 +116,61 @@ func PutImage(imageName string, file io.Reader, size int64, contentType string,
 	imageURL := fmt.Sprintf("%s/%s/%s", imagesHost, bucketName, imageName)
 	return imageURL, nil
 }
+
+func RemoveImage(imageName string, ctx context.Context) error {
+	tr := otel.Tracer(BucketManager)
+	_, span := tr.Start(ctx, fmt.Sprintf("%s.RemoveImage", BucketManager))
+	defer span.End()
+
+	if minioClient == nil {
+		err := errors.New("We couldn't connect to the bucket")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	if err := minioClient.RemoveObject(ctx, bucketName, imageName, minio.RemoveObjectOptions{}); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// GetImage opens an object of the bucket, the caller has to close it
+func GetImage(imageName string, ctx context.Context) (io.ReadCloser, error) {
+	tr := otel.Tracer(BucketManager)
+	_, span := tr.Start(ctx, fmt.Sprintf("%s.GetImage", BucketManager))
+	defer span.End()
+
+	if minioClient == nil {
+		err := errors.New("We couldn't connect to the bucket")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	object, err := minioClient.GetObject(ctx, bucketName, imageName, minio.GetObjectOptions{})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	// The object is read lazily, the stat finds a missing image before the
+	// caller writes anything
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// ImageObjectName returns the object of an URL built by PutImage
+func ImageObjectName(imageURL string) string {
+	return strings.TrimPrefix(imageURL, fmt.Sprintf("%s/%s/", imagesHost, bucketName))
+}
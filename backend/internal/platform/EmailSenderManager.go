@@ -1,9 +1,17 @@
 package platform
 
 import (
+	"mime/quotedprintable"
+	"mime/multipart"
+	"net/textproto"
+	"encoding/base64"
 	"net/smtp"
+	"net/mail"
+	"mime"
 	"context"
+	"strings"
 	"errors"
+	"bytes"
 	"time"
 	"net"
 	"fmt"
@@ -12,12 +20,21 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
 type EmailSenderManager struct {
 	Host string
+	// From is the header with the display name, Address goes to the envelope
 	From string
+	Address string
+}
+
+type EmailAttachment struct {
+	Name string
+	ContentType string
+	Content []byte
 }
 
 var (
@@ -56,19 +73,165 @@ func InitMailManager(ctx context.Context) error {
 	}
 	conn.Close()
 
+	address := os.Getenv("SMTP_FROM")
+	if address == "" {
+		address = "no-reply@sender.com"
+	}
+
+	from := mail.Address{Name: os.Getenv("SMTP_FROM_NAME"), Address: address}
+
 	emailManager = &EmailSenderManager{
 		Host: host,
-		From: "no-reply@sender.com",
+		From: from.String(),
+		Address: address,
 	}
 
 	return nil
 }
 
-func SendEmail(to []string, msg []byte) error {
+// Email is a message before it's encoded, the text and html bodies become a
+// multipart/alternative so every client shows the best one
+type Email struct {
+	To []string
+	Subject string
+	Text string
+	HTML string
+	Attachments []EmailAttachment
+	// MessageId is generated when it's empty, a retry with the same id lets
+	// the mail server or the client discard the copy
+	MessageId string
+}
+
+func SendEmail(email Email) error {
 	if emailManager == nil {
 		return errors.New("Empty manager")
 	}
 
-	return smtp.SendMail(emailManager.Host, nil, emailManager.From, to, msg)
+	msg, err := ComposeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(emailManager.Host, nil, emailManager.Address, email.To, msg)
+}
+
+// ComposeEmail builds the RFC 5322 message with its MIME parts
+func ComposeEmail(email Email) ([]byte, error) {
+	if emailManager == nil {
+		return nil, errors.New("Empty manager")
+	}
+
+	if len(email.To) == 0 {
+		return nil, errors.New("The email doesn't have recipients")
+	}
+
+	for _, to := range email.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return nil, fmt.Errorf("Invalid recipient %q: %w", to, err)
+		}
+	}
+
+	messageId := email.MessageId
+	if messageId == "" {
+		messageId = NewMessageId()
+	}
+
+	var buf bytes.Buffer
+	mixed := multipart.NewWriter(&buf)
+
+	writeHeader(&buf, "From", emailManager.From)
+	writeHeader(&buf, "To", strings.Join(email.To, ", "))
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	writeHeader(&buf, "Date", time.Now().UTC().Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageId)
+	writeHeader(&buf, "MIME-Version", "1.0")
+	writeHeader(&buf, "Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", mixed.Boundary()))
+	buf.WriteString("\r\n")
+
+	// The bodies are written first, the part needs the boundary of its writer
+	var bodies bytes.Buffer
+	alternative := multipart.NewWriter(&bodies)
+
+	if err := writeBody(alternative, "text/plain; charset=utf-8", email.Text); err != nil {
+		return nil, err
+	}
+
+	if email.HTML != "" {
+		if err := writeBody(alternative, "text/html; charset=utf-8", email.HTML); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", alternative.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	part.Write(bodies.Bytes())
+
+	for _, attachment := range email.Attachments {
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition": {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
 }
 
+// NewMessageId returns an id for the Message-ID header in the domain of the
+// sender
+func NewMessageId() string {
+	domain := "localhost"
+	if emailManager != nil {
+		if at := strings.LastIndex(emailManager.Address, "@"); at >= 0 {
+			domain = emailManager.Address[at + 1:]
+		}
+	}
+
+	return fmt.Sprintf("<%s@%s>", uuid.New().String(), domain)
+}
+
+// The values can't break the header with a new line
+func writeHeader(buf *bytes.Buffer, name string, value string) {
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+}
+
+func writeBody(writer *multipart.Writer, contentType string, body string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	encoder := quotedprintable.NewWriter(part)
+	if _, err := encoder.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
@@ -0,0 +1,10 @@
+package platform
+
+import "os"
+
+// IsDevelopment reports if APP_ENV is development. The simulators that let
+// the caller choose the result, like the mock OIDC and payment providers,
+// refuse to run anywhere else
+func IsDevelopment() bool {
+	return os.Getenv("APP_ENV") == "development"
+}
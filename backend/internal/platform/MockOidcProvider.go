@@ -0,0 +1,255 @@
+package platform
+
+import (
+	"net/http/httptest"
+	"encoding/base64"
+	"encoding/json"
+	"crypto/elliptic"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const MockOidcProviderName = "mock"
+
+// MockOidcProvider is a local identity provider for the simulator, the
+// authorize endpoint signs in the login_hint or MOCK_OIDC_EMAIL without asking
+// anything so the whole flow runs offline. Its key only lives in memory and it
+// only redirects to the callback of the API
+type MockOidcProvider struct {
+	issuer string
+	clientId string
+	redirectURI string
+	kid string
+	key *ecdsa.PrivateKey
+	defaultEmail string
+
+	mu sync.Mutex
+	codes map[string]mockOidcCode
+}
+
+type mockOidcCode struct {
+	redirectURI string
+	challenge string
+	nonce string
+	email string
+	expiresAt time.Time
+}
+
+func newMockOidcProvider(issuer string, clientId string, redirectURI string) (*MockOidcProvider, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &MockOidcProvider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		clientId: clientId,
+		redirectURI: redirectURI,
+		kid: "mock-1",
+		key: key,
+		defaultEmail: "oidc.user@example.com",
+		codes: map[string]mockOidcCode{},
+	}
+
+	if email := os.Getenv("MOCK_OIDC_EMAIL"); email != "" {
+		provider.defaultEmail = email
+	}
+
+	return provider, nil
+}
+
+func (m *MockOidcProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+		case strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration"):
+			m.writeJSON(w, http.StatusOK, oidcDiscovery{
+				Issuer: m.issuer,
+				AuthorizationEndpoint: m.issuer + "/authorize",
+				TokenEndpoint: m.issuer + "/token",
+				JwksUri: m.issuer + "/jwks",
+			})
+
+		case strings.HasSuffix(r.URL.Path, "/authorize") && r.Method == http.MethodGet:
+			m.authorize(w, r)
+
+		case strings.HasSuffix(r.URL.Path, "/token") && r.Method == http.MethodPost:
+			m.token(w, r)
+
+		case strings.HasSuffix(r.URL.Path, "/jwks"):
+			m.jwks(w)
+
+		default:
+			http.NotFound(w, r)
+	}
+}
+
+func (m *MockOidcProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	// Any other redirect_uri would hand the code to another site
+	if query.Get("redirect_uri") != m.redirectURI {
+		m.writeError(w, "invalid_request", "Unknown redirect_uri")
+		return
+	}
+
+	redirectURI, err := url.Parse(m.redirectURI)
+	if err != nil || redirectURI.Scheme == "" {
+		m.writeError(w, "invalid_request", "Invalid redirect_uri")
+		return
+	}
+
+	if query.Get("client_id") != m.clientId || query.Get("response_type") != "code" {
+		m.writeError(w, "unauthorized_client", "Unknown client or response type")
+		return
+	}
+
+	if query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256" {
+		m.writeError(w, "invalid_request", "The S256 code challenge is required")
+		return
+	}
+
+	email := query.Get("login_hint")
+	if email == "" {
+		email = m.defaultEmail
+	}
+
+	code := randomHex(16)
+
+	m.mu.Lock()
+	m.codes[code] = mockOidcCode{
+		redirectURI: redirectURI.String(),
+		challenge: query.Get("code_challenge"),
+		nonce: query.Get("nonce"),
+		email: email,
+		expiresAt: time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	params := redirectURI.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	redirectURI.RawQuery = params.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockOidcProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		m.writeError(w, "invalid_request", "Invalid form")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("client_id") != m.clientId {
+		m.writeError(w, "unauthorized_client", "Unknown client or grant type")
+		return
+	}
+
+	// The codes are single use
+	m.mu.Lock()
+	code, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(code.expiresAt) || code.redirectURI != r.PostForm.Get("redirect_uri") {
+		m.writeError(w, "invalid_grant", "Invalid or expired code")
+		return
+	}
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		m.writeError(w, "invalid_grant", "The code verifier doesn't match")
+		return
+	}
+
+	now := time.Now()
+	subject := sha256.Sum256([]byte(strings.ToLower(code.email)))
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": m.issuer,
+		"sub": hex.EncodeToString(subject[:16]),
+		"aud": m.clientId,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"nonce": code.nonce,
+		"email": code.email,
+		"email_verified": true,
+		"name": strings.Split(code.email, "@")[0],
+	})
+	token.Header["kid"] = m.kid
+
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		m.writeError(w, "server_error", err.Error())
+		return
+	}
+
+	m.writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomHex(16),
+		"token_type": "Bearer",
+		"expires_in": 300,
+		"id_token": idToken,
+	})
+}
+
+func (m *MockOidcProvider) jwks(w http.ResponseWriter) {
+	point, err := m.key.PublicKey.ECDH()
+	if err != nil {
+		m.writeError(w, "server_error", err.Error())
+		return
+	}
+
+	// Uncompressed point, 0x04 followed by the 32 bytes of x and y
+	raw := point.Bytes()
+	m.writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{
+			{
+				"kty": "EC",
+				"crv": "P-256",
+				"x": base64.RawURLEncoding.EncodeToString(raw[1:33]),
+				"y": base64.RawURLEncoding.EncodeToString(raw[33:]),
+				"kid": m.kid,
+				"use": "sig",
+				"alg": "ES256",
+			},
+		},
+	})
+}
+
+func (m *MockOidcProvider) writeError(w http.ResponseWriter, code string, description string) {
+	m.writeJSON(w, http.StatusBadRequest, map[string]string{
+		"error": code,
+		"error_description": description,
+	})
+}
+
+func (m *MockOidcProvider) writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func randomHex(size int) string {
+	bytes := make([]byte, size)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// handlerTransport sends the requests of a client to a handler in the same
+// process, the API reaches the mock provider with it
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	t.handler.ServeHTTP(recorder, r)
+	return recorder.Result(), nil
+}
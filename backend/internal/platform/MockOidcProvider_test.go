@@ -0,0 +1,51 @@
+package platform
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestMockOidcAuthorizeRedirect(t *testing.T) {
+	callback := "http://api.localhost/auth/oidc/callback"
+	mock, err := newMockOidcProvider("http://api.localhost/oidc/mock", "ecommerce-simulator", callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		redirectURI string
+		status int
+	}{
+		{"configured callback", callback, http.StatusFound},
+		{"another site", "https://evil.example/steal", http.StatusBadRequest},
+		{"callback with extra query", callback + "?next=https://evil.example", http.StatusBadRequest},
+		{"missing", "", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			query := url.Values{}
+			query.Set("client_id", "ecommerce-simulator")
+			query.Set("response_type", "code")
+			query.Set("redirect_uri", c.redirectURI)
+			query.Set("code_challenge", "challenge")
+			query.Set("code_challenge_method", "S256")
+			query.Set("state", "state-1")
+
+			recorder := httptest.NewRecorder()
+			mock.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/oidc/mock/authorize?" + query.Encode(), nil))
+
+			if recorder.Code != c.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, c.status)
+			}
+
+			if c.status == http.StatusFound && !strings.HasPrefix(recorder.Header().Get("Location"), callback + "?") {
+				t.Fatalf("redirected to %s", recorder.Header().Get("Location"))
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package platform
+
+import (
+	"encoding/json"
+	"net/http"
+	"context"
+	"strings"
+	"errors"
+	"bytes"
+	"sync"
+	"time"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/google/uuid"
+)
+
+const MockPaymentProviderName = "mock"
+
+// The state of the payments is in redis so a refund or a void still finds
+// the payment after a restart or on another instance
+const (
+	mockPaymentPrefix = "mock-payment:"
+	mockPaymentTTL = 90 * 24 * time.Hour
+)
+
+const (
+	MockApprove = "approve"
+	MockDecline = "decline"
+	MockTimeout = "timeout"
+	MockLate = "late"
+	MockLateDecline = "late_decline"
+)
+
+// MockPaymentProvider is a local gateway for the simulator, every
+// authorization takes the next scripted outcome or the default one
+type MockPaymentProvider struct {
+	mu sync.Mutex
+	script []string
+	defaultOutcome string
+	timeout time.Duration
+	lateDelay time.Duration
+	webhookURL string
+	client *http.Client
+}
+
+func newMockPaymentProvider() *MockPaymentProvider {
+	provider := &MockPaymentProvider{
+		script: make([]string, 0),
+		defaultOutcome: MockApprove,
+		timeout: 3 * time.Second,
+		lateDelay: 5 * time.Second,
+		webhookURL: "http://backend:4321/payments/webhook",
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	if outcome := os.Getenv("MOCK_PAYMENT_OUTCOME"); IsMockOutcome(outcome) {
+		provider.defaultOutcome = outcome
+	}
+
+	if delay, err := time.ParseDuration(os.Getenv("MOCK_PAYMENT_TIMEOUT")); err == nil {
+		provider.timeout = delay
+	}
+
+	if delay, err := time.ParseDuration(os.Getenv("MOCK_PAYMENT_LATE_DELAY")); err == nil {
+		provider.lateDelay = delay
+	}
+
+	if url := os.Getenv("PAYMENT_WEBHOOK_URL"); url != "" {
+		provider.webhookURL = url
+	}
+
+	return provider
+}
+
+func IsMockOutcome(outcome string) bool {
+	switch outcome {
+		case MockApprove, MockDecline, MockTimeout, MockLate, MockLateDecline:
+			return true
+		default:
+			return false
+	}
+}
+
+func (m *MockPaymentProvider) Name() string {
+	return MockPaymentProviderName
+}
+
+// Script queues the outcomes of the next authorizations
+func (m *MockPaymentProvider) Script(outcomes ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.script = append(m.script, outcomes...)
+}
+
+func (m *MockPaymentProvider) nextOutcome(request PaymentRequest) string {
+	if outcome := request.Metadata["mock_outcome"]; IsMockOutcome(outcome) {
+		return outcome
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.script) == 0 {
+		return m.defaultOutcome
+	}
+
+	outcome := m.script[0]
+	m.script = m.script[1:]
+
+	return outcome
+}
+
+func (m *MockPaymentProvider) Authorize(request PaymentRequest, ctx context.Context) (*PaymentResult, error) {
+	tr := otel.Tracer(PaymentManagerName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.mock.Authorize", PaymentManagerName))
+	defer span.End()
+
+	outcome := m.nextOutcome(request)
+	ref := "mock_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+
+	span.SetAttributes(
+		attribute.String("payment.intent", request.IntentId),
+		attribute.String("payment.mock.outcome", outcome),
+		attribute.Float64("payment.amount", float64(request.Amount)),
+	)
+
+	switch outcome {
+		case MockDecline:
+			return &PaymentResult{ProviderRef: ref, Status: PaymentDeclined, Reason: "card_declined"}, nil
+
+		case MockTimeout:
+			select {
+				case <-time.After(m.timeout):
+				case <-ctx.Done():
+			}
+
+			span.RecordError(ErrPaymentTimeout)
+			span.SetStatus(codes.Error, ErrPaymentTimeout.Error())
+			return nil, ErrPaymentTimeout
+
+		case MockLate, MockLateDecline:
+			if err := m.setState(ref, PaymentPending, ctx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return nil, err
+			}
+
+			event := PaymentEvent{
+				Type: WebhookPaymentSucceeded,
+				IntentId: request.IntentId,
+				ProviderRef: ref,
+			}
+
+			if outcome == MockLateDecline {
+				event.Type = WebhookPaymentFailed
+				event.Reason = "card_declined"
+			}
+
+			go m.deliverLater(event)
+
+			return &PaymentResult{ProviderRef: ref, Status: PaymentPending}, nil
+
+		default:
+			if err := m.setState(ref, PaymentAuthorized, ctx); err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return nil, err
+			}
+
+			return &PaymentResult{ProviderRef: ref, Status: PaymentAuthorized}, nil
+	}
+}
+
+func (m *MockPaymentProvider) Capture(providerRef string, amount float32, ctx context.Context) (*PaymentResult, error) {
+	return m.transition(providerRef, []string{PaymentAuthorized}, PaymentCaptured, ctx)
+}
+
+func (m *MockPaymentProvider) Refund(providerRef string, amount float32, ctx context.Context) (*PaymentResult, error) {
+	return m.transition(providerRef, []string{PaymentCaptured}, PaymentRefunded, ctx)
+}
+
+func (m *MockPaymentProvider) Void(providerRef string, ctx context.Context) (*PaymentResult, error) {
+	return m.transition(providerRef, []string{PaymentAuthorized, PaymentPending}, PaymentVoided, ctx)
+}
+
+func (m *MockPaymentProvider) setState(providerRef string, state string, ctx context.Context) error {
+	return SaveSecretWithTTL(mockPaymentPrefix + providerRef, state, mockPaymentTTL, ctx)
+}
+
+func (m *MockPaymentProvider) transition(providerRef string, from []string, to string, ctx context.Context) (*PaymentResult, error) {
+	current, swapped, err := SwapSecret(mockPaymentPrefix + providerRef, from, to, ctx)
+	if errors.Is(err, ErrSecretNotFound) {
+		return nil, fmt.Errorf("Unknown payment: %s", providerRef)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !swapped {
+		return nil, fmt.Errorf("The payment %s is %s and can't be %s", providerRef, current, to)
+	}
+
+	return &PaymentResult{ProviderRef: providerRef, Status: to}, nil
+}
+
+func (m *MockPaymentProvider) deliverLater(event PaymentEvent) {
+	time.Sleep(m.lateDelay)
+
+	tr := otel.Tracer(PaymentManagerName)
+	ctx, span := tr.Start(context.Background(), fmt.Sprintf("%s.mock.deliverWebhook", PaymentManagerName))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("payment.intent", event.IntentId),
+		attribute.String("payment.event", event.Type),
+	)
+
+	// A payment voided while it was pending keeps its state, the webhook is
+	// still sent so the intent is settled
+	state := PaymentDeclined
+	if event.Type == WebhookPaymentSucceeded {
+		state = PaymentCaptured
+	}
+
+	if _, err := m.transition(event.ProviderRef, []string{PaymentPending}, state, ctx); err != nil {
+		span.RecordError(err)
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Payment-Signature", SignWebhook(body, time.Now()))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		err := errors.New(resp.Status)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	span.SetStatus(codes.Ok, "Webhook delivered")
+}
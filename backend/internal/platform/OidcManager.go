@@ -0,0 +1,452 @@
+package platform
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/joho/godotenv"
+)
+
+const OidcManagerName = "oidc-manager"
+
+var ErrOidcDisabled = errors.New("The OIDC login is disabled")
+var ErrOidcInvalidToken = errors.New("Invalid ID token")
+
+// OidcIdentity is the user described by a verified ID token
+type OidcIdentity struct {
+	Issuer string
+	Subject string
+	Email string
+	EmailVerified bool
+	Name string
+}
+
+type oidcDiscovery struct {
+	Issuer string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JwksUri string `json:"jwks_uri"`
+}
+
+type oidcJSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	X string `json:"x"`
+	Y string `json:"y"`
+	N string `json:"n"`
+	E string `json:"e"`
+}
+
+// oidcClient talks to the provider, the discovery document and the keys are
+// loaded on the first login and the keys again when a token has an unknown kid
+type oidcClient struct {
+	issuer string
+	clientId string
+	clientSecret string
+	redirectURL string
+	client *http.Client
+
+	mutex sync.Mutex
+	discovery *oidcDiscovery
+	keys map[string]any
+	keysLoadedAt time.Time
+}
+
+var (
+	oidcProvider *oidcClient
+	mockOidcProvider *MockOidcProvider
+)
+
+// InitOidcManager reads OIDC_PROVIDER, empty disables the login, mock starts
+// the embedded provider and oidc uses OIDC_ISSUER with the client of
+// OIDC_CLIENT_ID and OIDC_CLIENT_SECRET
+func InitOidcManager(ctx context.Context) error {
+	tr := otel.Tracer(OidcManagerName)
+	_, span := tr.Start(ctx, fmt.Sprintf("%s.InitOidcManager", OidcManagerName))
+	defer span.End()
+
+	if err := godotenv.Load(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, fmt.Sprintf("Unable to load env: %s", err.Error()))
+		return err
+	}
+
+	provider := os.Getenv("OIDC_PROVIDER")
+	span.SetAttributes(attribute.String("oidc.provider", provider))
+
+	redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = "http://api.localhost/auth/oidc/callback"
+	}
+
+	switch provider {
+		case "":
+			return nil
+
+		case MockOidcProviderName:
+			// The mock signs in any email, so it can't run with real accounts
+			if !IsDevelopment() {
+				err := errors.New("The mock OIDC provider only runs with APP_ENV=development")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return err
+			}
+
+			issuer := os.Getenv("OIDC_MOCK_ISSUER")
+			if issuer == "" {
+				issuer = "http://api.localhost/oidc/mock"
+			}
+
+			mock, err := newMockOidcProvider(issuer, "ecommerce-simulator", redirectURL)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				return err
+			}
+
+			// The API calls the embedded provider without the network
+			mockOidcProvider = mock
+			oidcProvider = &oidcClient{
+				issuer: issuer,
+				clientId: mock.clientId,
+				redirectURL: redirectURL,
+				client: &http.Client{Transport: handlerTransport{handler: mock}, Timeout: 5 * time.Second},
+			}
+
+		case "oidc":
+			issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+			clientId := os.Getenv("OIDC_CLIENT_ID")
+			if issuer == "" || clientId == "" {
+				err := errors.New("OIDC_ISSUER and OIDC_CLIENT_ID environment variables are required")
+				span.RecordError(err)
+				span.SetStatus(codes.Error, fmt.Sprintf("Unable to load env: %s", err.Error()))
+				return err
+			}
+
+			oidcProvider = &oidcClient{
+				issuer: issuer,
+				clientId: clientId,
+				clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+				redirectURL: redirectURL,
+				client: &http.Client{Timeout: 10 * time.Second},
+			}
+
+		default:
+			err := fmt.Errorf("Unknown OIDC provider: %s", provider)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+	}
+
+	return nil
+}
+
+// GetMockOidcProvider is nil unless OIDC_PROVIDER is mock
+func GetMockOidcProvider() *MockOidcProvider {
+	return mockOidcProvider
+}
+
+// OidcAuthorizationURL is where the browser starts the login, the challenge
+// is the S256 of the PKCE verifier
+func OidcAuthorizationURL(state string, nonce string, challenge string, ctx context.Context) (string, error) {
+	tr := otel.Tracer(OidcManagerName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.OidcAuthorizationURL", OidcManagerName))
+	defer span.End()
+
+	if oidcProvider == nil {
+		return "", ErrOidcDisabled
+	}
+
+	discovery, err := oidcProvider.loadDiscovery(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", oidcProvider.clientId)
+	query.Set("redirect_uri", oidcProvider.redirectURL)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", challenge)
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// ExchangeOidcCode trades the code for the tokens and returns the identity of
+// the ID token once its signature, issuer, audience, expiration and nonce are
+// verified
+func ExchangeOidcCode(code string, verifier string, nonce string, ctx context.Context) (*OidcIdentity, error) {
+	tr := otel.Tracer(OidcManagerName)
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s.ExchangeOidcCode", OidcManagerName))
+	defer span.End()
+
+	if oidcProvider == nil {
+		return nil, ErrOidcDisabled
+	}
+
+	discovery, err := oidcProvider.loadDiscovery(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidcProvider.redirectURL)
+	form.Set("client_id", oidcProvider.clientId)
+	form.Set("code_verifier", verifier)
+	if oidcProvider.clientSecret != "" {
+		form.Set("client_secret", oidcProvider.clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tokens struct {
+		IdToken string `json:"id_token"`
+	}
+
+	if err := oidcProvider.doJSON(req, &tokens); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	identity, err := oidcProvider.verifyIdToken(tokens.IdToken, nonce, discovery, ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("oidc.subject", identity.Subject),
+		attribute.Bool("oidc.email_verified", identity.EmailVerified),
+	)
+
+	return identity, nil
+}
+
+func (o *oidcClient) loadDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.issuer + "/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var discovery oidcDiscovery
+	if err := o.doJSON(req, &discovery); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != o.issuer {
+		return nil, fmt.Errorf("The discovery document is for the issuer %s", discovery.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, errors.New("The discovery document is incomplete")
+	}
+
+	o.discovery = &discovery
+
+	return o.discovery, nil
+}
+
+// publicKey returns the key of the kid, the keys are loaded again when the
+// provider rotated them but not more than once every 10 seconds
+func (o *oidcClient) publicKey(kid string, jwksUri string, ctx context.Context) (any, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(o.keysLoadedAt) < 10 * time.Second {
+		return nil, fmt.Errorf("Unknown key %s", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksUri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []oidcJSONWebKey `json:"keys"`
+	}
+
+	if err := o.doJSON(req, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]any{}
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	o.keys = keys
+	o.keysLoadedAt = time.Now()
+
+	key, ok := o.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key %s", kid)
+	}
+
+	return key, nil
+}
+
+func (o *oidcClient) verifyIdToken(idToken string, nonce string, discovery *oidcDiscovery, ctx context.Context) (*OidcIdentity, error) {
+	if idToken == "" {
+		return nil, ErrOidcInvalidToken
+	}
+
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return o.publicKey(kid, discovery.JwksUri, ctx)
+	},
+		jwt.WithValidMethods([]string{"ES256", "RS256"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(o.clientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOidcInvalidToken, err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrOidcInvalidToken
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, fmt.Errorf("%w: the nonce doesn't match", ErrOidcInvalidToken)
+	}
+
+	identity := OidcIdentity{Issuer: discovery.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+
+	// Some providers send the flag as a string
+	switch verified := claims["email_verified"].(type) {
+		case bool:
+			identity.EmailVerified = verified
+		case string:
+			identity.EmailVerified = verified == "true"
+	}
+
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrOidcInvalidToken)
+	}
+
+	return &identity, nil
+}
+
+func (o *oidcClient) doJSON(req *http.Request, target any) error {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1 << 20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("The OIDC provider answered %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, target)
+}
+
+func (k oidcJSONWebKey) publicKey() (any, error) {
+	switch k.Kty {
+		case "EC":
+			if k.Crv != "P-256" {
+				return nil, fmt.Errorf("Unsupported curve %s", k.Crv)
+			}
+
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, err
+			}
+
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, err
+			}
+
+			// Uncompressed point, 0x04 followed by x and y
+			point := append([]byte{4}, x...)
+			return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(point, y...))
+
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, err
+			}
+
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, err
+			}
+
+			return &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}, nil
+
+		default:
+			return nil, fmt.Errorf("Unsupported key type %s", k.Kty)
+	}
+}
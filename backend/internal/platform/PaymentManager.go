@@ -0,0 +1,179 @@
+package platform
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"context"
+	"errors"
+	"time"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel"
+	"github.com/joho/godotenv"
+)
+
+const (
+	PaymentAuthorized = "authorized"
+	PaymentCaptured = "captured"
+	PaymentDeclined = "declined"
+	PaymentPending = "pending"
+	PaymentRefunded = "refunded"
+	PaymentVoided = "voided"
+)
+
+const (
+	WebhookPaymentSucceeded = "payment.succeeded"
+	WebhookPaymentFailed = "payment.failed"
+)
+
+var ErrPaymentTimeout = errors.New("The payment provider didn't answer in time")
+var ErrInvalidSignature = errors.New("Invalid webhook signature")
+
+type PaymentRequest struct {
+	IntentId string
+	Reference string
+	Amount float32
+	Currency string
+	Metadata map[string]string
+}
+
+type PaymentResult struct {
+	ProviderRef string
+	Status string
+	Reason string
+}
+
+// PaymentEvent is the body the providers send to the webhook endpoint
+type PaymentEvent struct {
+	Type string `json:"type"`
+	IntentId string `json:"intent_id"`
+	ProviderRef string `json:"provider_ref"`
+	Reason string `json:"reason"`
+}
+
+type PaymentProvider interface {
+	Name() string
+	Authorize(request PaymentRequest, ctx context.Context) (*PaymentResult, error)
+	Capture(providerRef string, amount float32, ctx context.Context) (*PaymentResult, error)
+	Refund(providerRef string, amount float32, ctx context.Context) (*PaymentResult, error)
+	Void(providerRef string, ctx context.Context) (*PaymentResult, error)
+}
+
+var (
+	paymentProvider PaymentProvider
+	paymentCurrency string
+	webhookSecret string
+)
+
+const PaymentManagerName = "payment-manager"
+
+func InitPaymentManager(ctx context.Context) error {
+	tr := otel.Tracer(PaymentManagerName)
+	_, span := tr.Start(ctx, fmt.Sprintf("%s.InitPaymentManager", PaymentManagerName))
+	defer span.End()
+
+	if err := godotenv.Load(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, fmt.Sprintf("Unable to load env: %s", err.Error()))
+		return err
+	}
+
+	webhookSecret = os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		err := errors.New("PAYMENT_WEBHOOK_SECRET environment variable is empty")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, fmt.Sprintf("Unable to load env: %s", err.Error()))
+		return err
+	}
+
+	paymentCurrency = os.Getenv("PAYMENT_CURRENCY")
+	if paymentCurrency == "" {
+		paymentCurrency = "USD"
+	}
+
+	provider := os.Getenv("PAYMENT_PROVIDER")
+	span.SetAttributes(attribute.String("payment.provider", provider))
+
+	switch provider {
+		case "", MockPaymentProviderName:
+			paymentProvider = newMockPaymentProvider()
+		default:
+			err := fmt.Errorf("Unknown payment provider: %s", provider)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+	}
+
+	return nil
+}
+
+func GetPaymentProvider() PaymentProvider {
+	return paymentProvider
+}
+
+func GetPaymentCurrency() string {
+	return paymentCurrency
+}
+
+// SignWebhook returns the signature header for a webhook body, the format is
+// t=<unix seconds>,v1=<hex hmac-sha256 of "t.body">
+func SignWebhook(body []byte, at time.Time) string {
+	return SignWebhookWith(webhookSecret, body, at)
+}
+
+// SignWebhookWith signs a body with the given secret, used by the webhooks
+// that we send to the sellers
+func SignWebhookWith(secret string, body []byte, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, webhookMAC(secret, timestamp, body))
+}
+
+func VerifyWebhookSignature(header string, body []byte) error {
+	if webhookSecret == "" {
+		return errors.New("Empty webhook secret")
+	}
+
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+
+		switch key {
+			case "t":
+				timestamp = value
+			case "v1":
+				signature = value
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return ErrInvalidSignature
+	}
+
+	// Reject replayed events
+	age := time.Since(time.Unix(seconds, 0))
+	if age > 5 * time.Minute || age < -5 * time.Minute {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(webhookMAC(webhookSecret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+func webhookMAC(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
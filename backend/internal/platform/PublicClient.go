@@ -0,0 +1,65 @@
+package platform
+
+import (
+	"net"
+	"time"
+	"errors"
+	"syscall"
+	"net/http"
+	"net/netip"
+)
+
+var ErrPrivateAddress = errors.New("The address is not public")
+
+// IsPublicAddress rejects the addresses of this host and its networks, a
+// user given url must never reach them
+func IsPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified()
+}
+
+// NewPublicClient is the client for the urls given by the users. The address
+// is checked after the name is resolved so a public name pointing to a private
+// address is rejected too, and the redirects are never followed
+func NewPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !IsPublicAddress(addrPort.Addr()) {
+				return ErrPrivateAddress
+			}
+
+			return nil
+		},
+	}
+
+	// Without a proxy, it would dial the addresses itself
+	transport := &http.Transport{
+		Proxy: nil,
+		DialContext: dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns: 10,
+		IdleConnTimeout: 90 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,49 @@
+package platform
+
+import (
+	"errors"
+	"time"
+	"testing"
+	"net/http"
+	"net/netip"
+	"net/http/httptest"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	cases := []struct {
+		addr string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.8", false},
+		{"172.18.0.3", false},
+		{"192.168.1.10", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			if public := IsPublicAddress(netip.MustParseAddr(c.addr)); public != c.public {
+				t.Fatalf("IsPublicAddress(%s) = %v, want %v", c.addr, public, c.public)
+			}
+		})
+	}
+}
+
+func TestPublicClientRejectsLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := NewPublicClient(time.Second).Get(server.URL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("err = %v, want %v", err, ErrPrivateAddress)
+	}
+}
@@ -18,6 +18,8 @@ var (
 	redisClient *redis.Client
 )
 
+var ErrSecretNotFound = errors.New("Secret Not Found")
+
 const SecretsManager = "secrets-manager"
 
 func InitSecretsManager(ctx context.Context) error {
@@ -103,6 +105,201 @@ func GetSecret(key string, ctx context.Context) (string, error)  {
 	)
 
 	val, err := redisClient.Get(getCtx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrSecretNotFound
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return val, err
+}
+
+
+// SaveSecretWithTTL stores a key that expires after the ttl
+func SaveSecretWithTTL(key string, value string, ttl time.Duration, ctx context.Context) error {
+	tr := otel.Tracer(SecretsManager)
+	saveCtx, span := tr.Start(ctx, fmt.Sprintf("%s.SaveSecretWithTTL", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	if err := redisClient.Set(saveCtx, key, value, ttl).Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// SaveSecretIfAbsent stores the key only when it doesn't exist yet and
+// reports if it was stored, the key expires after the ttl
+func SaveSecretIfAbsent(key string, value string, ttl time.Duration, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(SecretsManager)
+	saveCtx, span := tr.Start(ctx, fmt.Sprintf("%s.SaveSecretIfAbsent", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	saved, err := redisClient.SetNX(saveCtx, key, value, ttl).Result()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	return saved, nil
+}
+
+func DeleteSecret(key string, ctx context.Context) error {
+	tr := otel.Tracer(SecretsManager)
+	deleteCtx, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteSecret", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	if err := redisClient.Del(deleteCtx, key).Err(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Only the holder of the value deletes the key, a lock that expired and was
+// taken by another instance is left alone
+var deleteIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// DeleteSecretIfEqual deletes the key only while it still has the value and
+// reports if it was deleted
+func DeleteSecretIfEqual(key string, value string, ctx context.Context) (bool, error) {
+	tr := otel.Tracer(SecretsManager)
+	deleteCtx, span := tr.Start(ctx, fmt.Sprintf("%s.DeleteSecretIfEqual", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	deleted, err := deleteIfEqualScript.Run(deleteCtx, redisClient, []string{key}, value).Int64()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, err
+	}
+
+	return deleted == 1, nil
+}
+
+// The counter only gets its expiration with the first hit so the window
+// starts with it
+var incrementScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// IncrementCounter adds one to the counter of the key and returns the new
+// value with the time left until the counter resets
+func IncrementCounter(key string, window time.Duration, ctx context.Context) (int64, time.Duration, error) {
+	tr := otel.Tracer(SecretsManager)
+	incrementCtx, span := tr.Start(ctx, fmt.Sprintf("%s.IncrementCounter", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, 0, err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	result, err := incrementScript.Run(incrementCtx, redisClient, []string{key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return 0, 0, err
+	}
+
+	ttl := time.Duration(result[1]) * time.Millisecond
+	if ttl < 0 {
+		ttl = window
+	}
+
+	return result[0], ttl, nil
+}
+
+// ConsumeSecret returns the value of the key and deletes it in the same step,
+// two requests can't read a single use secret
+func ConsumeSecret(key string, ctx context.Context) (string, error) {
+	tr := otel.Tracer(SecretsManager)
+	consumeCtx, span := tr.Start(ctx, fmt.Sprintf("%s.ConsumeSecret", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	val, err := redisClient.GetDel(consumeCtx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrSecretNotFound
+	}
+
 	if err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
@@ -111,3 +308,59 @@ func GetSecret(key string, ctx context.Context) (string, error)  {
 	return val, err
 }
 
+// The value is only replaced when it is one of the expected ones, the key
+// keeps its expiration
+var swapScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current then
+	return {0, false}
+end
+for i = 2, #ARGV do
+	if current == ARGV[i] then
+		redis.call("SET", KEYS[1], ARGV[1], "KEEPTTL")
+		return {1, current}
+	end
+end
+return {0, current}
+`)
+
+// SwapSecret replaces the value of the key when the current one is any of
+// the expected values, it returns the value it found and if it was replaced
+func SwapSecret(key string, expected []string, value string, ctx context.Context) (string, bool, error) {
+	tr := otel.Tracer(SecretsManager)
+	swapCtx, span := tr.Start(ctx, fmt.Sprintf("%s.SwapSecret", SecretsManager))
+	defer span.End()
+
+	if redisClient == nil {
+		err := errors.New("Empty Secrets")
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", false, err
+	}
+
+	span.SetAttributes(
+		attribute.String("secret-key", key),
+	)
+
+	args := make([]interface{}, 0, len(expected) + 1)
+	args = append(args, value)
+	for _, state := range expected {
+		args = append(args, state)
+	}
+
+	result, err := swapScript.Run(swapCtx, redisClient, []string{key}, args...).Slice()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", false, err
+	}
+
+	current, found := result[1].(string)
+	if !found {
+		return "", false, ErrSecretNotFound
+	}
+
+	swapped, _ := result[0].(int64)
+
+	return current, swapped == 1, nil
+}
@@ -0,0 +1,33 @@
+-- Sequential invoice numbers per seller, one invoice per seller in a ticket
+
+CREATE TABLE IF NOT EXISTS invoice_sequences (
+  seller VARCHAR(36) NOT NULL,
+  last_number BIGINT NOT NULL DEFAULT 0,
+  PRIMARY KEY (seller)
+);
+
+CREATE TABLE IF NOT EXISTS invoices (
+  uuid VARCHAR(36) NOT NULL,
+  ticket_id VARCHAR(36) NOT NULL,
+  seller VARCHAR(36) NOT NULL,
+  number BIGINT NOT NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY invoices_seller_number (seller, number),
+  UNIQUE KEY invoices_ticket_seller (ticket_id, seller)
+);
+
+-- Backfill the tickets created before invoices existed, in purchase order
+INSERT INTO invoices (uuid, ticket_id, seller, number, created_at)
+SELECT UUID(), t.ticket_id, t.seller,
+  ROW_NUMBER() OVER (PARTITION BY t.seller ORDER BY t.created_at, t.ticket_id),
+  t.created_at
+FROM (
+  SELECT p.ticket_id, pr.belongs_to AS seller, MIN(p.created_at) AS created_at
+  FROM purchases p
+  JOIN products pr ON pr.uuid = p.product
+  GROUP BY p.ticket_id, pr.belongs_to
+) t;
+
+INSERT INTO invoice_sequences (seller, last_number)
+SELECT seller, MAX(number) FROM invoices GROUP BY seller;
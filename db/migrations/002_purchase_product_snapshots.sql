@@ -0,0 +1,15 @@
+-- Snapshot of the product on every purchase line, taken at checkout
+
+ALTER TABLE purchases
+  ADD COLUMN product_name VARCHAR(255) NOT NULL DEFAULT '' AFTER product,
+  ADD COLUMN product_image VARCHAR(2048) NULL AFTER product_name,
+  ADD COLUMN seller VARCHAR(36) NOT NULL DEFAULT '' AFTER product_image;
+
+-- Products deleted before this migration keep an empty snapshot
+UPDATE purchases p
+JOIN products pr ON pr.uuid = p.product
+SET p.product_name = pr.name,
+  p.product_image = pr.image,
+  p.seller = pr.belongs_to;
+
+CREATE INDEX purchases_seller ON purchases (seller);
@@ -0,0 +1,33 @@
+-- One sub-order per seller inside a ticket, the ticket stays as the parent order
+
+CREATE TABLE IF NOT EXISTS sub_orders (
+  uuid VARCHAR(36) NOT NULL,
+  ticket_id VARCHAR(36) NOT NULL,
+  seller VARCHAR(36) NOT NULL,
+  buyer VARCHAR(36) NOT NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'placed',
+  units INT NOT NULL DEFAULT 0,
+  subtotal DECIMAL(15, 2) NOT NULL DEFAULT 0,
+  total DECIMAL(15, 2) NOT NULL DEFAULT 0,
+  fulfillment_status VARCHAR(16) NOT NULL DEFAULT 'unfulfilled',
+  tracking_number VARCHAR(64) NULL,
+  fulfilled_at DATETIME(3) NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY sub_orders_ticket_seller (ticket_id, seller),
+  KEY sub_orders_seller_created (seller, created_at)
+);
+
+ALTER TABLE purchases
+  ADD COLUMN sub_order_id VARCHAR(36) NOT NULL DEFAULT '' AFTER ticket_id,
+  ADD KEY purchases_sub_order (sub_order_id);
+
+INSERT INTO sub_orders (uuid, ticket_id, seller, buyer, units, subtotal, total, created_at)
+SELECT UUID(), ticket_id, seller, MAX(purchased_by), SUM(quantity), SUM(price * quantity), SUM(price * quantity), MIN(created_at)
+FROM purchases
+GROUP BY ticket_id, seller;
+
+UPDATE purchases p
+JOIN sub_orders so ON so.ticket_id = p.ticket_id AND so.seller = p.seller
+SET p.sub_order_id = so.uuid;
@@ -0,0 +1,18 @@
+-- One payment intent per checkout attempt of a ticket
+
+CREATE TABLE IF NOT EXISTS payment_intents (
+  uuid VARCHAR(36) NOT NULL,
+  ticket_id VARCHAR(36) NOT NULL,
+  buyer VARCHAR(36) NOT NULL,
+  provider VARCHAR(32) NOT NULL,
+  provider_ref VARCHAR(128) NULL,
+  amount DECIMAL(15, 2) NOT NULL,
+  currency CHAR(3) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  failure_reason VARCHAR(255) NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  KEY payment_intents_ticket (ticket_id, created_at),
+  KEY payment_intents_provider_ref (provider, provider_ref)
+);
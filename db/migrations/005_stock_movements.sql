@@ -0,0 +1,20 @@
+-- Append only ledger of every change to products.quantity
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+  uuid VARCHAR(36) NOT NULL,
+  product VARCHAR(36) NOT NULL,
+  delta INT NOT NULL,
+  resulting_quantity INT NOT NULL,
+  reason VARCHAR(32) NOT NULL,
+  reference_id VARCHAR(36) NULL,
+  actor VARCHAR(36) NOT NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  KEY stock_movements_product_created (product, created_at)
+);
+
+-- Opening balance so the ledger of existing products adds up to their quantity
+INSERT INTO stock_movements (uuid, product, delta, resulting_quantity, reason, reference_id, actor, created_at)
+SELECT UUID(), uuid, quantity, quantity, 'import', NULL, belongs_to, UTC_TIMESTAMP(3)
+FROM products
+WHERE quantity <> 0;
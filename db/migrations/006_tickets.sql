@@ -0,0 +1,43 @@
+-- Tickets become their own table, written in the same transaction as the lines
+
+CREATE TABLE IF NOT EXISTS tickets (
+  uuid VARCHAR(36) NOT NULL,
+  buyer VARCHAR(36) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  payment_status VARCHAR(16) NULL,
+  `lines` INT NOT NULL DEFAULT 0,
+  units INT NOT NULL DEFAULT 0,
+  subtotal DECIMAL(15, 2) NOT NULL DEFAULT 0,
+  total DECIMAL(15, 2) NOT NULL DEFAULT 0,
+  notes VARCHAR(500) NULL,
+  shipping_address JSON NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  KEY tickets_buyer (buyer, created_at)
+);
+
+-- Cancelled tickets used to delete their lines, so every ticket left in
+-- purchases is still active. The payment state comes from its latest intent
+INSERT INTO tickets (uuid, buyer, status, payment_status, `lines`, units, subtotal, total, created_at)
+SELECT
+  p.ticket_id,
+  MIN(p.purchased_by),
+  CASE WHEN MIN(pi.status) IN ('pending', 'authorized') THEN 'pending_payment' ELSE 'paid' END,
+  MIN(pi.status),
+  COUNT(*),
+  SUM(p.quantity),
+  SUM(p.price * p.quantity),
+  SUM(p.price * p.quantity),
+  MIN(p.created_at)
+FROM purchases p
+LEFT JOIN payment_intents pi ON pi.uuid = (
+  SELECT latest.uuid
+  FROM payment_intents latest
+  WHERE latest.ticket_id = p.ticket_id
+  ORDER BY latest.created_at DESC
+  LIMIT 1
+)
+LEFT JOIN tickets t ON t.uuid = p.ticket_id
+WHERE t.uuid IS NULL
+GROUP BY p.ticket_id;
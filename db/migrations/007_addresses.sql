@@ -0,0 +1,20 @@
+-- Address book of the buyers, tickets keep a json copy in shipping_address
+
+CREATE TABLE IF NOT EXISTS addresses (
+  uuid VARCHAR(36) NOT NULL,
+  owner VARCHAR(36) NOT NULL,
+  label VARCHAR(40) NULL,
+  recipient VARCHAR(100) NOT NULL,
+  line1 VARCHAR(120) NOT NULL,
+  line2 VARCHAR(120) NULL,
+  city VARCHAR(80) NOT NULL,
+  region VARCHAR(80) NOT NULL DEFAULT '',
+  postal_code VARCHAR(16) NOT NULL,
+  country CHAR(2) NOT NULL,
+  phone VARCHAR(20) NULL,
+  is_default BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  KEY addresses_owner (owner, is_default)
+);
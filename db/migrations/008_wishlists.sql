@@ -0,0 +1,27 @@
+-- Named wishlists per user, the share id signs the public link
+
+CREATE TABLE IF NOT EXISTS wishlists (
+  uuid VARCHAR(36) NOT NULL,
+  owner VARCHAR(36) NOT NULL,
+  name VARCHAR(60) NOT NULL,
+  share_id VARCHAR(36) NULL,
+  shared_until DATETIME(3) NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY wishlists_owner_name (owner, name)
+);
+
+-- Items keep the name and price of the product when it was added
+CREATE TABLE IF NOT EXISTS wishlist_items (
+  uuid VARCHAR(36) NOT NULL,
+  wishlist_id VARCHAR(36) NOT NULL,
+  product VARCHAR(36) NOT NULL,
+  product_name VARCHAR(255) NOT NULL,
+  price_at_add DECIMAL(15, 2) NOT NULL,
+  product_removed_at DATETIME(3) NULL,
+  added_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY wishlist_items_product (wishlist_id, product),
+  KEY wishlist_items_by_product (product)
+);
@@ -0,0 +1,47 @@
+-- Rating aggregates of the product, kept in the same transaction as the reviews
+
+ALTER TABLE products
+  ADD COLUMN rating_average DECIMAL(3, 2) NOT NULL DEFAULT 0,
+  ADD COLUMN rating_count INT NOT NULL DEFAULT 0,
+  ADD COLUMN rating_sum BIGINT NOT NULL DEFAULT 0,
+  ADD KEY products_by_rating (rating_average, rating_count);
+
+-- One review per user and product, only buyers with a paid ticket can write it
+CREATE TABLE IF NOT EXISTS reviews (
+  uuid VARCHAR(36) NOT NULL,
+  product VARCHAR(36) NOT NULL,
+  author VARCHAR(36) NOT NULL,
+  rating TINYINT NOT NULL,
+  title VARCHAR(120) NOT NULL,
+  body TEXT NOT NULL,
+  status VARCHAR(20) NOT NULL DEFAULT 'published',
+  flag_count INT NOT NULL DEFAULT 0,
+  reply TEXT NULL,
+  replied_at DATETIME(3) NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY reviews_product_author (product, author),
+  KEY reviews_by_product (product, status, created_at)
+);
+
+CREATE TABLE IF NOT EXISTS review_images (
+  uuid VARCHAR(36) NOT NULL,
+  review_id VARCHAR(36) NOT NULL,
+  object_name VARCHAR(255) NOT NULL,
+  url VARCHAR(1024) NOT NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  KEY review_images_by_review (review_id)
+);
+
+-- Reports of the users, enough of them hide the review
+CREATE TABLE IF NOT EXISTS review_flags (
+  uuid VARCHAR(36) NOT NULL,
+  review_id VARCHAR(36) NOT NULL,
+  reporter VARCHAR(36) NOT NULL,
+  reason VARCHAR(20) NOT NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY review_flags_reporter (review_id, reporter)
+);
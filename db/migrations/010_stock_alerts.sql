@@ -0,0 +1,22 @@
+-- Low stock threshold of the product, NULL uses the default of the seller
+
+ALTER TABLE products
+  ADD COLUMN low_stock_threshold INT NULL;
+
+CREATE TABLE IF NOT EXISTS seller_settings (
+  seller VARCHAR(36) NOT NULL,
+  low_stock_threshold INT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (seller)
+);
+
+-- Endpoints that receive the stock alerts, signed with the secret
+CREATE TABLE IF NOT EXISTS seller_webhooks (
+  uuid VARCHAR(36) NOT NULL,
+  seller VARCHAR(36) NOT NULL,
+  url VARCHAR(500) NOT NULL,
+  secret VARCHAR(64) NOT NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  KEY seller_webhooks_by_seller (seller)
+);
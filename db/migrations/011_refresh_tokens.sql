@@ -0,0 +1,17 @@
+-- Rotating refresh tokens, a used token that shows up again revokes its family
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+  uuid VARCHAR(36) NOT NULL,
+  family_id VARCHAR(36) NOT NULL,
+  user_uuid VARCHAR(36) NOT NULL,
+  token_hash CHAR(64) NOT NULL,
+  expires_at DATETIME(3) NOT NULL,
+  used_at DATETIME(3) NULL,
+  revoked_at DATETIME(3) NULL,
+  replaced_by VARCHAR(36) NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY refresh_tokens_hash (token_hash),
+  KEY refresh_tokens_by_family (family_id),
+  KEY refresh_tokens_by_user (user_uuid)
+);
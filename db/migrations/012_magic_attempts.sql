@@ -0,0 +1,3 @@
+-- Failed attempts of each magic code, the code is deleted after too many
+
+ALTER TABLE magics ADD COLUMN attempts INT NOT NULL DEFAULT 0;
@@ -0,0 +1,37 @@
+-- Roles of the users and the permissions of each role, the tokens carry both
+
+CREATE TABLE IF NOT EXISTS roles (
+  name VARCHAR(30) NOT NULL,
+  description VARCHAR(255) NOT NULL,
+  PRIMARY KEY (name)
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role VARCHAR(30) NOT NULL,
+  permission VARCHAR(50) NOT NULL,
+  PRIMARY KEY (role, permission)
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+  user_uuid VARCHAR(36) NOT NULL,
+  role VARCHAR(30) NOT NULL,
+  assigned_by VARCHAR(36) NULL,
+  created_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (user_uuid, role),
+  KEY user_roles_by_role (role)
+);
+
+INSERT IGNORE INTO roles (name, description) VALUES
+  ('member', 'Buys and sells products'),
+  ('admin', 'Manages the users and their roles');
+
+INSERT IGNORE INTO role_permissions (role, permission) VALUES
+  ('member', 'products:write'),
+  ('member', 'orders:fulfil'),
+  ('admin', 'products:write'),
+  ('admin', 'orders:fulfil'),
+  ('admin', 'admin:users');
+
+-- Every user could sell before the roles existed
+INSERT IGNORE INTO user_roles (user_uuid, role, assigned_by, created_at)
+SELECT uuid, 'member', NULL, UTC_TIMESTAMP(3) FROM users;
@@ -0,0 +1,17 @@
+-- API keys of the integrations, only the hash of each key is stored
+
+CREATE TABLE IF NOT EXISTS api_keys (
+  uuid VARCHAR(36) NOT NULL,
+  user_uuid VARCHAR(36) NOT NULL,
+  name VARCHAR(100) NOT NULL,
+  prefix VARCHAR(20) NOT NULL,
+  key_hash CHAR(64) NOT NULL,
+  scopes JSON NOT NULL,
+  expires_at DATETIME(3) NOT NULL,
+  last_used_at DATETIME(3) NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY api_keys_hash (key_hash),
+  KEY api_keys_by_user (user_uuid)
+);
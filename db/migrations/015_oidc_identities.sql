@@ -0,0 +1,12 @@
+-- Accounts of the OIDC providers linked to the users
+
+CREATE TABLE IF NOT EXISTS oidc_identities (
+  issuer VARCHAR(255) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  user_uuid VARCHAR(36) NOT NULL,
+  email VARCHAR(255) NOT NULL,
+  created_at DATETIME(3) NOT NULL,
+  last_login_at DATETIME(3) NOT NULL,
+  PRIMARY KEY (issuer, subject),
+  KEY oidc_identities_by_user (user_uuid)
+);
@@ -0,0 +1,28 @@
+-- Outbox of the emails, they are written in the transaction of the change
+-- that sends them and a worker delivers them with retries. The Message-ID is
+-- kept between the attempts so a repeated send is discarded as a copy
+
+CREATE TABLE IF NOT EXISTS outbox_emails (
+  uuid VARCHAR(36) NOT NULL,
+  template VARCHAR(50) NOT NULL,
+  message_id VARCHAR(255) NOT NULL,
+  recipients JSON NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  text_body MEDIUMTEXT NOT NULL,
+  html_body MEDIUMTEXT NOT NULL,
+  attachments JSON NOT NULL,
+  status VARCHAR(10) NOT NULL DEFAULT 'pending',
+  attempts INT NOT NULL DEFAULT 0,
+  next_attempt_at DATETIME(3) NOT NULL,
+  last_error TEXT NULL,
+  sent_at DATETIME(3) NULL,
+  created_at DATETIME(3) NOT NULL,
+  updated_at DATETIME(3) NULL,
+  PRIMARY KEY (uuid),
+  UNIQUE KEY outbox_emails_message_id (message_id),
+  KEY outbox_emails_due (status, next_attempt_at)
+);
+
+-- The admins list and retry the failed emails
+INSERT IGNORE INTO role_permissions (role, permission) VALUES
+  ('admin', 'admin:emails');
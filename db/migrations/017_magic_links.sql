@@ -0,0 +1,6 @@
+-- Purpose of each code and the hash of the nonce of its signed link, the
+-- link is used once like the code
+
+ALTER TABLE magics ADD COLUMN purpose VARCHAR(10) NOT NULL DEFAULT 'verify';
+ALTER TABLE magics ADD COLUMN link_hash CHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE magics ADD KEY magics_by_link (belongs_to, link_hash);
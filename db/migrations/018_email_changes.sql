@@ -0,0 +1,5 @@
+-- The new address of a change_email code, the account switches to it when
+-- the code is confirmed
+
+ALTER TABLE magics ADD COLUMN new_email VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE magics MODIFY COLUMN purpose VARCHAR(20) NOT NULL DEFAULT 'verify';
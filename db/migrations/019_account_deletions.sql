@@ -0,0 +1,15 @@
+-- Deletions requested by the users, the account is anonymized once the
+-- cooling-off period ends unless the request is cancelled before
+
+CREATE TABLE IF NOT EXISTS account_deletions (
+  user_uuid VARCHAR(36) NOT NULL,
+  requested_at DATETIME(3) NOT NULL,
+  scheduled_for DATETIME(3) NOT NULL,
+  completed_at DATETIME(3) NULL,
+  PRIMARY KEY (user_uuid),
+  KEY account_deletions_due (completed_at, scheduled_for)
+);
+
+-- The archived products aren't sold anymore but keep their stock ledger and
+-- stay referenced by the purchases
+ALTER TABLE products ADD COLUMN archived_at DATETIME(3) NULL;
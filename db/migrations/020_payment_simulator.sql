@@ -0,0 +1,3 @@
+-- Only the admins script the mock payment gateway, and only in development
+INSERT IGNORE INTO role_permissions (role, permission) VALUES
+  ('admin', 'admin:payments');